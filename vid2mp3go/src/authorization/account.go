@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	PasswordHash "microservices/authorization/password_hash"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Profile of the logged-in user, as returned by the GET /me endpoint
+type Profile struct {
+	ID				int64		`json:"id"`
+	Username		string		`json:"username"`
+	EmailVerified	bool		`json:"email_verified"`
+	MfaEnabled		bool		`json:"mfa_enabled"`
+	Roles			[]string	`json:"roles"`
+	Permissions		[]string	`json:"permissions"`
+}
+
+// Endpoint for the account of the user of the JWT in the Authorization header.
+// GET returns the user's profile as JSON. DELETE deletes the account, along with
+// everything stored about it, after checking the user's password, given in the
+// Password header. Every JWT of the user is revoked.
+func Me(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Me request received with method", r.Method)
+	if r.Method != "GET" && r.Method != "DELETE" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username := GetStringClaim(claims, "username")
+	if r.Method == "DELETE" {
+		DeleteAccount(users, w, r, claims)
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	profile := Profile{ID: user.ID, Username: username, EmailVerified: user.Verified}
+	profile.Roles, profile.Permissions, err = GetUserRoles(profile.ID)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch roles from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	profile.MfaEnabled, err = IsMfaEnabled(profile.ID)
+	if err != nil {
+		log.Printf("Error occured while checking MFA of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// Deletes the account of the user the given JWT claims belong to, if the request's
+// Password header matches the user's password. With the MySQL user store, rows
+// referencing the user are deleted with it by the DB.
+func DeleteAccount(users UserStore.Store, w http.ResponseWriter, r *http.Request, claims jwt.MapClaims) {
+	username := GetStringClaim(claims, "username")
+	userID, ok := CheckCurrentPassword(users, w, r, username, r.Header.Get("Password"))
+	if !ok { return }
+	if err := users.Delete(userID); err != nil && !errors.Is(err, UserStore.ErrUserNotFound) {
+		log.Printf("Error occured while trying to delete user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	// Revoking the user's JWTs misses those issued in the same second, so the JWT of
+	// the request is revoked by its jti too
+	err := revocationStore.RevokeUser(username, time.Now())
+	if expiresAt, expErr := claims.GetExpirationTime(); err == nil && expErr == nil && expiresAt != nil {
+		err = revocationStore.RevokeToken(GetStringClaim(claims, "jti"), expiresAt.Time)
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to revoke JWTs of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Account of user %s deleted", username)
+	fmt.Fprintf(w, "Account deleted.")
+}
+
+// Changes the password of the user of the JWT in the Authorization header. The POST
+// request needs the current password in the Password header and the new one in the
+// New-Password header. Every other session of the user is ended by revoking the user's
+// JWTs and refresh tokens. A new JWT and refresh token are returned for the current one.
+func ChangePassword(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ChangePassword request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username := GetStringClaim(claims, "username")
+	newPassword := r.Header.Get("New-Password")
+	if newPassword == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	userID, ok := CheckCurrentPassword(users, w, r, username, r.Header.Get("Password"))
+	if !ok { return }
+	hash, err := hashParams.Hash(newPassword)
+	if err != nil {
+		log.Printf("Error occured while hashing password:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if err := ReplacePassword(users, userID, hash); err != nil {
+		log.Printf("Error occured while trying to change password of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if err := revocationStore.RevokeUser(username, time.Now()); err != nil {
+		log.Printf("Error occured while trying to revoke JWTs of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Password of user %s changed", username)
+	if err := SendTokens(users, w, r, userID, username, ""); err != nil {
+		log.Printf("Error occured while trying to create tokens:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+}
+
+// Checks the given password of the logged-in user before a sensitive change to the
+// account. Wrong passwords count as failed logins, so that a stolen JWT can not be used
+// for guessing the password. If the check fails, the appropriate status is sent and ok
+// is false. Otherwise the user's ID is returned.
+func CheckCurrentPassword(users UserStore.Store, w http.ResponseWriter, r *http.Request, username string, password string) (userID int64, ok bool) {
+	if password == "" {
+		SendStatus.BadRequest(w)
+		return 0, false
+	}
+	ip, now := GetClientIP(r), time.Now()
+	retryAfter, err := LoginRetryAfter(username, ip, now)
+	if err != nil {
+		log.Printf("Error occured while checking login lockout:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return 0, false
+	} else if retryAfter > 0 {
+		SendStatus.TooManyRequests(w, retryAfter)
+		return 0, false
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return 0, false
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return 0, false
+	}
+	match, err := PasswordHash.Verify(password, user.Password)
+	if err != nil {
+		log.Printf("Error occured while verifying password of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return 0, false
+	}
+	if !match {
+		RecordLoginFailure(username, ip, now)
+		SendStatus.InvalidCredentials(w)
+		return 0, false
+	}
+	return user.ID, true
+}
+
+// Revokes the user's refresh tokens and sets the user's password to the given hash.
+// The refresh tokens are revoked first, so that the user's sessions never outlive
+// the old password, even if setting the new one fails.
+func ReplacePassword(users UserStore.Store, userID int64, hash string) (err error) {
+	if _, err := db.Exec("UPDATE refresh_token SET revoked=TRUE WHERE user_id=?", userID); err != nil {
+		return err
+	}
+	return users.Update(userID, UserStore.Changes{Password: &hash})
+}
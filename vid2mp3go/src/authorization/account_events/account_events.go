@@ -0,0 +1,92 @@
+package accountevents
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Types of the events published about user accounts
+const (
+	PasswordResetRequested     = "password_reset_requested"
+	EmailVerificationRequested = "email_verification_requested"
+	OrganizationInvited        = "organization_invited"
+)
+
+// An event about a user account, published as JSON for the notification service,
+// which turns it into a message to the user. Organization is only set for invitations
+// to join an organization.
+type Event struct {
+	Type         string    `json:"type"`
+	Username     string    `json:"username"`
+	Token        string    `json:"token,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Publishes account events to whoever notifies the users.
+type Publisher interface {
+	Publish(event Event) (err error)
+}
+
+// Publisher implementation that sends the events to a RabbitMQ queue.
+type RabbitMQPublisher struct {
+	mu      sync.Mutex
+	channel *amqp.Channel
+	queue   string
+}
+
+func NewRabbitMQPublisher(channel *amqp.Channel, queue string) *RabbitMQPublisher {
+	return &RabbitMQPublisher{channel: channel, queue: queue}
+}
+
+func (p *RabbitMQPublisher) Publish(event Event) (err error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.channel.PublishWithContext(
+		ctx,
+		"",      // Exchange
+		p.queue, // Routing key
+		false,   // Mandatory
+		false,   // Immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		},
+	)
+}
+
+// Publisher implementation that keeps the events in memory instead of sending
+// them anywhere. Only meant for tests and running the service locally.
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (p *MemoryPublisher) Publish(event Event) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+// Returns the events published so far.
+func (p *MemoryPublisher) Events() (events []Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Event{}, p.events...)
+}
@@ -0,0 +1,29 @@
+package accountevents
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventJSON(t *testing.T) {
+	expiresAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	body, err := json.Marshal(Event{Type: PasswordResetRequested, Username: "test_user", Token: "test_token", ExpiresAt: expiresAt})
+	if err != nil { t.Fatal(err.Error()) }
+	expected := `{"type":"password_reset_requested","username":"test_user","token":"test_token","expires_at":"2024-05-01T12:00:00Z"}`
+	if string(body) != expected { t.Fatal("JSON was incorrect", string(body)) }
+
+	body, _ = json.Marshal(Event{Type: PasswordResetRequested, Username: "test_user"})
+	if strings.Contains(string(body), "token") { t.Fatal("Empty token was included", string(body)) }
+}
+
+func TestMemoryPublisher(t *testing.T) {
+	p := NewMemoryPublisher()
+	if err := p.Publish(Event{Type: PasswordResetRequested, Username: "test_user"}); err != nil { t.Fatal(err.Error()) }
+	events := p.Events()
+	if len(events) != 1 || events[0].Username != "test_user" { t.Fatal("Events were incorrect", events) }
+
+	events[0].Username = "changed"
+	if p.Events()[0].Username != "test_user" { t.Fatal("Events could be modified through the returned slice") }
+}
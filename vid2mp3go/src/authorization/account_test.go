@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	LoginThrottle "microservices/authorization/login_throttle"
+	RevocationStore "microservices/authorization/revocation_store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Adds the expectation of the password of test_user, "test_password", being fetched.
+// The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectCurrentPasswordQuery(mock sqlmock.Sqlmock) {
+	hash, _ := hashParams.Hash("test_password")
+	mock.ExpectQuery(selectUserByEmail).WithArgs("test_user").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", hash, true, false, nil))
+}
+
+func TestMe(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		password		string
+		lockedOut		bool
+		authHeader		string
+	}{
+		{
+			name: "Successful profile fetch",
+			method: "GET",
+			expectedCode: 200,
+		},
+		{
+			name: "Successful account deletion",
+			method: "DELETE",
+			expectedCode: 200,
+			password: "test_password",
+		},
+		{
+			name: "Password incorrect",
+			method: "DELETE",
+			expectedCode: 401,
+			password: "wrong_password",
+		},
+		{
+			name: "Password missing",
+			method: "DELETE",
+			expectedCode: 400,
+		},
+		{
+			name: "Account locked out",
+			method: "DELETE",
+			expectedCode: 429,
+			password: "test_password",
+			lockedOut: true,
+		},
+		{
+			name: "JWT missing from headers",
+			method: "GET",
+			expectedCode: 401,
+			authHeader: "none",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "PUT",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			if tt.lockedOut {
+				loginAttempts.Lock("account:test_user", time.Now().Add(time.Minute))
+			}
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "GET" && tt.expectedCode == 200 {
+				mock.ExpectQuery(selectUserByEmail).WithArgs("test_user").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+				ExpectUserRolesQuery(mock, 1)
+				ExpectMfaEnabledQuery(mock, 1, true)
+			}
+			if tt.method == "DELETE" && tt.password != "" && !tt.lockedOut {
+				ExpectCurrentPasswordQuery(mock)
+			}
+			if tt.method == "DELETE" && tt.expectedCode == 200 {
+				mock.ExpectExec("DELETE FROM user WHERE id=?").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req, err := http.NewRequest(tt.method, "/me", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			tokenString, _ := CreateJWT(testUser)
+			if tt.authHeader != "none" {
+				req.Header.Set("Authorization", "Bearer " + tokenString)
+			}
+			req.Header.Set("Password", tt.password)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Me)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 && tt.method == "GET" {
+				var profile Profile
+				if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil { t.Fatal(err.Error()) }
+				if profile.ID != 1 || profile.Username != "test_user" || !profile.EmailVerified || !profile.MfaEnabled || len(profile.Permissions) != 2 {
+					t.Fatal("Profile was incorrect", profile)
+				}
+			}
+			if resp.Code == 200 && tt.method == "DELETE" {
+				claims, _ := ParseJWT(tokenString)
+				if revoked, _ := IsTokenRevoked(claims); !revoked { t.Fatal("JWT of deleted user was not revoked") }
+			}
+			if tt.password == "wrong_password" {
+				if failures, _ := loginAttempts.AddFailure("account:test_user", time.Now(), time.Hour); failures != 2 {
+					t.Fatal("Wrong password was not recorded as failed login")
+				}
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		password		string
+		newPassword		string
+	}{
+		{
+			name: "Successful password change",
+			method: "POST",
+			expectedCode: 200,
+			password: "test_password",
+			newPassword: "new_password",
+		},
+		{
+			name: "Current password incorrect",
+			method: "POST",
+			expectedCode: 401,
+			password: "wrong_password",
+			newPassword: "new_password",
+		},
+		{
+			name: "New password missing",
+			method: "POST",
+			expectedCode: 400,
+			password: "test_password",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "POST" && tt.newPassword != "" {
+				ExpectCurrentPasswordQuery(mock)
+			}
+			if tt.expectedCode == 200 {
+				mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE user_id=?").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("UPDATE user SET password=? WHERE id=?").WithArgs(hashOf(tt.newPassword), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				ExpectSendTokens(mock, 1, true)
+			}
+
+			tokenString, _ := CreateJWT(testUser)
+			// JWT of another session of the user, issued earlier
+			otherSession := jwt.MapClaims{"jti": "other", "username": "test_user", "iat": time.Now().Add(-time.Minute).Unix()}
+
+			req, err := http.NewRequest(tt.method, "/me/password", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", "Bearer " + tokenString)
+			req.Header.Set("Password", tt.password)
+			req.Header.Set("New-Password", tt.newPassword)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ChangePassword)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 {
+				newClaims, err := ParseJWT(resp.Body.String())
+				if err != nil { t.Fatal(err.Error()) }
+				if revoked, _ := IsTokenRevoked(newClaims); revoked { t.Fatal("New JWT was revoked") }
+				if resp.Header().Get("Refresh-Token") == "" { t.Fatal("Refresh token was missing") }
+				if revoked, _ := IsTokenRevoked(otherSession); !revoked { t.Fatal("JWT of other session was not revoked") }
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Number of users or actions listed per page, unless the per_page query parameter is given
+const defaultPageSize = 20
+
+// Maximum value of the per_page query parameter
+const maxPageSize = 100
+
+// Actions on user accounts recorded in the admin action log
+const (
+	actionDisable       = "disable"
+	actionEnable        = "enable"
+	actionPasswordReset = "password_reset"
+	actionDelete        = "delete"
+)
+
+// A user as listed by the GET /admin/users endpoint. LastLoginAt is nil if the user
+// has never logged in.
+type AdminUser struct {
+	ID				int64		`json:"id"`
+	Username		string		`json:"username"`
+	EmailVerified	bool		`json:"email_verified"`
+	Disabled		bool		`json:"disabled"`
+	LastLoginAt		*time.Time	`json:"last_login_at"`
+}
+
+// A page of users, as returned by the GET /admin/users endpoint. Total is the number
+// of users matching the search on all pages.
+type AdminUserPage struct {
+	Users	[]AdminUser	`json:"users"`
+	Page	int			`json:"page"`
+	PerPage	int			`json:"per_page"`
+	Total	int64		`json:"total"`
+}
+
+// An entry of the admin action log, as listed by the GET /admin/actions endpoint
+type AdminAction struct {
+	ID			int64		`json:"id"`
+	Admin		string		`json:"admin"`
+	Action		string		`json:"action"`
+	Target		string		`json:"target"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+// A page of the admin action log, as returned by the GET /admin/actions endpoint
+type AdminActionPage struct {
+	Actions	[]AdminAction	`json:"actions"`
+	Page	int				`json:"page"`
+	PerPage	int				`json:"per_page"`
+	Total	int64			`json:"total"`
+}
+
+// Admin endpoint for managing user accounts. Requires a JWT with the admin permission.
+// GET lists the users, newest last, whose username contains the optional search query
+// parameter. The list is paginated with the page and per_page query parameters.
+// DELETE deletes the user given in the Username header.
+func AdminUsers(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("AdminUsers request received with method", r.Method)
+	if r.Method != "GET" && r.Method != "DELETE" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if r.Method == "GET" {
+		if _, ok := RequirePermission(w, r, adminPermission); !ok { return }
+		ListUsers(users, w, r)
+		return
+	}
+	admin, userID, username, ok := GetAdminTarget(users, w, r)
+	if !ok { return }
+	err := RunAdminAction(admin, actionDelete, username, func() error {
+		return users.Delete(userID)
+	})
+	if err == nil {
+		err = revocationStore.RevokeUser(username, time.Now())
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to delete user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("User %s deleted by %s", username, admin)
+	fmt.Fprintf(w, "User deleted.")
+}
+
+// Sends a page of the users whose username contains the search query parameter as JSON.
+func ListUsers(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	page, perPage, ok := GetPage(r)
+	if !ok {
+		SendStatus.BadRequest(w)
+		return
+	}
+	listed, total, err := users.List(r.URL.Query().Get("search"), (page-1)*perPage, perPage)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch users:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	result := AdminUserPage{Users: []AdminUser{}, Page: page, PerPage: perPage, Total: total}
+	for _, user := range listed {
+		result.Users = append(result.Users, AdminUser{
+			ID: user.ID,
+			Username: user.Email,
+			EmailVerified: user.Verified,
+			Disabled: user.Disabled,
+			LastLoginAt: user.LastLoginAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Admin endpoint for disabling the account of the user given in the Username header of
+// a POST request. Disabled users can not log in, refresh their tokens or use their API
+// keys. Their JWTs and refresh tokens are revoked.
+func DisableUser(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("DisableUser request received with method", r.Method)
+	SetUserDisabled(users, w, r, true)
+}
+
+// Admin endpoint for enabling the account of the user given in the Username header of
+// a POST request again. The user's API keys work again, but the user has to log in.
+func EnableUser(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("EnableUser request received with method", r.Method)
+	SetUserDisabled(users, w, r, false)
+}
+
+// Disables or enables the account of the user given in the Username header.
+func SetUserDisabled(users UserStore.Store, w http.ResponseWriter, r *http.Request, disabled bool) {
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	admin, userID, username, ok := GetAdminTarget(users, w, r)
+	if !ok { return }
+	action := actionEnable
+	if disabled {
+		action = actionDisable
+	}
+	err := RunAdminAction(admin, action, username, func() error {
+		if err := users.Update(userID, UserStore.Changes{Disabled: &disabled}); err != nil || !disabled {
+			return err
+		}
+		_, err := db.Exec("UPDATE refresh_token SET revoked=TRUE WHERE user_id=?", userID)
+		return err
+	})
+	if err == nil && disabled {
+		err = revocationStore.RevokeUser(username, time.Now())
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to %s user %s:\n%s", action, username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("User %s %sd by %s", username, action, admin)
+	fmt.Fprintf(w, "User %sd.", action)
+}
+
+// Admin endpoint for forcing the user given in the Username header of a POST request to
+// reset their password. The user's password is replaced with a random one, every session
+// of the user is ended and a password reset token is sent to the user.
+func ForcePasswordReset(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ForcePasswordReset request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	admin, userID, username, ok := GetAdminTarget(users, w, r)
+	if !ok { return }
+	// Nobody knows the random password, so the user can only log in after the reset
+	password, err := SecureToken.Generate(32)
+	if err != nil {
+		log.Printf("Error occured while generating password:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	hash, err := hashParams.Hash(password)
+	if err != nil {
+		log.Printf("Error occured while hashing password:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	err = RunAdminAction(admin, actionPasswordReset, username, func() error {
+		return ReplacePassword(users, userID, hash)
+	})
+	if err == nil {
+		err = revocationStore.RevokeUser(username, time.Now())
+	}
+	if err == nil {
+		err = SendPasswordReset(userID, username)
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to force password reset of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Password reset of user %s forced by %s", username, admin)
+	fmt.Fprintf(w, "Password reset forced.")
+}
+
+// Admin endpoint for listing the admin action log, newest first. Requires a JWT with
+// the admin permission. The list is paginated with the page and per_page query parameters.
+func AdminActions(w http.ResponseWriter, r *http.Request) {
+	log.Println("AdminActions request received with method", r.Method)
+	if r.Method != "GET" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if _, ok := RequirePermission(w, r, adminPermission); !ok { return }
+	page, perPage, ok := GetPage(r)
+	if !ok {
+		SendStatus.BadRequest(w)
+		return
+	}
+	result := AdminActionPage{Actions: []AdminAction{}, Page: page, PerPage: perPage}
+	if err := db.QueryRow("SELECT COUNT(*) FROM admin_action").Scan(&result.Total); err != nil {
+		log.Printf("Error occured while trying to count admin actions:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	rows, err := db.Query(
+		"SELECT id, admin, action, target, created_at FROM admin_action ORDER BY id DESC LIMIT ? OFFSET ?",
+		perPage, (page-1)*perPage,
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch admin actions from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var action AdminAction
+		if err := rows.Scan(&action.ID, &action.Admin, &action.Action, &action.Target, &action.CreatedAt); err != nil {
+			log.Printf("Error occured while trying to fetch admin actions from DB:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		result.Actions = append(result.Actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error occured while trying to fetch admin actions from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Creates a verified user with the admin role, unless a user with the given username
+// exists already. Used on startup to create the first admin of a new database. If the
+// admin can not be set up completely, the user is deleted again, so that the next start
+// retries.
+func BootstrapAdmin(users UserStore.Store, username string, password string) (err error) {
+	_, err = users.FindByEmail(username)
+	if err == nil || !errors.Is(err, UserStore.ErrUserNotFound) {
+		return err
+	}
+	if password == "" {
+		return errors.New("password of the admin to create is empty")
+	}
+	hash, err := hashParams.Hash(password)
+	if err != nil {
+		return err
+	}
+	user, err := users.Create(username, hash)
+	if err != nil {
+		return err
+	}
+	verified := true
+	err = users.Update(user.ID, UserStore.Changes{Verified: &verified})
+	if err == nil {
+		_, err = db.Exec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?", user.ID, "admin")
+	}
+	if err != nil {
+		if deleteErr := users.Delete(user.ID); deleteErr != nil {
+			log.Printf("Error occured while trying to delete admin %s:\n%s", username, deleteErr.Error())
+		}
+		return err
+	}
+	log.Printf("Created admin %s", username)
+	return nil
+}
+
+// Checks that the request has a JWT with the admin permission and that the Username
+// header names an existing user. Admins can not use the admin endpoints on their own
+// account, so that they can not lock themselves out. If a check fails, the appropriate
+// status is sent and ok is false. Otherwise the admin's and the user's usernames are
+// returned along with the user's ID.
+func GetAdminTarget(users UserStore.Store, w http.ResponseWriter, r *http.Request) (admin string, userID int64, username string, ok bool) {
+	claims, ok := RequirePermission(w, r, adminPermission)
+	if !ok {
+		return "", 0, "", false
+	}
+	admin, username = GetStringClaim(claims, "username"), r.Header.Get("Username")
+	if username == "" || username == admin {
+		SendStatus.BadRequest(w)
+		return "", 0, "", false
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.NotFound(w)
+		return "", 0, "", false
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return "", 0, "", false
+	}
+	return admin, user.ID, username, true
+}
+
+// Records the given change to a user account in the admin action log and runs it. The
+// record is written in a transaction that is only committed after the change has been
+// made, so that no change goes unrecorded and failed changes are not recorded.
+func RunAdminAction(admin string, action string, target string, change func() error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		"INSERT INTO admin_action (admin, action, target, created_at) VALUES (?, ?, ?, ?)",
+		admin, action, target, time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the page and per_page query parameters of the request. Pages start at 1.
+// ok is false if either parameter is not a positive number or per_page is too large.
+func GetPage(r *http.Request) (page int, perPage int, ok bool) {
+	page, perPage = 1, defaultPageSize
+	query := r.URL.Query()
+	var err error
+	if value := query.Get("page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil || page < 1 {
+			return 0, 0, false
+		}
+	}
+	if value := query.Get("per_page"); value != "" {
+		if perPage, err = strconv.Atoi(value); err != nil || perPage < 1 || perPage > maxPageSize {
+			return 0, 0, false
+		}
+	}
+	return page, perPage, true
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	AccountEvents "microservices/authorization/account_events"
+	RevocationStore "microservices/authorization/revocation_store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const insertAdminAction = "INSERT INTO admin_action (admin, action, target, created_at) VALUES (?, ?, ?, ?)"
+
+// Returns an Authorization header with a JWT of the user "test_user", which has the
+// given permissions.
+func AdminAuthHeader(permissions ...string) string {
+	tokenString, _ := CreateJWT(User{ID: 1, Username: "test_user", Permissions: permissions})
+	return "Bearer " + tokenString
+}
+
+// Adds the expectation of the user given in the Username header being looked up by
+// GetAdminTarget. "other_user" has the ID 2, other users do not exist.
+// The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectAdminTargetQuery(mock sqlmock.Sqlmock, username string) {
+	rows := sqlmock.NewRows(userColumns)
+	if username == "other_user" {
+		rows.AddRow(2, "other_user", "", true, false, nil)
+	}
+	mock.ExpectQuery(selectUserByEmail).WithArgs(username).WillReturnRows(rows)
+}
+
+func TestAdminUsers(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	lastLogin := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name			string
+		method			string
+		query			string
+		expectedCode	int
+		header			string
+		username		string
+		expectedPattern	string
+		expectedOffset	int
+	}{
+		{
+			name: "List users",
+			method: "GET",
+			expectedCode: 200,
+			header: AdminAuthHeader("admin"),
+			expectedPattern: "%%",
+		},
+		{
+			name: "Search users on second page",
+			method: "GET",
+			query: "?search=a_b%25&page=2&per_page=10",
+			expectedCode: 200,
+			header: AdminAuthHeader("admin"),
+			expectedPattern: `%a\_b\%%`,
+			expectedOffset: 10,
+		},
+		{
+			name: "Invalid page",
+			method: "GET",
+			query: "?page=0",
+			expectedCode: 400,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Page size too large",
+			method: "GET",
+			query: "?per_page=1000",
+			expectedCode: 400,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Delete user",
+			method: "DELETE",
+			expectedCode: 200,
+			header: AdminAuthHeader("admin"),
+			username: "other_user",
+		},
+		{
+			name: "Delete unknown user",
+			method: "DELETE",
+			expectedCode: 404,
+			header: AdminAuthHeader("admin"),
+			username: "unknown_user",
+		},
+		{
+			name: "Delete own account",
+			method: "DELETE",
+			expectedCode: 400,
+			header: AdminAuthHeader("admin"),
+			username: "test_user",
+		},
+		{
+			name: "Recording action fails",
+			method: "DELETE",
+			expectedCode: 500,
+			header: AdminAuthHeader("admin"),
+			username: "other_user",
+		},
+		{
+			name: "Admin permission missing",
+			method: "GET",
+			expectedCode: 403,
+			header: AdminAuthHeader("upload:write"),
+		},
+		{
+			name: "JWT missing from headers",
+			method: "DELETE",
+			expectedCode: 401,
+			username: "other_user",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "POST",
+			expectedCode: 405,
+			header: AdminAuthHeader("admin"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "GET" && tt.expectedCode == 200 {
+				mock.ExpectQuery("SELECT COUNT(*) FROM user WHERE email LIKE ?").WithArgs(tt.expectedPattern).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(12))
+				mock.ExpectQuery("SELECT id, email, verified, disabled, last_login_at FROM user WHERE email LIKE ? ORDER BY id LIMIT ? OFFSET ?").
+					WithArgs(tt.expectedPattern, sqlmock.AnyArg(), tt.expectedOffset).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "email", "verified", "disabled", "last_login_at"}).
+						AddRow(1, "test_user", true, false, lastLogin).
+						AddRow(2, "other_user", false, true, nil))
+			}
+			if tt.method == "DELETE" && tt.header != "" && tt.username != "test_user" {
+				ExpectAdminTargetQuery(mock, tt.username)
+				if tt.username == "other_user" {
+					mock.ExpectBegin()
+					insert := mock.ExpectExec(insertAdminAction).WithArgs("test_user", "delete", "other_user", sqlmock.AnyArg())
+					if tt.expectedCode == 500 {
+						insert.WillReturnError(errors.New("db insert failed"))
+						mock.ExpectRollback()
+					} else {
+						insert.WillReturnResult(sqlmock.NewResult(1, 1))
+						mock.ExpectExec("DELETE FROM user WHERE id=?").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+						mock.ExpectCommit()
+					}
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/admin/users" + tt.query, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), AdminUsers)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if tt.method == "GET" && resp.Code == 200 {
+				var page AdminUserPage
+				if err := json.NewDecoder(resp.Body).Decode(&page); err != nil { t.Fatal(err.Error()) }
+				if page.Total != 12 || len(page.Users) != 2 {
+					t.Fatal("Listed users were incorrect", page)
+				}
+				if page.Users[0].LastLoginAt == nil || !page.Users[0].LastLoginAt.Equal(lastLogin) || page.Users[1].LastLoginAt != nil || !page.Users[1].Disabled {
+					t.Fatal("Listed users were incorrect", page.Users)
+				}
+			}
+			if tt.method == "DELETE" {
+				revoked, _ := revocationStore.IsRevoked("old_jti", "other_user", time.Now().Add(-time.Minute))
+				if revoked != (resp.Code == 200) { t.Fatal("JWTs of the user were not revoked as expected") }
+			}
+		})
+	}
+}
+
+func TestSetUserDisabled(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		disable			bool
+		username		string
+	}{
+		{
+			name: "Disable user",
+			method: "POST",
+			expectedCode: 200,
+			disable: true,
+			username: "other_user",
+		},
+		{
+			name: "Enable user",
+			method: "POST",
+			expectedCode: 200,
+			username: "other_user",
+		},
+		{
+			name: "Disable unknown user",
+			method: "POST",
+			expectedCode: 404,
+			disable: true,
+			username: "unknown_user",
+		},
+		{
+			name: "Disable own account",
+			method: "POST",
+			expectedCode: 400,
+			disable: true,
+			username: "test_user",
+		},
+		{
+			name: "Username missing from headers",
+			method: "POST",
+			expectedCode: 400,
+			disable: true,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			disable: true,
+			username: "other_user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "POST" && tt.username != "" && tt.username != "test_user" {
+				ExpectAdminTargetQuery(mock, tt.username)
+			}
+			if tt.expectedCode == 200 {
+				action := "enable"
+				if tt.disable {
+					action = "disable"
+				}
+				mock.ExpectBegin()
+				mock.ExpectExec(insertAdminAction).WithArgs("test_user", action, "other_user", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE user SET disabled=? WHERE id=?").WithArgs(tt.disable, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+				if tt.disable {
+					mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE user_id=?").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 2))
+				}
+				mock.ExpectCommit()
+			}
+
+			req, err := http.NewRequest(tt.method, "/admin/users/disable", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", AdminAuthHeader("admin"))
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), EnableUser)
+			if tt.disable {
+				handler = WithUserStore(MockUserStore(), DisableUser)
+			}
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			revoked, _ := revocationStore.IsRevoked("old_jti", "other_user", time.Now().Add(-time.Minute))
+			if revoked != (resp.Code == 200 && tt.disable) { t.Fatal("JWTs of the user were not revoked as expected") }
+		})
+	}
+}
+
+func TestForcePasswordReset(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		username		string
+	}{
+		{
+			name: "Force password reset",
+			method: "POST",
+			expectedCode: 200,
+			username: "other_user",
+		},
+		{
+			name: "Unknown user",
+			method: "POST",
+			expectedCode: 404,
+			username: "unknown_user",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			username: "other_user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			publisher := AccountEvents.NewMemoryPublisher()
+			accountEvents = publisher
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "POST" {
+				ExpectAdminTargetQuery(mock, tt.username)
+			}
+			if tt.expectedCode == 200 {
+				mock.ExpectBegin()
+				mock.ExpectExec(insertAdminAction).WithArgs("test_user", "password_reset", "other_user", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE user_id=?").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE user SET password=? WHERE id=?").WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE password_reset_token SET used=TRUE WHERE user_id=? AND used=FALSE").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO password_reset_token (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(2, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			}
+
+			req, err := http.NewRequest(tt.method, "/admin/users/password-reset", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", AdminAuthHeader("admin"))
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ForcePasswordReset)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			events := publisher.Events()
+			if resp.Code != 200 {
+				if len(events) != 0 { t.Fatal("Password reset was sent", events) }
+				return
+			}
+			if len(events) != 1 || events[0].Type != AccountEvents.PasswordResetRequested || events[0].Username != "other_user" {
+				t.Fatal("Password reset was not sent", events)
+			}
+			revoked, _ := revocationStore.IsRevoked("old_jti", "other_user", time.Now().Add(-time.Minute))
+			if !revoked { t.Fatal("JWTs of the user were not revoked") }
+		})
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		query			string
+		expectedCode	int
+		header			string
+	}{
+		{
+			name: "List actions",
+			method: "GET",
+			query: "?page=3&per_page=5",
+			expectedCode: 200,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Invalid page size",
+			method: "GET",
+			query: "?per_page=five",
+			expectedCode: 400,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Admin permission missing",
+			method: "GET",
+			expectedCode: 403,
+			header: AdminAuthHeader("download:read"),
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "DELETE",
+			expectedCode: 405,
+			header: AdminAuthHeader("admin"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode == 200 {
+				mock.ExpectQuery("SELECT COUNT(*) FROM admin_action").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(11))
+				mock.ExpectQuery("SELECT id, admin, action, target, created_at FROM admin_action ORDER BY id DESC LIMIT ? OFFSET ?").
+					WithArgs(5, 10).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "admin", "action", "target", "created_at"}).
+						AddRow(1, "test_user", "disable", "other_user", time.Now()))
+			}
+
+			req, err := http.NewRequest(tt.method, "/admin/actions" + tt.query, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(AdminActions)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 {
+				var page AdminActionPage
+				if err := json.NewDecoder(resp.Body).Decode(&page); err != nil { t.Fatal(err.Error()) }
+				if page.Total != 11 || page.Page != 3 || len(page.Actions) != 1 || page.Actions[0].Action != "disable" {
+					t.Fatal("Listed actions were incorrect", page)
+				}
+			}
+		})
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+
+	// An existing user is left as is
+	mock.ExpectQuery(selectUserByEmail).WithArgs("admin@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "admin@example.com", "", true, false, nil))
+	if err := BootstrapAdmin(MockUserStore(), "admin@example.com", "password"); err != nil { t.Fatal(err.Error()) }
+
+	// A new admin needs a password
+	mock.ExpectQuery(selectUserByEmail).WithArgs("admin@example.com").WillReturnRows(sqlmock.NewRows(userColumns))
+	if err := BootstrapAdmin(MockUserStore(), "admin@example.com", ""); err == nil { t.Fatal("Admin without password was created") }
+
+	mock.ExpectQuery(selectUserByEmail).WithArgs("admin@example.com").WillReturnRows(sqlmock.NewRows(userColumns))
+	ExpectCreateUser(mock, "admin@example.com", 3)
+	mock.ExpectExec("UPDATE user SET verified=? WHERE id=?").WithArgs(true, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(3, "admin").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := BootstrapAdmin(MockUserStore(), "admin@example.com", "password"); err != nil { t.Fatal(err.Error()) }
+
+	// The user is deleted again if granting the admin role fails
+	mock.ExpectQuery(selectUserByEmail).WithArgs("admin@example.com").WillReturnRows(sqlmock.NewRows(userColumns))
+	ExpectCreateUser(mock, "admin@example.com", 4)
+	mock.ExpectExec("UPDATE user SET verified=? WHERE id=?").WithArgs(true, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(4, "admin").WillReturnError(errors.New("db insert failed"))
+	mock.ExpectExec("DELETE FROM user WHERE id=?").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := BootstrapAdmin(MockUserStore(), "admin@example.com", "password"); err == nil { t.Fatal("Incomplete admin was created") }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
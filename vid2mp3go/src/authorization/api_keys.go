@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum length of the labels of API keys
+const maxApiKeyLabelLength = 255
+
+// An API key as listed by the GET /api-keys endpoint. The key itself is only
+// stored as a hash, so it can not be listed.
+type ApiKey struct {
+	ID			int64		`json:"id"`
+	Label		string		`json:"label"`
+	CreatedAt	time.Time	`json:"created_at"`
+	LastUsedAt	*time.Time	`json:"last_used_at"`
+	Revoked		bool		`json:"revoked"`
+}
+
+// A newly created API key, as returned by the POST /api-keys endpoint
+type NewApiKey struct {
+	ID		int64	`json:"id"`
+	Label	string	`json:"label"`
+	Key		string	`json:"key"`
+}
+
+// The owner of an API key, as looked up by GetApiKeyOwner
+type ApiKeyOwner struct {
+	KeyID		int64
+	UserID		int64
+	Username	string
+	Verified	bool
+	Revoked		bool
+	Disabled	bool
+}
+
+// Returns the API key of the request's Authorization header, if it uses the
+// ApiKey scheme, e.g. "ApiKey <key>".
+func GetApiKey(r *http.Request) (apiKey string, ok bool) {
+	authHeader := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authHeader) != 2 || !strings.EqualFold(authHeader[0], "ApiKey") || authHeader[1] == "" {
+		return "", false
+	}
+	return authHeader[1], true
+}
+
+// Validates an API key for /validate. The result has the same form as for JWTs, without
+// an expiration time. The user's roles and permissions are fetched from the DB, so that
+// changes to them affect API keys immediately. Unknown and revoked keys and keys of
+// disabled users are rejected with errInvalidToken.
+func ValidateApiKey(users UserStore.Store, apiKey string) (res JsonStruct, err error) {
+	owner, err := GetApiKeyOwner(users, apiKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Println("API key is unknown")
+		return JsonStruct{}, errInvalidToken
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch API key from DB:\n%s", err.Error())
+		return JsonStruct{}, err
+	}
+	if owner.Revoked {
+		log.Println("API key has been revoked")
+		return JsonStruct{}, errInvalidToken
+	}
+	if owner.Disabled {
+		log.Printf("API key belongs to disabled user %s", owner.Username)
+		return JsonStruct{}, errInvalidToken
+	}
+	roles, permissions, err := GetUserRoles(owner.UserID)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch roles from DB:\n%s", err.Error())
+		return JsonStruct{}, err
+	}
+	// Only used for listing the keys, so failures are only logged
+	if _, err := db.Exec("UPDATE api_key SET last_used_at=? WHERE id=?", time.Now().UTC(), owner.KeyID); err != nil {
+		log.Printf("Error occured while updating last use of API key %d:\n%s", owner.KeyID, err.Error())
+	}
+	return JsonStruct{
+		Username: owner.Username,
+		Admin: slices.Contains(roles, "admin"),
+		Roles: roles,
+		Permissions: permissions,
+		EmailVerified: owner.Verified,
+		Scope: strings.Join(permissions, " "),
+	}, nil
+}
+
+// Looks up the API key and the user it belongs to. Revoked keys and keys of disabled
+// users are returned as well.
+// If the key is unknown or its user does not exist anymore, sql.ErrNoRows is returned.
+func GetApiKeyOwner(users UserStore.Store, apiKey string) (owner ApiKeyOwner, err error) {
+	err = db.QueryRow(
+		"SELECT id, user_id, revoked FROM api_key WHERE key_hash=?",
+		SecureToken.Hash(apiKey),
+	).Scan(&owner.KeyID, &owner.UserID, &owner.Revoked)
+	if err != nil {
+		return ApiKeyOwner{}, err
+	}
+	user, err := users.FindByID(owner.UserID)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		return ApiKeyOwner{}, sql.ErrNoRows
+	} else if err != nil {
+		return ApiKeyOwner{}, err
+	}
+	owner.Username, owner.Verified, owner.Disabled = user.Email, user.Verified, user.Disabled
+	return owner, nil
+}
+
+// Endpoint for managing the API keys of the user of the JWT in the Authorization header.
+// API keys let machine clients call the gateway with "Authorization: ApiKey <key>" and
+// have the same permissions as the user. API keys can not be used to manage API keys.
+// GET lists the user's API keys as JSON. POST creates a new API key, labelled with the
+// optional Label header, and returns it as JSON. The key is only shown in this response.
+// PATCH changes the label of the API key given in the Key-Id header to the Label header.
+// DELETE revokes the API key given in the Key-Id header.
+func ApiKeys(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ApiKeys request received with method", r.Method)
+	if !slices.Contains([]string{"GET", "POST", "PATCH", "DELETE"}, r.Method) {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username, _ := claims["username"].(string)
+	label := r.Header.Get("Label")
+	if len(label) > maxApiKeyLabelLength || (r.Method == "PATCH" && label == "") {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var keyID int64
+	if r.Method == "PATCH" || r.Method == "DELETE" {
+		var err error
+		keyID, err = strconv.ParseInt(r.Header.Get("Key-Id"), 10, 64)
+		if err != nil {
+			SendStatus.BadRequest(w)
+			return
+		}
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		ListApiKeys(w, user.ID)
+	case "POST":
+		CreateApiKey(w, user.ID, username, label)
+	case "PATCH":
+		UpdateApiKey(w, user.ID, keyID, "UPDATE api_key SET label=? WHERE id=?", label, keyID)
+	case "DELETE":
+		UpdateApiKey(w, user.ID, keyID, "UPDATE api_key SET revoked=TRUE WHERE id=?", keyID)
+	}
+}
+
+// Sends the API keys of the given user as JSON.
+func ListApiKeys(w http.ResponseWriter, userID int64) {
+	rows, err := db.Query("SELECT id, label, created_at, last_used_at, revoked FROM api_key WHERE user_id=? ORDER BY id", userID)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch API keys from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer rows.Close()
+	apiKeys := []ApiKey{}
+	for rows.Next() {
+		var apiKey ApiKey
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&apiKey.ID, &apiKey.Label, &apiKey.CreatedAt, &lastUsedAt, &apiKey.Revoked); err != nil {
+			log.Printf("Error occured while trying to fetch API keys from DB:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		if lastUsedAt.Valid {
+			apiKey.LastUsedAt = &lastUsedAt.Time
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error occured while trying to fetch API keys from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeys)
+}
+
+// Creates a new API key for the given user and sends it as JSON. Only the key's
+// hash is stored, so the key can not be shown again.
+func CreateApiKey(w http.ResponseWriter, userID int64, username string, label string) {
+	apiKey, err := SecureToken.Generate(32)
+	if err != nil {
+		log.Printf("Error occured while generating API key:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	res, err := db.Exec(
+		"INSERT INTO api_key (user_id, label, key_hash, created_at) VALUES (?, ?, ?, ?)",
+		userID, label, SecureToken.Hash(apiKey), time.Now().UTC(),
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to insert API key into DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Printf("Error occured while trying to insert API key into DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("API key %d created for user %s", id, username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewApiKey{ID: id, Label: label, Key: apiKey})
+}
+
+// Runs the given update of an API key, if the key belongs to the given user.
+// Otherwise 404 is sent.
+func UpdateApiKey(w http.ResponseWriter, userID int64, keyID int64, query string, args ...any) {
+	var id int64
+	err := db.QueryRow("SELECT id FROM api_key WHERE id=? AND user_id=?", keyID, userID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch API key from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		log.Printf("Error occured while trying to update API key %d:\n%s", keyID, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	fmt.Fprintf(w, "API key updated.")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectApiKey = "SELECT id, user_id, revoked FROM api_key WHERE key_hash=?"
+
+func TestApiKeys(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		label			string
+		keyID			string
+		authHeader		string
+	}{
+		{
+			name: "Successful listing",
+			method: "GET",
+			expectedCode: 200,
+		},
+		{
+			name: "Successful creation",
+			method: "POST",
+			expectedCode: 200,
+			label: "batch pipeline",
+		},
+		{
+			name: "Successful relabelling",
+			method: "PATCH",
+			expectedCode: 200,
+			label: "nightly batch",
+			keyID: "3",
+		},
+		{
+			name: "Successful revocation",
+			method: "DELETE",
+			expectedCode: 200,
+			keyID: "3",
+		},
+		{
+			name: "Key of another user",
+			method: "DELETE",
+			expectedCode: 404,
+			keyID: "4",
+		},
+		{
+			name: "Key id invalid",
+			method: "DELETE",
+			expectedCode: 400,
+			keyID: "three",
+		},
+		{
+			name: "Label missing",
+			method: "PATCH",
+			expectedCode: 400,
+			keyID: "3",
+		},
+		{
+			name: "Label too long",
+			method: "POST",
+			expectedCode: 400,
+			label: strings.Repeat("a", 256),
+		},
+		{
+			name: "API key used for authentication",
+			method: "POST",
+			expectedCode: 401,
+			authHeader: "ApiKey test_api_key",
+		},
+		{
+			name: "JWT missing from headers",
+			method: "GET",
+			expectedCode: 401,
+			authHeader: "none",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "PUT",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode == 200 || tt.expectedCode == 404 {
+				ExpectUserQuery(mock, "test_user", 1)
+			}
+			keyRows := sqlmock.NewRows([]string{"id"})
+			if tt.keyID == "3" {
+				keyRows.AddRow(3)
+			}
+			if tt.expectedCode == 404 {
+				mock.ExpectQuery("SELECT id FROM api_key WHERE id=? AND user_id=?").WithArgs(4, 1).WillReturnRows(keyRows)
+			} else if tt.expectedCode == 200 {
+				switch tt.method {
+				case "GET":
+					mock.ExpectQuery("SELECT id, label, created_at, last_used_at, revoked FROM api_key WHERE user_id=? ORDER BY id").WithArgs(1).
+						WillReturnRows(sqlmock.NewRows([]string{"id", "label", "created_at", "last_used_at", "revoked"}).
+							AddRow(3, "batch pipeline", time.Now(), time.Now(), false).
+							AddRow(5, "", time.Now(), nil, true))
+				case "POST":
+					mock.ExpectExec("INSERT INTO api_key (user_id, label, key_hash, created_at) VALUES (?, ?, ?, ?)").
+						WithArgs(1, tt.label, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(3, 1))
+				case "PATCH":
+					mock.ExpectQuery("SELECT id FROM api_key WHERE id=? AND user_id=?").WithArgs(3, 1).WillReturnRows(keyRows)
+					mock.ExpectExec("UPDATE api_key SET label=? WHERE id=?").WithArgs(tt.label, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+				case "DELETE":
+					mock.ExpectQuery("SELECT id FROM api_key WHERE id=? AND user_id=?").WithArgs(3, 1).WillReturnRows(keyRows)
+					mock.ExpectExec("UPDATE api_key SET revoked=TRUE WHERE id=?").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/api-keys", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.authHeader == "" {
+				tokenString, _ := CreateJWT(testUser)
+				req.Header.Set("Authorization", "Bearer " + tokenString)
+			} else if tt.authHeader != "none" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			req.Header.Set("Label", tt.label)
+			req.Header.Set("Key-Id", tt.keyID)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ApiKeys)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 && tt.method == "GET" {
+				var apiKeys []ApiKey
+				if err := json.NewDecoder(resp.Body).Decode(&apiKeys); err != nil { t.Fatal(err.Error()) }
+				if len(apiKeys) != 2 || apiKeys[0].LastUsedAt == nil || apiKeys[1].LastUsedAt != nil || !apiKeys[1].Revoked {
+					t.Fatal("Listed API keys were incorrect", apiKeys)
+				}
+			}
+			if resp.Code == 200 && tt.method == "POST" {
+				var apiKey NewApiKey
+				if err := json.NewDecoder(resp.Body).Decode(&apiKey); err != nil { t.Fatal(err.Error()) }
+				if apiKey.ID != 3 || apiKey.Label != tt.label || len(apiKey.Key) != 43 {
+					t.Fatal("Created API key was incorrect", apiKey)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateApiKey(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		expectedCode	int
+		apiKey			string
+		revoked			bool
+		disabled		bool
+	}{
+		{
+			name: "Successful validation",
+			expectedCode: 200,
+			apiKey: "test_api_key",
+		},
+		{
+			name: "API key revoked",
+			expectedCode: 403,
+			apiKey: "test_api_key",
+			revoked: true,
+		},
+		{
+			name: "User disabled",
+			expectedCode: 403,
+			apiKey: "test_api_key",
+			disabled: true,
+		},
+		{
+			name: "API key unknown",
+			expectedCode: 403,
+			apiKey: "unknown_api_key",
+		},
+		{
+			name: "DB fetch fails",
+			expectedCode: 500,
+			apiKey: "test_api_key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			query := mock.ExpectQuery(selectApiKey).WithArgs(SecureToken.Hash(tt.apiKey))
+			rows := sqlmock.NewRows([]string{"id", "user_id", "revoked"})
+			if tt.name == "DB fetch fails" {
+				query.WillReturnError(errors.New("db fetch failed"))
+			} else if tt.apiKey == "test_api_key" {
+				query.WillReturnRows(rows.AddRow(3, 1, tt.revoked))
+				mock.ExpectQuery(selectUserByID).WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, tt.disabled, nil))
+			} else {
+				query.WillReturnRows(rows)
+			}
+			if tt.expectedCode == 200 {
+				ExpectUserRolesQuery(mock, 1)
+				mock.ExpectExec("UPDATE api_key SET last_used_at=? WHERE id=?").WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req, err := http.NewRequest("POST", "/validate", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", "ApiKey " + tt.apiKey)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Validate)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 {
+				var res JsonStruct
+				if err := json.NewDecoder(resp.Body).Decode(&res); err != nil { t.Fatal(err.Error()) }
+				if res.Username != "test_user" || len(res.Permissions) == 0 || !res.EmailVerified {
+					t.Fatal("Response JSON was incorrect", res)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	AuditLog "microservices/authorization/audit_log"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Length of the user_agent columns of the audit_event and session tables
+const maxUserAgentLength = 512
+
+// Trail of logins, registrations and issued tokens. Replaced with a MySQL backed store
+// in main(), unless the AUDIT_LOG_STORE env variable is set to "memory".
+var auditLog AuditLog.Store = AuditLog.NewMemoryStore()
+
+// A page of audit events, as returned by the GET /admin/audit endpoint. Total is the
+// number of events matching the filters on all pages.
+type AuditEventPage struct {
+	Events	[]AuditLog.Event	`json:"events"`
+	Page	int					`json:"page"`
+	PerPage	int					`json:"per_page"`
+	Total	int64				`json:"total"`
+}
+
+// Records an event of the given type for the given user, sent by the client of the
+// given request, in the audit log.
+func RecordAuditEvent(r *http.Request, eventType string, username string, outcome string) {
+	RecordClientAuditEvent(GetClientInfo(r), eventType, username, outcome)
+}
+
+// Records an event of the given type for the given user, sent by the given client, in
+// the audit log. Failures are only logged, so that the audit log being unavailable does
+// not keep users from logging in.
+func RecordClientAuditEvent(client ClientInfo, eventType string, username string, outcome string) {
+	err := auditLog.Record(AuditLog.Event{
+		Type: eventType,
+		Username: username,
+		IP: client.IP,
+		UserAgent: client.UserAgent,
+		Outcome: outcome,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("Error occured while trying to record %s %s of user %s:\n%s", eventType, outcome, username, err.Error())
+	}
+}
+
+// Client a login, registration or other request was sent by, as recorded in the audit
+// log and in sessions
+type ClientInfo struct {
+	IP			string
+	UserAgent	string
+}
+
+// Returns the client that sent the request
+func GetClientInfo(r *http.Request) ClientInfo {
+	return ClientInfo{IP: GetClientIP(r), UserAgent: GetUserAgent(r)}
+}
+
+// Returns the User-Agent header of the request, cut to the length the DB can store.
+func GetUserAgent(r *http.Request) (userAgent string) {
+	return TruncateUserAgent(r.UserAgent())
+}
+
+// Cuts a user agent to the length the DB can store. The cut is made at the start of
+// a rune, so that multi-byte characters are not split.
+func TruncateUserAgent(userAgent string) string {
+	if len(userAgent) <= maxUserAgentLength {
+		return userAgent
+	}
+	end := maxUserAgentLength
+	for end > 0 && !utf8.RuneStart(userAgent[end]) {
+		end--
+	}
+	return userAgent[:end]
+}
+
+// Calls IssueTokens and records whether tokens were issued as an event of the given type
+// in the audit log. Disabled users, who get no tokens, are recorded as failures.
+func IssueAuditedTokens(users UserStore.Store, client ClientInfo, eventType string, userID int64, username string, familyID string) (tokens IssuedTokens, err error) {
+	tokens, err = IssueTokens(users, client, userID, username, familyID)
+	if err != nil {
+		RecordClientAuditEvent(client, eventType, username, AuditLog.Failure)
+	} else {
+		RecordClientAuditEvent(client, eventType, username, AuditLog.Success)
+	}
+	return tokens, err
+}
+
+// Sends the tokens IssueAuditedTokens creates for the device of the request, like SendTokens.
+func SendAuditedTokens(users UserStore.Store, w http.ResponseWriter, r *http.Request, eventType string, userID int64, username string, familyID string) (err error) {
+	tokens, err := IssueAuditedTokens(users, GetClientInfo(r), eventType, userID, username, familyID)
+	return SendIssuedTokens(w, tokens, err)
+}
+
+// Admin endpoint for querying the audit log. Requires a JWT with the admin permission.
+// Lists the events, newest first, matching the optional type, username and outcome
+// query parameters and created between the from and to query parameters, which are
+// RFC 3339 timestamps. The list is paginated with the page and per_page query parameters.
+func AuditEvents(w http.ResponseWriter, r *http.Request) {
+	log.Println("AuditEvents request received with method", r.Method)
+	if r.Method != "GET" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if _, ok := RequirePermission(w, r, adminPermission); !ok { return }
+	filter, ok := GetAuditFilter(r)
+	if !ok {
+		SendStatus.BadRequest(w)
+		return
+	}
+	page, perPage, ok := GetPage(r)
+	if !ok {
+		SendStatus.BadRequest(w)
+		return
+	}
+	events, total, err := auditLog.Query(filter, (page-1)*perPage, perPage)
+	if err != nil {
+		log.Printf("Error occured while trying to query audit log:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuditEventPage{Events: events, Page: page, PerPage: perPage, Total: total})
+}
+
+// Admin endpoint for exporting the audit log as JSON lines, one event per line, oldest
+// first. Requires a JWT with the admin permission. Takes the same filters as /admin/audit,
+// but is not paginated. Events are streamed, so an error halfway cuts the export short.
+func ExportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	log.Println("ExportAuditEvents request received with method", r.Method)
+	if r.Method != "GET" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	admin, ok := RequirePermission(w, r, adminPermission)
+	if !ok { return }
+	filter, ok := GetAuditFilter(r)
+	if !ok {
+		SendStatus.BadRequest(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	encoder := json.NewEncoder(w)
+	if err := auditLog.Export(filter, func(event AuditLog.Event) error { return encoder.Encode(event) }); err != nil {
+		log.Printf("Error occured while trying to export audit log:\n%s", err.Error())
+		return
+	}
+	log.Printf("Audit log exported by %s", GetStringClaim(admin, "username"))
+}
+
+// Returns the filter given by the type, username, outcome, from and to query parameters
+// of the request. If from or to is not an RFC 3339 timestamp, ok is false.
+func GetAuditFilter(r *http.Request) (filter AuditLog.Filter, ok bool) {
+	query := r.URL.Query()
+	filter = AuditLog.Filter{Type: query.Get("type"), Username: query.Get("username"), Outcome: query.Get("outcome")}
+	var err error
+	if value := query.Get("from"); value != "" {
+		if filter.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return AuditLog.Filter{}, false
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if filter.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return AuditLog.Filter{}, false
+		}
+	}
+	return filter, true
+}
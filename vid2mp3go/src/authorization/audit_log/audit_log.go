@@ -0,0 +1,58 @@
+package auditlog
+
+import "time"
+
+// Types of audited events
+const (
+	Login		= "login"
+	Register	= "register"
+	Token		= "token"
+)
+
+// Outcomes of audited events
+const (
+	Success	= "success"
+	Failure	= "failure"
+)
+
+// An authentication event. Username is the one given by the client, so failed logins
+// are recorded under usernames that may not exist. It is empty if it is not known.
+type Event struct {
+	ID			int64		`json:"id"`
+	Type		string		`json:"type"`
+	Username	string		`json:"username"`
+	IP			string		`json:"ip"`
+	UserAgent	string		`json:"user_agent"`
+	Outcome		string		`json:"outcome"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+// Selects events by their fields. Empty fields match every event. Events are matched
+// if they were created at or after From and before To, unless those are zero.
+type Filter struct {
+	Type		string
+	Username	string
+	Outcome		string
+	From		time.Time
+	To			time.Time
+}
+
+// Persistent trail of authentication events
+type Store interface {
+	// Records the given event. Its ID is assigned by the store.
+	Record(event Event) (err error)
+	// Returns the events matching the filter, newest first, skipping offset events
+	// and returning at most limit. Total is the number of matching events.
+	Query(filter Filter, offset int, limit int) (events []Event, total int64, err error)
+	// Calls f with every event matching the filter, oldest first, until f fails.
+	Export(filter Filter, f func(event Event) error) (err error)
+}
+
+// Returns true if the event matches the filter.
+func (filter Filter) Matches(event Event) bool {
+	return (filter.Type == "" || event.Type == filter.Type) &&
+		(filter.Username == "" || event.Username == filter.Username) &&
+		(filter.Outcome == "" || event.Outcome == filter.Outcome) &&
+		(filter.From.IsZero() || !event.CreatedAt.Before(filter.From)) &&
+		(filter.To.IsZero() || event.CreatedAt.Before(filter.To))
+}
@@ -0,0 +1,106 @@
+package auditlog
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFilterMatches(t *testing.T) {
+	now := time.Now()
+	event := Event{Type: Login, Username: "test_user", Outcome: Failure, CreatedAt: now}
+	tests := []struct {
+		name		string
+		filter		Filter
+		expected	bool
+	}{
+		{name: "Empty filter", filter: Filter{}, expected: true},
+		{name: "Matching fields", filter: Filter{Type: Login, Username: "test_user", Outcome: Failure}, expected: true},
+		{name: "Other type", filter: Filter{Type: Register}, expected: false},
+		{name: "Other username", filter: Filter{Username: "other_user"}, expected: false},
+		{name: "Other outcome", filter: Filter{Outcome: Success}, expected: false},
+		{name: "Within time range", filter: Filter{From: now, To: now.Add(time.Second)}, expected: true},
+		{name: "Before time range", filter: Filter{From: now.Add(time.Second)}, expected: false},
+		{name: "At end of time range", filter: Filter{To: now}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.filter.Matches(event) != tt.expected { t.Fatal("Match was incorrect") }
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	for i, outcome := range []string{Failure, Success, Failure, Failure} {
+		s.Record(Event{Type: Login, Username: "test_user", Outcome: outcome, CreatedAt: now.Add(time.Duration(i) * time.Minute)})
+	}
+	s.Record(Event{Type: Register, Username: "other_user", Outcome: Success, CreatedAt: now})
+
+	events, total, err := s.Query(Filter{Username: "test_user", Outcome: Failure}, 1, 1)
+	if err != nil || total != 3 || len(events) != 1 || events[0].ID != 3 { t.Fatal("Queried events were incorrect", events, total, err) }
+	events, total, _ = s.Query(Filter{Type: Token}, 0, 10)
+	if total != 0 || events == nil || len(events) != 0 { t.Fatal("Events of other types were returned", events) }
+
+	var exported []int64
+	s.Export(Filter{From: now.Add(time.Minute)}, func(event Event) error {
+		exported = append(exported, event.ID)
+		return nil
+	})
+	if len(exported) != 3 || exported[0] != 2 || exported[2] != 4 { t.Fatal("Exported events were incorrect", exported) }
+	exportErr := errors.New("write failed")
+	if err := s.Export(Filter{}, func(event Event) error { return exportErr }); err != exportErr { t.Fatal("Export did not stop", err) }
+}
+
+func TestMySQLStoreRecord(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectExec("INSERT INTO audit_event (event_type, username, ip, user_agent, outcome, created_at) VALUES (?, ?, ?, ?, ?, ?)").
+		WithArgs(Login, "test_user", "203.0.113.7", "curl/8.0", Success, now.UTC()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	event := Event{Type: Login, Username: "test_user", IP: "203.0.113.7", UserAgent: "curl/8.0", Outcome: Success, CreatedAt: now}
+	if err := NewMySQLStore(db).Record(event); err != nil { t.Fatal(err.Error()) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestMySQLStoreQuery(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	from := time.Now().Add(-time.Hour)
+	where := " WHERE event_type=? AND outcome=? AND created_at >= ?"
+	mock.ExpectQuery("SELECT COUNT(*) FROM audit_event"+where).WithArgs(Login, Failure, from.UTC()).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(41))
+	mock.ExpectQuery("SELECT id, event_type, username, ip, user_agent, outcome, created_at FROM audit_event"+where+" ORDER BY id DESC LIMIT ? OFFSET ?").
+		WithArgs(Login, Failure, from.UTC(), 20, 40).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "username", "ip", "user_agent", "outcome", "created_at"}).AddRow(1, Login, "test_user", "203.0.113.7", "curl/8.0", Failure, time.Now()))
+
+	events, total, err := NewMySQLStore(db).Query(Filter{Type: Login, Outcome: Failure, From: from}, 40, 20)
+	if err != nil || total != 41 || len(events) != 1 || events[0].Username != "test_user" { t.Fatal("Queried events were incorrect", events, total, err) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestMySQLStoreExport(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, event_type, username, ip, user_agent, outcome, created_at FROM audit_event ORDER BY id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "username", "ip", "user_agent", "outcome", "created_at"}).
+			AddRow(1, Register, "test_user", "203.0.113.7", "", Success, time.Now()).
+			AddRow(2, Login, "test_user", "203.0.113.7", "", Success, time.Now()))
+
+	var exported []int64
+	err = NewMySQLStore(db).Export(Filter{}, func(event Event) error {
+		exported = append(exported, event.ID)
+		return nil
+	})
+	if err != nil || len(exported) != 2 || exported[0] != 1 { t.Fatal("Exported events were incorrect", exported, err) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
@@ -0,0 +1,61 @@
+package auditlog
+
+import (
+	"sync"
+)
+
+// Store implementation that keeps events in memory, for tests and local instances
+type MemoryStore struct {
+	mu		sync.Mutex
+	events	[]Event
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Record(event Event) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.ID = int64(len(s.events) + 1)
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *MemoryStore) Query(filter Filter, offset int, limit int) (events []Event, total int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events = []Event{}
+	for i := len(s.events) - 1; i >= 0; i-- {
+		if !filter.Matches(s.events[i]) {
+			continue
+		}
+		if total >= int64(offset) && len(events) < limit {
+			events = append(events, s.events[i])
+		}
+		total++
+	}
+	return events, total, nil
+}
+
+func (s *MemoryStore) Export(filter Filter, f func(event Event) error) (err error) {
+	s.mu.Lock()
+	events := append([]Event{}, s.events...)
+	s.mu.Unlock()
+	for _, event := range events {
+		if !filter.Matches(event) {
+			continue
+		}
+		if err := f(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns every recorded event, oldest first.
+func (s *MemoryStore) Events() (events []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event{}, s.events...)
+}
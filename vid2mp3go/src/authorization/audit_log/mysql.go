@@ -0,0 +1,92 @@
+package auditlog
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Store implementation backed by the audit_event table, so that events of every
+// replica of the service end up in the same trail.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) Record(event Event) (err error) {
+	_, err = s.db.Exec(
+		"INSERT INTO audit_event (event_type, username, ip, user_agent, outcome, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		event.Type, event.Username, event.IP, event.UserAgent, event.Outcome, event.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (s *MySQLStore) Query(filter Filter, offset int, limit int) (events []Event, total int64, err error) {
+	where, args := whereClause(filter)
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM audit_event"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	events = []Event{}
+	err = s.scan("SELECT id, event_type, username, ip, user_agent, outcome, created_at FROM audit_event"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset), func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+func (s *MySQLStore) Export(filter Filter, f func(event Event) error) (err error) {
+	where, args := whereClause(filter)
+	return s.scan("SELECT id, event_type, username, ip, user_agent, outcome, created_at FROM audit_event"+where+" ORDER BY id", args, f)
+}
+
+// Runs the given query and calls f with every event it returns, until f fails.
+func (s *MySQLStore) scan(query string, args []any, f func(event Event) error) (err error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.Type, &event.Username, &event.IP, &event.UserAgent, &event.Outcome, &event.CreatedAt); err != nil {
+			return err
+		}
+		if err := f(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Returns the WHERE clause selecting the events matching the filter, or an empty
+// string if it matches every event, along with its arguments.
+func whereClause(filter Filter) (where string, args []any) {
+	var conditions []string
+	for _, field := range []struct{ column, value string }{
+		{"event_type", filter.Type},
+		{"username", filter.Username},
+		{"outcome", filter.Outcome},
+	} {
+		if field.value != "" {
+			conditions = append(conditions, field.column+"=?")
+			args = append(args, field.value)
+		}
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To.UTC())
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	AuditLog "microservices/authorization/audit_log"
+	RevocationStore "microservices/authorization/revocation_store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Replaces the audit log with an empty one holding a failed login and a registration
+// of "test_user", made an hour ago, and a login of "other_user", made just now.
+func WithTestAuditLog(t *testing.T) *AuditLog.MemoryStore {
+	store := AuditLog.NewMemoryStore()
+	now := time.Now().UTC()
+	store.Record(AuditLog.Event{Type: AuditLog.Login, Username: "test_user", IP: "203.0.113.7", Outcome: AuditLog.Failure, CreatedAt: now.Add(-time.Hour)})
+	store.Record(AuditLog.Event{Type: AuditLog.Register, Username: "test_user", IP: "203.0.113.7", Outcome: AuditLog.Success, CreatedAt: now.Add(-time.Hour)})
+	store.Record(AuditLog.Event{Type: AuditLog.Login, Username: "other_user", IP: "198.51.100.2", Outcome: AuditLog.Success, CreatedAt: now})
+	auditLog = store
+	t.Cleanup(func() { auditLog = AuditLog.NewMemoryStore() })
+	return store
+}
+
+func TestRecordAuditEvent(t *testing.T) {
+	store := AuditLog.NewMemoryStore()
+	auditLog = store
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	FromTrustedPeer(t, req)
+	req.Header.Set("User-Agent", strings.Repeat("a", maxUserAgentLength+10))
+
+	RecordAuditEvent(req, AuditLog.Login, "test_user", AuditLog.Failure)
+
+	events := store.Events()
+	if len(events) != 1 || events[0].IP != "203.0.113.7" || events[0].Username != "test_user" || events[0].Outcome != AuditLog.Failure {
+		t.Fatal("Event was not recorded", events)
+	}
+	if len(events[0].UserAgent) != maxUserAgentLength { t.Fatal("User agent was not truncated") }
+}
+
+func TestTruncateUserAgent(t *testing.T) {
+	tests := []struct {
+		name		string
+		userAgent	string
+		expected	string
+	}{
+		{name: "Short user agent kept", userAgent: "curl/8.0", expected: "curl/8.0"},
+		{name: "Long user agent cut", userAgent: strings.Repeat("a", maxUserAgentLength+10), expected: strings.Repeat("a", maxUserAgentLength)},
+		{name: "Rune at the limit not split", userAgent: strings.Repeat("a", maxUserAgentLength-1) + "é", expected: strings.Repeat("a", maxUserAgentLength-1)},
+		{name: "Rune ending at the limit kept", userAgent: strings.Repeat("a", maxUserAgentLength-2) + "é" + "a", expected: strings.Repeat("a", maxUserAgentLength-2) + "é"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			truncated := TruncateUserAgent(tt.userAgent)
+			if truncated != tt.expected { t.Fatal("User agent was incorrect", len(truncated)) }
+			if !utf8.ValidString(truncated) { t.Fatal("User agent was not valid UTF-8") }
+		})
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		query			string
+		expectedCode	int
+		expectedTotal	int64
+		header			string
+	}{
+		{
+			name: "List every event",
+			method: "GET",
+			expectedCode: 200,
+			expectedTotal: 3,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Filter by type and username",
+			method: "GET",
+			query: "?type=login&username=test_user",
+			expectedCode: 200,
+			expectedTotal: 1,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Filter by time range",
+			method: "GET",
+			query: "?from=" + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+			expectedCode: 200,
+			expectedTotal: 1,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Invalid time",
+			method: "GET",
+			query: "?to=yesterday",
+			expectedCode: 400,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Invalid page",
+			method: "GET",
+			query: "?page=0",
+			expectedCode: 400,
+			header: AdminAuthHeader("admin"),
+		},
+		{
+			name: "Admin permission missing",
+			method: "GET",
+			expectedCode: 403,
+			header: AdminAuthHeader("download:read"),
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "POST",
+			expectedCode: 405,
+			header: AdminAuthHeader("admin"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			WithTestAuditLog(t)
+
+			req, err := http.NewRequest(tt.method, "/admin/audit" + tt.query, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(AuditEvents)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if resp.Code == 200 {
+				var page AuditEventPage
+				if err := json.NewDecoder(resp.Body).Decode(&page); err != nil { t.Fatal(err.Error()) }
+				if page.Total != tt.expectedTotal || int64(len(page.Events)) != tt.expectedTotal || page.Page != 1 {
+					t.Fatal("Listed events were incorrect", page)
+				}
+			}
+		})
+	}
+}
+
+func TestExportAuditEvents(t *testing.T) {
+	revocationStore = RevocationStore.NewMemoryStore()
+	WithTestAuditLog(t)
+
+	req, err := http.NewRequest("GET", "/admin/audit/export?username=test_user", nil)
+	if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+	req.Header.Set("Authorization", AdminAuthHeader("admin"))
+
+	resp := httptest.NewRecorder()
+	handler := http.HandlerFunc(ExportAuditEvents)
+	handler.ServeHTTP(resp, req)
+
+	if resp.Code != 200 || resp.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("Export was not sent", resp.Code)
+	}
+	var types []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event AuditLog.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil { t.Fatal(err.Error()) }
+		types = append(types, event.Type)
+	}
+	if len(types) != 2 || types[0] != AuditLog.Login || types[1] != AuditLog.Register {
+		t.Fatal("Exported events were incorrect", types)
+	}
+}
@@ -0,0 +1,7 @@
+// Package authservice holds the protobuf definition of the authorization service's
+// gRPC API and the Go code generated from it. The gateway keeps its own copy of the
+// generated code in gateway/auth_service, which is regenerated along with this one.
+package authservice
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative auth_service.proto
+//go:generate protoc --go_out=../../gateway/auth_service --go_opt=paths=source_relative,Mauth_service.proto=gateway/auth_service;authservice --go-grpc_out=../../gateway/auth_service --go-grpc_opt=paths=source_relative,Mauth_service.proto=gateway/auth_service;authservice auth_service.proto
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	AuthService "microservices/authorization/auth_service"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// gRPC status codes of the HTTP statuses of the errors of the service functions, as
+// returned by ServiceErrorStatus. Other statuses are returned as UNKNOWN.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest: codes.InvalidArgument,
+	http.StatusUnauthorized: codes.Unauthenticated,
+	http.StatusForbidden: codes.PermissionDenied,
+	http.StatusNotFound: codes.NotFound,
+	http.StatusConflict: codes.AlreadyExists,
+	http.StatusTooManyRequests: codes.ResourceExhausted,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// Serves the AuthService gRPC API. Each RPC calls the same function as the HTTP handler
+// of the matching route, so lockouts, sessions and the audit log work the same for both APIs.
+type AuthServiceServer struct {
+	AuthService.UnimplementedAuthServiceServer
+	users	UserStore.Store
+}
+
+// Returns a gRPC server with the AuthService registered, using the given user store
+func NewGrpcServer(users UserStore.Store) *grpc.Server {
+	server := grpc.NewServer()
+	AuthService.RegisterAuthServiceServer(server, &AuthServiceServer{users: users})
+	return server
+}
+
+// Networks of the peers that may pass on the IP of the client they received a request
+// from, i.e. the gateway, over gRPC or HTTP. Set in main() from the GRPC_TRUSTED_PEERS
+// env variable, a comma separated list of CIDR ranges and IPs.
+var trustedPeers []netip.Prefix
+
+// Serves the gRPC API on the port in the GRPC_PORT env variable
+func ServeGrpc(users UserStore.Store) {
+	grpcPort := GetEnv("GRPC_PORT", "50051")
+	listener, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	log.Println("Authorization gRPC API running on port", grpcPort)
+	if err := NewGrpcServer(users).Serve(listener); err != nil {
+		log.Panic(err.Error())
+	}
+}
+
+func (s *AuthServiceServer) Login(ctx context.Context, req *AuthService.LoginRequest) (*AuthService.LoginResponse, error) {
+	if err := CheckContext(ctx); err != nil { return nil, err }
+	result, err := LoginUser(s.users, GrpcClientInfo(ctx, req.GetClient()), req.GetUsername(), req.GetPassword())
+	if err != nil { return nil, GrpcError(err) }
+	if result.MfaChallenge != "" {
+		return &AuthService.LoginResponse{MfaChallenge: result.MfaChallenge}, nil
+	}
+	return &AuthService.LoginResponse{Tokens: GrpcTokens(result.Tokens)}, nil
+}
+
+func (s *AuthServiceServer) Register(ctx context.Context, req *AuthService.RegisterRequest) (*AuthService.RegisterResponse, error) {
+	if err := CheckContext(ctx); err != nil { return nil, err }
+	tokens, err := RegisterUser(s.users, GrpcClientInfo(ctx, req.GetClient()), req.GetUsername(), req.GetPassword(), req.GetInviteCode())
+	if err != nil { return nil, GrpcError(err) }
+	return &AuthService.RegisterResponse{Tokens: GrpcTokens(tokens)}, nil
+}
+
+func (s *AuthServiceServer) Validate(ctx context.Context, req *AuthService.ValidateRequest) (*AuthService.ValidateResponse, error) {
+	if err := CheckContext(ctx); err != nil { return nil, err }
+	var validated JsonStruct
+	var err error
+	switch credential := req.GetCredential().(type) {
+	case *AuthService.ValidateRequest_AccessToken:
+		validated, err = ValidateAccessToken(credential.AccessToken)
+	case *AuthService.ValidateRequest_ApiKey:
+		validated, err = ValidateApiKey(s.users, credential.ApiKey)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "access_token or api_key is required")
+	}
+	if err != nil { return nil, GrpcError(err) }
+	return &AuthService.ValidateResponse{
+		Username: validated.Username,
+		Exp: int64(validated.Exp),
+		Admin: validated.Admin,
+		Roles: validated.Roles,
+		Permissions: validated.Permissions,
+		EmailVerified: validated.EmailVerified,
+		ClientId: validated.ClientID,
+		Scope: validated.Scope,
+		Fid: validated.Fid,
+		Org: validated.Org,
+	}, nil
+}
+
+func (s *AuthServiceServer) Introspect(ctx context.Context, req *AuthService.IntrospectRequest) (*AuthService.IntrospectResponse, error) {
+	if err := CheckContext(ctx); err != nil { return nil, err }
+	introspection, err := IntrospectToken(s.users, req.GetClientId(), req.GetClientSecret(), req.GetToken())
+	if err != nil { return nil, GrpcError(err) }
+	return &AuthService.IntrospectResponse{
+		Active: introspection.Active,
+		Scope: introspection.Scope,
+		ClientId: introspection.ClientID,
+		Username: introspection.Username,
+		TokenType: introspection.TokenType,
+		Exp: introspection.Exp,
+		Iat: introspection.Iat,
+		Sub: introspection.Sub,
+		Aud: introspection.Aud,
+		Iss: introspection.Iss,
+		Jti: introspection.Jti,
+		Roles: introspection.Roles,
+		Permissions: introspection.Permissions,
+		EmailVerified: introspection.EmailVerified,
+		Fid: introspection.Fid,
+	}, nil
+}
+
+// Parses a comma separated list of CIDR ranges and IPs. Empty entries are skipped.
+func ParseTrustedPeers(value string) (prefixes []netip.Prefix, err error) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted peer %q is not a CIDR range", entry)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted peer %q is not an IP", entry)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Returns the client of an RPC. Its IP is the address of the gRPC peer, unless the peer
+// is trusted, i.e. the gateway, which passes on the IP of the client it received the
+// request from. The user agent is passed on by any peer, since it is not used for lockouts.
+func GrpcClientInfo(ctx context.Context, client *AuthService.Client) ClientInfo {
+	info := ClientInfo{UserAgent: TruncateUserAgent(client.GetUserAgent())}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return info
+	}
+	info.IP = p.Addr.String()
+	if host, _, err := net.SplitHostPort(info.IP); err == nil {
+		info.IP = host
+	}
+	if _, err := netip.ParseAddr(client.GetIp()); err == nil && IsTrustedPeer(info.IP) {
+		info.IP = client.GetIp()
+	}
+	return info
+}
+
+// Returns true if the IP belongs to one of the trustedPeers
+func IsTrustedPeer(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedPeers {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the gRPC status of a cancelled RPC or one whose deadline has passed, so that
+// it is not handled. Otherwise nil is returned.
+func CheckContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
+
+// Returns an error of the service functions as a gRPC status, with the code and message
+// of its HTTP status. Lockouts get RetryInfo, like the Retry-After header over HTTP.
+func GrpcError(err error) error {
+	statusCode, message := ServiceErrorStatus(err)
+	code, ok := grpcCodes[statusCode]
+	if !ok { code = codes.Unknown }
+	st := status.New(code, message)
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		retryDelay := time.Duration(SendStatus.RetryAfterSeconds(lockout.RetryAfter)) * time.Second
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)}); err == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+// Returns the tokens issued by IssueTokens
+func GrpcTokens(tokens IssuedTokens) *AuthService.Tokens {
+	return &AuthService.Tokens{
+		AccessToken: tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		TokenType: "Bearer",
+		ExpiresIn: int64(accessTokenTTL.Seconds()),
+	}
+}
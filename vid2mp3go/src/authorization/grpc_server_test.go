@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	AuditLog "microservices/authorization/audit_log"
+	AuthService "microservices/authorization/auth_service"
+	LoginThrottle "microservices/authorization/login_throttle"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Serves the gRPC API on a loopback port for the duration of the test and returns a
+// client connected to it, whose peer address is 127.0.0.1.
+func NewTestAuthClient(t *testing.T) AuthService.AuthServiceClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatalf("Listening failed:\n%s", err.Error()) }
+	server := NewGrpcServer(MockUserStore())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil { t.Fatalf("Client creation failed:\n%s", err.Error()) }
+	t.Cleanup(func() { conn.Close() })
+	return AuthService.NewAuthServiceClient(conn)
+}
+
+func TestGrpcLogin(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		password		string
+		lockedOut		bool
+		mfa				bool
+		trustedPeers	string
+		expectedIP		string
+		expectedCode	codes.Code
+	}{
+		{
+			name: "Successful login",
+			password: "test_password",
+			trustedPeers: "127.0.0.1",
+			expectedIP: "203.0.113.7",
+			expectedCode: codes.OK,
+		},
+		{
+			name: "Client IP from untrusted peer ignored",
+			password: "test_password",
+			trustedPeers: "10.0.0.0/8",
+			expectedIP: "127.0.0.1",
+			expectedCode: codes.OK,
+		},
+		{
+			name: "MFA challenge",
+			password: "test_password",
+			mfa: true,
+			trustedPeers: "127.0.0.0/8",
+			expectedCode: codes.OK,
+		},
+		{
+			name: "Password is incorrect",
+			password: "different_password",
+			trustedPeers: "127.0.0.0/8",
+			expectedIP: "203.0.113.7",
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name: "IP locked out",
+			password: "test_password",
+			lockedOut: true,
+			trustedPeers: "127.0.0.0/8",
+			expectedIP: "203.0.113.7",
+			expectedCode: codes.ResourceExhausted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedPeers, _ = ParseTrustedPeers(tt.trustedPeers)
+			defer func() { trustedPeers = nil }()
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			audit := AuditLog.NewMemoryStore()
+			auditLog = audit
+			if tt.lockedOut {
+				loginAttempts.Lock("ip:203.0.113.7", time.Now().Add(time.Minute))
+			}
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if !tt.lockedOut {
+				storedPassword, _ := hashParams.Hash("test_password")
+				rows := sqlmock.NewRows(userColumns).AddRow(1, "test_user", storedPassword, true, false, nil)
+				mock.ExpectQuery(selectUserByEmail).WithArgs("test_user").WillReturnRows(rows)
+			}
+			if tt.mfa {
+				ExpectMfaEnabledQuery(mock, 1, true)
+				mock.ExpectExec("INSERT INTO mfa_challenge (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			} else if tt.expectedCode == codes.OK {
+				ExpectMfaEnabledQuery(mock, 1, false)
+				ExpectSendTokens(mock, 1, true)
+			}
+
+			client := NewTestAuthClient(t)
+			resp, err := client.Login(context.Background(), &AuthService.LoginRequest{
+				Username: "test_user",
+				Password: tt.password,
+				Client: &AuthService.Client{Ip: "203.0.113.7", UserAgent: "test_agent"},
+			})
+
+			if status.Code(err) != tt.expectedCode { t.Fatal("Status code was incorrect", err) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if tt.lockedOut {
+				details := status.Convert(err).Details()
+				if len(details) != 1 { t.Fatal("RetryInfo was missing", details) }
+				retryInfo, ok := details[0].(*errdetails.RetryInfo)
+				if !ok || retryInfo.GetRetryDelay().AsDuration() != time.Minute { t.Fatal("RetryInfo was incorrect", details) }
+			}
+			if events := audit.Events(); !tt.mfa && (len(events) != 1 || events[0].IP != tt.expectedIP || events[0].UserAgent != "test_agent") {
+				t.Fatal("Client was not passed on to the audit log", events)
+			}
+			if tt.expectedCode != codes.OK { return }
+			if tt.mfa {
+				if resp.GetMfaChallenge() == "" || resp.GetTokens() != nil { t.Fatal("Did not receive only an MFA challenge", resp) }
+				return
+			}
+			tokens := resp.GetTokens()
+			if tokens.GetAccessToken() == "" || tokens.GetRefreshToken() == "" { t.Fatal("Did not receive tokens", resp) }
+			if tokens.GetTokenType() != "Bearer" || tokens.GetExpiresIn() != int64(accessTokenTTL.Seconds()) { t.Fatal("Token type or expiry was incorrect", tokens) }
+		})
+	}
+}
+
+func TestGrpcRegister(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+	auditLog = AuditLog.NewMemoryStore()
+	client := NewTestAuthClient(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WillReturnError(duplicateEntryErr)
+	mock.ExpectRollback()
+
+	_, err = client.Register(context.Background(), &AuthService.RegisterRequest{Username: "test_user", Password: "test_password"})
+	if status.Code(err) != codes.InvalidArgument { t.Fatal("Username that is not an email address was accepted", err) }
+	_, err = client.Register(context.Background(), &AuthService.RegisterRequest{Username: "taken@example.com", Password: "test_password"})
+	if status.Code(err) != codes.AlreadyExists { t.Fatal("Duplicate user was not rejected", err) }
+}
+
+func TestGrpcValidate(t *testing.T) {
+	tokenString, _ := CreateJWT(testUser)
+	tests := []struct {
+		name			string
+		req				*AuthService.ValidateRequest
+		expectedCode	codes.Code
+	}{
+		{
+			name: "Valid access token",
+			req: &AuthService.ValidateRequest{Credential: &AuthService.ValidateRequest_AccessToken{AccessToken: tokenString}},
+			expectedCode: codes.OK,
+		},
+		{
+			name: "Invalid access token",
+			req: &AuthService.ValidateRequest{Credential: &AuthService.ValidateRequest_AccessToken{AccessToken: "invalid.test.token"}},
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name: "Credential missing",
+			req: &AuthService.ValidateRequest{},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+	client := NewTestAuthClient(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client.Validate(context.Background(), tt.req)
+			if status.Code(err) != tt.expectedCode { t.Fatal("Status code was incorrect", err) }
+			if tt.expectedCode != codes.OK { return }
+			if resp.GetUsername() != testUser.Username || !resp.GetAdmin() || resp.GetScope() != "upload:write download:read admin" || resp.GetExp() == 0 {
+				t.Fatal("Validation response was incorrect", resp)
+			}
+		})
+	}
+}
+
+func TestGrpcDeadlineExceeded(t *testing.T) {
+	client := NewTestAuthClient(t)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	tokenString, _ := CreateJWT(testUser)
+	_, err := client.Validate(ctx, &AuthService.ValidateRequest{Credential: &AuthService.ValidateRequest_AccessToken{AccessToken: tokenString}})
+	if status.Code(err) != codes.DeadlineExceeded { t.Fatal("Status code was incorrect", err) }
+}
+
+func TestParseTrustedPeers(t *testing.T) {
+	prefixes, err := ParseTrustedPeers(" 10.244.0.0/16, 192.0.2.1,,2001:db8::/32")
+	if err != nil { t.Fatal(err.Error()) }
+	if len(prefixes) != 3 || prefixes[1].String() != "192.0.2.1/32" { t.Fatal("Trusted peers were incorrect", prefixes) }
+	trustedPeers = prefixes
+	defer func() { trustedPeers = nil }()
+	for ip, trusted := range map[string]bool{"10.244.3.4": true, "::ffff:10.244.3.4": true, "192.0.2.1": true, "192.0.2.2": false, "2001:db8::1": true, "bufconn": false} {
+		if IsTrustedPeer(ip) != trusted { t.Fatal("Trust of peer was incorrect", ip) }
+	}
+	for _, invalid := range []string{"10.244.0.0/33", "gateway"} {
+		if _, err := ParseTrustedPeers(invalid); err == nil { t.Fatal("Invalid trusted peer was accepted", invalid) }
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Response of the /introspect endpoint, as defined by RFC 7662. Inactive tokens only
+// have active set to false. Roles, permissions, email_verified and fid are extensions.
+type Introspection struct {
+	Active			bool		`json:"active"`
+	Scope			string		`json:"scope,omitempty"`
+	ClientID		string		`json:"client_id,omitempty"`
+	Username		string		`json:"username,omitempty"`
+	TokenType		string		`json:"token_type,omitempty"`
+	Exp				int64		`json:"exp,omitempty"`
+	Iat				int64		`json:"iat,omitempty"`
+	Sub				string		`json:"sub,omitempty"`
+	Aud				[]string	`json:"aud,omitempty"`
+	Iss				string		`json:"iss,omitempty"`
+	Jti				string		`json:"jti,omitempty"`
+	Roles			[]string	`json:"roles,omitempty"`
+	Permissions		[]string	`json:"permissions,omitempty"`
+	EmailVerified	bool		`json:"email_verified,omitempty"`
+	Fid				string		`json:"fid,omitempty"`
+}
+
+// Token introspection endpoint (RFC 7662) for resource servers, which can validate
+// tokens without knowing the layout of our JWTs. The token is sent in the token form
+// parameter of a POST request. Both JWTs and API keys can be introspected. Since they
+// can be told apart, token_type_hint is ignored. The resource server authenticates like
+// at /token, as a confidential OAuth client with the token:introspect scope. The scope
+// of an active token lists the permissions it grants.
+func Introspect(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Introspect request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	clientID, clientSecret := GetOAuthClientCredentials(r)
+	introspection, err := IntrospectToken(users, clientID, clientSecret, r.PostForm.Get("token"))
+	if errors.Is(err, errInvalidClient) {
+		SendOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	} else if errors.Is(err, errUnauthorizedClient) {
+		SendOAuthError(w, http.StatusForbidden, "unauthorized_client", errUnauthorizedClient.Error())
+		return
+	} else if errors.Is(err, errInvalidRequest) {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	} else if err != nil {
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(introspection)
+}
+
+// Returned by IntrospectToken if the client is not confidential or lacks the
+// token:introspect scope
+var errUnauthorizedClient = errors.New("client may not introspect tokens")
+
+// Returned by IntrospectToken if the token to introspect is missing
+var errInvalidRequest = errors.New("token is missing")
+
+// Introspects a JWT or an API key for the OAuth client with the given ID and secret.
+// Returns errInvalidClient if the client can not be authenticated, errUnauthorizedClient
+// if it may not introspect tokens and errInvalidRequest if the token is empty.
+func IntrospectToken(users UserStore.Store, clientID string, clientSecret string, token string) (introspection Introspection, err error) {
+	client, err := CheckOAuthClient(clientID, clientSecret)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if !client.IsConfidential() || !slices.Contains(client.Scopes, introspectScope) {
+		return Introspection{}, errUnauthorizedClient
+	}
+	if token == "" {
+		return Introspection{}, errInvalidRequest
+	}
+	if strings.Count(token, ".") == 2 {
+		introspection, err = IntrospectJWT(token)
+	} else {
+		introspection, err = IntrospectApiKey(users, token)
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to introspect token:\n%s", err.Error())
+		return Introspection{}, err
+	}
+	return introspection, nil
+}
+
+// Introspects a JWT created by CreateJWT. JWTs that are invalid, expired or revoked
+// are inactive. Claims of unexpected types are left out.
+func IntrospectJWT(tokenString string) (introspection Introspection, err error) {
+	claims, err := ParseJWT(tokenString)
+	if err != nil {
+		return Introspection{Active: false}, nil
+	}
+	revoked, err := IsTokenRevoked(claims)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if revoked {
+		return Introspection{Active: false}, nil
+	}
+	permissions := GetStringsClaim(claims, "permissions")
+	introspection = Introspection{
+		Active: true,
+		Scope: strings.Join(permissions, " "),
+		ClientID: GetStringClaim(claims, "client_id"),
+		Username: GetStringClaim(claims, "username"),
+		TokenType: "Bearer",
+		Sub: GetStringClaim(claims, "sub"),
+		Iss: GetStringClaim(claims, "iss"),
+		Jti: GetStringClaim(claims, "jti"),
+		Roles: GetStringsClaim(claims, "roles"),
+		Permissions: permissions,
+		Fid: GetStringClaim(claims, "fid"),
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		introspection.Exp = exp.Unix()
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		introspection.Iat = iat.Unix()
+	}
+	if aud, err := claims.GetAudience(); err == nil {
+		introspection.Aud = aud
+	}
+	introspection.EmailVerified, _ = claims["email_verified"].(bool)
+	return introspection, nil
+}
+
+// Introspects an API key. Unknown and revoked keys and keys of disabled users are
+// inactive. API keys do not expire, so exp is left out. The user's roles and
+// permissions are fetched from the DB.
+func IntrospectApiKey(users UserStore.Store, apiKey string) (introspection Introspection, err error) {
+	owner, err := GetApiKeyOwner(users, apiKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Introspection{Active: false}, nil
+	} else if err != nil {
+		return Introspection{}, err
+	}
+	if owner.Revoked || owner.Disabled {
+		return Introspection{Active: false}, nil
+	}
+	roles, permissions, err := GetUserRoles(owner.UserID)
+	if err != nil {
+		return Introspection{}, err
+	}
+	return Introspection{
+		Active: true,
+		Scope: strings.Join(permissions, " "),
+		Username: owner.Username,
+		TokenType: "ApiKey",
+		Sub: strconv.FormatInt(owner.UserID, 10),
+		Iss: jwtIssuer,
+		Roles: roles,
+		Permissions: permissions,
+		EmailVerified: owner.Verified,
+	}, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Signs the given claims with the current signing key, like CreateJWT does.
+func SignClaims(t *testing.T, claims jwt.MapClaims) (tokenString string) {
+	signingKey, err := keyRing.SigningKey()
+	if err != nil { t.Fatal(err.Error()) }
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = signingKey.Kid
+	tokenString, err = token.SignedString(signingKey.PrivateKey)
+	if err != nil { t.Fatal(err.Error()) }
+	return tokenString
+}
+
+func TestIntrospect(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	validJWT, _ := CreateJWT(testUser)
+	revokedJWT, _ := CreateJWT(testUser)
+	delegatedUser := testUser
+	delegatedUser.ClientID = "public_client"
+	delegatedUser.Permissions = []string{"download:read"}
+	delegatedJWT, _ := CreateJWT(delegatedUser)
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		expectedActive	bool
+		clientID		string
+		clientSecret	string
+		token			string
+		apiKeyRevoked	bool
+	}{
+		{
+			name: "Active JWT",
+			method: "POST",
+			expectedCode: 200,
+			expectedActive: true,
+			token: validJWT,
+		},
+		{
+			name: "Active JWT issued to OAuth client",
+			method: "POST",
+			expectedCode: 200,
+			expectedActive: true,
+			token: delegatedJWT,
+		},
+		{
+			name: "Revoked JWT",
+			method: "POST",
+			expectedCode: 200,
+			token: revokedJWT,
+		},
+		{
+			name: "JWT with invalid signature",
+			method: "POST",
+			expectedCode: 200,
+			token: validJWT[:len(validJWT)-4] + "AAAA",
+		},
+		{
+			name: "Active API key",
+			method: "POST",
+			expectedCode: 200,
+			expectedActive: true,
+			token: "test_api_key",
+		},
+		{
+			name: "Revoked API key",
+			method: "POST",
+			expectedCode: 200,
+			token: "test_api_key",
+			apiKeyRevoked: true,
+		},
+		{
+			name: "Unknown API key",
+			method: "POST",
+			expectedCode: 200,
+			token: "unknown_api_key",
+		},
+		{
+			name: "Client without introspection scope",
+			method: "POST",
+			expectedCode: 403,
+			clientID: "confidential_client",
+			token: validJWT,
+		},
+		{
+			name: "Public client",
+			method: "POST",
+			expectedCode: 403,
+			clientID: "public_client",
+			clientSecret: "none",
+			token: validJWT,
+		},
+		{
+			name: "Client secret incorrect",
+			method: "POST",
+			expectedCode: 401,
+			clientSecret: "wrong_secret",
+			token: validJWT,
+		},
+		{
+			name: "Token missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			claims, _ := ParseJWT(revokedJWT)
+			revocationStore.RevokeToken(GetStringClaim(claims, "jti"), time.Now().Add(time.Hour))
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.clientID == "" {
+				tt.clientID = "resource_server"
+			}
+			if tt.clientSecret == "" {
+				tt.clientSecret = "client_secret"
+			} else if tt.clientSecret == "none" {
+				tt.clientSecret = ""
+			}
+			if tt.expectedCode != 405 {
+				ExpectOAuthClientQuery(mock, tt.clientID)
+			}
+			if tt.expectedCode == 200 && strings.HasSuffix(tt.token, "api_key") {
+				rows := sqlmock.NewRows([]string{"id", "user_id", "revoked"})
+				if tt.token == "test_api_key" {
+					rows.AddRow(3, 1, tt.apiKeyRevoked)
+				}
+				mock.ExpectQuery(selectApiKey).WithArgs(SecureToken.Hash(tt.token)).WillReturnRows(rows)
+				if tt.token == "test_api_key" {
+					mock.ExpectQuery(selectUserByID).WithArgs(1).
+						WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+				}
+				if tt.expectedActive {
+					ExpectUserRolesQuery(mock, 1)
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/introspect", strings.NewReader(url.Values{"token": {tt.token}}.Encode()))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth(tt.clientID, tt.clientSecret)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Introspect)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code != 200 { return }
+			var introspection Introspection
+			if err := json.NewDecoder(resp.Body).Decode(&introspection); err != nil { t.Fatal(err.Error()) }
+			if introspection.Active != tt.expectedActive { t.Fatal("Active was incorrect", introspection) }
+			if !tt.expectedActive && (introspection.Username != "" || introspection.Scope != "") {
+				t.Fatal("Inactive token revealed claims", introspection)
+			}
+			if tt.expectedActive && (introspection.Sub != "1" || introspection.Username != "test_user" || introspection.Scope == "") {
+				t.Fatal("Introspection was incorrect", introspection)
+			}
+			if tt.token == validJWT && (introspection.TokenType != "Bearer" || introspection.Exp <= introspection.Iat || introspection.Iss != jwtIssuer || introspection.ClientID != "") {
+				t.Fatal("Introspection was incorrect", introspection)
+			}
+			if tt.token == delegatedJWT && (introspection.ClientID != "public_client" || introspection.Scope != "download:read") {
+				t.Fatal("Introspection was incorrect", introspection)
+			}
+		})
+	}
+}
+
+// Claims of unexpected types must not make /validate or /introspect panic
+func TestUnexpectedClaimTypes(t *testing.T) {
+	revocationStore = RevocationStore.NewMemoryStore()
+	tokenString := SignClaims(t, jwt.MapClaims{
+		"jti": "jti",
+		"iss": jwtIssuer,
+		"aud": jwtAudience,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"iat": time.Now().Unix(),
+		"username": 42,
+		"admin": "yes",
+		"roles": "admin",
+		"permissions": []any{"upload:write", 7},
+		"client_id": false,
+	})
+
+	req, err := http.NewRequest("POST", "/validate", nil)
+	if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+	req.Header.Set("Authorization", "Bearer " + tokenString)
+	resp := httptest.NewRecorder()
+	WithUserStore(MockUserStore(), Validate).ServeHTTP(resp, req)
+	if resp.Code != 200 { t.Fatal("Status was incorrect", resp.Code) }
+	var res JsonStruct
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil { t.Fatal(err.Error()) }
+	if res.Username != "" || res.Admin || len(res.Roles) != 0 || len(res.Permissions) != 1 || res.Exp == 0 {
+		t.Fatal("Response JSON was incorrect", res)
+	}
+
+	introspection, err := IntrospectJWT(tokenString)
+	if err != nil { t.Fatal(err.Error()) }
+	if !introspection.Active || introspection.Username != "" || introspection.Scope != "upload:write" || introspection.ClientID != "" {
+		t.Fatal("Introspection was incorrect", introspection)
+	}
+}
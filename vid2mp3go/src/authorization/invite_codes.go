@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Registration modes. In open mode anyone can register at /register. In invite-only
+// mode registering requires an invite code created by an admin at /admin/invites.
+// In closed mode nobody can register, so the only new user is the admin created from
+// the ADMIN_EMAIL env variable. Outside of open mode, users can not be provisioned
+// by logging in with the IdP either, although existing users can still link their
+// identity.
+const (
+	registrationOpen       = "open"
+	registrationInviteOnly = "invite-only"
+	registrationClosed     = "closed"
+)
+
+// Registration mode of the service. Configured with the REGISTRATION_MODE env variable.
+var registrationMode = GetEnv("REGISTRATION_MODE", registrationOpen)
+
+// Lifetime of invite codes that are created without an Expires-In header.
+// Configured with the INVITE_CODE_TTL env variable.
+var inviteCodeTTL = GetDurationEnv("INVITE_CODE_TTL", 7*24*time.Hour)
+
+// Returned by RedeemInviteCode if the invite code does not exist, has expired or
+// has been used as often as it may be.
+var errInvalidInviteCode = errors.New("invite code is invalid, expired or used up")
+
+// An invite code, as listed by the GET /admin/invites endpoint. The code itself is
+// only stored as a hash, so it can not be listed. Roles are given to the users that
+// register with the code, besides the default role.
+type InviteCode struct {
+	ID			int64		`json:"id"`
+	MaxUses		int			`json:"max_uses"`
+	Uses		int			`json:"uses"`
+	Roles		[]string	`json:"roles"`
+	CreatedBy	string		`json:"created_by"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+// A newly created invite code, as returned by the POST /admin/invites endpoint
+type NewInviteCode struct {
+	ID			int64		`json:"id"`
+	Code		string		`json:"code"`
+	MaxUses		int			`json:"max_uses"`
+	Roles		[]string	`json:"roles"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+}
+
+// Returns an error if the REGISTRATION_MODE env variable is not a registration mode,
+// so that a typo can not open registration to anyone.
+func CheckRegistrationMode() (err error) {
+	if !slices.Contains([]string{registrationOpen, registrationInviteOnly, registrationClosed}, registrationMode) {
+		return fmt.Errorf("unknown registration mode %q", registrationMode)
+	}
+	return nil
+}
+
+// Admin endpoint for managing invite codes. Requires a JWT with the admin permission.
+// GET lists the invite codes as JSON. POST creates an invite code, which can be used
+// as often as the Max-Uses header allows, 1 by default, until the duration in the
+// Expires-In header, e.g. "72h", has passed. Without Expires-In, the code expires after
+// INVITE_CODE_TTL. Users registering with the code get the roles listed in the Roles
+// header, separated by spaces. The code is only returned once, by the POST request.
+// DELETE revokes the invite code with the ID in the Invite-Id header.
+func InviteCodes(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("InviteCodes request received with method", r.Method)
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequirePermission(w, r, adminPermission)
+	if !ok { return }
+	switch r.Method {
+	case "GET":
+		ListInviteCodes(users, w)
+	case "POST":
+		adminID, err := GetUserIDClaim(claims)
+		if err != nil {
+			log.Println("JWT had an invalid sub claim")
+			SendStatus.InvalidCredentials(w)
+			return
+		}
+		CreateInviteCode(w, r, adminID, GetStringClaim(claims, "username"))
+	case "DELETE":
+		inviteID, err := strconv.ParseInt(r.Header.Get("Invite-Id"), 10, 64)
+		if err != nil {
+			SendStatus.BadRequest(w)
+			return
+		}
+		RevokeInviteCode(w, inviteID)
+	}
+}
+
+// Sends every invite code as JSON, oldest first.
+func ListInviteCodes(users UserStore.Store, w http.ResponseWriter) {
+	rows, err := db.Query(
+		"SELECT id, max_uses, uses, created_by, expires_at, created_at FROM invite_code ORDER BY id",
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch invite codes from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer rows.Close()
+	inviteCodes := []InviteCode{}
+	creatorIDs := []int64{}
+	for rows.Next() {
+		inviteCode := InviteCode{Roles: []string{}}
+		var creatorID int64
+		if err := rows.Scan(&inviteCode.ID, &inviteCode.MaxUses, &inviteCode.Uses, &creatorID, &inviteCode.ExpiresAt, &inviteCode.CreatedAt); err != nil {
+			log.Printf("Error occured while trying to fetch invite codes from DB:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		inviteCodes = append(inviteCodes, inviteCode)
+		creatorIDs = append(creatorIDs, creatorID)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error occured while trying to fetch invite codes from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	// Admins usually create several invite codes, so each creator is only looked up once
+	creators := map[int64]string{}
+	for i, creatorID := range creatorIDs {
+		creator, found := creators[creatorID]
+		if !found {
+			user, err := users.FindByID(creatorID)
+			if err != nil && !errors.Is(err, UserStore.ErrUserNotFound) {
+				log.Printf("Error occured while trying to fetch creator of invite code from DB:\n%s", err.Error())
+				SendStatus.InternalServerError(w)
+				return
+			}
+			creator = user.Email
+			creators[creatorID] = creator
+		}
+		inviteCodes[i].CreatedBy = creator
+	}
+	if err := AddInviteCodeRoles(inviteCodes); err != nil {
+		log.Printf("Error occured while trying to fetch roles of invite codes from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inviteCodes)
+}
+
+// Fetches the roles of the invite codes from the DB and adds them to the codes.
+func AddInviteCodeRoles(inviteCodes []InviteCode) (err error) {
+	rows, err := db.Query(
+		"SELECT invite_code_role.invite_code_id, role.name FROM invite_code_role JOIN role ON role.id = invite_code_role.role_id ORDER BY role.name",
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var inviteID int64
+		var role string
+		if err := rows.Scan(&inviteID, &role); err != nil {
+			return err
+		}
+		for i := range inviteCodes {
+			if inviteCodes[i].ID == inviteID {
+				inviteCodes[i].Roles = append(inviteCodes[i].Roles, role)
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// Creates an invite code as described by the headers of the POST request and sends it
+// as JSON. Only the code's hash is stored, so the code can not be shown again. If one of
+// the roles does not exist, 404 is sent.
+func CreateInviteCode(w http.ResponseWriter, r *http.Request, adminID int64, admin string) {
+	maxUses, ttl := 1, inviteCodeTTL
+	var err error
+	if value := r.Header.Get("Max-Uses"); value != "" {
+		if maxUses, err = strconv.Atoi(value); err != nil || maxUses < 1 {
+			SendStatus.BadRequest(w)
+			return
+		}
+	}
+	if value := r.Header.Get("Expires-In"); value != "" {
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+			SendStatus.BadRequest(w)
+			return
+		}
+	}
+	roles := strings.Fields(r.Header.Get("Roles"))
+	slices.Sort(roles)
+	roles = slices.Compact(roles)
+	code, err := SecureToken.Generate(32)
+	if err != nil {
+		log.Printf("Error occured while trying to create invite code:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	now := time.Now().UTC()
+	inviteCode := NewInviteCode{Code: code, MaxUses: maxUses, Roles: roles, ExpiresAt: now.Add(ttl)}
+	inviteCode.ID, err = InsertInviteCode(SecureToken.Hash(code), inviteCode, adminID, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to insert invite code into DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Invite code %d created by %s", inviteCode.ID, admin)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inviteCode)
+}
+
+// Stores the invite code with the given hash and its roles in one transaction.
+// If one of the roles does not exist, sql.ErrNoRows is returned.
+func InsertInviteCode(codeHash string, inviteCode NewInviteCode, createdBy int64, now time.Time) (inviteID int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		"INSERT INTO invite_code (code_hash, max_uses, created_by, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		codeHash, inviteCode.MaxUses, createdBy, inviteCode.ExpiresAt, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if inviteID, err = res.LastInsertId(); err != nil {
+		return 0, err
+	}
+	for _, role := range inviteCode.Roles {
+		res, err := tx.Exec("INSERT INTO invite_code_role (invite_code_id, role_id) SELECT ?, id FROM role WHERE name=?", inviteID, role)
+		if err != nil {
+			return 0, err
+		}
+		if inserted, err := res.RowsAffected(); err != nil {
+			return 0, err
+		} else if inserted == 0 {
+			return 0, sql.ErrNoRows
+		}
+	}
+	return inviteID, tx.Commit()
+}
+
+// Deletes the invite code with the given ID, so that it can not be used anymore.
+// Users that have already registered with it keep their roles.
+func RevokeInviteCode(w http.ResponseWriter, inviteID int64) {
+	res, err := db.Exec("DELETE FROM invite_code WHERE id=?", inviteID)
+	var deleted int64
+	if err == nil {
+		deleted, err = res.RowsAffected()
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to delete invite code %d:\n%s", inviteID, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if deleted == 0 {
+		SendStatus.NotFound(w)
+		return
+	}
+	log.Printf("Invite code %d revoked", inviteID)
+	fmt.Fprintf(w, "Invite code revoked.")
+}
+
+// Uses up one use of the invite code and returns its ID. If the code does not exist,
+// has expired or has no uses left, errInvalidInviteCode is returned.
+func RedeemInviteCode(code string) (inviteID int64, err error) {
+	err = db.QueryRow("SELECT id FROM invite_code WHERE code_hash=?", SecureToken.Hash(code)).Scan(&inviteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errInvalidInviteCode
+	} else if err != nil {
+		return 0, err
+	}
+	// Checking and counting the use in one statement keeps concurrent registrations
+	// from using the code more often than it may be
+	res, err := db.Exec(
+		"UPDATE invite_code SET uses = uses + 1 WHERE id=? AND uses < max_uses AND expires_at > ?",
+		inviteID, time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	if redeemed, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if redeemed == 0 {
+		return 0, errInvalidInviteCode
+	}
+	return inviteID, nil
+}
+
+// Gives back the use of an invite code, when registering with it failed.
+// Failures are only logged, since they only cost the code one use.
+func ReleaseInviteCode(inviteID int64) {
+	if _, err := db.Exec("UPDATE invite_code SET uses = uses - 1 WHERE id=? AND uses > 0", inviteID); err != nil {
+		log.Printf("Error occured while trying to release invite code %d:\n%s", inviteID, err.Error())
+	}
+}
+
+// Gives the user the roles of the invite code it registered with.
+func GrantInviteCodeRoles(userID int64, inviteID int64) (err error) {
+	_, err = db.Exec(
+		"INSERT IGNORE INTO user_role (user_id, role_id) SELECT ?, role_id FROM invite_code_role WHERE invite_code_id=?",
+		userID, inviteID,
+	)
+	return err
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	AccountEvents "microservices/authorization/account_events"
+	AuditLog "microservices/authorization/audit_log"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const redeemInviteCode = "UPDATE invite_code SET uses = uses + 1 WHERE id=? AND uses < max_uses AND expires_at > ?"
+
+// Sets the registration mode for the duration of the test
+func WithRegistrationMode(t *testing.T, mode string) {
+	previous := registrationMode
+	registrationMode = mode
+	t.Cleanup(func() { registrationMode = previous })
+}
+
+func TestCheckRegistrationMode(t *testing.T) {
+	for _, mode := range []string{registrationOpen, registrationInviteOnly, registrationClosed} {
+		WithRegistrationMode(t, mode)
+		if err := CheckRegistrationMode(); err != nil { t.Fatal(err.Error()) }
+	}
+	WithRegistrationMode(t, "invite_only")
+	if err := CheckRegistrationMode(); err == nil { t.Fatal("Unknown registration mode was accepted") }
+}
+
+func TestInviteCodes(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	createdAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name			string
+		method			string
+		header			string
+		maxUses			string
+		expiresIn		string
+		roles			string
+		inviteID		string
+		expectedCode	int
+	}{
+		{
+			name: "List invite codes",
+			method: "GET",
+			header: AdminAuthHeader("admin"),
+			expectedCode: 200,
+		},
+		{
+			name: "Create single-use invite code",
+			method: "POST",
+			header: AdminAuthHeader("admin"),
+			expectedCode: 200,
+		},
+		{
+			name: "Create multi-use invite code with roles",
+			method: "POST",
+			header: AdminAuthHeader("admin"),
+			maxUses: "10",
+			expiresIn: "72h",
+			roles: "uploader listener uploader",
+			expectedCode: 200,
+		},
+		{
+			name: "Role does not exist",
+			method: "POST",
+			header: AdminAuthHeader("admin"),
+			roles: "unknown",
+			expectedCode: 404,
+		},
+		{
+			name: "Invalid Max-Uses",
+			method: "POST",
+			header: AdminAuthHeader("admin"),
+			maxUses: "0",
+			expectedCode: 400,
+		},
+		{
+			name: "Invalid Expires-In",
+			method: "POST",
+			header: AdminAuthHeader("admin"),
+			expiresIn: "-1h",
+			expectedCode: 400,
+		},
+		{
+			name: "Revoke invite code",
+			method: "DELETE",
+			header: AdminAuthHeader("admin"),
+			inviteID: "3",
+			expectedCode: 200,
+		},
+		{
+			name: "Invite code does not exist",
+			method: "DELETE",
+			header: AdminAuthHeader("admin"),
+			inviteID: "4",
+			expectedCode: 404,
+		},
+		{
+			name: "Invite-Id missing",
+			method: "DELETE",
+			header: AdminAuthHeader("admin"),
+			expectedCode: 400,
+		},
+		{
+			name: "Not an admin",
+			method: "POST",
+			header: AdminAuthHeader("upload:write"),
+			expectedCode: 403,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "PUT",
+			header: AdminAuthHeader("admin"),
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			switch {
+			case tt.method == "GET":
+				mock.ExpectQuery("SELECT id, max_uses, uses, created_by, expires_at, created_at FROM invite_code ORDER BY id").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "max_uses", "uses", "created_by", "expires_at", "created_at"}).
+						AddRow(1, 1, 0, 1, createdAt.Add(time.Hour), createdAt).
+						AddRow(2, 5, 2, 1, createdAt.Add(time.Hour), createdAt))
+				mock.ExpectQuery(selectUserByID).WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+				mock.ExpectQuery("SELECT invite_code_role.invite_code_id, role.name FROM invite_code_role JOIN role ON role.id = invite_code_role.role_id ORDER BY role.name").
+					WillReturnRows(sqlmock.NewRows([]string{"invite_code_id", "name"}).AddRow(2, "listener").AddRow(2, "uploader"))
+			case tt.method == "POST" && tt.expectedCode != 400 && tt.expectedCode != 403:
+				mock.ExpectBegin()
+				maxUses := 1
+				if tt.maxUses == "10" { maxUses = 10 }
+				mock.ExpectExec("INSERT INTO invite_code (code_hash, max_uses, created_by, expires_at, created_at) VALUES (?, ?, ?, ?, ?)").
+					WithArgs(sqlmock.AnyArg(), maxUses, 1, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(3, 1))
+				if tt.expectedCode == 404 {
+					mock.ExpectExec("INSERT INTO invite_code_role (invite_code_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(3, "unknown").WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectRollback()
+					break
+				}
+				for _, role := range []string{"listener", "uploader"} {
+					if tt.roles == "" { break }
+					mock.ExpectExec("INSERT INTO invite_code_role (invite_code_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(3, role).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectCommit()
+			case tt.method == "DELETE" && tt.inviteID != "":
+				deleted := int64(0)
+				if tt.expectedCode == 200 { deleted = 1 }
+				inviteID, _ := strconv.ParseInt(tt.inviteID, 10, 64)
+				mock.ExpectExec("DELETE FROM invite_code WHERE id=?").WithArgs(inviteID).WillReturnResult(sqlmock.NewResult(0, deleted))
+			}
+
+			req, err := http.NewRequest(tt.method, "/admin/invites", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			if tt.maxUses != "" { req.Header.Set("Max-Uses", tt.maxUses) }
+			if tt.expiresIn != "" { req.Header.Set("Expires-In", tt.expiresIn) }
+			if tt.roles != "" { req.Header.Set("Roles", tt.roles) }
+			if tt.inviteID != "" { req.Header.Set("Invite-Id", tt.inviteID) }
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), InviteCodes)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code != 200 { return }
+			switch tt.method {
+			case "GET":
+				var inviteCodes []InviteCode
+				if err := json.NewDecoder(resp.Body).Decode(&inviteCodes); err != nil { t.Fatal(err.Error()) }
+				if len(inviteCodes) != 2 || len(inviteCodes[0].Roles) != 0 || len(inviteCodes[1].Roles) != 2 || inviteCodes[1].Uses != 2 || inviteCodes[1].CreatedBy != "test_user" {
+					t.Fatal("Invite codes were incorrect", inviteCodes)
+				}
+			case "POST":
+				var inviteCode NewInviteCode
+				if err := json.NewDecoder(resp.Body).Decode(&inviteCode); err != nil { t.Fatal(err.Error()) }
+				ttl := inviteCodeTTL
+				if tt.expiresIn != "" { ttl, _ = time.ParseDuration(tt.expiresIn) }
+				if inviteCode.ID != 3 || inviteCode.Code == "" || time.Until(inviteCode.ExpiresAt) > ttl || time.Until(inviteCode.ExpiresAt) < ttl - time.Minute {
+					t.Fatal("Invite code was incorrect", inviteCode)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterRegistrationMode(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		mode			string
+		inviteCode		string
+		redeemable		bool
+		duplicate		bool
+		expectedCode	int
+	}{
+		{
+			name: "Open registration without invite code",
+			mode: registrationOpen,
+			expectedCode: 200,
+		},
+		{
+			name: "Open registration with invite code",
+			mode: registrationOpen,
+			inviteCode: "test_code",
+			redeemable: true,
+			expectedCode: 200,
+		},
+		{
+			name: "Invite-only registration with invite code",
+			mode: registrationInviteOnly,
+			inviteCode: "test_code",
+			redeemable: true,
+			expectedCode: 200,
+		},
+		{
+			name: "Invite-only registration without invite code",
+			mode: registrationInviteOnly,
+			expectedCode: 403,
+		},
+		{
+			name: "Invite code expired or used up",
+			mode: registrationInviteOnly,
+			inviteCode: "test_code",
+			expectedCode: 403,
+		},
+		{
+			name: "Invite code unknown",
+			mode: registrationInviteOnly,
+			inviteCode: "unknown_code",
+			expectedCode: 403,
+		},
+		{
+			name: "Duplicate user gives back invite code use",
+			mode: registrationInviteOnly,
+			inviteCode: "test_code",
+			redeemable: true,
+			duplicate: true,
+			expectedCode: 409,
+		},
+		{
+			name: "Closed registration",
+			mode: registrationClosed,
+			inviteCode: "test_code",
+			expectedCode: 403,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			WithRegistrationMode(t, tt.mode)
+			accountEvents = AccountEvents.NewMemoryPublisher()
+			audit := AuditLog.NewMemoryStore()
+			auditLog = audit
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.inviteCode != "" && tt.mode != registrationClosed {
+				rows := sqlmock.NewRows([]string{"id"})
+				if tt.inviteCode == "test_code" { rows.AddRow(3) }
+				mock.ExpectQuery("SELECT id FROM invite_code WHERE code_hash=?").WithArgs(SecureToken.Hash(tt.inviteCode)).WillReturnRows(rows)
+				if tt.inviteCode == "test_code" {
+					redeemed := int64(0)
+					if tt.redeemable { redeemed = 1 }
+					mock.ExpectExec(redeemInviteCode).WithArgs(3, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, redeemed))
+				}
+			}
+			if tt.duplicate {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WillReturnError(duplicateEntryErr)
+				mock.ExpectRollback()
+				mock.ExpectExec("UPDATE invite_code SET uses = uses - 1 WHERE id=? AND uses > 0").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+			} else if tt.expectedCode == 200 {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WithArgs("test_user@example.com", hashOf("test_password")).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(1, "user").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				if tt.inviteCode != "" {
+					mock.ExpectExec("INSERT IGNORE INTO user_role (user_id, role_id) SELECT ?, role_id FROM invite_code_role WHERE invite_code_id=?").WithArgs(1, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				ExpectSendVerification(mock, 1)
+				ExpectSendTokens(mock, 1, true)
+			}
+
+			req, err := http.NewRequest("POST", "/register", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Username", "test_user@example.com")
+			req.Header.Set("Password", "test_password")
+			if tt.inviteCode != "" { req.Header.Set("Invite-Code", tt.inviteCode) }
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Register)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if events := audit.Events(); resp.Code == 403 && (len(events) != 1 || events[0].Outcome != AuditLog.Failure) {
+				t.Fatal("Rejected registration was not audited", events)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Largest body accepted by the JSON endpoints
+const maxJsonBodySize = 1 << 16
+
+// Body of a POST request to /v1/register or /v1/login. InviteCode is only used by
+// /v1/register, where it is required in invite-only registration mode.
+type CredentialsRequest struct {
+	Username	string	`json:"username"`
+	Password	string	`json:"password"`
+	InviteCode	string	`json:"invite_code,omitempty"`
+}
+
+// User the tokens of a TokenResponse were issued to, as stated in the access token
+type TokenUser struct {
+	ID				int64		`json:"id"`
+	Username		string		`json:"username"`
+	EmailVerified	bool		`json:"email_verified"`
+	Roles			[]string	`json:"roles"`
+	Permissions		[]string	`json:"permissions"`
+	Org				string		`json:"org,omitempty"`
+}
+
+// Successful response of /v1/register and /v1/login
+type TokenResponse struct {
+	AccessToken		string		`json:"access_token"`
+	TokenType		string		`json:"token_type"`
+	ExpiresIn		int64		`json:"expires_in"`
+	RefreshToken	string		`json:"refresh_token"`
+	User			TokenUser	`json:"user"`
+}
+
+// Response of /v1/login for users that have enabled MFA
+type MfaChallengeResponse struct {
+	MfaChallenge	string	`json:"mfa_challenge"`
+}
+
+// Error response of the JSON endpoints
+type ErrorResponse struct {
+	Error	string	`json:"error"`
+}
+
+// JSON version of /login. The POST request's body is a CredentialsRequest instead of
+// Basic auth credentials. A TokenResponse is returned, or, for users that have enabled
+// MFA, 202 with a MfaChallengeResponse, which is completed at /login/mfa. Errors are
+// returned as an ErrorResponse with the status code /login would have sent.
+func LoginV1(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("LoginV1 request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	credentials, ok := DecodeCredentials(w, r)
+	if !ok { return }
+	result, err := LoginUser(users, GetClientInfo(r), credentials.Username, credentials.Password)
+	if err != nil {
+		SendJsonServiceError(w, err)
+		return
+	}
+	if result.MfaChallenge != "" {
+		w.Header().Set("Cache-Control", "no-store")
+		SendJson(w, http.StatusAccepted, MfaChallengeResponse{MfaChallenge: result.MfaChallenge})
+		return
+	}
+	SendJsonTokens(w, result.Tokens)
+}
+
+// JSON version of /register. The POST request's body is a CredentialsRequest instead
+// of the Username, Password and Invite-Code headers. Like LoginV1, a TokenResponse or an
+// ErrorResponse is returned.
+func RegisterV1(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("RegisterV1 request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	credentials, ok := DecodeCredentials(w, r)
+	if !ok { return }
+	tokens, err := RegisterUser(users, GetClientInfo(r), credentials.Username, credentials.Password, credentials.InviteCode)
+	if err != nil {
+		SendJsonServiceError(w, err)
+		return
+	}
+	SendJsonTokens(w, tokens)
+}
+
+// Decodes the CredentialsRequest in the request's body. If the body is not one,
+// 400 is sent and ok is false.
+func DecodeCredentials(w http.ResponseWriter, r *http.Request) (credentials CredentialsRequest, ok bool) {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJsonBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&credentials); err != nil {
+		log.Printf("Credentials could not be decoded:\n%s", err.Error())
+		SendJsonError(w, http.StatusBadRequest, "Bad request.")
+		return CredentialsRequest{}, false
+	}
+	return credentials, true
+}
+
+// Sends the tokens issued by LoginUser or RegisterUser as a TokenResponse
+func SendJsonTokens(w http.ResponseWriter, tokens IssuedTokens) {
+	w.Header().Set("Cache-Control", "no-store")
+	SendJson(w, http.StatusOK, TokenResponse{
+		AccessToken: tokens.AccessToken,
+		TokenType: "Bearer",
+		ExpiresIn: int64(accessTokenTTL / time.Second),
+		RefreshToken: tokens.RefreshToken,
+		User: TokenUser{
+			ID: tokens.User.ID,
+			Username: tokens.User.Username,
+			EmailVerified: tokens.User.EmailVerified,
+			Roles: tokens.User.Roles,
+			Permissions: tokens.User.Permissions,
+			Org: tokens.User.Org,
+		},
+	})
+}
+
+// Sends an error of LoginUser or RegisterUser as an ErrorResponse with the status code
+// and message /login or /register would have sent. Lockouts get a Retry-After header.
+func SendJsonServiceError(w http.ResponseWriter, err error) {
+	w.Header().Set("Cache-Control", "no-store")
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		w.Header().Set("Retry-After", strconv.Itoa(SendStatus.RetryAfterSeconds(lockout.RetryAfter)))
+	}
+	statusCode, message := ServiceErrorStatus(err)
+	SendJsonError(w, statusCode, message)
+}
+
+// Sends the value as JSON with the given status code
+func SendJson(w http.ResponseWriter, statusCode int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Sends an ErrorResponse with the given status code and message
+func SendJsonError(w http.ResponseWriter, statusCode int, message string) {
+	SendJson(w, statusCode, ErrorResponse{Error: message})
+}
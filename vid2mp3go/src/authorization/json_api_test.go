@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	AccountEvents "microservices/authorization/account_events"
+	AuditLog "microservices/authorization/audit_log"
+	LoginThrottle "microservices/authorization/login_throttle"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoginV1(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		body			string
+		lockedOut		bool
+		mfa				bool
+		expectedCode	int
+	}{
+		{
+			name: "Successful login",
+			method: "POST",
+			body: `{"username": "test_user", "password": "test_password"}`,
+			expectedCode: 200,
+		},
+		{
+			name: "MFA challenge",
+			method: "POST",
+			body: `{"username": "test_user", "password": "test_password"}`,
+			mfa: true,
+			expectedCode: 202,
+		},
+		{
+			name: "Password is incorrect",
+			method: "POST",
+			body: `{"username": "test_user", "password": "different_password"}`,
+			expectedCode: 401,
+		},
+		{
+			name: "Account locked out",
+			method: "POST",
+			body: `{"username": "test_user", "password": "test_password"}`,
+			lockedOut: true,
+			expectedCode: 429,
+		},
+		{
+			name: "Body is not JSON",
+			method: "POST",
+			body: "username=test_user&password=test_password",
+			expectedCode: 400,
+		},
+		{
+			name: "Unknown field",
+			method: "POST",
+			body: `{"username": "test_user", "password": "test_password", "admin": true}`,
+			expectedCode: 400,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			auditLog = AuditLog.NewMemoryStore()
+			if tt.lockedOut {
+				loginAttempts.Lock("account:test_user", time.Now().Add(time.Minute))
+			}
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode == 200 || tt.expectedCode == 202 || tt.expectedCode == 401 {
+				storedPassword, _ := hashParams.Hash("test_password")
+				rows := sqlmock.NewRows(userColumns).AddRow(1, "test_user", storedPassword, true, false, nil)
+				mock.ExpectQuery(selectUserByEmail).WithArgs("test_user").WillReturnRows(rows)
+			}
+			if tt.mfa {
+				ExpectMfaEnabledQuery(mock, 1, true)
+				mock.ExpectExec("INSERT INTO mfa_challenge (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			} else if tt.expectedCode == 200 {
+				ExpectMfaEnabledQuery(mock, 1, false)
+				ExpectSendTokens(mock, 1, true)
+			}
+
+			req, err := http.NewRequest(tt.method, "/v1/login", strings.NewReader(tt.body))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), LoginV1)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if tt.method != "POST" { return }
+			if resp.Header().Get("Content-Type") != "application/json" { t.Fatal("Response was not JSON") }
+			switch resp.Code {
+			case 200:
+				var tokens TokenResponse
+				if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil { t.Fatal(err.Error()) }
+				if tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.TokenType != "Bearer" || tokens.ExpiresIn != int64(accessTokenTTL / time.Second) {
+					t.Fatal("Tokens were incorrect", tokens)
+				}
+				if tokens.User.ID != 1 || tokens.User.Username != "test_user" || !tokens.User.EmailVerified || len(tokens.User.Permissions) != 2 {
+					t.Fatal("User was incorrect", tokens.User)
+				}
+				if resp.Header().Get("Cache-Control") != "no-store" { t.Fatal("Tokens may be cached") }
+			case 202:
+				var challenge MfaChallengeResponse
+				if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil { t.Fatal(err.Error()) }
+				if challenge.MfaChallenge == "" { t.Fatal("Did not receive MFA challenge") }
+			default:
+				var errorResponse ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil { t.Fatal(err.Error()) }
+				if errorResponse.Error == "" { t.Fatal("Error was missing") }
+				if resp.Code == 429 && resp.Header().Get("Retry-After") != "60" {
+					t.Fatal("Retry-After was incorrect", resp.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterV1(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		body			string
+		expectedCode	int
+	}{
+		{
+			name: "Successful registration",
+			body: `{"username": "test_user@example.com", "password": "test_password"}`,
+			expectedCode: 200,
+		},
+		{
+			name: "Duplicate in DB",
+			body: `{"username": "test_user@example.com", "password": "test_password"}`,
+			expectedCode: 409,
+		},
+		{
+			name: "Username is not an email address",
+			body: `{"username": "test_user", "password": "test_password"}`,
+			expectedCode: 400,
+		},
+		{
+			name: "Body missing",
+			expectedCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accountEvents = AccountEvents.NewMemoryPublisher()
+			auditLog = AuditLog.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode == 409 {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WillReturnError(duplicateEntryErr)
+				mock.ExpectRollback()
+			} else if tt.expectedCode == 200 {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WithArgs("test_user@example.com", hashOf("test_password")).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(1, "user").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				ExpectSendVerification(mock, 1)
+				ExpectSendTokens(mock, 1, true)
+			}
+
+			req, err := http.NewRequest("POST", "/v1/register", strings.NewReader(tt.body))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), RegisterV1)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code != 200 { return }
+			var tokens TokenResponse
+			if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil { t.Fatal(err.Error()) }
+			if tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.User.ID != 1 || tokens.User.Username != "test_user@example.com" {
+				t.Fatal("Response was incorrect", tokens)
+			}
+		})
+	}
+}
+
+func TestRegisterV1InviteCode(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	WithRegistrationMode(t, registrationInviteOnly)
+	auditLog = AuditLog.NewMemoryStore()
+	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.ExpectQuery("SELECT id FROM invite_code WHERE code_hash=?").WithArgs(SecureToken.Hash("unknown_code")).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	req, err := http.NewRequest("POST", "/v1/register", strings.NewReader(`{"username": "test_user@example.com", "password": "test_password", "invite_code": "unknown_code"}`))
+	if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+	resp := httptest.NewRecorder()
+	RegisterV1(MockUserStore(), resp, req)
+
+	if resp.Code != 403 { t.Fatal("Status was incorrect", resp.Code) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal("Invite code was not passed on", err.Error()) }
+}
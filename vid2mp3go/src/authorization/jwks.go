@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	SendStatus "microservices/authorization/send_status"
+	SigningKeys "microservices/authorization/signing_keys"
+	"net/http"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// How often a new signing key is created. Configured with the JWT_KEY_ROTATION env variable.
+var keyRotationInterval = GetDurationEnv("JWT_KEY_ROTATION", 30*24*time.Hour)
+
+// Keys used for signing and verifying JWTs. Replaced with a MySQL backed key ring
+// in main(), unless the SIGNING_KEY_STORE env variable is set to "memory".
+var keyRing = SigningKeys.NewKeyRing(SigningKeys.NewMemoryStore(), keyRotationInterval, accessTokenTTL)
+
+// Minimum time between reloading the keys because of an unknown kid, so that
+// JWTs with made up kids can not be used to flood the DB with queries.
+const keyReloadInterval = 10 * time.Second
+
+// jwt.Keyfunc that returns the public key matching the kid in the JWT's header.
+// If the kid is unknown, the keys are reloaded in case another replica has
+// created a new signing key.
+func GetVerificationKey(token *jwt.Token) (key interface{}, err error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("kid was missing from JWT header")
+	}
+	if publicKey, ok := keyRing.PublicKey(kid); ok {
+		return publicKey, nil
+	}
+	if err := keyRing.Reload(time.Now(), keyReloadInterval); err != nil {
+		return nil, err
+	}
+	if publicKey, ok := keyRing.PublicKey(kid); ok {
+		return publicKey, nil
+	}
+	return nil, fmt.Errorf("unknown kid %s", kid)
+}
+
+// Rotates the signing keys once an hour. Rotating only creates a new key once
+// keyRotationInterval has passed, but retired keys are removed every time.
+func RotateKeysPeriodically() {
+	for range time.Tick(time.Hour) {
+		if err := keyRing.Rotate(time.Now()); err != nil {
+			log.Printf("Error occured while rotating signing keys:\n%s", err.Error())
+		}
+	}
+}
+
+// Publishes the public keys used for verifying JWTs as a JSON Web Key Set.
+// The set includes keys that no longer sign new JWTs, until the JWTs they have
+// signed expire.
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(keyRing.JWKS())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	SigningKeys "microservices/authorization/signing_keys"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWKS(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+	}{
+		{
+			name: "Successful JWKS request",
+			method: "GET",
+			expectedCode: 200,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "POST",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "/.well-known/jwks.json", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(JWKS)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if resp.Code == 200 {
+				var jwks SigningKeys.JWKS
+				if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+					t.Fatalf("Response was not a JWKS:\n%s", err.Error())
+				}
+				signingKey, _ := keyRing.SigningKey()
+				if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != signingKey.Kid {
+					t.Fatal("JWKS did not contain the signing key", jwks.Keys)
+				}
+				if resp.Header().Get("Content-Type") != "application/json" { t.Fatal("Content-Type was incorrect") }
+			}
+		})
+	}
+}
+
+func TestGetVerificationKeyReloads(t *testing.T) {
+	store := SigningKeys.NewMemoryStore()
+	ring := keyRing
+	keyRing = SigningKeys.NewKeyRing(store, time.Hour, time.Hour)
+	t.Cleanup(func() { keyRing = ring })
+
+	// Key created by another replica sharing the store
+	key, _ := SigningKeys.GenerateKey(time.Now())
+	store.Insert(key)
+
+	token := &jwt.Token{Header: map[string]interface{}{"kid": key.Kid}}
+	publicKey, err := GetVerificationKey(token)
+	if err != nil { t.Fatalf("Key was not found after reload:\n%s", err.Error()) }
+	if !key.PublicKey().Equal(publicKey) { t.Fatal("Public key was incorrect") }
+
+	token.Header["kid"] = "unknown_kid"
+	if _, err := GetVerificationKey(token); err == nil { t.Fatal("Unknown kid was accepted") }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	LoginThrottle "microservices/authorization/login_throttle"
+	SendStatus "microservices/authorization/send_status"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Counters of failed logins. Replaced with a MySQL backed store in main(),
+// unless the LOGIN_THROTTLE_STORE env variable is set to "memory".
+var loginAttempts LoginThrottle.Store = LoginThrottle.NewMemoryStore()
+
+// Lockout policies for failed logins to a single account and from a single client IP.
+// IPs are allowed more failures, since many users may share one IP behind a NAT.
+var accountLockoutPolicy = LoginThrottle.Policy{
+	MaxFailures: GetIntEnv("LOGIN_MAX_FAILURES", 5),
+	BaseLockout: GetDurationEnv("LOGIN_LOCKOUT_BASE", 30*time.Second),
+	MaxLockout:  GetDurationEnv("LOGIN_LOCKOUT_MAX", time.Hour),
+	Window:      GetDurationEnv("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+}
+var ipLockoutPolicy = LoginThrottle.Policy{
+	MaxFailures: GetIntEnv("LOGIN_IP_MAX_FAILURES", 20),
+	BaseLockout: accountLockoutPolicy.BaseLockout,
+	MaxLockout:  accountLockoutPolicy.MaxLockout,
+	Window:      accountLockoutPolicy.Window,
+}
+
+func accountKey(username string) string { return "account:" + username }
+func ipKey(ip string) string { return "ip:" + ip }
+
+// Returns the IP address of the client that sent the request. Trusted peers, i.e. the
+// gateway, put the client's address in X-Forwarded-For. The last address is used, since
+// it was added by the trusted peer. Anyone else could forge the header, so the address
+// of the connection is used for them.
+func GetClientIP(r *http.Request) (ip string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" && IsTrustedPeer(ip) {
+		addresses := strings.Split(forwardedFor, ",")
+		forwarded := strings.TrimSpace(addresses[len(addresses)-1])
+		if _, err := netip.ParseAddr(forwarded); err == nil {
+			return forwarded
+		}
+	}
+	return ip
+}
+
+// Returned by LoginUser if the account or the client IP is locked out. The client
+// has to wait RetryAfter before it may try to log in again.
+type LockoutError struct {
+	RetryAfter	time.Duration
+}
+
+func (err *LockoutError) Error() string {
+	return fmt.Sprintf("login locked out for %s", err.RetryAfter)
+}
+
+// Returns how long the client has to wait before it may try to log in to the
+// account again. Both the account and the client IP may be locked out.
+func LoginRetryAfter(username string, ip string, now time.Time) (retryAfter time.Duration, err error) {
+	for _, key := range []string{accountKey(username), ipKey(ip)} {
+		keyRetryAfter, err := LoginThrottle.RetryAfter(loginAttempts, key, now)
+		if err != nil {
+			return 0, err
+		}
+		retryAfter = max(retryAfter, keyRetryAfter)
+	}
+	return retryAfter, nil
+}
+
+// Counts a failed login against both the account and the client IP, locking
+// them out once their policies allow no further attempts. Failures are only
+// logged, so that the client still gets the response for its credentials.
+func RecordLoginFailure(username string, ip string, now time.Time) {
+	if lockout, err := LoginThrottle.RecordFailure(loginAttempts, accountLockoutPolicy, accountKey(username), now); err != nil {
+		log.Printf("Error occured while recording failed login of user %s:\n%s", username, err.Error())
+	} else if lockout > 0 {
+		log.Printf("User %s locked out for %s after failed logins", username, lockout)
+	}
+	if lockout, err := LoginThrottle.RecordFailure(loginAttempts, ipLockoutPolicy, ipKey(ip), now); err != nil {
+		log.Printf("Error occured while recording failed login from %s:\n%s", ip, err.Error())
+	} else if lockout > 0 {
+		log.Printf("IP %s locked out for %s after failed logins", ip, lockout)
+	}
+}
+
+// Forgets the failed logins of an account after a successful login. The client
+// IP's failures are kept, so that logging in to an account of one's own can not
+// be used to keep guessing the passwords of other accounts.
+func RecordLoginSuccess(username string) {
+	if err := loginAttempts.Reset(accountKey(username)); err != nil {
+		log.Printf("Error occured while resetting failed logins of user %s:\n%s", username, err.Error())
+	}
+}
+
+// Admin endpoint for lifting login lockouts. Requires a JWT with the admin permission.
+// POST clears the failed logins of the account given in the Username header and/or
+// the client IP given in the IP header.
+func Unlock(w http.ResponseWriter, r *http.Request) {
+	log.Println("Unlock request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if _, ok := RequirePermission(w, r, adminPermission); !ok {
+		return
+	}
+	username, ip := r.Header.Get("Username"), r.Header.Get("IP")
+	if username == "" && ip == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var keys []string
+	if username != "" {
+		keys = append(keys, accountKey(username))
+	}
+	if ip != "" {
+		keys = append(keys, ipKey(ip))
+	}
+	for _, key := range keys {
+		if err := loginAttempts.Reset(key); err != nil {
+			log.Printf("Error occured while trying to unlock %s:\n%s", key, err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+	}
+	log.Printf("Unlocked %s", strings.Join(keys, ", "))
+	fmt.Fprintf(w, "Unlocked.")
+}
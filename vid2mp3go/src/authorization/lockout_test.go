@@ -0,0 +1,153 @@
+package main
+
+import (
+	LoginThrottle "microservices/authorization/login_throttle"
+	RevocationStore "microservices/authorization/revocation_store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Makes the request come from a trusted peer, like the requests the gateway passes on
+// with the client's IP in X-Forwarded-For.
+func FromTrustedPeer(t *testing.T, req *http.Request) {
+	trustedPeers, _ = ParseTrustedPeers("10.0.0.0/8")
+	t.Cleanup(func() { trustedPeers = nil })
+	req.RemoteAddr = "10.0.0.5:5000"
+}
+
+func TestGetClientIP(t *testing.T) {
+	trustedPeers, _ = ParseTrustedPeers("10.0.0.0/8")
+	defer func() { trustedPeers = nil }()
+	tests := []struct {
+		name			string
+		remoteAddr		string
+		forwardedFor	string
+		expected		string
+	}{
+		{ name: "Remote address", remoteAddr: "192.0.2.1:5000", expected: "192.0.2.1", },
+		{ name: "Forwarded by gateway", remoteAddr: "10.0.0.5:5000", forwardedFor: "203.0.113.7", expected: "203.0.113.7", },
+		{ name: "Forwarded by several proxies", remoteAddr: "10.0.0.5:5000", forwardedFor: "198.51.100.1, 203.0.113.7", expected: "203.0.113.7", },
+		{ name: "Forwarded by untrusted peer", remoteAddr: "192.0.2.1:5000", forwardedFor: "203.0.113.7", expected: "192.0.2.1", },
+		{ name: "Invalid forwarded address", remoteAddr: "10.0.0.5:5000", forwardedFor: "unknown", expected: "10.0.0.5", },
+		{ name: "Remote address without port", remoteAddr: "192.0.2.1", expected: "192.0.2.1", },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/login", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if ip := GetClientIP(req); ip != tt.expected { t.Fatal("IP was incorrect", ip) }
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	loginAttempts = LoginThrottle.NewMemoryStore()
+	now := time.Now()
+	for i := 0; i < accountLockoutPolicy.MaxFailures; i++ {
+		retryAfter, _ := LoginRetryAfter("test_user", "203.0.113.7", now)
+		if retryAfter != 0 { t.Fatal("Account was locked out before MaxFailures", i) }
+		RecordLoginFailure("test_user", "203.0.113.7", now)
+	}
+	retryAfter, err := LoginRetryAfter("test_user", "198.51.100.1", now)
+	if err != nil || retryAfter != accountLockoutPolicy.BaseLockout {
+		t.Fatal("Account was not locked out after MaxFailures", retryAfter)
+	}
+	retryAfter, _ = LoginRetryAfter("other_user", "203.0.113.7", now)
+	if retryAfter != 0 { t.Fatal("IP was locked out before its MaxFailures", retryAfter) }
+
+	// A successful login resets the account but not the IP
+	for i := accountLockoutPolicy.MaxFailures; i < ipLockoutPolicy.MaxFailures; i++ {
+		RecordLoginFailure("other_user", "203.0.113.7", now)
+	}
+	RecordLoginSuccess("test_user")
+	retryAfter, _ = LoginRetryAfter("test_user", "198.51.100.1", now)
+	if retryAfter != 0 { t.Fatal("Account was still locked out after successful login", retryAfter) }
+	retryAfter, _ = LoginRetryAfter("test_user", "203.0.113.7", now)
+	if retryAfter != ipLockoutPolicy.BaseLockout { t.Fatal("IP was not locked out after MaxFailures", retryAfter) }
+}
+
+func TestUnlock(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		permissions		[]string
+		username		string
+		ip				string
+	}{
+		{
+			name: "Unlock account",
+			method: "POST",
+			expectedCode: 200,
+			permissions: []string{"admin"},
+			username: "test_user",
+		},
+		{
+			name: "Unlock IP",
+			method: "POST",
+			expectedCode: 200,
+			permissions: []string{"admin"},
+			ip: "203.0.113.7",
+		},
+		{
+			name: "Nothing to unlock",
+			method: "POST",
+			expectedCode: 400,
+			permissions: []string{"admin"},
+		},
+		{
+			name: "Admin permission missing",
+			method: "POST",
+			expectedCode: 403,
+			permissions: []string{"upload:write"},
+			username: "test_user",
+		},
+		{
+			name: "JWT missing",
+			method: "POST",
+			expectedCode: 401,
+			username: "test_user",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			permissions: []string{"admin"},
+			username: "test_user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			loginAttempts.Lock("account:test_user", time.Now().Add(time.Hour))
+			loginAttempts.Lock("ip:203.0.113.7", time.Now().Add(time.Hour))
+
+			req, err := http.NewRequest(tt.method, "/admin/unlock", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.permissions != nil {
+				tokenString, _ := CreateJWT(User{ID: 1, Username: "admin_user", Permissions: tt.permissions})
+				req.Header.Set("Authorization", "Bearer " + tokenString)
+			}
+			req.Header.Set("Username", tt.username)
+			req.Header.Set("IP", tt.ip)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Unlock)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			accountRetryAfter, _ := LoginThrottle.RetryAfter(loginAttempts, "account:test_user", time.Now())
+			ipRetryAfter, _ := LoginThrottle.RetryAfter(loginAttempts, "ip:203.0.113.7", time.Now())
+			if (accountRetryAfter == 0) != (resp.Code == 200 && tt.username != "") { t.Fatal("Account lockout was incorrect", accountRetryAfter) }
+			if (ipRetryAfter == 0) != (resp.Code == 200 && tt.ip != "") { t.Fatal("IP lockout was incorrect", ipRetryAfter) }
+		})
+	}
+}
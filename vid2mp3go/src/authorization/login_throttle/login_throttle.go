@@ -0,0 +1,69 @@
+package loginthrottle
+
+import "time"
+
+// Keeps track of failed login attempts and lockouts. Keys identify what the
+// attempts are counted for, e.g. an account or a client IP address.
+type Store interface {
+	// Records a failed attempt for key at now and returns the number of failures
+	// since the counter was last reset. If the previous failure was more than
+	// window ago, the counter starts over.
+	AddFailure(key string, now time.Time, window time.Duration) (failures int, err error)
+	// Locks key until the given time.
+	Lock(key string, until time.Time) (err error)
+	// Returns the time until which key is locked. The zero time is returned
+	// if key has never been locked.
+	LockedUntil(key string) (until time.Time, err error)
+	// Forgets the failures and the lockout of key.
+	Reset(key string) (err error)
+}
+
+// Decides how long a key is locked out after a number of failed attempts.
+type Policy struct {
+	// Number of failures allowed before the first lockout
+	MaxFailures int
+	// Length of the first lockout. Every further failure doubles it.
+	BaseLockout time.Duration
+	// Upper limit for the length of a lockout
+	MaxLockout time.Duration
+	// Failures are forgotten once there have been none for this long
+	Window time.Duration
+}
+
+// Returns how long a key with the given number of failures is locked out.
+// Zero is returned while failures is below MaxFailures.
+func (p Policy) LockDuration(failures int) time.Duration {
+	if failures < p.MaxFailures {
+		return 0
+	}
+	// Stop shifting well before the duration could overflow
+	shift := min(failures-p.MaxFailures, 32)
+	lockout := p.BaseLockout << shift
+	if lockout > p.MaxLockout || lockout <= 0 {
+		return p.MaxLockout
+	}
+	return lockout
+}
+
+// Records a failure for key and locks it if the policy says so.
+// Returns how long the key is locked out, zero if it is not.
+func RecordFailure(s Store, p Policy, key string, now time.Time) (lockout time.Duration, err error) {
+	failures, err := s.AddFailure(key, now, p.Window)
+	if err != nil {
+		return 0, err
+	}
+	lockout = p.LockDuration(failures)
+	if lockout == 0 {
+		return 0, nil
+	}
+	return lockout, s.Lock(key, now.Add(lockout))
+}
+
+// Returns how long key is still locked out at now, zero if it is not.
+func RetryAfter(s Store, key string, now time.Time) (retryAfter time.Duration, err error) {
+	until, err := s.LockedUntil(key)
+	if err != nil || !until.After(now) {
+		return 0, err
+	}
+	return until.Sub(now), nil
+}
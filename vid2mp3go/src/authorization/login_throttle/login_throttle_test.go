@@ -0,0 +1,149 @@
+package loginthrottle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var testPolicy = Policy{MaxFailures: 3, BaseLockout: time.Second, MaxLockout: time.Minute, Window: 15 * time.Minute}
+
+func TestLockDuration(t *testing.T) {
+	tests := []struct {
+		failures	int
+		expected	time.Duration
+	}{
+		{ failures: 0, expected: 0, },
+		{ failures: 2, expected: 0, },
+		{ failures: 3, expected: time.Second, },
+		{ failures: 4, expected: 2 * time.Second, },
+		{ failures: 6, expected: 8 * time.Second, },
+		{ failures: 9, expected: time.Minute, },
+		{ failures: 1000, expected: time.Minute, },
+	}
+	for _, tt := range tests {
+		if d := testPolicy.LockDuration(tt.failures); d != tt.expected {
+			t.Fatal("Lock duration was incorrect", tt.failures, d)
+		}
+	}
+}
+
+func TestRecordFailureAndRetryAfter(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	for i := 1; i < testPolicy.MaxFailures; i++ {
+		lockout, err := RecordFailure(s, testPolicy, "account:test_user", now)
+		if err != nil || lockout != 0 { t.Fatal("Key was locked before MaxFailures", i, lockout) }
+	}
+	lockout, err := RecordFailure(s, testPolicy, "account:test_user", now)
+	if err != nil || lockout != time.Second { t.Fatal("Key was not locked after MaxFailures", lockout) }
+
+	retryAfter, _ := RetryAfter(s, "account:test_user", now.Add(500*time.Millisecond))
+	if retryAfter != 500*time.Millisecond { t.Fatal("RetryAfter was incorrect", retryAfter) }
+	retryAfter, _ = RetryAfter(s, "account:test_user", now.Add(time.Second))
+	if retryAfter != 0 { t.Fatal("Key was still locked after lockout", retryAfter) }
+	retryAfter, _ = RetryAfter(s, "account:other_user", now)
+	if retryAfter != 0 { t.Fatal("Other key was locked", retryAfter) }
+
+	// Backoff doubles with every further failure
+	lockout, _ = RecordFailure(s, testPolicy, "account:test_user", now.Add(time.Second))
+	if lockout != 2*time.Second { t.Fatal("Lockout did not double", lockout) }
+}
+
+func TestMemoryStoreWindow(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.AddFailure("ip:127.0.0.1", now, time.Minute)
+	failures, _ := s.AddFailure("ip:127.0.0.1", now.Add(30*time.Second), time.Minute)
+	if failures != 2 { t.Fatal("Failures within window were not counted", failures) }
+	failures, _ = s.AddFailure("ip:127.0.0.1", now.Add(2*time.Minute), time.Minute)
+	if failures != 1 { t.Fatal("Failures outside window were counted", failures) }
+}
+
+func TestMemoryStoreReset(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.AddFailure("account:test_user", now, time.Minute)
+	s.Lock("account:test_user", now.Add(time.Hour))
+	if err := s.Reset("account:test_user"); err != nil { t.Fatal(err.Error()) }
+	until, _ := s.LockedUntil("account:test_user")
+	if !until.IsZero() { t.Fatal("Lockout was not reset") }
+	failures, _ := s.AddFailure("account:test_user", now, time.Minute)
+	if failures != 1 { t.Fatal("Failures were not reset", failures) }
+}
+
+func TestMemoryStoreForgetsStaleKeys(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.AddFailure("stale", now.Add(-time.Hour), time.Minute)
+	s.AddFailure("locked", now.Add(-time.Hour), time.Minute)
+	s.Lock("locked", now.Add(time.Hour))
+	s.AddFailure("new", now, time.Minute)
+	if _, ok := s.attempts["stale"]; ok { t.Fatal("Stale key was not forgotten") }
+	if _, ok := s.attempts["locked"]; !ok { t.Fatal("Locked key was forgotten") }
+}
+
+func TestMySQLStoreAddFailure(t *testing.T) {
+	tests := []struct {
+		name		string
+		existing	bool
+		expected	int
+	}{
+		{ name: "First failure", existing: false, expected: 1, },
+		{ name: "Further failure", existing: true, expected: 4, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+			defer db.Close()
+
+			now := time.Now()
+			windowStart := now.UTC().Add(-time.Minute)
+			mock.ExpectExec("DELETE FROM login_attempt WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)").
+				WithArgs(windowStart, now.UTC()).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectBegin()
+			update := mock.ExpectExec("UPDATE login_attempt SET failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END, last_failure_at=? WHERE attempt_key=?").
+				WithArgs(windowStart, now.UTC(), "account:test_user")
+			if tt.existing {
+				update.WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT failures FROM login_attempt WHERE attempt_key=?").WithArgs("account:test_user").
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(tt.expected))
+			} else {
+				update.WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO login_attempt (attempt_key, failures, last_failure_at) VALUES (?, ?, ?)").
+					WithArgs("account:test_user", 1, now.UTC()).WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectCommit()
+
+			failures, err := NewMySQLStore(db).AddFailure("account:test_user", now, time.Minute)
+			if err != nil { t.Fatal(err.Error()) }
+			if failures != tt.expected { t.Fatal("Failures were incorrect", failures) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+		})
+	}
+}
+
+func TestMySQLStoreLockedUntil(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	until := time.Now().Add(time.Minute)
+	mock.ExpectExec("UPDATE login_attempt SET locked_until=? WHERE attempt_key=?").WithArgs(until.UTC(), "ip:127.0.0.1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT locked_until FROM login_attempt WHERE attempt_key=?").WithArgs("ip:127.0.0.1").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(until))
+	mock.ExpectQuery("SELECT locked_until FROM login_attempt WHERE attempt_key=?").WithArgs("ip:10.0.0.1").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+	mock.ExpectExec("DELETE FROM login_attempt WHERE attempt_key=?").WithArgs("ip:127.0.0.1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	s := NewMySQLStore(db)
+	if err := s.Lock("ip:127.0.0.1", until); err != nil { t.Fatal(err.Error()) }
+	lockedUntil, err := s.LockedUntil("ip:127.0.0.1")
+	if err != nil || !lockedUntil.Equal(until) { t.Fatal("Lockout was incorrect", lockedUntil) }
+	lockedUntil, err = s.LockedUntil("ip:10.0.0.1")
+	if err != nil || !lockedUntil.IsZero() { t.Fatal("Unknown key was locked", lockedUntil) }
+	if err := s.Reset("ip:127.0.0.1"); err != nil { t.Fatal(err.Error()) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
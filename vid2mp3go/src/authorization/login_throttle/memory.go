@@ -0,0 +1,74 @@
+package loginthrottle
+
+import (
+	"sync"
+	"time"
+)
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	window      time.Duration
+}
+
+// Store implementation that keeps the counters in memory, for tests and local instances
+type MemoryStore struct {
+	mu       sync.Mutex
+	attempts map[string]*attempts
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attempts: map[string]*attempts{}}
+}
+
+func (s *MemoryStore) AddFailure(key string, now time.Time, window time.Duration) (failures int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Forget keys whose failures and lockouts have run out since
+	for k, a := range s.attempts {
+		if now.Sub(a.lastFailure) > a.window && now.After(a.lockedUntil) {
+			delete(s.attempts, k)
+		}
+	}
+	a, ok := s.attempts[key]
+	if !ok {
+		a = &attempts{}
+		s.attempts[key] = a
+	}
+	if now.Sub(a.lastFailure) > window {
+		a.failures = 0
+	}
+	a.failures++
+	a.lastFailure = now
+	a.window = window
+	return a.failures, nil
+}
+
+func (s *MemoryStore) Lock(key string, until time.Time) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attempts[key]
+	if !ok {
+		a = &attempts{}
+		s.attempts[key] = a
+	}
+	a.lockedUntil = until
+	return nil
+}
+
+func (s *MemoryStore) LockedUntil(key string) (until time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.attempts[key]; ok {
+		return a.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (s *MemoryStore) Reset(key string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
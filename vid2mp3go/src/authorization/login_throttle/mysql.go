@@ -0,0 +1,77 @@
+package loginthrottle
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Store implementation backed by the login_attempt table, so that the counters
+// are shared by every replica of the service.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) AddFailure(key string, now time.Time, window time.Duration) (failures int, err error) {
+	now = now.UTC()
+	// Forget keys whose failures and lockouts have run out since
+	_, err = s.db.Exec(
+		"DELETE FROM login_attempt WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)",
+		now.Add(-window), now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// Incrementing in the UPDATE keeps concurrent failures from overwriting each other
+	res, err := tx.Exec(
+		"UPDATE login_attempt SET failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END, last_failure_at=? WHERE attempt_key=?",
+		now.Add(-window), now, key,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		_, err = tx.Exec("INSERT INTO login_attempt (attempt_key, failures, last_failure_at) VALUES (?, ?, ?)", key, 1, now)
+		if err != nil {
+			return 0, err
+		}
+		return 1, tx.Commit()
+	}
+	err = tx.QueryRow("SELECT failures FROM login_attempt WHERE attempt_key=?", key).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+	return failures, tx.Commit()
+}
+
+func (s *MySQLStore) Lock(key string, until time.Time) (err error) {
+	_, err = s.db.Exec("UPDATE login_attempt SET locked_until=? WHERE attempt_key=?", until.UTC(), key)
+	return err
+}
+
+func (s *MySQLStore) LockedUntil(key string) (until time.Time, err error) {
+	var lockedUntil sql.NullTime
+	err = s.db.QueryRow("SELECT locked_until FROM login_attempt WHERE attempt_key=?", key).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+func (s *MySQLStore) Reset(key string) (err error) {
+	_, err = s.db.Exec("DELETE FROM login_attempt WHERE attempt_key=?", key)
+	return err
+}
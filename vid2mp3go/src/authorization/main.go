@@ -4,12 +4,21 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
+	AccountEvents "microservices/authorization/account_events"
+	AuditLog "microservices/authorization/audit_log"
+	LoginThrottle "microservices/authorization/login_throttle"
 	MySQLConf "microservices/authorization/mysql_conf"
+	PasswordHash "microservices/authorization/password_hash"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	SigningKeys "microservices/authorization/signing_keys"
 	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,10 +29,40 @@ import (
 
 var db *sql.DB
 
+// Cost parameters used for hashing passwords
+var hashParams = PasswordHash.NewParams()
+
+// Hash compared against when a user does not exist, so that unknown usernames
+// take as long to reject as incorrect passwords.
+var dummyHash, _ = hashParams.Hash("dummy password")
+
+// Issuer and audience claims of the JWTs. Configured with the JWT_ISSUER and JWT_AUDIENCE
+// env variables, which have to match the ones of the gateway verifying the JWTs.
+var jwtIssuer = GetEnv("JWT_ISSUER", "auth")
+var jwtAudience = GetEnv("JWT_AUDIENCE", "gateway")
+
 type JsonStruct struct {
 	Username	string		`json:"username"`
 	Exp			float64		`json:"exp"`
 	Admin		bool		`json:"admin"`
+	Roles		[]string	`json:"roles"`
+	Permissions	[]string	`json:"permissions"`
+	EmailVerified	bool	`json:"email_verified"`
+	ClientID	string		`json:"client_id,omitempty"`
+	Scope		string		`json:"scope"`
+	Fid			string		`json:"fid,omitempty"`
+	Org			string		`json:"org,omitempty"`
+}
+
+// Handler that is given the store of the user accounts, instead of using a global one.
+// Turned into an http.HandlerFunc with WithUserStore.
+type UserHandler func(users UserStore.Store, w http.ResponseWriter, r *http.Request)
+
+// Returns an http.HandlerFunc calling the handler with the given user store.
+func WithUserStore(users UserStore.Store, handler UserHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(users, w, r)
+	}
 }
 
 // Gets the BasicAuth credentials present in a given http.Request.
@@ -39,30 +78,94 @@ func GetBasicAuth(r *http.Request) (username string, password string, ok bool) {
 	return username, password, ok
 }
 
-// Returns JWT string, expiring in one day, for a given user.
-// If something goes wrong, an error is returned.
-func CreateJWT(username string) (tokenString string, err error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "", errors.New("env variable JWT_SECRET was empty")
+// Gets the token from a "Bearer <token>" Authorization header present in a given
+// http.Request. If the header is missing or malformed, "ok" will be false.
+func GetBearerToken(r *http.Request) (tokenString string, ok bool) {
+	authHeader := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authHeader) != 2 || !strings.EqualFold(authHeader[0], "Bearer") || authHeader[1] == "" {
+		return "", false
+	}
+	return authHeader[1], true
+}
+
+// Returns JWT string, expiring after accessTokenTTL, for a given user. The JWT contains
+// the user's roles and the permissions granted by them, which are also listed in the
+// space separated scope claim. Every JWT gets a unique jti claim, so that it can be
+// revoked. JWTs issued to OAuth clients also get a client_id claim and JWTs belonging to
+// a session a sid claim. Scoped JWTs are marked with the scoped claim and may be
+// restricted to a single mp3 with the fid claim. Members of an organization get its ID
+// in the org claim. The JWT is signed with the key ring's
+// current signing key, whose kid is set in the header. If something goes wrong, an
+// error is returned.
+func CreateJWT(user User) (tokenString string, err error) {
+	signingKey, err := keyRing.SigningKey()
+	if err != nil {
+		return "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"username": username,
-			"exp": time.Now().Add(time.Hour * 24).Unix(),
-			"admin": true,
-		})
-	tokenString, err = token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	jti, err := SecureToken.Generate(16)
+	if err != nil {
+		return "", err
+	}
+	claims := jwt.MapClaims{
+		"jti": jti,
+		"sub": strconv.FormatInt(user.ID, 10),
+		"iss": jwtIssuer,
+		"aud": jwtAudience,
+		"username": user.Username,
+		"exp": time.Now().Add(accessTokenTTL).Unix(),
+		"iat": time.Now().Unix(),
+		"admin": slices.Contains(user.Roles, "admin"),
+		"roles": user.Roles,
+		"permissions": user.Permissions,
+		"scope": strings.Join(user.Permissions, " "),
+		"email_verified": user.EmailVerified,
+	}
+	if user.ClientID != "" {
+		claims["client_id"] = user.ClientID
+	}
+	if user.SessionID != "" {
+		claims["sid"] = user.SessionID
+	}
+	if user.Scoped {
+		claims["scoped"] = true
+	}
+	if user.Fid != "" {
+		claims["fid"] = user.Fid
+	}
+	if user.Org != "" {
+		claims["org"] = user.Org
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = signingKey.Kid
+	tokenString, err = token.SignedString(signingKey.PrivateKey)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
-// Login handler. Checks that credentials present in the http.Request's
-// BasicAuth header also exist in the Authorization database.
-// A JWT is returned on successful login, otherwise an error is returned.
-func Login(w http.ResponseWriter, r *http.Request) {
+// Verifies the signature and, unless disabled with the given options, the expiration
+// time, issuer and audience of a JWT created by CreateJWT. Returns the claims of the JWT.
+func ParseJWT(tokenString string, options ...jwt.ParserOption) (claims jwt.MapClaims, err error) {
+	claims = jwt.MapClaims{}
+	options = append(options,
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithAudience(jwtAudience),
+	)
+	_, err = jwt.ParseWithClaims(tokenString, claims, GetVerificationKey, options...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Login handler. Logs in the user with the credentials present in the http.Request's
+// BasicAuth header using LoginUser. A JWT and a refresh token are returned on successful
+// login, otherwise an error is returned. During a lockout, 429 is returned with a
+// Retry-After header. Users that have enabled MFA get an MFA challenge token with 202
+// instead, which has to be exchanged for the tokens at /login/mfa.
+func Login(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
 	log.Println("Login request received with method", r.Method)
 	if r.Method != "POST" {
 		SendStatus.MethodNotAllowed(w)
@@ -72,122 +175,310 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		SendStatus.InvalidCredentials(w)
 		return
 	}
-	log.Printf("Log in request received for user %s with password %s\n", username, password)
-	rows, err := db.Query(`SELECT email, password FROM user WHERE email=?`, username)
+	result, err := LoginUser(users, GetClientInfo(r), username, password)
 	if err != nil {
-		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
-		SendStatus.InternalServerError(w)
+		SendServiceError(w, err)
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var r_user, r_password string
-		if err := rows.Scan(&r_user, &r_password); err != nil {
-			log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
-			SendStatus.InternalServerError(w)
-			return
+	if result.MfaChallenge != "" {
+		SendMfaChallengeToken(w, result.MfaChallenge)
+		return
+	}
+	SendIssuedTokens(w, result.Tokens, nil)
+}
+
+// Result of LoginUser. Users that have enabled MFA get a challenge token instead of
+// tokens, which has to be exchanged for them at /login/mfa.
+type LoginResult struct {
+	Tokens			IssuedTokens
+	MfaChallenge	string
+}
+
+// Returned by LoginUser if the credentials do not match a user
+var errInvalidCredentials = errors.New("credentials were invalid")
+
+// Checks that the credentials match a user in the Authorization database and issues
+// the user's tokens for the client. Used by the HTTP, JSON and gRPC APIs. Passwords
+// still stored in plaintext are replaced with a hash after a successful login.
+// Repeated failures lock out the account and the client IP with exponential backoff,
+// during which a LockoutError is returned. Wrong credentials return errInvalidCredentials
+// and disabled users errUserDisabled. Users that have enabled MFA get an MFA challenge.
+func LoginUser(users UserStore.Store, client ClientInfo, username string, password string) (result LoginResult, err error) {
+	if username == "" || password == "" {
+		return LoginResult{}, errInvalidCredentials
+	}
+	now := time.Now()
+	retryAfter, err := LoginRetryAfter(username, client.IP, now)
+	if err != nil {
+		log.Printf("Error occured while checking login lockout:\n%s", err.Error())
+		return LoginResult{}, err
+	} else if retryAfter > 0 {
+		log.Printf("Login of user %s from %s rejected due to lockout", username, client.IP)
+		RecordClientAuditEvent(client, AuditLog.Login, username, AuditLog.Failure)
+		return LoginResult{}, &LockoutError{RetryAfter: retryAfter}
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		// Hash anyway so that response times do not reveal which usernames exist
+		PasswordHash.Verify(password, dummyHash)
+		RecordLoginFailure(username, client.IP, now)
+		RecordClientAuditEvent(client, AuditLog.Login, username, AuditLog.Failure)
+		return LoginResult{}, errInvalidCredentials
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		return LoginResult{}, err
+	}
+	match, err := PasswordHash.Verify(password, user.Password)
+	if err != nil {
+		log.Printf("Error occured while verifying password of user %s:\n%s", user.Email, err.Error())
+		return LoginResult{}, err
+	}
+	if username != user.Email || !match {
+		RecordLoginFailure(username, client.IP, now)
+		RecordClientAuditEvent(client, AuditLog.Login, username, AuditLog.Failure)
+		return LoginResult{}, errInvalidCredentials
+	}
+	if hashParams.NeedsRehash(user.Password) {
+		UpgradePasswordHash(users, user, password)
+	}
+	mfaEnabled, err := IsMfaEnabled(user.ID)
+	if err != nil {
+		log.Printf("Error occured while checking MFA of user %s:\n%s", user.Email, err.Error())
+		return LoginResult{}, err
+	}
+	if mfaEnabled {
+		// Failed logins are only forgotten after the second factor has been verified too,
+		// so that the lockout also limits guessing TOTP codes
+		challengeToken, err := CreateMfaChallenge(user.ID)
+		if err != nil {
+			log.Printf("Error occured while trying to create MFA challenge:\n%s", err.Error())
+			return LoginResult{}, err
 		}
-		log.Printf("Read %s %s from db\n", r_user, r_password)
-
-		if username != r_user || password != r_password {
-			SendStatus.InvalidCredentials(w)
-			return
-		} else {
-			tokenString, err := CreateJWT(r_user)
-			if err != nil {
-				log.Printf("Error occured while trying to create JWT:\n%s", err.Error())
-				SendStatus.InternalServerError(w)
-				return
-			}
-			fmt.Fprintf(w, "%s", tokenString)
-			return
+		return LoginResult{MfaChallenge: challengeToken}, nil
+	}
+	RecordLoginSuccess(user.Email)
+	tokens, err := IssueAuditedTokens(users, client, AuditLog.Login, user.ID, user.Email, "")
+	if err != nil {
+		if !errors.Is(err, errUserDisabled) {
+			log.Printf("Error occured while trying to create tokens:\n%s", err.Error())
 		}
+		return LoginResult{}, err
+	}
+	return LoginResult{Tokens: tokens}, nil
+}
+
+// Replaces the stored password of a user with a hash created using the current
+// argon2id parameters. Used after a successful login to migrate plaintext rows
+// and hashes with outdated parameters. Failures are only logged, since the
+// login itself has already succeeded.
+func UpgradePasswordHash(users UserStore.Store, user UserStore.User, password string) {
+	hash, err := hashParams.Hash(password)
+	if err != nil {
+		log.Printf("Error occured while hashing password of user %s:\n%s", user.Email, err.Error())
+		return
+	}
+	if err := users.Update(user.ID, UserStore.Changes{Password: &hash}); err != nil {
+		log.Printf("Error occured while upgrading password hash of user %s:\n%s", user.Email, err.Error())
+		return
 	}
-	SendStatus.InvalidCredentials(w)
+	log.Printf("Upgraded password hash of user %s", user.Email)
 }
 
-// Attempts to register a new user based on the Username and Password included in the
-// received POST request's headers. A JWT is returned after successful registrations.
-// In all other cases, an error is returned.
-func Register(w http.ResponseWriter, r *http.Request) {
+// Registers a new user with RegisterUser, based on the Username, Password and Invite-Code
+// included in the received POST request's headers. A JWT and a refresh token are returned
+// after successful registrations. In all other cases, an error is returned.
+func Register(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
 	log.Println("Register request received with method", r.Method)
 	if r.Method != "POST" {
 		SendStatus.MethodNotAllowed(w)
 		return
 	}
-	username, password := r.Header.Get("Username"), r.Header.Get("Password")
-	if username == "" || password == "" {
-		SendStatus.BadRequest(w)
+	tokens, err := RegisterUser(users, GetClientInfo(r), r.Header.Get("Username"), r.Header.Get("Password"), r.Header.Get("Invite-Code"))
+	if err != nil {
+		SendServiceError(w, err)
 		return
 	}
-	_, err := db.Exec("INSERT INTO user (email, password) VALUES (?, ?)", username, password)
+	SendIssuedTokens(w, tokens, nil)
+}
+
+// Returned by RegisterUser if the username is not an email address or the password is empty
+var errInvalidRegistration = errors.New("username is not an email address or password is empty")
+
+// Returned by RegisterUser if the registration mode does not allow the registration
+var errRegistrationRejected = errors.New("registration is not allowed in this registration mode")
 
+// Registers a new user and issues the user's tokens for the client. Used by the HTTP,
+// JSON and gRPC APIs. The username has to be an email address, otherwise
+// errInvalidRegistration is returned. The password is stored as an argon2id hash. New
+// users are unverified until they use the verification token sent to their email address.
+// Taken usernames return UserStore.ErrDuplicateUser.
+// In invite-only registration mode, an invite code is required, otherwise
+// errRegistrationRejected is returned. In open mode an invite code is optional. Either
+// way, the user gets the roles of the invite code, and invalid invite codes return
+// errInvalidInviteCode. In closed mode, errRegistrationRejected is always returned.
+func RegisterUser(users UserStore.Store, client ClientInfo, username string, password string, inviteCode string) (tokens IssuedTokens, err error) {
+	if !IsValidEmail(username) || password == "" {
+		return IssuedTokens{}, errInvalidRegistration
+	}
+	if registrationMode == registrationClosed || (registrationMode == registrationInviteOnly && inviteCode == "") {
+		log.Printf("Registration of user %s rejected in %s registration mode", username, registrationMode)
+		RecordClientAuditEvent(client, AuditLog.Register, username, AuditLog.Failure)
+		return IssuedTokens{}, errRegistrationRejected
+	}
+	hash, err := hashParams.Hash(password)
 	if err != nil {
-		errString := err.Error()
-		log.Printf("Something went wrong trying to register user to DB:\n%s", errString)
-		if strings.Contains(errString, "Error 1062") {
-			SendStatus.Conflict(w)
-			return
+		log.Printf("Error occured while hashing password:\n%s", err.Error())
+		return IssuedTokens{}, err
+	}
+	var inviteID int64
+	if inviteCode != "" {
+		inviteID, err = RedeemInviteCode(inviteCode)
+		if errors.Is(err, errInvalidInviteCode) {
+			log.Printf("Registration of user %s rejected due to an invalid invite code", username)
+			RecordClientAuditEvent(client, AuditLog.Register, username, AuditLog.Failure)
+			return IssuedTokens{}, err
+		} else if err != nil {
+			log.Printf("Error occured while trying to redeem invite code:\n%s", err.Error())
+			return IssuedTokens{}, err
 		}
-		SendStatus.InternalServerError(w)
-		return
 	}
-	tokenString, err := CreateJWT(username)
+	user, err := users.Create(username, hash)
+
 	if err != nil {
-		log.Printf("Error occured while trying to create JWT:\n%s", err.Error())
-		SendStatus.InternalServerError(w)
-		return
+		log.Printf("Something went wrong trying to register user to DB:\n%s", err.Error())
+		if inviteID != 0 {
+			ReleaseInviteCode(inviteID)
+		}
+		if errors.Is(err, UserStore.ErrDuplicateUser) {
+			RecordClientAuditEvent(client, AuditLog.Register, username, AuditLog.Failure)
+		}
+		return IssuedTokens{}, err
+	}
+	RecordClientAuditEvent(client, AuditLog.Register, username, AuditLog.Success)
+	// An admin can still assign the roles at /admin/roles, so failing to grant them is only logged
+	if inviteID != 0 {
+		if err := GrantInviteCodeRoles(user.ID, inviteID); err != nil {
+			log.Printf("Error occured while trying to grant roles of invite code %d to user %s:\n%s", inviteID, username, err.Error())
+		}
+	}
+	// The user can ask for a new verification token, so failing to send one is only logged
+	if err := SendVerification(user.ID, username); err != nil {
+		log.Printf("Error occured while trying to send verification to user %s:\n%s", username, err.Error())
 	}
-	fmt.Fprintf(w, "%s", tokenString)
+	tokens, err = IssueTokens(users, client, user.ID, username, "")
+	if err != nil && !errors.Is(err, errUserDisabled) {
+		log.Printf("Error occured while trying to create tokens:\n%s", err.Error())
+	}
+	return tokens, err
 }
 
-// Checks whether a valid JSON Web Token is present in the received POST request.
-func Validate(w http.ResponseWriter, r *http.Request) {
+// Checks whether a valid JSON Web Token, that has not been revoked,
+// is present in the received POST request. API keys, sent with the
+// ApiKey scheme instead of Bearer, are validated as well.
+func Validate(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		SendStatus.MethodNotAllowed(w)
 		return
 	}
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Println("Env variable JWT_SECRET was empty")
-		SendStatus.InternalServerError(w)
-		return
-	}
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		log.Println("JWT was missing from request headers")
+	var res JsonStruct
+	var err error
+	if apiKey, ok := GetApiKey(r); ok {
+		res, err = ValidateApiKey(users, apiKey)
+	} else if tokenString, ok := GetBearerToken(r); ok {
+		res, err = ValidateAccessToken(tokenString)
+	} else {
+		log.Println("JWT was missing from request headers or malformed")
 		SendStatus.BadRequest(w)
 		return
 	}
-	tokenString := strings.Split(authHeader, " ")
-	if len(tokenString) != 2 {
-		log.Println("JWT length was incorrect after split")
-		SendStatus.BadRequest(w)
+	if err != nil {
+		SendServiceError(w, err)
 		return
 	}
-	// Extract claims from the received JWT
-	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(tokenString[1], claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(jwtSecret), nil
-	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Returned by ValidateAccessToken and ValidateApiKey if the credential is invalid,
+// expired or revoked, or belongs to a disabled user
+var errInvalidToken = errors.New("credential is invalid or revoked")
+
+// Validates a JWT created by CreateJWT, which must not have been revoked, and turns it
+// into the JSON that is sent back to the Gateway service. Claims of unexpected types are
+// left empty. Invalid and revoked JWTs return errInvalidToken.
+func ValidateAccessToken(tokenString string) (res JsonStruct, err error) {
+	claims, err := ParseJWT(tokenString)
 	if err != nil {
 		log.Printf("JWT decode failed:\n%s", err.Error())
-		SendStatus.Forbidden(w)
+		return JsonStruct{}, errInvalidToken
+	}
+	revoked, err := IsTokenRevoked(claims)
+	if err != nil {
+		log.Printf("Error occured while checking if JWT was revoked:\n%s", err.Error())
+		return JsonStruct{}, err
+	}
+	if revoked {
+		log.Println("JWT has been revoked")
+		return JsonStruct{}, errInvalidToken
+	}
+	res = JsonStruct{
+		Username: GetStringClaim(claims, "username"),
+		Roles: GetStringsClaim(claims, "roles"),
+		Permissions: GetStringsClaim(claims, "permissions"),
+		ClientID: GetStringClaim(claims, "client_id"),
+		Scope: GetStringClaim(claims, "scope"),
+		Fid: GetStringClaim(claims, "fid"),
+		Org: GetStringClaim(claims, "org"),
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		res.Exp = float64(exp.Unix())
+	}
+	res.Admin, _ = claims["admin"].(bool)
+	res.EmailVerified, _ = claims["email_verified"].(bool)
+	return res, nil
+}
+
+// Returns the HTTP status and the message of an error returned by LoginUser,
+// RegisterUser, ValidateAccessToken, ValidateApiKey or IntrospectToken. Unexpected
+// errors, which have been logged already, are internal server errors.
+func ServiceErrorStatus(err error) (statusCode int, message string) {
+	var lockout *LockoutError
+	switch {
+	case errors.As(err, &lockout):
+		return http.StatusTooManyRequests, "Too many requests."
+	case errors.Is(err, errInvalidCredentials), errors.Is(err, errInvalidClient):
+		return http.StatusUnauthorized, "Credentials were invalid."
+	case errors.Is(err, errInvalidRegistration), errors.Is(err, errInvalidRequest):
+		return http.StatusBadRequest, "Bad request."
+	case errors.Is(err, errUserDisabled), errors.Is(err, errRegistrationRejected), errors.Is(err, errInvalidInviteCode),
+		errors.Is(err, errInvalidToken), errors.Is(err, errUnauthorizedClient):
+		return http.StatusForbidden, "Credentials were invalid."
+	case errors.Is(err, UserStore.ErrDuplicateUser):
+		return http.StatusConflict, "Conflict."
+	}
+	return http.StatusInternalServerError, "Internal server error."
+}
+
+// Sends the status of an error returned by LoginUser, RegisterUser, ValidateAccessToken
+// or ValidateApiKey. Lockouts are sent with a Retry-After header.
+func SendServiceError(w http.ResponseWriter, err error) {
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		SendStatus.TooManyRequests(w, lockout.RetryAfter)
 		return
 	}
-	// Turn the JWT into JSON that is sent back to the Gateway service
-	res := JsonStruct{}
-	for key, val := range claims {
-		if key == "username" {
-			res.Username = val.(string)
-		} else if key == "admin" {
-			res.Admin = val.(bool)
-		} else if key == "exp" {
-			res.Exp = val.(float64)
-		}
+	switch statusCode, _ := ServiceErrorStatus(err); statusCode {
+	case http.StatusUnauthorized:
+		SendStatus.InvalidCredentials(w)
+	case http.StatusBadRequest:
+		SendStatus.BadRequest(w)
+	case http.StatusForbidden:
+		SendStatus.Forbidden(w)
+	case http.StatusConflict:
+		SendStatus.Conflict(w)
+	default:
+		SendStatus.InternalServerError(w)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(res)
 }
 
 func main() {
@@ -202,10 +493,138 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := CheckRegistrationMode(); err != nil {
+		log.Panic(err.Error())
+	}
+
+	// Bring the auth database up to date. With MIGRATE_ON_STARTUP set to "false", the
+	// migrations have to be applied with the migrate subcommand instead.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := RunMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+	if GetEnv("MIGRATE_ON_STARTUP", "true") != "false" {
+		if err := MigrateSchema(); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+
+	// Keep the user accounts in the MySQL database, unless the USER_STORE env variable
+	// is set to "sqlite" or "memory". Roles, tokens and the other tables of the auth
+	// database are still kept in MySQL.
+	var users UserStore.Store
+	switch os.Getenv("USER_STORE") {
+	case "sqlite":
+		sqliteDB, err := sql.Open("sqlite", GetEnv("USER_STORE_SQLITE_PATH", "auth.db"))
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		defer sqliteDB.Close()
+		if users, err = UserStore.NewSQLiteStore(sqliteDB); err != nil {
+			log.Panic(err.Error())
+		}
+	case "memory":
+		users = UserStore.NewMemoryStore()
+	default:
+		users = UserStore.NewMySQLStore(db, defaultRole)
+	}
+
+	// Create the first admin from the ADMIN_EMAIL and ADMIN_PASSWORD env variables
+	if adminEmail := os.Getenv("ADMIN_EMAIL"); adminEmail != "" {
+		if err := BootstrapAdmin(users, adminEmail, os.Getenv("ADMIN_PASSWORD")); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+
+	// The audit log, revocations, signing keys and login counters are kept in MySQL as
+	// well, unless their env variable is set to "memory". Memory stores lose their data
+	// on restart and are not shared between replicas, so they are only meant for tests
+	// and running a single instance locally.
+	if os.Getenv("AUDIT_LOG_STORE") != "memory" {
+		auditLog = AuditLog.NewMySQLStore(db)
+	}
+
+	if os.Getenv("REVOCATION_STORE") != "memory" {
+		revocationStore = RevocationStore.NewMySQLStore(db)
+	}
+
+	// Load or create the keys used for signing JWTs and rotate them periodically
+	if os.Getenv("SIGNING_KEY_STORE") != "memory" {
+		keyRing = SigningKeys.NewKeyRing(SigningKeys.NewMySQLStore(db), keyRotationInterval, accessTokenTTL)
+	}
+	if err := keyRing.Rotate(time.Now()); err != nil {
+		log.Panic(err.Error())
+	}
+	go RotateKeysPeriodically()
+
+	if os.Getenv("LOGIN_THROTTLE_STORE") != "memory" {
+		loginAttempts = LoginThrottle.NewMySQLStore(db)
+	}
+
+	// Connect to RabbitMQ for publishing account events to the notification service
+	if os.Getenv("EVENT_PUBLISHER") != "memory" {
+		connection := ConnectToRabbitMQ()
+		defer connection.Close()
+		channel := OpenChannel(connection)
+		defer channel.Close()
+		queue := CreateQueue(channel, os.Getenv("ACCOUNT_QUEUE"))
+		accountEvents = AccountEvents.NewRabbitMQPublisher(channel, queue.Name)
+	}
+
+	// Only the gateway may pass on client IPs, which the login lockouts rely on
+	if trustedPeers, err = ParseTrustedPeers(os.Getenv("GRPC_TRUSTED_PEERS")); err != nil {
+		log.Panic(err.Error())
+	}
+
 	// Register handler functions to routes
-	http.HandleFunc("/login", Login)
-	http.HandleFunc("/register", Register)
-	http.HandleFunc("/validate", Validate)
+	http.HandleFunc("/login", WithUserStore(users, Login))
+	http.HandleFunc("/login/mfa", WithUserStore(users, LoginMfa))
+	http.HandleFunc("/login/oidc", OidcLogin)
+	http.HandleFunc("/login/oidc/callback", WithUserStore(users, OidcCallback))
+	http.HandleFunc("/login/oidc/link", WithUserStore(users, ConfirmOidcLink))
+	http.HandleFunc("/mfa/enroll", WithUserStore(users, EnrollMfa))
+	http.HandleFunc("/mfa/confirm", WithUserStore(users, ConfirmMfa))
+	http.HandleFunc("/api-keys", WithUserStore(users, ApiKeys))
+	http.HandleFunc("/oauth/clients", WithUserStore(users, OAuthClients))
+	http.HandleFunc("/oauth/consents", WithUserStore(users, OAuthConsents))
+	http.HandleFunc("/authorize", WithUserStore(users, Authorize))
+	http.HandleFunc("/token", WithUserStore(users, Token))
+	http.HandleFunc("/register", WithUserStore(users, Register))
+	http.HandleFunc("/admin/invites", WithUserStore(users, InviteCodes))
+	http.HandleFunc("/v1/login", WithUserStore(users, LoginV1))
+	http.HandleFunc("/v1/register", WithUserStore(users, RegisterV1))
+	http.HandleFunc("/me", WithUserStore(users, Me))
+	http.HandleFunc("/me/password", WithUserStore(users, ChangePassword))
+	http.HandleFunc("/sessions", WithUserStore(users, Sessions))
+	http.HandleFunc("/tokens/scoped", ScopedTokens)
+	http.HandleFunc("/orgs", WithUserStore(users, Organizations))
+	http.HandleFunc("/orgs/members", WithUserStore(users, OrganizationMembers))
+	http.HandleFunc("/orgs/invitations", OrganizationInvitations)
+	http.HandleFunc("/orgs/invitations/accept", AcceptOrganizationInvitation)
+	http.HandleFunc("/validate", WithUserStore(users, Validate))
+	http.HandleFunc("/introspect", WithUserStore(users, Introspect))
+	http.HandleFunc("/refresh", WithUserStore(users, Refresh))
+	http.HandleFunc("/logout", Logout)
+	http.HandleFunc("/revocations", Revocations)
+	http.HandleFunc("/admin/roles", WithUserStore(users, Roles))
+	http.HandleFunc("/admin/unlock", Unlock)
+	http.HandleFunc("/admin/users", WithUserStore(users, AdminUsers))
+	http.HandleFunc("/admin/users/disable", WithUserStore(users, DisableUser))
+	http.HandleFunc("/admin/users/enable", WithUserStore(users, EnableUser))
+	http.HandleFunc("/admin/users/password-reset", WithUserStore(users, ForcePasswordReset))
+	http.HandleFunc("/admin/actions", AdminActions)
+	http.HandleFunc("/admin/audit", AuditEvents)
+	http.HandleFunc("/admin/audit/export", ExportAuditEvents)
+	http.HandleFunc("/password/forgot", WithUserStore(users, ForgotPassword))
+	http.HandleFunc("/password/reset", WithUserStore(users, ResetPassword))
+	http.HandleFunc("/verify", WithUserStore(users, Verify))
+	http.HandleFunc("/verify/resend", WithUserStore(users, ResendVerification))
+	http.HandleFunc("/.well-known/jwks.json", JWKS)
+
+	// Serve the gRPC API alongside the HTTP routes
+	go ServeGrpc(users)
 
 	servicePort := os.Getenv("SERVICE_PORT")
 
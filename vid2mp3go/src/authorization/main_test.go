@@ -2,17 +2,135 @@ package main
 
 import (
 	"bytes"
+	"database/sql/driver"
 	"errors"
 	"io"
+	AccountEvents "microservices/authorization/account_events"
+	AuditLog "microservices/authorization/audit_log"
+	LoginThrottle "microservices/authorization/login_throttle"
+	PasswordHash "microservices/authorization/password_hash"
+	RevocationStore "microservices/authorization/revocation_store"
+	SigningKeys "microservices/authorization/signing_keys"
+	UserStore "microservices/authorization/user_store"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	jwt "github.com/golang-jwt/jwt/v5"
 )
 
+// Query of the MySQL user store looking up a user by email and the columns it returns
+const selectUserByEmail = "SELECT id, email, password, verified, disabled, last_login_at FROM user WHERE email=?"
+var userColumns = []string{"id", "email", "password", "verified", "disabled", "last_login_at"}
+
+// Returns the MySQL user store on the mocked DB, which the tests give to the handlers
+func MockUserStore() UserStore.Store {
+	return UserStore.NewMySQLStore(db, defaultRole)
+}
+
+// Adds the expectation of the MySQL user store looking up the verified user with the
+// given username and ID. The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectUserQuery(mock sqlmock.Sqlmock, username string, userID int64) {
+	mock.ExpectQuery(selectUserByEmail).WithArgs(username).
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(userID, username, "", true, false, nil))
+}
+
+// Adds the expectations of the MySQL user store creating a user with the given username
+// and ID, who is given the "user" role. The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectCreateUser(mock sqlmock.Sqlmock, username string, userID int64) {
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WithArgs(username, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(userID, 1))
+	mock.ExpectExec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(userID, "user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// Error returned by MySQL for inserting a duplicate value into a UNIQUE column
+var duplicateEntryErr = &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+
+// sqlmock.Argument that matches an argon2id hash of the given password
+type hashOf string
+
+func (h hashOf) Match(v driver.Value) bool {
+	encoded, ok := v.(string)
+	if !ok || !PasswordHash.IsHashed(encoded) {
+		return false
+	}
+	match, err := PasswordHash.Verify(string(h), encoded)
+	return err == nil && match
+}
+
+// User with the admin role, used for creating JWTs in tests
+var testUser = User{
+	ID: 1,
+	Username: "test_user",
+	Roles: []string{"admin"},
+	Permissions: []string{"upload:write", "download:read", "admin"},
+	EmailVerified: true,
+}
+
+// Query of the MySQL user store looking up a user by ID
+const selectUserByID = "SELECT id, email, password, verified, disabled, last_login_at FROM user WHERE id=?"
+
+// Query of IssueTokens fetching the organization of a user
+const selectUserOrg = "SELECT organization_id FROM organization_member WHERE user_id=?"
+
+// Adds the expectations of SendTokens fetching the verification status, roles and
+// organization of the given user and, if creating the JWT succeeds, starting a session
+// and storing a new refresh token for the user and recording the login. The mock has
+// to use sqlmock.QueryMatcherEqual.
+func ExpectSendTokens(mock sqlmock.Sqlmock, userID int64, jwtCreated bool) {
+	mock.ExpectQuery(selectUserByID).WithArgs(userID).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(userID, "test_user", "", true, false, nil))
+	ExpectUserRolesQuery(mock, userID)
+	mock.ExpectQuery(selectUserOrg).WithArgs(userID).WillReturnRows(sqlmock.NewRows([]string{"organization_id"}))
+	if !jwtCreated {
+		return
+	}
+	mock.ExpectExec("INSERT INTO session (family_id, user_id, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?)").
+		WithArgs(sqlmock.AnyArg(), userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO refresh_token (user_id, family_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?)").
+		WithArgs(userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE user SET last_login_at=? WHERE id=?").WithArgs(sqlmock.AnyArg(), userID).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// Adds the expectation of the roles of the given user being fetched.
+// The user has the "user" role. The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectUserRolesQuery(mock sqlmock.Sqlmock, userID int64) {
+	mock.ExpectQuery("SELECT role.name, permission.name FROM user_role JOIN role ON role.id = user_role.role_id LEFT JOIN role_permission ON role_permission.role_id = role.id LEFT JOIN permission ON permission.id = role_permission.permission_id WHERE user_role.user_id=?").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"role", "permission"}).AddRow("user", "upload:write").AddRow("user", "download:read"))
+}
+
+// Creates the signing key used by the tests
+func TestMain(m *testing.M) {
+	if err := keyRing.Rotate(time.Now()); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// Replaces the key ring with an empty one for the duration of the test,
+// so that creating JWTs fails.
+func WithoutSigningKeys(t *testing.T) {
+	ring := keyRing
+	keyRing = SigningKeys.NewKeyRing(SigningKeys.NewMemoryStore(), time.Hour, time.Hour)
+	t.Cleanup(func() { keyRing = ring })
+}
+
+// Signs a JWT with the given claims and key the same way CreateJWT does.
+func SignTestJWT(key SigningKeys.Key, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = key.Kid
+	tokenString, _ := token.SignedString(key.PrivateKey)
+	return tokenString
+}
+
 func TestGetBasicAuthAllCorrect(t *testing.T) {
 	r, _ := http.NewRequest("POST", "", bytes.NewReader([]byte("")))
 	r.SetBasicAuth("test_user", "test_password")
@@ -58,21 +176,47 @@ func TestGetBasicAuthCredentialsMissing(t *testing.T) {
 }
 
 func TestCreateJWT(t *testing.T) {
-	os.Setenv("JWT_SECRET", "test_secret")
-	tokenString, err := CreateJWT("test_user")
+	tokenString, err := CreateJWT(testUser)
 	if err != nil {
 		t.Fatalf("An unexpected error occured while creating JWT:\n%s", err.Error())
 	}
 	if tokenString == "" {
 		t.Fatal("tokenString was empty")
 	}
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil { t.Fatalf("JWT could not be parsed:\n%s", err.Error()) }
+	if token.Method != jwt.SigningMethodEdDSA { t.Fatal("JWT was not signed with EdDSA", token.Method.Alg()) }
+	signingKey, _ := keyRing.SigningKey()
+	if token.Header["kid"] != signingKey.Kid { t.Fatal("kid was incorrect", token.Header["kid"]) }
 }
 
-func TestCreateJWTSecretNotSet(t *testing.T) {
-	os.Setenv("JWT_SECRET", "")
-	_, err := CreateJWT("test_user")
+func TestCreateJWTNoSigningKey(t *testing.T) {
+	WithoutSigningKeys(t)
+	_, err := CreateJWT(testUser)
 	if err == nil {
-		t.Fatal("JWT was created with empty JWT_SECRET")
+		t.Fatal("JWT was created without a signing key")
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	tokenString, _ := CreateJWT(testUser)
+	claims, err := ParseJWT(tokenString)
+	if err != nil { t.Fatalf("JWT could not be parsed:\n%s", err.Error()) }
+	if claims["username"] != "test_user" { t.Fatal("Username was incorrect", claims["username"]) }
+	if claims["iss"] != jwtIssuer || claims["aud"] != jwtAudience { t.Fatal("Issuer or audience was incorrect", claims) }
+
+	unknownKey, _ := SigningKeys.GenerateKey(time.Now())
+	if _, err := ParseJWT(SignTestJWT(unknownKey, jwt.MapClaims{"username": "test_user"})); err == nil {
+		t.Fatal("JWT signed with an unknown key was accepted")
+	}
+	signingKey, _ := keyRing.SigningKey()
+	otherAudience := SignTestJWT(signingKey, jwt.MapClaims{"iss": jwtIssuer, "aud": "other", "username": "test_user"})
+	if _, err := ParseJWT(otherAudience); err == nil {
+		t.Fatal("JWT with another audience was accepted")
+	}
+	hs256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "test_user"}).SignedString([]byte("secret"))
+	if _, err := ParseJWT(hs256); err == nil {
+		t.Fatal("JWT signed with HS256 was accepted")
 	}
 }
 
@@ -85,7 +229,10 @@ func TestLogin(t *testing.T) {
 		expectedCode	int
 		credentials		[]string
 		row				[]string
-		jwtSecret		string
+		hashed			bool
+		noSigningKey	bool
+		lockedOut		string
+		mfa				bool
 	}{
 		{
 			name: "Successful login",
@@ -93,7 +240,23 @@ func TestLogin(t *testing.T) {
 			expectedCode: 200,
 			credentials: []string{"test_user", "test_password"},
 			row: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
+			hashed: true,
+		},
+		{
+			name: "MFA challenge",
+			method: "POST",
+			expectedCode: 202,
+			credentials: []string{"test_user", "test_password"},
+			row: []string{"test_user", "test_password"},
+			hashed: true,
+			mfa: true,
+		},
+		{
+			name: "Successful login upgrades plaintext password",
+			method: "POST",
+			expectedCode: 200,
+			credentials: []string{"test_user", "test_password"},
+			row: []string{"test_user", "test_password"},
 		},
 		{
 			name: "Incorrect HTTP request method",
@@ -101,7 +264,6 @@ func TestLogin(t *testing.T) {
 			expectedCode: 405,
 			credentials: []string{"test_user", "test_password"},
 			row: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
 		},
 		{
 			name: "Credentials missing",
@@ -109,7 +271,6 @@ func TestLogin(t *testing.T) {
 			expectedCode: 401,
 			credentials: []string{"test_user", ""},
 			row: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
 		},
 		{
 			name: "Username is incorrect",
@@ -117,7 +278,6 @@ func TestLogin(t *testing.T) {
 			expectedCode: 401,
 			credentials: []string{"test_user", "test_password"},
 			row: []string{},
-			jwtSecret: "test_secret",
 		},
 		{
 			name: "Password is incorrect",
@@ -125,7 +285,14 @@ func TestLogin(t *testing.T) {
 			expectedCode: 401,
 			credentials: []string{"test_user", "test_password"},
 			row: []string{"test_user", "different_password"},
-			jwtSecret: "test_secret",
+		},
+		{
+			name: "Hashed password is incorrect",
+			method: "POST",
+			expectedCode: 401,
+			credentials: []string{"test_user", "test_password"},
+			row: []string{"test_user", "different_password"},
+			hashed: true,
 		},
 		{
 			name: "JWT creation fails",
@@ -133,7 +300,7 @@ func TestLogin(t *testing.T) {
 			expectedCode: 500,
 			credentials: []string{"test_user", "test_password"},
 			row: []string{"test_user", "test_password"},
-			jwtSecret: "",
+			noSigningKey: true,
 		},
 		{
 			name: "DB fetch fails",
@@ -141,45 +308,108 @@ func TestLogin(t *testing.T) {
 			expectedCode: 500,
 			credentials: []string{"test_user", "test_password"},
 			row: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
+		},
+		{
+			name: "Account locked out",
+			method: "POST",
+			expectedCode: 429,
+			credentials: []string{"test_user", "test_password"},
+			row: []string{"test_user", "test_password"},
+			lockedOut: "account:test_user",
+		},
+		{
+			name: "IP locked out",
+			method: "POST",
+			expectedCode: 429,
+			credentials: []string{"test_user", "test_password"},
+			row: []string{"test_user", "test_password"},
+			lockedOut: "ip:203.0.113.7",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			os.Setenv("JWT_SECRET", tt.jwtSecret)
-			db, mock, err = sqlmock.New()
+			if tt.noSigningKey { WithoutSigningKeys(t) }
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			audit := AuditLog.NewMemoryStore()
+			auditLog = audit
+			if tt.lockedOut != "" {
+				loginAttempts.Lock(tt.lockedOut, time.Now().Add(time.Minute))
+			}
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 			if err != nil {
 				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 			}
 			defer db.Close()
 
-			if tt.name == "DB fetch fails" {
-				mock.ExpectQuery("SELECT email, password FROM user WHERE email=?").WithArgs(tt.row[0]).WillReturnError(errors.New("db fetch failed"))
+			if tt.lockedOut != "" {
+				// Locked out logins are rejected without checking the credentials
+			} else if tt.name == "DB fetch fails" {
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.row[0]).WillReturnError(errors.New("db fetch failed"))
 			} else if len(tt.row) == 0 {
-				mock.ExpectQuery("SELECT email, password FROM user WHERE email=?").WithArgs(tt.credentials[0]).WillReturnRows(sqlmock.NewRows([]string{"email", "password"}))
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.credentials[0]).WillReturnRows(sqlmock.NewRows(userColumns))
 			} else {
-				rows := sqlmock.NewRows([]string{"email", "password"}).AddRow(tt.row[0], tt.row[1])
-				mock.ExpectQuery("SELECT email, password FROM user WHERE email=?").WithArgs(tt.row[0]).WillReturnRows(rows)
+				storedPassword := tt.row[1]
+				if tt.hashed {
+					storedPassword, _ = hashParams.Hash(tt.row[1])
+				}
+				rows := sqlmock.NewRows(userColumns).AddRow(1, tt.row[0], storedPassword, true, false, nil)
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.row[0]).WillReturnRows(rows)
+				if !tt.hashed && tt.row[1] == tt.credentials[1] {
+					// Plaintext passwords are replaced with a hash after a successful login
+					mock.ExpectExec("UPDATE user SET password=? WHERE id=?").
+						WithArgs(hashOf(tt.credentials[1]), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				if tt.mfa {
+					ExpectMfaEnabledQuery(mock, 1, true)
+					mock.ExpectExec("INSERT INTO mfa_challenge (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)").
+						WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				} else if tt.expectedCode == 200 || tt.name == "JWT creation fails" {
+					ExpectMfaEnabledQuery(mock, 1, false)
+					ExpectSendTokens(mock, 1, tt.expectedCode == 200)
+				}
 			}
 
 			req, err := http.NewRequest(tt.method, "/login", nil)
 			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
 			req.SetBasicAuth(tt.credentials[0], tt.credentials[1])
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			FromTrustedPeer(t, req)
 
 			resp := httptest.NewRecorder()
-			handler := http.HandlerFunc(Login)
+			handler := WithUserStore(MockUserStore(), Login)
 			handler.ServeHTTP(resp, req)
 
 			if resp.Code != tt.expectedCode {
 				t.Fatal("Status was incorrect", resp.Code)
 			}
+			if resp.Code == 429 && resp.Header().Get("Retry-After") != "60" {
+				t.Fatal("Retry-After was incorrect", resp.Header().Get("Retry-After"))
+			}
+			if events := audit.Events(); resp.Code == 200 || resp.Code == 429 {
+				expectedOutcome := AuditLog.Success
+				if resp.Code == 429 { expectedOutcome = AuditLog.Failure }
+				if len(events) != 1 || events[0].Type != AuditLog.Login || events[0].Outcome != expectedOutcome || events[0].IP != "203.0.113.7" {
+					t.Fatal("Login was not audited", events)
+				}
+			}
+			if resp.Code == 202 {
+				if resp.Header().Get("Mfa-Challenge") == "" || resp.Header().Get("Refresh-Token") != "" {
+					t.Fatal("Did not receive only an MFA challenge")
+				}
+			}
 			if resp.Code == 200 {
 				bodyBytes, err := io.ReadAll(resp.Body)
 				if err != nil { t.Fatalf("Error while reading resp body:\n%s", err.Error()) }
 				if len(string(bodyBytes)) == 0 {
 					t.Fatal("Did not receive JWT")
 				}
+				if resp.Header().Get("Refresh-Token") == "" {
+					t.Fatal("Did not receive refresh token")
+				}
+			}
+			if tt.method == "POST" && len(tt.credentials[1]) > 0 {
+				if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
 			}
 		})
 	}
@@ -193,54 +423,59 @@ func TestRegister(t *testing.T) {
 		method			string
 		expectedCode	int
 		credentials		[]string
-		jwtSecret		string
+		noSigningKey	bool
 	}{
 		{
 			name: "Successful registration",
 			method: "POST",
 			expectedCode: 200,
-			credentials: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
+			credentials: []string{"test_user@example.com", "test_password"},
 		},
 		{
 			name: "Incorrect HTTP request method",
 			method: "GET",
 			expectedCode: 405,
-			credentials: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
+			credentials: []string{"test_user@example.com", "test_password"},
 		},
 		{
 			name: "Credentials missing from headers",
 			method: "POST",
 			expectedCode: 400,
 			credentials: []string{},
-			jwtSecret: "test_secret",
+		},
+		{
+			name: "Username is not an email address",
+			method: "POST",
+			expectedCode: 400,
+			credentials: []string{"test_user", "test_password"},
 		},
 		{
 			name: "JWT creation fails",
 			method: "POST",
 			expectedCode: 500,
-			credentials: []string{"test_user", "test_password"},
-			jwtSecret: "",
+			credentials: []string{"test_user@example.com", "test_password"},
+			noSigningKey: true,
 		},
 		{
 			name: "Duplicate in DB",
 			method: "POST",
 			expectedCode: 409,
-			credentials: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
+			credentials: []string{"test_user@example.com", "test_password"},
 		},
 		{
 			name: "Insert into DB fails",
 			method: "POST",
 			expectedCode: 500,
-			credentials: []string{"test_user", "test_password"},
-			jwtSecret: "test_secret",
+			credentials: []string{"test_user@example.com", "test_password"},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			os.Setenv("JWT_SECRET", tt.jwtSecret)
+			if tt.noSigningKey { WithoutSigningKeys(t) }
+			publisher := AccountEvents.NewMemoryPublisher()
+			accountEvents = publisher
+			audit := AuditLog.NewMemoryStore()
+			auditLog = audit
 			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 			if err != nil {
 				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
@@ -255,26 +490,43 @@ func TestRegister(t *testing.T) {
 			}
 
 			if tt.name == "Insert into DB fails" {
+				mock.ExpectBegin()
 				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WillReturnError(errors.New("Something bad happened"))
+				mock.ExpectRollback()
 			} else if tt.name == "Duplicate in DB" {
-				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WillReturnError(errors.New("Error 1062 (23000): Duplicate entry"))
-			} else if len(tt.credentials) > 0 {
-				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WithArgs(tt.credentials[0], tt.credentials[1]).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WillReturnError(duplicateEntryErr)
+				mock.ExpectRollback()
+			} else if tt.expectedCode != 400 {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WithArgs(tt.credentials[0], hashOf(tt.credentials[1])).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(1, "user").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				ExpectSendVerification(mock, 1)
+				ExpectSendTokens(mock, 1, tt.expectedCode == 200)
 			}
 
 			resp := httptest.NewRecorder()
-			handler := http.HandlerFunc(Register)
+			handler := WithUserStore(MockUserStore(), Register)
 			handler.ServeHTTP(resp, req)
 
 			if status := resp.Code; status != tt.expectedCode {
 				t.Fatal("Status was incorrect", status)
 			}
+			if events := audit.Events(); resp.Code == 409 && (len(events) != 1 || events[0].Outcome != AuditLog.Failure) {
+				t.Fatal("Duplicate registration was not audited", events)
+			}
 			if resp.Code == 200 {
 				bodyBytes, err := io.ReadAll(resp.Body)
 				if err != nil { t.Fatalf("Error while reading resp body:\n%s", err.Error()) }
 				if len(string(bodyBytes)) == 0 {
 					t.Fatal("Did not receive JWT")
 				}
+				if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+				events := publisher.Events()
+				if len(events) != 1 || events[0].Type != AccountEvents.EmailVerificationRequested || events[0].Username != tt.credentials[0] {
+					t.Fatal("Verification event was not published", events)
+				}
 			}
 		})
 	}
@@ -285,63 +537,113 @@ func TestValidate(t *testing.T) {
 		name			string
 		method			string
 		expectedCode	int
-		jwtSecret		string
+		noSigningKey	bool
 	} {
 		{
 			name: "Successful validation",
 			method: "POST",
 			expectedCode: 200,
-			jwtSecret: "test_secret",
 		},
 		{
 			name: "Incorrect HTTP request method",
 			method: "GET",
 			expectedCode: 405,
-			jwtSecret: "test_secret",
 		},
 		{
-			name: "JWT secret not set",
+			name: "JWT signed with unknown key",
 			method: "POST",
-			expectedCode: 500,
-			jwtSecret: "",
+			expectedCode: 403,
 		},
 		{
 			name: "JWT missing from headers",
 			method: "POST",
 			expectedCode: 400,
-			jwtSecret: "test_secret",
 		},
 		{
 			name: "Bearer token length is incorrect",
 			method: "POST",
 			expectedCode: 400,
-			jwtSecret: "test_secret",
 		},
 		{
 			name: "Not Authorized",
 			method: "POST",
 			expectedCode: 403,
-			jwtSecret: "test_secret",
+		},
+		{
+			name: "JWT revoked",
+			method: "POST",
+			expectedCode: 403,
+		},
+		{
+			name: "JWT of revoked user",
+			method: "POST",
+			expectedCode: 403,
+		},
+		{
+			name: "JWT of revoked session",
+			method: "POST",
+			expectedCode: 403,
+		},
+		{
+			name: "JWT without jti",
+			method: "POST",
+			expectedCode: 403,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			os.Setenv("JWT_SECRET", tt.jwtSecret)
+			revocationStore = RevocationStore.NewMemoryStore()
 			req, err := http.NewRequest(tt.method, "/validate", nil)
 			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
 
 			if tt.expectedCode == 200 {
-				tokenString, err := CreateJWT("test_user")
+				tokenString, err := CreateJWT(testUser)
 				if err != nil { t.Fatalf("JWT creation failed\n:%s", err.Error()) }
 				req.Header.Add("Authorization", "Bearer " +  tokenString)
 			} else if tt.name == "Bearer token length is incorrect" {
 				req.Header.Add("Authorization", "tokenString")
+			} else if tt.name == "JWT revoked" {
+				tokenString, _ := CreateJWT(testUser)
+				claims, _ := ParseJWT(tokenString)
+				revocationStore.RevokeToken(claims["jti"].(string), time.Now().Add(time.Hour))
+				req.Header.Add("Authorization", "Bearer " +  tokenString)
+			} else if tt.name == "JWT of revoked user" {
+				tokenString, _ := CreateJWT(testUser)
+				revocationStore.RevokeUser("test_user", time.Now().Add(time.Second))
+				req.Header.Add("Authorization", "Bearer " +  tokenString)
+			} else if tt.name == "JWT of revoked session" {
+				sessionUser := testUser
+				sessionUser.SessionID = "revoked_session"
+				tokenString, _ := CreateJWT(sessionUser)
+				revocationStore.RevokeToken("revoked_session", time.Now().Add(time.Hour))
+				req.Header.Add("Authorization", "Bearer " +  tokenString)
+			} else if tt.name == "JWT without jti" {
+				signingKey, _ := keyRing.SigningKey()
+				tokenString := SignTestJWT(signingKey, jwt.MapClaims{
+					"iss": jwtIssuer,
+					"aud": jwtAudience,
+					"username": "test_user",
+					"exp": time.Now().Add(time.Hour).Unix(),
+					"iat": time.Now().Unix(),
+				})
+				req.Header.Add("Authorization", "Bearer " +  tokenString)
+			} else if tt.name == "JWT signed with unknown key" {
+				unknownKey, _ := SigningKeys.GenerateKey(time.Now())
+				tokenString := SignTestJWT(unknownKey, jwt.MapClaims{
+					"jti": "test_jti",
+					"iss": jwtIssuer,
+					"aud": jwtAudience,
+					"username": "test_user",
+					"exp": time.Now().Add(time.Hour).Unix(),
+					"iat": time.Now().Unix(),
+				})
+				req.Header.Add("Authorization", "Bearer " +  tokenString)
 			} else if tt.expectedCode != 400 {
 				req.Header.Add("Authorization", "Bearer " + "tokenString")
 			}
 
 			resp := httptest.NewRecorder()
-			handler := http.HandlerFunc(Validate)
+			handler := WithUserStore(MockUserStore(), Validate)
 			handler.ServeHTTP(resp, req)
 
 			if status := resp.Code; status != tt.expectedCode {
@@ -357,9 +659,15 @@ func TestValidate(t *testing.T) {
 				if !strings.Contains(body, `"username":"test_user"`) {
 					t.Fatal("Response JSON did not include username")
 				}
-				if !strings.Contains(body, `"admin":true}`) {
+				if !strings.Contains(body, `"admin":true`) {
 					t.Fatal("Response JSON did not include admin")
 				}
+				if !strings.Contains(body, `"permissions":["upload:write","download:read","admin"]`) {
+					t.Fatal("Response JSON did not include permissions")
+				}
+				if !strings.Contains(body, `"email_verified":true`) {
+					t.Fatal("Response JSON did not include email_verified")
+				}
 			}
 		})
 	}
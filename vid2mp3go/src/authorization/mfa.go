@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	AuditLog "microservices/authorization/audit_log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	Totp "microservices/authorization/totp"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"time"
+)
+
+// Lifetime of the challenge tokens returned by the first step of a login with MFA.
+// Configured with the MFA_CHALLENGE_TTL env variable.
+var mfaChallengeTTL = GetDurationEnv("MFA_CHALLENGE_TTL", 5*time.Minute)
+
+// Issuer shown in authenticator apps. Configured with the MFA_ISSUER env variable.
+var mfaIssuer = GetEnv("MFA_ISSUER", "vid2mp3")
+
+// Number of recovery codes created when MFA is enabled
+const recoveryCodeCount = 10
+
+// Secret of a pending MFA enrollment, as returned by the /mfa/enroll endpoint
+type MfaEnrollment struct {
+	Secret	string	`json:"secret"`
+	URI		string	`json:"uri"`
+}
+
+// Recovery codes of a confirmed MFA enrollment, as returned by the /mfa/confirm endpoint
+type MfaRecoveryCodes struct {
+	RecoveryCodes	[]string	`json:"recovery_codes"`
+}
+
+// Returns true if the user has confirmed an MFA enrollment.
+func IsMfaEnabled(userID int64) (enabled bool, err error) {
+	err = db.QueryRow("SELECT confirmed FROM user_mfa WHERE user_id=?", userID).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Stores a new MFA challenge token for the user and returns it. The challenge token is
+// exchanged for the user's tokens at /login/mfa together with a code of the second factor.
+func CreateMfaChallenge(userID int64) (challengeToken string, err error) {
+	challengeToken, err = SecureToken.Generate(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(
+		"INSERT INTO mfa_challenge (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		userID, SecureToken.Hash(challengeToken), now.Add(mfaChallengeTTL), now,
+	)
+	if err != nil {
+		return "", err
+	}
+	return challengeToken, nil
+}
+
+// Creates an MFA challenge for the user and sends it with SendMfaChallengeToken,
+// instead of sending the user's tokens.
+func SendMfaChallenge(w http.ResponseWriter, userID int64) (err error) {
+	challengeToken, err := CreateMfaChallenge(userID)
+	if err != nil {
+		return err
+	}
+	SendMfaChallengeToken(w, challengeToken)
+	return nil
+}
+
+// Sends the MFA challenge token in the Mfa-Challenge header with 202
+func SendMfaChallengeToken(w http.ResponseWriter, challengeToken string) {
+	w.Header().Set("Mfa-Challenge", challengeToken)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "MFA code required.")
+}
+
+// Second step of a login with MFA. Exchanges the challenge token in the POST request's
+// Mfa-Challenge header for a JWT and a refresh token, if the request also has either
+// a valid TOTP code in the Mfa-Code header or an unused recovery code in the
+// Recovery-Code header. Every challenge token, TOTP code and recovery code can be
+// used only once. Wrong codes count as failed logins.
+func LoginMfa(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("LoginMfa request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	challengeToken, code, recoveryCode := r.Header.Get("Mfa-Challenge"), r.Header.Get("Mfa-Code"), r.Header.Get("Recovery-Code")
+	if challengeToken == "" || (code == "") == (recoveryCode == "") {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var id, userID int64
+	var expiresAt time.Time
+	var used bool
+	err := db.QueryRow(
+		"SELECT id, user_id, expires_at, used FROM mfa_challenge WHERE token_hash=?",
+		SecureToken.Hash(challengeToken),
+	).Scan(&id, &userID, &expiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch MFA challenge from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	ip, now := GetClientIP(r), time.Now()
+	if used || now.After(expiresAt) {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	user, err := users.FindByID(userID)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	username := user.Email
+	retryAfter, err := LoginRetryAfter(username, ip, now)
+	if err != nil {
+		log.Printf("Error occured while checking login lockout:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if retryAfter > 0 {
+		log.Printf("MFA login of user %s from %s rejected due to lockout", username, ip)
+		RecordAuditEvent(r, AuditLog.Login, username, AuditLog.Failure)
+		SendStatus.TooManyRequests(w, retryAfter)
+		return
+	}
+	var ok bool
+	if code != "" {
+		ok, err = UseTotpCode(id, userID, code, now)
+	} else {
+		ok, err = UseRecoveryCode(id, userID, recoveryCode)
+	}
+	if err != nil {
+		log.Printf("Error occured while verifying MFA code of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if !ok {
+		RecordLoginFailure(username, ip, now)
+		RecordAuditEvent(r, AuditLog.Login, username, AuditLog.Failure)
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	RecordLoginSuccess(username)
+	if err := SendAuditedTokens(users, w, r, AuditLog.Login, userID, username, ""); err != nil {
+		log.Printf("Error occured while trying to create tokens:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+}
+
+// Marks the MFA challenge with the given id as used, if the TOTP code is valid for
+// the user's secret and newer than the last code the user has used. Nothing is changed
+// and ok is false if the code is not accepted or the challenge has already been used.
+func UseTotpCode(challengeID int64, userID int64, code string, now time.Time) (ok bool, err error) {
+	var secret string
+	var lastUsedStep int64
+	err = db.QueryRow("SELECT secret, last_used_step FROM user_mfa WHERE user_id=? AND confirmed=TRUE", userID).Scan(&secret, &lastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	step, valid := Totp.Validate(secret, code, now)
+	if !valid || step <= lastUsedStep {
+		return false, nil
+	}
+	return UseMfaChallenge(challengeID, func(tx *sql.Tx) (sql.Result, error) {
+		// Codes can not be replayed, even by requests that arrive at the same time
+		return tx.Exec("UPDATE user_mfa SET last_used_step=? WHERE user_id=? AND last_used_step<?", step, userID, step)
+	})
+}
+
+// Marks the MFA challenge with the given id and the user's recovery code as used.
+// Nothing is changed and ok is false if the recovery code is unknown or has already
+// been used, or the challenge has already been used.
+func UseRecoveryCode(challengeID int64, userID int64, recoveryCode string) (ok bool, err error) {
+	return UseMfaChallenge(challengeID, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec("UPDATE mfa_recovery_code SET used=TRUE WHERE user_id=? AND code_hash=? AND used=FALSE", userID, SecureToken.Hash(recoveryCode))
+	})
+}
+
+// Marks the MFA challenge with the given id as used and runs useCode in the same
+// transaction. The transaction is only committed, and ok is true, if both the
+// challenge and useCode update exactly one row.
+func UseMfaChallenge(challengeID int64, useCode func(tx *sql.Tx) (sql.Result, error)) (ok bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE mfa_challenge SET used=TRUE WHERE id=? AND used=FALSE", challengeID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n != 1 {
+		return false, nil
+	}
+	res, err = useCode(tx)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n != 1 {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+// Starts an MFA enrollment for the user of the JWT in the POST request's Authorization
+// header. A new TOTP secret is returned as JSON, both as is and as an otpauth:// URI.
+// MFA is enabled once the enrollment is confirmed with a code at /mfa/confirm.
+// Starting a new enrollment replaces any unconfirmed one. If MFA is already enabled,
+// 409 is returned.
+func EnrollMfa(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("EnrollMfa request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username, _ := claims["username"].(string)
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	secret, err := Totp.GenerateSecret()
+	if err != nil {
+		log.Printf("Error occured while generating TOTP secret:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	err = InsertMfaEnrollment(user.ID, secret)
+	if errors.Is(err, errMfaEnabled) {
+		SendStatus.Conflict(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to insert MFA enrollment into DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("MFA enrollment started for user %s", username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MfaEnrollment{Secret: secret, URI: Totp.URI(mfaIssuer, username, secret)})
+}
+
+// Returned by InsertMfaEnrollment if the user has already enabled MFA
+var errMfaEnabled = errors.New("MFA is enabled already")
+
+// Replaces the user's unconfirmed MFA enrollment, if any, with a new one using the
+// given secret. Returns errMfaEnabled if the user has already enabled MFA.
+func InsertMfaEnrollment(userID int64, secret string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM user_mfa WHERE user_id=? AND confirmed=FALSE", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO user_mfa (user_id, secret, confirmed, last_used_step, created_at) VALUES (?, ?, FALSE, 0, ?)",
+		userID, secret, time.Now().UTC(),
+	)
+	if UserStore.IsDuplicateEntry(err) {
+		return errMfaEnabled
+	} else if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Confirms the pending MFA enrollment of the user of the JWT in the POST request's
+// Authorization header with a TOTP code, given in the Mfa-Code header. This enables
+// MFA for the user and returns a new set of single-use recovery codes as JSON. The
+// recovery codes can be used instead of TOTP codes if the user loses their device.
+// They are only stored as hashes, so they can not be shown again.
+func ConfirmMfa(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ConfirmMfa request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	code := r.Header.Get("Mfa-Code")
+	if code == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	username, _ := claims["username"].(string)
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	userID := user.ID
+	var secret string
+	err = db.QueryRow("SELECT secret FROM user_mfa WHERE user_id=? AND confirmed=FALSE", userID).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch MFA enrollment from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	step, valid := Totp.Validate(secret, code, time.Now())
+	if !valid {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	recoveryCodes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		recoveryCodes[i], err = SecureToken.Generate(10)
+		if err != nil {
+			log.Printf("Error occured while generating recovery codes:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+	}
+	confirmed, err := ConfirmMfaEnrollment(userID, step, recoveryCodes)
+	if err != nil {
+		log.Printf("Error occured while trying to confirm MFA enrollment of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if !confirmed {
+		SendStatus.NotFound(w)
+		return
+	}
+	log.Printf("MFA enabled for user %s", username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MfaRecoveryCodes{RecoveryCodes: recoveryCodes})
+}
+
+// Marks the user's MFA enrollment as confirmed, remembering the step of the code it was
+// confirmed with, and replaces the user's recovery codes with the given ones in one
+// transaction. If the enrollment has already been confirmed, nothing is changed and
+// confirmed is false.
+func ConfirmMfaEnrollment(userID int64, step int64, recoveryCodes []string) (confirmed bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE user_mfa SET confirmed=TRUE, last_used_step=? WHERE user_id=? AND confirmed=FALSE", step, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n != 1 {
+		return false, nil
+	}
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_code WHERE user_id=?", userID); err != nil {
+		return false, err
+	}
+	for _, recoveryCode := range recoveryCodes {
+		_, err := tx.Exec("INSERT INTO mfa_recovery_code (user_id, code_hash) VALUES (?, ?)", userID, SecureToken.Hash(recoveryCode))
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
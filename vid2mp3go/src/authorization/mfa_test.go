@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	LoginThrottle "microservices/authorization/login_throttle"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	Totp "microservices/authorization/totp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectMfaChallenge = "SELECT id, user_id, expires_at, used FROM mfa_challenge WHERE token_hash=?"
+
+// TOTP secret of the test user
+const testMfaSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// Adds the expectation of Login checking whether the given user has enabled MFA.
+// The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectMfaEnabledQuery(mock sqlmock.Sqlmock, userID int64, enabled bool) {
+	rows := sqlmock.NewRows([]string{"confirmed"})
+	if enabled {
+		rows.AddRow(true)
+	}
+	mock.ExpectQuery("SELECT confirmed FROM user_mfa WHERE user_id=?").WithArgs(userID).WillReturnRows(rows)
+}
+
+func TestLoginMfa(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	currentCode, _ := Totp.Code(testMfaSecret, Totp.Step(time.Now()))
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		challengeToken	string
+		code			string
+		recoveryCode	string
+		expiresAt		time.Time
+		used			bool
+		lastUsedStep	int64
+		concurrentUse	bool
+		lockedOut		bool
+	}{
+		{
+			name: "Successful login with TOTP code",
+			method: "POST",
+			expectedCode: 200,
+			challengeToken: "test_challenge",
+			code: currentCode,
+			expiresAt: time.Now().Add(time.Minute),
+		},
+		{
+			name: "Successful login with recovery code",
+			method: "POST",
+			expectedCode: 200,
+			challengeToken: "test_challenge",
+			recoveryCode: "test_recovery_code",
+			expiresAt: time.Now().Add(time.Minute),
+		},
+		{
+			name: "TOTP code incorrect",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "test_challenge",
+			code: "000000",
+			expiresAt: time.Now().Add(time.Minute),
+		},
+		{
+			name: "TOTP code replayed",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "test_challenge",
+			code: currentCode,
+			expiresAt: time.Now().Add(time.Minute),
+			lastUsedStep: Totp.Step(time.Now()) + Totp.Skew,
+		},
+		{
+			name: "Recovery code unknown or used",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "test_challenge",
+			recoveryCode: "used_recovery_code",
+			expiresAt: time.Now().Add(time.Minute),
+		},
+		{
+			name: "Challenge used concurrently",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "test_challenge",
+			code: currentCode,
+			expiresAt: time.Now().Add(time.Minute),
+			concurrentUse: true,
+		},
+		{
+			name: "Challenge already used",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "test_challenge",
+			code: currentCode,
+			expiresAt: time.Now().Add(time.Minute),
+			used: true,
+		},
+		{
+			name: "Challenge expired",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "test_challenge",
+			code: currentCode,
+			expiresAt: time.Now().Add(-time.Minute),
+		},
+		{
+			name: "Challenge unknown",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "unknown_challenge",
+			code: currentCode,
+		},
+		{
+			name: "Account locked out",
+			method: "POST",
+			expectedCode: 429,
+			challengeToken: "test_challenge",
+			code: currentCode,
+			expiresAt: time.Now().Add(time.Minute),
+			lockedOut: true,
+		},
+		{
+			name: "Code missing",
+			method: "POST",
+			expectedCode: 400,
+			challengeToken: "test_challenge",
+		},
+		{
+			name: "Both codes given",
+			method: "POST",
+			expectedCode: 400,
+			challengeToken: "test_challenge",
+			code: currentCode,
+			recoveryCode: "test_recovery_code",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			challengeToken: "test_challenge",
+			code: currentCode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			if tt.lockedOut {
+				loginAttempts.Lock("account:test_user", time.Now().Add(time.Minute))
+			}
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "POST" && tt.expectedCode != 400 {
+				rows := sqlmock.NewRows([]string{"id", "user_id", "expires_at", "used"})
+				if tt.challengeToken == "test_challenge" {
+					rows.AddRow(5, 1, tt.expiresAt, tt.used)
+				}
+				mock.ExpectQuery(selectMfaChallenge).WithArgs(SecureToken.Hash(tt.challengeToken)).WillReturnRows(rows)
+				if tt.challengeToken == "test_challenge" && !tt.used && tt.expiresAt.After(time.Now()) {
+					mock.ExpectQuery(selectUserByID).WithArgs(1).
+						WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+				}
+			}
+			checksCode := tt.expectedCode == 200 || tt.concurrentUse || tt.name == "TOTP code incorrect" || tt.name == "TOTP code replayed"
+			if checksCode && tt.code != "" {
+				mock.ExpectQuery("SELECT secret, last_used_step FROM user_mfa WHERE user_id=? AND confirmed=TRUE").WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"secret", "last_used_step"}).AddRow(testMfaSecret, tt.lastUsedStep))
+			}
+			if tt.expectedCode == 200 || tt.concurrentUse || tt.recoveryCode == "used_recovery_code" {
+				mock.ExpectBegin()
+				if tt.concurrentUse {
+					mock.ExpectExec("UPDATE mfa_challenge SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectRollback()
+				} else {
+					mock.ExpectExec("UPDATE mfa_challenge SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+					if tt.code != "" {
+						mock.ExpectExec("UPDATE user_mfa SET last_used_step=? WHERE user_id=? AND last_used_step<?").
+							WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					} else if tt.expectedCode == 200 {
+						mock.ExpectExec("UPDATE mfa_recovery_code SET used=TRUE WHERE user_id=? AND code_hash=? AND used=FALSE").
+							WithArgs(1, SecureToken.Hash(tt.recoveryCode)).WillReturnResult(sqlmock.NewResult(0, 1))
+					} else {
+						mock.ExpectExec("UPDATE mfa_recovery_code SET used=TRUE WHERE user_id=? AND code_hash=? AND used=FALSE").
+							WithArgs(1, SecureToken.Hash(tt.recoveryCode)).WillReturnResult(sqlmock.NewResult(0, 0))
+					}
+					if tt.expectedCode == 200 {
+						mock.ExpectCommit()
+						ExpectSendTokens(mock, 1, true)
+					} else {
+						mock.ExpectRollback()
+					}
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/login/mfa", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Mfa-Challenge", tt.challengeToken)
+			req.Header.Set("Mfa-Code", tt.code)
+			req.Header.Set("Recovery-Code", tt.recoveryCode)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			FromTrustedPeer(t, req)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), LoginMfa)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 && resp.Header().Get("Refresh-Token") == "" {
+				t.Fatal("Did not receive refresh token")
+			}
+		})
+	}
+}
+
+func TestEnrollMfa(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		noJWT			bool
+	}{
+		{
+			name: "Successful enrollment",
+			method: "POST",
+			expectedCode: 200,
+		},
+		{
+			name: "MFA already enabled",
+			method: "POST",
+			expectedCode: 409,
+		},
+		{
+			name: "JWT missing from headers",
+			method: "POST",
+			expectedCode: 401,
+			noJWT: true,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode == 200 || tt.expectedCode == 409 {
+				ExpectUserQuery(mock, "test_user", 1)
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM user_mfa WHERE user_id=? AND confirmed=FALSE").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+				insert := mock.ExpectExec("INSERT INTO user_mfa (user_id, secret, confirmed, last_used_step, created_at) VALUES (?, ?, FALSE, 0, ?)").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg())
+				if tt.expectedCode == 409 {
+					insert.WillReturnError(duplicateEntryErr)
+					mock.ExpectRollback()
+				} else {
+					insert.WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectCommit()
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/mfa/enroll", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if !tt.noJWT {
+				tokenString, _ := CreateJWT(testUser)
+				req.Header.Set("Authorization", "Bearer " + tokenString)
+			}
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), EnrollMfa)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 {
+				var enrollment MfaEnrollment
+				if err := json.NewDecoder(resp.Body).Decode(&enrollment); err != nil { t.Fatal(err.Error()) }
+				if enrollment.Secret == "" || !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+					t.Fatal("Enrollment was incorrect", enrollment)
+				}
+			}
+		})
+	}
+}
+
+func TestConfirmMfa(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	currentCode, _ := Totp.Code(testMfaSecret, Totp.Step(time.Now()))
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		code			string
+		noJWT			bool
+	}{
+		{
+			name: "Successful confirmation",
+			method: "POST",
+			expectedCode: 200,
+			code: currentCode,
+		},
+		{
+			name: "Code incorrect",
+			method: "POST",
+			expectedCode: 401,
+			code: "000000",
+		},
+		{
+			name: "No pending enrollment",
+			method: "POST",
+			expectedCode: 404,
+			code: currentCode,
+		},
+		{
+			name: "Code missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "JWT missing from headers",
+			method: "POST",
+			expectedCode: 401,
+			code: currentCode,
+			noJWT: true,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			code: currentCode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "POST" && tt.code != "" && !tt.noJWT {
+				ExpectUserQuery(mock, "test_user", 1)
+				rows := sqlmock.NewRows([]string{"secret"})
+				if tt.expectedCode != 404 {
+					rows.AddRow(testMfaSecret)
+				}
+				mock.ExpectQuery("SELECT secret FROM user_mfa WHERE user_id=? AND confirmed=FALSE").WithArgs(1).WillReturnRows(rows)
+			}
+			if tt.expectedCode == 200 {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE user_mfa SET confirmed=TRUE, last_used_step=? WHERE user_id=? AND confirmed=FALSE").
+					WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM mfa_recovery_code WHERE user_id=?").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+				for range recoveryCodeCount {
+					mock.ExpectExec("INSERT INTO mfa_recovery_code (user_id, code_hash) VALUES (?, ?)").
+						WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				mock.ExpectCommit()
+			}
+
+			req, err := http.NewRequest(tt.method, "/mfa/confirm", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if !tt.noJWT {
+				tokenString, _ := CreateJWT(testUser)
+				req.Header.Set("Authorization", "Bearer " + tokenString)
+			}
+			req.Header.Set("Mfa-Code", tt.code)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ConfirmMfa)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 {
+				var recoveryCodes MfaRecoveryCodes
+				if err := json.NewDecoder(resp.Body).Decode(&recoveryCodes); err != nil { t.Fatal(err.Error()) }
+				if len(recoveryCodes.RecoveryCodes) != recoveryCodeCount {
+					t.Fatal("Number of recovery codes was incorrect", len(recoveryCodes.RecoveryCodes))
+				}
+			}
+		})
+	}
+}
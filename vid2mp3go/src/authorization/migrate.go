@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	Migrations "microservices/authorization/migrations"
+	"strconv"
+	"time"
+)
+
+// How long to wait for another replica to finish migrating the auth database.
+// Configured with the MIGRATION_LOCK_TIMEOUT env variable.
+var migrationLockTimeout = GetDurationEnv("MIGRATION_LOCK_TIMEOUT", time.Minute)
+
+// Usage of the migrate subcommand
+const migrateUsage = "usage: go-auth migrate up | down [steps] | status"
+
+// Returns a Migrator for the migrations embedded in the binary.
+func NewMigrator() (migrator *Migrations.Migrator, err error) {
+	migrations, err := Migrations.Embedded()
+	if err != nil {
+		return nil, err
+	}
+	return Migrations.NewMigrator(db, migrations, migrationLockTimeout), nil
+}
+
+// Applies the migrations of the auth database that have not been applied yet.
+func MigrateSchema() (err error) {
+	migrator, err := NewMigrator()
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up()
+	for _, migration := range applied {
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+	}
+	return err
+}
+
+// Runs the migrate subcommand with the given arguments. "up" applies every pending
+// migration, "down" reverts the given number of migrations, one by default, and
+// "status" lists the migrations and when they were applied.
+func RunMigrateCommand(args []string) (err error) {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "down") {
+		return errors.New(migrateUsage)
+	}
+	steps := 1
+	if len(args) == 2 {
+		if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+			return errors.New(migrateUsage)
+		}
+	}
+	if args[0] == "up" {
+		return MigrateSchema()
+	}
+	migrator, err := NewMigrator()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "down":
+		reverted, err := migrator.Down(steps)
+		for _, migration := range reverted {
+			log.Printf("Reverted migration %d_%s", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Changed {
+				state += ", changed since"
+			}
+			if status.Unknown {
+				state += ", unknown to this binary"
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return nil
+	}
+	return errors.New(migrateUsage)
+}
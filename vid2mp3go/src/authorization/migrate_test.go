@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestRunMigrateCommandUsage(t *testing.T) {
+	invalid := [][]string{{}, {"sideways"}, {"up", "2"}, {"down", "0"}, {"down", "two"}, {"status", "all"}, {"down", "1", "2"}}
+	for _, args := range invalid {
+		if err := RunMigrateCommand(args); err == nil || err.Error() != migrateUsage {
+			t.Fatal("Invalid arguments were accepted", args, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package migrations
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const createTableQuery = "CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, checksum CHAR(64) NOT NULL, applied_at DATETIME NOT NULL)"
+
+// Two migrations, the first creating table a and the second table b
+var testFS = fstest.MapFS{
+	"0001_create_a.up.sql":   {Data: []byte("-- Creates a\nCREATE TABLE a (\n\tid INT\n);\n")},
+	"0001_create_a.down.sql": {Data: []byte("DROP TABLE a;\n")},
+	"0002_create_b.up.sql":   {Data: []byte("CREATE TABLE b (id INT);\nINSERT INTO b (id) VALUES (1);\n")},
+	"0002_create_b.down.sql": {Data: []byte("DROP TABLE b;\n")},
+	"README.md":              {Data: []byte("not a migration")},
+}
+
+func mustLoad(t *testing.T) []Migration {
+	migrations, err := Load(testFS)
+	if err != nil { t.Fatal(err.Error()) }
+	return migrations
+}
+
+// Adds the expectations of the lock being taken and the applied migrations being
+// fetched. The migrations with the given versions have been applied.
+func expectApplied(mock sqlmock.Sqlmock, migrations []Migration, versions ...int64) {
+	mock.ExpectQuery("SELECT GET_LOCK(?, ?)").WithArgs("schema_migrations", 10).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+	mock.ExpectExec(createTableQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "checksum"})
+	for _, migration := range migrations {
+		if slices.Contains(versions, migration.Version) {
+			rows.AddRow(migration.Version, migration.Checksum)
+		}
+	}
+	mock.ExpectQuery("SELECT version, checksum FROM schema_migrations ORDER BY version").WillReturnRows(rows)
+}
+
+func TestLoad(t *testing.T) {
+	migrations := mustLoad(t)
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Name != "create_b" {
+		t.Fatal("Migrations were loaded incorrectly", migrations)
+	}
+	if migrations[0].Down != "DROP TABLE a;\n" || len(migrations[0].Checksum) != 64 || migrations[0].Checksum == migrations[1].Checksum {
+		t.Fatal("Migration contents were loaded incorrectly", migrations[0])
+	}
+
+	invalid := map[string]fstest.MapFS{
+		"Missing down file": {"0001_a.up.sql": {Data: []byte("SELECT 1;")}},
+		"Misnamed file": {"1-a.up.sql": {Data: []byte("SELECT 1;")}},
+		"Version used twice": {
+			"0001_a.up.sql": {Data: []byte("SELECT 1;")}, "0001_a.down.sql": {Data: []byte("SELECT 1;")},
+			"0001_b.up.sql": {Data: []byte("SELECT 1;")}, "0001_b.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"Version zero": {"0000_a.up.sql": {Data: []byte("SELECT 1;")}, "0000_a.down.sql": {Data: []byte("SELECT 1;")}},
+	}
+	for name, fsys := range invalid {
+		if _, err := Load(fsys); err == nil { t.Fatal(name, "was loaded") }
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	migrations, err := Embedded()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(migrations) == 0 || migrations[0].Version != 1 { t.Fatal("Embedded migrations were not found") }
+	for i, migration := range migrations {
+		if migration.Version != int64(i+1) { t.Fatal("Migration versions have a gap at", migration.Version) }
+		if len(SplitStatements(migration.Up)) == 0 || len(SplitStatements(migration.Down)) == 0 {
+			t.Fatal("Migration has no statements", migration.Name)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := SplitStatements("-- comment\r\nCREATE TABLE a (\r\n\tid INT\r\n);\r\n\r\nINSERT INTO a VALUES (1);\nSELECT 1")
+	expected := []string{"CREATE TABLE a (\n\tid INT\n);", "INSERT INTO a VALUES (1);", "SELECT 1"}
+	if !slices.Equal(statements, expected) { t.Fatal("Statements were split incorrectly", statements) }
+}
+
+func TestUp(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+	migrations := mustLoad(t)
+
+	// Only the second migration is pending
+	expectApplied(mock, migrations, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE b (id INT);").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO b (id) VALUES (1);").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)").
+		WithArgs(2, "create_b", migrations[1].Checksum, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT RELEASE_LOCK(?)").WithArgs("schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := NewMigrator(db, migrations, 10*time.Second).Up()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(applied) != 1 || applied[0].Version != 2 { t.Fatal("Applied migrations were incorrect", applied) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestUpFailingMigration(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+	migrations := mustLoad(t)
+
+	// The failed migration is not recorded and the later one is not attempted
+	expectApplied(mock, migrations)
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE a (\n\tid INT\n);").WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+	mock.ExpectExec("SELECT RELEASE_LOCK(?)").WithArgs("schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := NewMigrator(db, migrations, 10*time.Second).Up()
+	if err == nil || len(applied) != 0 { t.Fatal("Failing migration was applied", applied) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestUpRefusesChangedAndUnknownMigrations(t *testing.T) {
+	migrations := mustLoad(t)
+	tests := []struct {
+		name		string
+		rows		*sqlmock.Rows
+		expectedErr	error
+	}{
+		{
+			name: "Checksum mismatch",
+			rows: sqlmock.NewRows([]string{"version", "checksum"}).AddRow(1, "changed"),
+			expectedErr: ErrChecksumMismatch,
+		},
+		{
+			name: "Unknown version",
+			rows: sqlmock.NewRows([]string{"version", "checksum"}).AddRow(1, migrations[0].Checksum).AddRow(3, "newer"),
+			expectedErr: ErrUnknownVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil { t.Fatal(err.Error()) }
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT GET_LOCK(?, ?)").WithArgs("schema_migrations", 10).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+			mock.ExpectExec(createTableQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT version, checksum FROM schema_migrations ORDER BY version").WillReturnRows(tt.rows)
+			mock.ExpectExec("SELECT RELEASE_LOCK(?)").WithArgs("schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			_, err = NewMigrator(db, migrations, 10*time.Second).Up()
+			if !errors.Is(err, tt.expectedErr) { t.Fatal("Error was incorrect", err) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+		})
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+
+	// Another replica holds the lock, so nothing is touched
+	mock.ExpectQuery("SELECT GET_LOCK(?, ?)").WithArgs("schema_migrations", 10).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(0))
+
+	_, err = NewMigrator(db, mustLoad(t), 10*time.Second).Up()
+	if !errors.Is(err, ErrLockTimeout) { t.Fatal("Error was incorrect", err) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestDown(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+	migrations := mustLoad(t)
+
+	// Reverting more steps than applied reverts the applied ones only
+	expectApplied(mock, migrations, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec("DROP TABLE a;").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations WHERE version=?").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT RELEASE_LOCK(?)").WithArgs("schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	reverted, err := NewMigrator(db, migrations, 10*time.Second).Down(2)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(reverted) != 1 || reverted[0].Version != 1 { t.Fatal("Reverted migrations were incorrect", reverted) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestStatus(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+	migrations := mustLoad(t)
+	appliedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT GET_LOCK(?, ?)").WithArgs("schema_migrations", 10).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+	mock.ExpectExec(createTableQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+			AddRow(1, "create_a", "changed", appliedAt).
+			AddRow(3, "create_c", "newer", appliedAt))
+	mock.ExpectExec("SELECT RELEASE_LOCK(?)").WithArgs("schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	statuses, err := NewMigrator(db, migrations, 10*time.Second).Status()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(statuses) != 3 { t.Fatal("Statuses were incorrect", statuses) }
+	if statuses[0].AppliedAt == nil || !statuses[0].AppliedAt.Equal(appliedAt) || !statuses[0].Changed {
+		t.Fatal("Status of the changed migration was incorrect", statuses[0])
+	}
+	if statuses[1].AppliedAt != nil || statuses[1].Changed { t.Fatal("Status of the pending migration was incorrect", statuses[1]) }
+	if statuses[2].Name != "create_c" || statuses[2].AppliedAt == nil || !statuses[2].Unknown { t.Fatal("Status of the unknown migration was incorrect", statuses[2]) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
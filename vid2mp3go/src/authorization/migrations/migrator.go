@@ -0,0 +1,238 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Name of the MySQL lock held while migrating, so that replicas starting at the same
+// time do not apply the same migration twice
+const lockName = "schema_migrations"
+
+var ErrLockTimeout = errors.New("timed out waiting for the schema migration lock")
+var ErrChecksumMismatch = errors.New("applied migration was changed")
+var ErrUnknownVersion = errors.New("database has a migration applied that this binary does not know")
+
+// The state of a migration, as returned by Migrator.Status. AppliedAt is nil for
+// migrations that have not been applied yet. Changed is true if the migration was
+// changed after it had been applied, and Unknown if the binary does not know it.
+type Status struct {
+	Migration
+	AppliedAt	*time.Time
+	Changed		bool
+	Unknown		bool
+}
+
+// Applies and reverts migrations of a MySQL database. Applied migrations are
+// recorded in the schema_migrations table.
+type Migrator struct {
+	db			*sql.DB
+	migrations	[]Migration
+	lockTimeout	time.Duration
+}
+
+// Creates a Migrator for the given migrations, which have to be ordered by version.
+// Waiting for another replica to finish migrating fails after lockTimeout.
+func NewMigrator(db *sql.DB, migrations []Migration, lockTimeout time.Duration) *Migrator {
+	return &Migrator{db: db, migrations: migrations, lockTimeout: lockTimeout}
+}
+
+// Applies every migration that has not been applied yet, in order, and returns them.
+// Fails without applying anything if an applied migration has been changed or is
+// unknown, e.g. because an older binary was deployed after a newer one.
+func (m *Migrator) Up() (applied []Migration, err error) {
+	err = m.withLock(func(conn *sql.Conn) error {
+		appliedChecksums, err := m.appliedChecksums(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := appliedChecksums[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(conn, migration.Version, migration.Up, func(tx *sql.Tx) error {
+				_, err := tx.Exec(
+					"INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)",
+					migration.Version, migration.Name, migration.Checksum, time.Now().UTC(),
+				)
+				return err
+			}); err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Reverts the given number of the most recently applied migrations, newest first,
+// and returns them.
+func (m *Migrator) Down(steps int) (reverted []Migration, err error) {
+	err = m.withLock(func(conn *sql.Conn) error {
+		appliedChecksums, err := m.appliedChecksums(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := appliedChecksums[migration.Version]; !ok {
+				continue
+			}
+			if err := m.apply(conn, migration.Version, migration.Down, func(tx *sql.Tx) error {
+				_, err := tx.Exec("DELETE FROM schema_migrations WHERE version=?", migration.Version)
+				return err
+			}); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Returns the known migrations along with when they were applied, followed by applied
+// migrations this binary does not know. Migrations that were changed after being applied
+// are marked as such, instead of failing like Up and Down do.
+func (m *Migrator) Status() (statuses []Status, err error) {
+	err = m.withLock(func(conn *sql.Conn) error {
+		if err := createTable(conn); err != nil {
+			return err
+		}
+		rows, err := conn.QueryContext(context.Background(), "SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		applied := map[int64]Status{}
+		var unknown []Status
+		for rows.Next() {
+			var status Status
+			var appliedAt time.Time
+			if err := rows.Scan(&status.Version, &status.Name, &status.Checksum, &appliedAt); err != nil {
+				return err
+			}
+			status.AppliedAt = &appliedAt
+			status.Unknown = !m.isKnown(status.Version)
+			applied[status.Version] = status
+			if status.Unknown {
+				unknown = append(unknown, status)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if record, ok := applied[migration.Version]; ok {
+				status.AppliedAt = record.AppliedAt
+				status.Changed = record.Checksum != migration.Checksum
+			}
+			statuses = append(statuses, status)
+		}
+		statuses = append(statuses, unknown...)
+		return nil
+	})
+	return statuses, err
+}
+
+// Returns true if a migration with the given version is known.
+func (m *Migrator) isKnown(version int64) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the statements of a migration script and records the result with the given
+// function. MySQL commits schema changes implicitly, so a migration that fails halfway
+// has to be fixed by hand, but it is only recorded once all of its statements succeed.
+func (m *Migrator) apply(conn *sql.Conn, version int64, script string, record func(tx *sql.Tx) error) (err error) {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range SplitStatements(script) {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Creates the schema_migrations table if needed and returns the checksums of the applied
+// migrations by version. Fails if they do not match the known migrations.
+func (m *Migrator) appliedChecksums(conn *sql.Conn) (checksums map[int64]string, err error) {
+	if err := createTable(conn); err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, checksum FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checksums = map[int64]string{}
+	for rows.Next() {
+		var version int64
+		var checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		checksums[version] = checksum
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for version := range checksums {
+		if !m.isKnown(version) {
+			return nil, fmt.Errorf("%w: version %d", ErrUnknownVersion, version)
+		}
+	}
+	for _, migration := range m.migrations {
+		if checksum, ok := checksums[migration.Version]; ok && checksum != migration.Checksum {
+			return nil, fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, migration.Version, migration.Name)
+		}
+	}
+	return checksums, nil
+}
+
+// Creates the schema_migrations table, unless it exists already.
+func createTable(conn *sql.Conn) (err error) {
+	_, err = conn.ExecContext(
+		context.Background(),
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, checksum CHAR(64) NOT NULL, applied_at DATETIME NOT NULL)",
+	)
+	return err
+}
+
+// Runs the given function on a connection holding the migration lock. The lock belongs
+// to the connection's session, so every statement has to use that connection.
+func (m *Migrator) withLock(f func(conn *sql.Conn) error) (err error) {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(m.lockTimeout/time.Second)).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return ErrLockTimeout
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", lockName)
+	return f(conn)
+}
@@ -0,0 +1,22 @@
+DROP TABLE IF EXISTS admin_action;
+DROP TABLE IF EXISTS user_role;
+DROP TABLE IF EXISTS role_permission;
+DROP TABLE IF EXISTS permission;
+DROP TABLE IF EXISTS role;
+DROP TABLE IF EXISTS signing_key;
+DROP TABLE IF EXISTS login_attempt;
+DROP TABLE IF EXISTS oidc_login;
+DROP TABLE IF EXISTS user_identity;
+DROP TABLE IF EXISTS oauth_authorization_code;
+DROP TABLE IF EXISTS oauth_consent;
+DROP TABLE IF EXISTS oauth_client;
+DROP TABLE IF EXISTS api_key;
+DROP TABLE IF EXISTS mfa_challenge;
+DROP TABLE IF EXISTS mfa_recovery_code;
+DROP TABLE IF EXISTS user_mfa;
+DROP TABLE IF EXISTS verification_token;
+DROP TABLE IF EXISTS password_reset_token;
+DROP TABLE IF EXISTS revoked_user;
+DROP TABLE IF EXISTS revoked_token;
+DROP TABLE IF EXISTS refresh_token;
+DROP TABLE IF EXISTS user;
@@ -0,0 +1,180 @@
+-- Schema of the auth database as created by sql/init_sql.sh before migrations were
+-- introduced. Tables that already exist are kept, so such databases are adopted as is.
+CREATE TABLE IF NOT EXISTS user (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	email VARCHAR(255) NOT NULL UNIQUE,
+	password VARCHAR(255) NOT NULL,
+	verified BOOLEAN NOT NULL DEFAULT FALSE,
+	disabled BOOLEAN NOT NULL DEFAULT FALSE,
+	last_login_at DATETIME NULL
+);
+CREATE TABLE IF NOT EXISTS refresh_token (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	family_id VARCHAR(32) NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	expires_at DATETIME NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL,
+	INDEX (family_id),
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS revoked_token (
+	jti VARCHAR(64) NOT NULL PRIMARY KEY,
+	expires_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS revoked_user (
+	email VARCHAR(255) NOT NULL PRIMARY KEY,
+	revoked_before DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS password_reset_token (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	expires_at DATETIME NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS verification_token (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	expires_at DATETIME NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS user_mfa (
+	user_id INT NOT NULL PRIMARY KEY,
+	secret VARCHAR(64) NOT NULL,
+	confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+	last_used_step BIGINT NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS mfa_recovery_code (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	code_hash CHAR(64) NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS mfa_challenge (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	expires_at DATETIME NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS api_key (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	label VARCHAR(255) NOT NULL DEFAULT '',
+	key_hash CHAR(64) NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL,
+	last_used_at DATETIME NULL,
+	revoked BOOLEAN NOT NULL DEFAULT FALSE,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS oauth_client (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	client_id VARCHAR(64) NOT NULL UNIQUE,
+	client_secret_hash CHAR(64) NULL,
+	name VARCHAR(255) NOT NULL,
+	redirect_uris TEXT NOT NULL,
+	scopes VARCHAR(1024) NOT NULL,
+	owner_id INT NOT NULL,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (owner_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS oauth_consent (
+	user_id INT NOT NULL,
+	client_id INT NOT NULL,
+	scope VARCHAR(1024) NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (user_id, client_id),
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE,
+	FOREIGN KEY (client_id) REFERENCES oauth_client(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS oauth_authorization_code (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	client_id INT NOT NULL,
+	user_id INT NOT NULL,
+	code_hash CHAR(64) NOT NULL UNIQUE,
+	redirect_uri VARCHAR(2048) NOT NULL,
+	scope VARCHAR(1024) NOT NULL,
+	code_challenge VARCHAR(128) NOT NULL,
+	expires_at DATETIME NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (client_id) REFERENCES oauth_client(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS user_identity (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	issuer VARCHAR(255) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	created_at DATETIME NOT NULL,
+	UNIQUE (issuer, subject),
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS oidc_login (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	state_hash CHAR(64) NOT NULL UNIQUE,
+	nonce VARCHAR(64) NOT NULL,
+	code_verifier VARCHAR(128) NOT NULL,
+	expires_at DATETIME NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS login_attempt (
+	attempt_key VARCHAR(320) NOT NULL PRIMARY KEY,
+	failures INT NOT NULL,
+	last_failure_at DATETIME NOT NULL,
+	locked_until DATETIME NULL
+);
+CREATE TABLE IF NOT EXISTS signing_key (
+	kid VARCHAR(64) NOT NULL PRIMARY KEY,
+	private_key TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS role (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(64) NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS permission (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(64) NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS role_permission (
+	role_id INT NOT NULL,
+	permission_id INT NOT NULL,
+	PRIMARY KEY (role_id, permission_id),
+	FOREIGN KEY (role_id) REFERENCES role(id) ON DELETE CASCADE,
+	FOREIGN KEY (permission_id) REFERENCES permission(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS user_role (
+	user_id INT NOT NULL,
+	role_id INT NOT NULL,
+	PRIMARY KEY (user_id, role_id),
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE,
+	FOREIGN KEY (role_id) REFERENCES role(id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS admin_action (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	admin VARCHAR(255) NOT NULL,
+	action VARCHAR(32) NOT NULL,
+	target VARCHAR(255) NOT NULL,
+	created_at DATETIME NOT NULL,
+	INDEX (created_at)
+);
+INSERT IGNORE INTO role (name) VALUES ("admin"), ("user");
+INSERT IGNORE INTO permission (name) VALUES ("upload:write"), ("download:read"), ("admin");
+INSERT IGNORE INTO role_permission (role_id, permission_id)
+	SELECT role.id, permission.id FROM role, permission
+	WHERE role.name = "admin" OR permission.name IN ("upload:write", "download:read");
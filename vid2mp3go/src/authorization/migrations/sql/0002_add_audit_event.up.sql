@@ -0,0 +1,12 @@
+-- Trail of logins, registrations and issued tokens, queried by admins
+CREATE TABLE audit_event (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	event_type VARCHAR(32) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	ip VARCHAR(45) NOT NULL,
+	user_agent VARCHAR(512) NOT NULL,
+	outcome VARCHAR(16) NOT NULL,
+	created_at DATETIME NOT NULL,
+	INDEX (created_at),
+	INDEX (username, created_at)
+);
@@ -0,0 +1,11 @@
+-- Devices users are logged in on. A session lasts as long as its refresh token family.
+CREATE TABLE session (
+	family_id VARCHAR(32) NOT NULL PRIMARY KEY,
+	user_id INT NOT NULL,
+	user_agent VARCHAR(512) NOT NULL,
+	ip VARCHAR(45) NOT NULL,
+	created_at DATETIME NOT NULL,
+	last_used_at DATETIME NOT NULL,
+	INDEX (user_id),
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
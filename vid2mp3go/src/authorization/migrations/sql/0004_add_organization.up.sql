@@ -0,0 +1,29 @@
+-- Organizations let a team share its uploaded videos and mp3s. A user can be a
+-- member of one organization, with the role owner, admin or member.
+CREATE TABLE organization (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL UNIQUE,
+	created_at DATETIME NOT NULL
+);
+CREATE TABLE organization_member (
+	user_id INT NOT NULL PRIMARY KEY,
+	organization_id INT NOT NULL,
+	role VARCHAR(16) NOT NULL,
+	joined_at DATETIME NOT NULL,
+	INDEX (organization_id),
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE,
+	FOREIGN KEY (organization_id) REFERENCES organization(id) ON DELETE CASCADE
+);
+-- Invitations to join an organization, sent to an email address
+CREATE TABLE organization_invitation (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	organization_id INT NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	role VARCHAR(16) NOT NULL,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	invited_by INT NOT NULL,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (organization_id) REFERENCES organization(id) ON DELETE CASCADE,
+	FOREIGN KEY (invited_by) REFERENCES user(id) ON DELETE CASCADE
+);
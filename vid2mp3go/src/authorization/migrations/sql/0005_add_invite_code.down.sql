@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS invite_code_role;
+DROP TABLE IF EXISTS invite_code;
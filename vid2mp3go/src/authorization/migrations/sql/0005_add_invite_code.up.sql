@@ -0,0 +1,20 @@
+-- Invite codes created by admins, required to register in the invite-only
+-- registration mode. A code can be used max_uses times until it expires.
+CREATE TABLE invite_code (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	code_hash CHAR(64) NOT NULL UNIQUE,
+	max_uses INT NOT NULL,
+	uses INT NOT NULL DEFAULT 0,
+	created_by INT NOT NULL,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (created_by) REFERENCES user(id) ON DELETE CASCADE
+);
+-- Roles given to users registering with an invite code, besides the default role
+CREATE TABLE invite_code_role (
+	invite_code_id INT NOT NULL,
+	role_id INT NOT NULL,
+	PRIMARY KEY (invite_code_id, role_id),
+	FOREIGN KEY (invite_code_id) REFERENCES invite_code(id) ON DELETE CASCADE,
+	FOREIGN KEY (role_id) REFERENCES role(id) ON DELETE CASCADE
+);
@@ -0,0 +1,13 @@
+-- Pending links of IdP identities to existing users with the same email address.
+-- The identity is only linked once the user confirms the link while logged in.
+CREATE TABLE oidc_link (
+	id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	user_id INT NOT NULL,
+	issuer VARCHAR(255) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	expires_at DATETIME NOT NULL,
+	used BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- The columns belong to the schema of 0001_initial_schema, so they are kept.
+DO 0;
@@ -0,0 +1,15 @@
+-- The user table of databases created by sql/init_sql.sh before migrations were
+-- introduced only has id, email and password, and 0001_initial_schema keeps it as is.
+-- Add the missing columns to such tables, mark their users as verified, since they
+-- could log in before, and give them the default role.
+SET @baseline = (SELECT COUNT(*) = 0 FROM information_schema.columns
+	WHERE table_schema = DATABASE() AND table_name = "user" AND column_name = "verified");
+SET @add_columns = IF(@baseline,
+	"ALTER TABLE user ADD COLUMN verified BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN last_login_at DATETIME NULL",
+	"DO 0");
+PREPARE add_columns FROM @add_columns;
+EXECUTE add_columns;
+DEALLOCATE PREPARE add_columns;
+UPDATE user SET verified = TRUE WHERE @baseline;
+INSERT IGNORE INTO user_role (user_id, role_id)
+	SELECT user.id, role.id FROM user, role WHERE @baseline AND role.name = "user";
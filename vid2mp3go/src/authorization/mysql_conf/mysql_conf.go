@@ -21,7 +21,7 @@ func NewMySQLConf() MySQLConf {
 }
 
 // Creates a string that can be used as the dataSourceName for db.Open()
-// based on the MySQLConf's field values
+// based on the MySQLConf's field values. DATETIME columns are parsed into time.Time.
 func (c MySQLConf) GetDataSourceName() (dataSourceName string) {
-	return c.User + ":" + c.Password + "@tcp(" + c.Host + ":" + c.Port + ")/" + c.DB
+	return c.User + ":" + c.Password + "@tcp(" + c.Host + ":" + c.Port + ")/" + c.DB + "?parseTime=true"
 }
\ No newline at end of file
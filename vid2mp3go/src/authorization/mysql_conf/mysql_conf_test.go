@@ -28,7 +28,7 @@ func TestGetDataSourceName(t *testing.T) {
 	setMySqlEnv()
 	c := NewMySQLConf()
 	dataSourceName := c.GetDataSourceName()
-	if dataSourceName != "USER:PASSWORD@tcp(HOST:1000)/DB" {
+	if dataSourceName != "USER:PASSWORD@tcp(HOST:1000)/DB?parseTime=true" {
 		t.Fatalf("DataSourceName was icorrect, got %s\n", dataSourceName)
 	}
 }
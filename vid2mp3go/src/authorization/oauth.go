@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes that OAuth clients can be granted. Each scope grants the permission of the
+// same name, if the user has it. The admin permission can not be delegated.
+var oauthScopes = []string{"upload:write", "download:read"}
+
+// Scope of OAuth clients that may use /introspect, e.g. resource servers. It grants no
+// permissions, and only admins can register confidential clients with it.
+const introspectScope = "token:introspect"
+
+// An OAuth client, as stored in the oauth_client table. Public clients, e.g. native
+// apps, have no secret and can only use the authorization code grant with PKCE.
+type OAuthClient struct {
+	ID					int64
+	ClientID			string
+	ClientSecretHash	sql.NullString
+	Name				string
+	RedirectURIs		[]string
+	Scopes				[]string
+	OwnerID				int64
+}
+
+// Returns true if the client has a secret to authenticate with.
+func (c OAuthClient) IsConfidential() bool {
+	return c.ClientSecretHash.Valid
+}
+
+// Body of a POST /oauth/clients request
+type OAuthClientRegistration struct {
+	Name			string		`json:"name"`
+	RedirectURIs	[]string	`json:"redirect_uris"`
+	Scopes			[]string	`json:"scopes"`
+	Confidential	bool		`json:"confidential"`
+}
+
+// A newly registered OAuth client, as returned by the POST /oauth/clients endpoint.
+// The client secret is only shown in this response.
+type RegisteredOAuthClient struct {
+	ClientID		string		`json:"client_id"`
+	ClientSecret	string		`json:"client_secret,omitempty"`
+	Name			string		`json:"name"`
+	RedirectURIs	[]string	`json:"redirect_uris"`
+	Scopes			[]string	`json:"scopes"`
+}
+
+// A user's consent to an OAuth client, as listed by the GET /oauth/consents endpoint
+type OAuthConsent struct {
+	ClientID	string		`json:"client_id"`
+	ClientName	string		`json:"client_name"`
+	Scope		string		`json:"scope"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+// Splits a space separated OAuth scope parameter into its scopes, dropping duplicates.
+func ParseScope(scope string) (scopes []string) {
+	scopes = []string{}
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// Returns true if every scope in requested is also in granted.
+func ScopesCovered(requested []string, granted []string) bool {
+	for _, s := range requested {
+		if !slices.Contains(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the permissions of the user that the given scopes grant.
+func ScopedPermissions(permissions []string, scopes []string) (scoped []string) {
+	scoped = []string{}
+	for _, p := range permissions {
+		if slices.Contains(scopes, p) && slices.Contains(oauthScopes, p) {
+			scoped = append(scoped, p)
+		}
+	}
+	return scoped
+}
+
+// Checks a PKCE code verifier against the S256 code challenge sent to /authorize.
+func VerifyCodeChallenge(codeVerifier string, codeChallenge string) bool {
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(codeChallenge)) == 1
+}
+
+// Returns true if the URI can be registered as a redirect URI. Only absolute https
+// URIs without a fragment are accepted, except for http on the loopback interface,
+// which native apps use.
+func IsValidRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Fragment != "" || u.Host == "" || strings.Contains(uri, " ") {
+		return false
+	}
+	if u.Scheme == "http" {
+		return u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"
+	}
+	return u.Scheme == "https"
+}
+
+// Fetches the OAuth client with the given client_id from the DB.
+// If the client does not exist, sql.ErrNoRows is returned.
+func GetOAuthClient(clientID string) (client OAuthClient, err error) {
+	var redirectURIs, scopes string
+	err = db.QueryRow(
+		"SELECT id, client_id, client_secret_hash, name, redirect_uris, scopes, owner_id FROM oauth_client WHERE client_id=?",
+		clientID,
+	).Scan(&client.ID, &client.ClientID, &client.ClientSecretHash, &client.Name, &redirectURIs, &scopes, &client.OwnerID)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = strings.Fields(scopes)
+	return client, nil
+}
+
+// Endpoint for registering OAuth clients, e.g. third-party tools that want to act on
+// behalf of users. Requires a JWT of the user registering the client. The POST request's
+// JSON body names the client, lists its redirect URIs and the scopes it may request, and
+// tells whether the client can keep a secret. The client_id, and the client_secret of
+// confidential clients, are returned as JSON. The secret is only stored as a hash.
+// Confidential clients can also use the client credentials grant, which acts on behalf
+// of the user that registered them.
+func OAuthClients(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("OAuthClients request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username, _ := claims["username"].(string)
+	var registration OAuthClientRegistration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		SendStatus.BadRequest(w)
+		return
+	}
+	if !IsValidOAuthClientRegistration(registration) {
+		SendStatus.BadRequest(w)
+		return
+	}
+	if slices.Contains(registration.Scopes, introspectScope) && !slices.Contains(GetStringsClaim(claims, "permissions"), "admin") {
+		SendStatus.Forbidden(w)
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	client := RegisteredOAuthClient{
+		Name: registration.Name,
+		RedirectURIs: registration.RedirectURIs,
+		Scopes: ParseScope(strings.Join(registration.Scopes, " ")),
+	}
+	client.ClientID, err = SecureToken.Generate(16)
+	if err != nil {
+		log.Printf("Error occured while generating client id:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	var clientSecretHash sql.NullString
+	if registration.Confidential {
+		client.ClientSecret, err = SecureToken.Generate(32)
+		if err != nil {
+			log.Printf("Error occured while generating client secret:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		clientSecretHash = sql.NullString{String: SecureToken.Hash(client.ClientSecret), Valid: true}
+	}
+	_, err = db.Exec(
+		"INSERT INTO oauth_client (client_id, client_secret_hash, name, redirect_uris, scopes, owner_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		client.ClientID, clientSecretHash, client.Name, strings.Join(client.RedirectURIs, " "), strings.Join(client.Scopes, " "), user.ID, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to insert OAuth client into DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("OAuth client %s registered by user %s", client.ClientID, username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
+// Checks that the registration names the client and only requests supported scopes,
+// and that its redirect URIs are valid. Public clients need at least one redirect URI,
+// since the authorization code grant is the only one they can use, and can not
+// introspect tokens.
+func IsValidOAuthClientRegistration(registration OAuthClientRegistration) bool {
+	if registration.Name == "" || len(registration.Name) > 255 || len(registration.Scopes) == 0 {
+		return false
+	}
+	if !registration.Confidential && (len(registration.RedirectURIs) == 0 || slices.Contains(registration.Scopes, introspectScope)) {
+		return false
+	}
+	for _, uri := range registration.RedirectURIs {
+		if !IsValidRedirectURI(uri) {
+			return false
+		}
+	}
+	return ScopesCovered(registration.Scopes, slices.Concat(oauthScopes, []string{introspectScope}))
+}
+
+// Endpoint for managing the consents the user of the JWT in the Authorization header
+// has given to OAuth clients. GET lists the consents as JSON. DELETE withdraws the consent
+// given to the client in the Client-Id header, so that the client has to ask for consent
+// again. JWTs already issued to the client stay valid until they expire.
+func OAuthConsents(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("OAuthConsents request received with method", r.Method)
+	if r.Method != "GET" && r.Method != "DELETE" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username, _ := claims["username"].(string)
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if r.Method == "DELETE" {
+		WithdrawOAuthConsent(w, user.ID, r.Header.Get("Client-Id"))
+		return
+	}
+	rows, err := db.Query(
+		"SELECT oauth_client.client_id, oauth_client.name, oauth_consent.scope, oauth_consent.created_at FROM oauth_consent JOIN oauth_client ON oauth_client.id = oauth_consent.client_id WHERE oauth_consent.user_id=?",
+		user.ID,
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch OAuth consents from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer rows.Close()
+	consents := []OAuthConsent{}
+	for rows.Next() {
+		var consent OAuthConsent
+		if err := rows.Scan(&consent.ClientID, &consent.ClientName, &consent.Scope, &consent.CreatedAt); err != nil {
+			log.Printf("Error occured while trying to fetch OAuth consents from DB:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		consents = append(consents, consent)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error occured while trying to fetch OAuth consents from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(consents)
+}
+
+// Deletes the user's consent to the OAuth client with the given client_id.
+// If there is no such consent, 404 is sent.
+func WithdrawOAuthConsent(w http.ResponseWriter, userID int64, clientID string) {
+	if clientID == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	client, err := GetOAuthClient(clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch OAuth client from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	res, err := db.Exec("DELETE FROM oauth_consent WHERE user_id=? AND client_id=?", userID, client.ID)
+	if err != nil {
+		log.Printf("Error occured while trying to delete OAuth consent:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		log.Printf("Error occured while trying to delete OAuth consent:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if n == 0 {
+		SendStatus.NotFound(w)
+		return
+	}
+	fmt.Fprintf(w, "Consent withdrawn.")
+}
+
+// Error response of the OAuth endpoints, as defined by RFC 6749
+type OAuthError struct {
+	Error		string	`json:"error"`
+	Description	string	`json:"error_description,omitempty"`
+}
+
+// Sends an OAuth error response with the given status and error code as JSON.
+// Client authentication failures (401) also get a WWW-Authenticate header.
+func SendOAuthError(w http.ResponseWriter, statusCode int, errorCode string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if statusCode == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(OAuthError{Error: errorCode, Description: description})
+}
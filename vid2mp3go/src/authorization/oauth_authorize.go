@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Lifetime of OAuth authorization codes. Configured with the OAUTH_CODE_TTL env variable.
+var oauthCodeTTL = GetDurationEnv("OAUTH_CODE_TTL", time.Minute)
+
+// Response of /authorize when the user has not yet consented to the requested scopes
+type OAuthConsentRequest struct {
+	ClientID	string	`json:"client_id"`
+	ClientName	string	`json:"client_name"`
+	Scope		string	`json:"scope"`
+}
+
+// Authorization endpoint of the OAuth authorization code grant. The user is identified
+// by the JWT in the Authorization header. The client_id, redirect_uri, response_type=code,
+// scope, state and PKCE code_challenge with code_challenge_method=S256 are read from the
+// query or the form of a POST request. PKCE is required for every client.
+// If the user has already consented to the requested scopes, a GET request redirects to
+// the redirect URI with a single-use authorization code. Otherwise the consent request is
+// returned as JSON, and the user approves or denies it by sending the same parameters in
+// a POST request with consent=approve or consent=deny. Errors caused by an unknown client
+// or redirect URI are returned as JSON, all other errors are sent to the redirect URI.
+func Authorize(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Authorize request received with method", r.Method)
+	if r.Method != "GET" && r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username, _ := claims["username"].(string)
+	client, err := GetOAuthClient(r.FormValue("client_id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request", "unknown client_id")
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch OAuth client from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	redirectURI := r.FormValue("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for the client")
+		return
+	}
+	state := r.FormValue("state")
+	if r.FormValue("response_type") != "code" {
+		RedirectWithOAuthError(w, r, redirectURI, state, "unsupported_response_type")
+		return
+	}
+	codeChallenge := r.FormValue("code_challenge")
+	if codeChallenge == "" || r.FormValue("code_challenge_method") != "S256" {
+		RedirectWithOAuthError(w, r, redirectURI, state, "invalid_request")
+		return
+	}
+	scopes := ParseScope(r.FormValue("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !ScopesCovered(scopes, client.Scopes) {
+		RedirectWithOAuthError(w, r, redirectURI, state, "invalid_scope")
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	granted, err := GetOAuthConsent(user.ID, client.ID)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch OAuth consent from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if r.Method == "POST" {
+		switch r.FormValue("consent") {
+		case "approve":
+			for _, s := range scopes {
+				if !slices.Contains(granted, s) {
+					granted = append(granted, s)
+				}
+			}
+			if err := StoreOAuthConsent(user.ID, client.ID, granted); err != nil {
+				log.Printf("Error occured while trying to store OAuth consent:\n%s", err.Error())
+				SendStatus.InternalServerError(w)
+				return
+			}
+			log.Printf("User %s consented to scopes %v of OAuth client %s", username, scopes, client.ClientID)
+		case "deny":
+			RedirectWithOAuthError(w, r, redirectURI, state, "access_denied")
+			return
+		default:
+			SendStatus.BadRequest(w)
+			return
+		}
+	} else if !ScopesCovered(scopes, granted) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(OAuthConsentRequest{ClientID: client.ClientID, ClientName: client.Name, Scope: strings.Join(scopes, " ")})
+		return
+	}
+	code, err := CreateAuthorizationCode(client.ID, user.ID, redirectURI, scopes, codeChallenge)
+	if err != nil {
+		log.Printf("Error occured while trying to create authorization code:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	RedirectWithParams(w, r, redirectURI, url.Values{"code": {code}}, state)
+}
+
+// Returns the scopes the user has consented to grant to the OAuth client with the given id.
+func GetOAuthConsent(userID int64, clientID int64) (scopes []string, err error) {
+	var scope string
+	err = db.QueryRow("SELECT scope FROM oauth_consent WHERE user_id=? AND client_id=?", userID, clientID).Scan(&scope)
+	if errors.Is(err, sql.ErrNoRows) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseScope(scope), nil
+}
+
+// Replaces the user's consent to the OAuth client with the given id with the given scopes.
+func StoreOAuthConsent(userID int64, clientID int64, scopes []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM oauth_consent WHERE user_id=? AND client_id=?", userID, clientID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO oauth_consent (user_id, client_id, scope, created_at) VALUES (?, ?, ?, ?)",
+		userID, clientID, strings.Join(scopes, " "), time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Stores a new authorization code, expiring after oauthCodeTTL, and returns it.
+// Only the code's hash is stored.
+func CreateAuthorizationCode(clientID int64, userID int64, redirectURI string, scopes []string, codeChallenge string) (code string, err error) {
+	code, err = SecureToken.Generate(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(
+		"INSERT INTO oauth_authorization_code (client_id, user_id, code_hash, redirect_uri, scope, code_challenge, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		clientID, userID, SecureToken.Hash(code), redirectURI, strings.Join(scopes, " "), codeChallenge, now.Add(oauthCodeTTL), now,
+	)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Redirects to the given redirect URI with the given query parameters added to it,
+// along with the client's state, if it sent one.
+func RedirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values, state string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		SendStatus.InternalServerError(w)
+		return
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Redirects to the given redirect URI with the given OAuth error code.
+func RedirectWithOAuthError(w http.ResponseWriter, r *http.Request, redirectURI string, state string, errorCode string) {
+	RedirectWithParams(w, r, redirectURI, url.Values{"error": {errorCode}}, state)
+}
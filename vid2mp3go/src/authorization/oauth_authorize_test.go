@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	RevocationStore "microservices/authorization/revocation_store"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuthorize(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name				string
+		method				string
+		expectedCode		int
+		expectedError		string
+		clientID			string
+		redirectURI			string
+		responseType		string
+		codeChallenge		string
+		scope				string
+		consentedScope		string
+		consent				string
+		authHeader			string
+	}{
+		{
+			name: "Code issued with existing consent",
+			method: "GET",
+			expectedCode: 302,
+			consentedScope: "upload:write download:read",
+		},
+		{
+			name: "Consent requested",
+			method: "GET",
+			expectedCode: 200,
+			consentedScope: "download:read",
+		},
+		{
+			name: "Consent approved",
+			method: "POST",
+			expectedCode: 302,
+			consentedScope: "download:read",
+			consent: "approve",
+		},
+		{
+			name: "Consent denied",
+			method: "POST",
+			expectedCode: 302,
+			expectedError: "access_denied",
+			consent: "deny",
+		},
+		{
+			name: "Consent value invalid",
+			method: "POST",
+			expectedCode: 400,
+			consent: "maybe",
+		},
+		{
+			name: "Scope not allowed for client",
+			method: "GET",
+			expectedCode: 302,
+			expectedError: "invalid_scope",
+			scope: "admin",
+		},
+		{
+			name: "PKCE missing",
+			method: "GET",
+			expectedCode: 302,
+			expectedError: "invalid_request",
+			codeChallenge: "none",
+		},
+		{
+			name: "Response type unsupported",
+			method: "GET",
+			expectedCode: 302,
+			expectedError: "unsupported_response_type",
+			responseType: "token",
+		},
+		{
+			name: "Redirect URI not registered",
+			method: "GET",
+			expectedCode: 400,
+			expectedError: "invalid_request",
+			redirectURI: "https://attacker.example/cb",
+		},
+		{
+			name: "Client unknown",
+			method: "GET",
+			expectedCode: 400,
+			expectedError: "invalid_request",
+			clientID: "unknown_client",
+		},
+		{
+			name: "JWT missing from headers",
+			method: "GET",
+			expectedCode: 401,
+			authHeader: "none",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "DELETE",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.clientID == "" {
+				tt.clientID = "public_client"
+			}
+			if tt.redirectURI == "" {
+				tt.redirectURI = "https://client.example/cb"
+			}
+			if tt.responseType == "" {
+				tt.responseType = "code"
+			}
+			if tt.codeChallenge == "" {
+				tt.codeChallenge = testCodeChallenge
+			} else if tt.codeChallenge == "none" {
+				tt.codeChallenge = ""
+			}
+			if tt.scope == "" {
+				tt.scope = "upload:write download:read"
+			}
+			if tt.expectedCode != 401 && tt.expectedCode != 405 {
+				ExpectOAuthClientQuery(mock, tt.clientID)
+			}
+			if tt.expectedCode != 401 && tt.expectedCode != 405 && (tt.expectedError == "" || tt.expectedError == "access_denied") {
+				ExpectUserQuery(mock, "test_user", 1)
+				consentRows := sqlmock.NewRows([]string{"scope"})
+				if tt.consentedScope != "" {
+					consentRows.AddRow(tt.consentedScope)
+				}
+				mock.ExpectQuery("SELECT scope FROM oauth_consent WHERE user_id=? AND client_id=?").WithArgs(1, 7).WillReturnRows(consentRows)
+			}
+			if tt.consent == "approve" {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM oauth_consent WHERE user_id=? AND client_id=?").WithArgs(1, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO oauth_consent (user_id, client_id, scope, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(1, 7, "download:read upload:write", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+			if tt.expectedCode == 302 && tt.expectedError == "" {
+				mock.ExpectExec("INSERT INTO oauth_authorization_code (client_id, user_id, code_hash, redirect_uri, scope, code_challenge, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(7, 1, sqlmock.AnyArg(), tt.redirectURI, tt.scope, testCodeChallenge, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			params := url.Values{
+				"client_id": {tt.clientID},
+				"redirect_uri": {tt.redirectURI},
+				"response_type": {tt.responseType},
+				"scope": {tt.scope},
+				"state": {"xyz"},
+				"code_challenge": {tt.codeChallenge},
+				"code_challenge_method": {"S256"},
+			}
+			var req *http.Request
+			if tt.method == "POST" {
+				params.Set("consent", tt.consent)
+				req, err = http.NewRequest(tt.method, "/authorize", strings.NewReader(params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req, err = http.NewRequest(tt.method, "/authorize?" + params.Encode(), nil)
+			}
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.authHeader != "none" {
+				tokenString, _ := CreateJWT(testUser)
+				req.Header.Set("Authorization", "Bearer " + tokenString)
+			}
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Authorize)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 302 {
+				location, err := url.Parse(resp.Header().Get("Location"))
+				if err != nil { t.Fatal(err.Error()) }
+				query := location.Query()
+				if location.Host != "client.example" || query.Get("state") != "xyz" || query.Get("error") != tt.expectedError {
+					t.Fatal("Redirect was incorrect", location)
+				}
+				if tt.expectedError == "" && len(query.Get("code")) != 43 {
+					t.Fatal("Authorization code was incorrect", location)
+				}
+			}
+			if resp.Code == 400 && tt.expectedError != "" {
+				var oauthError OAuthError
+				if err := json.NewDecoder(resp.Body).Decode(&oauthError); err != nil { t.Fatal(err.Error()) }
+				if oauthError.Error != tt.expectedError { t.Fatal("Error was incorrect", oauthError) }
+			}
+			if resp.Code == 200 {
+				var consentRequest OAuthConsentRequest
+				if err := json.NewDecoder(resp.Body).Decode(&consentRequest); err != nil { t.Fatal(err.Error()) }
+				if consentRequest.ClientName != "Test client" || consentRequest.Scope != tt.scope {
+					t.Fatal("Consent request was incorrect", consentRequest)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectOAuthClient = "SELECT id, client_id, client_secret_hash, name, redirect_uris, scopes, owner_id FROM oauth_client WHERE client_id=?"
+
+// PKCE code verifier and its S256 code challenge, from RFC 7636 appendix B
+const (
+	testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+// Adds the expectation of the OAuth client with the given client_id being fetched.
+// "public_client" is a public client and "confidential_client" has the secret
+// "client_secret", any other client does not exist. Both clients have the id 7, are
+// owned by user 1, may request every scope and redirect to https://client.example/cb.
+// "resource_server" also has the secret "client_secret" and may only introspect tokens.
+// The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectOAuthClientQuery(mock sqlmock.Sqlmock, clientID string) {
+	rows := sqlmock.NewRows([]string{"id", "client_id", "client_secret_hash", "name", "redirect_uris", "scopes", "owner_id"})
+	switch clientID {
+	case "public_client":
+		rows.AddRow(7, clientID, nil, "Test client", "https://client.example/cb", "upload:write download:read", 1)
+	case "confidential_client":
+		rows.AddRow(7, clientID, SecureToken.Hash("client_secret"), "Test client", "https://client.example/cb", "upload:write download:read", 1)
+	case "resource_server":
+		rows.AddRow(8, clientID, SecureToken.Hash("client_secret"), "Resource server", "", "token:introspect", 1)
+	}
+	mock.ExpectQuery(selectOAuthClient).WithArgs(clientID).WillReturnRows(rows)
+}
+
+func TestParseScope(t *testing.T) {
+	scopes := ParseScope(" upload:write  download:read upload:write ")
+	if !slices.Equal(scopes, []string{"upload:write", "download:read"}) { t.Fatal("Scopes were incorrect", scopes) }
+	if scopes := ParseScope(""); scopes == nil || len(scopes) != 0 { t.Fatal("Scopes were incorrect", scopes) }
+}
+
+func TestScopedPermissions(t *testing.T) {
+	scoped := ScopedPermissions(testUser.Permissions, []string{"download:read", "admin"})
+	if !slices.Equal(scoped, []string{"download:read"}) { t.Fatal("Scoped permissions were incorrect", scoped) }
+	scoped = ScopedPermissions([]string{"download:read"}, []string{"upload:write", "download:read"})
+	if !slices.Equal(scoped, []string{"download:read"}) { t.Fatal("Scoped permissions were incorrect", scoped) }
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	tests := []struct {
+		name			string
+		codeVerifier	string
+		codeChallenge	string
+		expected		bool
+	}{
+		{
+			name: "Matching verifier",
+			codeVerifier: testCodeVerifier,
+			codeChallenge: testCodeChallenge,
+			expected: true,
+		},
+		{
+			name: "Verifier does not match",
+			codeVerifier: testCodeVerifier[1:] + "a",
+			codeChallenge: testCodeChallenge,
+		},
+		{
+			name: "Verifier too short",
+			codeVerifier: "short",
+			codeChallenge: "vn9dz1hiEtzSHSmsX6avSgAIVawqYj8gGCI-1nM0Aes",
+		},
+		{
+			name: "Challenge is the verifier itself",
+			codeVerifier: testCodeVerifier,
+			codeChallenge: testCodeVerifier,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if VerifyCodeChallenge(tt.codeVerifier, tt.codeChallenge) != tt.expected { t.Fatal("Result was incorrect") }
+		})
+	}
+}
+
+func TestIsValidRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri			string
+		expected	bool
+	}{
+		{"https://client.example/cb", true},
+		{"https://client.example/cb?app=1", true},
+		{"http://localhost:8080/cb", true},
+		{"http://127.0.0.1/cb", true},
+		{"http://client.example/cb", false},
+		{"https://client.example/cb#fragment", false},
+		{"/cb", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			if IsValidRedirectURI(tt.uri) != tt.expected { t.Fatal("Result was incorrect") }
+		})
+	}
+}
+
+func TestOAuthClients(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		registration	OAuthClientRegistration
+		nonAdmin		bool
+	}{
+		{
+			name: "Successful registration of public client",
+			method: "POST",
+			expectedCode: 200,
+			registration: OAuthClientRegistration{Name: "CLI", RedirectURIs: []string{"http://127.0.0.1/cb"}, Scopes: []string{"download:read"}},
+		},
+		{
+			name: "Successful registration of confidential client",
+			method: "POST",
+			expectedCode: 200,
+			registration: OAuthClientRegistration{Name: "Batch job", Scopes: []string{"upload:write", "download:read"}, Confidential: true},
+		},
+		{
+			name: "Successful registration of introspection client",
+			method: "POST",
+			expectedCode: 200,
+			registration: OAuthClientRegistration{Name: "Converter", Scopes: []string{"token:introspect"}, Confidential: true},
+		},
+		{
+			name: "Introspection client registered by non-admin",
+			method: "POST",
+			expectedCode: 403,
+			registration: OAuthClientRegistration{Name: "Converter", Scopes: []string{"token:introspect"}, Confidential: true},
+			nonAdmin: true,
+		},
+		{
+			name: "Public introspection client",
+			method: "POST",
+			expectedCode: 400,
+			registration: OAuthClientRegistration{Name: "Converter", RedirectURIs: []string{"http://127.0.0.1/cb"}, Scopes: []string{"token:introspect"}},
+		},
+		{
+			name: "Public client without redirect URI",
+			method: "POST",
+			expectedCode: 400,
+			registration: OAuthClientRegistration{Name: "CLI", Scopes: []string{"download:read"}},
+		},
+		{
+			name: "Redirect URI invalid",
+			method: "POST",
+			expectedCode: 400,
+			registration: OAuthClientRegistration{Name: "CLI", RedirectURIs: []string{"http://client.example/cb"}, Scopes: []string{"download:read"}},
+		},
+		{
+			name: "Scope not supported",
+			method: "POST",
+			expectedCode: 400,
+			registration: OAuthClientRegistration{Name: "Batch job", Scopes: []string{"admin"}, Confidential: true},
+		},
+		{
+			name: "Name missing",
+			method: "POST",
+			expectedCode: 400,
+			registration: OAuthClientRegistration{Scopes: []string{"download:read"}, Confidential: true},
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode == 200 {
+				ExpectUserQuery(mock, "test_user", 1)
+				mock.ExpectExec("INSERT INTO oauth_client (client_id, client_secret_hash, name, redirect_uris, scopes, owner_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), tt.registration.Name, sqlmock.AnyArg(), sqlmock.AnyArg(), 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(7, 1))
+			}
+
+			body, _ := json.Marshal(tt.registration)
+			req, err := http.NewRequest(tt.method, "/oauth/clients", bytes.NewReader(body))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			user := testUser
+			if tt.nonAdmin {
+				user.Roles, user.Permissions = []string{"user"}, []string{"upload:write", "download:read"}
+			}
+			tokenString, _ := CreateJWT(user)
+			req.Header.Set("Authorization", "Bearer " + tokenString)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), OAuthClients)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 {
+				var client RegisteredOAuthClient
+				if err := json.NewDecoder(resp.Body).Decode(&client); err != nil { t.Fatal(err.Error()) }
+				if client.ClientID == "" || (client.ClientSecret != "") != tt.registration.Confidential || client.Name != tt.registration.Name {
+					t.Fatal("Registered client was incorrect", client)
+				}
+			}
+		})
+	}
+}
+
+func TestOAuthConsents(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		clientID		string
+	}{
+		{
+			name: "Successful listing",
+			method: "GET",
+			expectedCode: 200,
+		},
+		{
+			name: "Successful withdrawal",
+			method: "DELETE",
+			expectedCode: 200,
+			clientID: "public_client",
+		},
+		{
+			name: "No consent given to client",
+			method: "DELETE",
+			expectedCode: 404,
+			clientID: "confidential_client",
+		},
+		{
+			name: "Client unknown",
+			method: "DELETE",
+			expectedCode: 404,
+			clientID: "unknown_client",
+		},
+		{
+			name: "Client id missing",
+			method: "DELETE",
+			expectedCode: 400,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "POST",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode != 405 {
+				ExpectUserQuery(mock, "test_user", 1)
+			}
+			if tt.method == "GET" && tt.expectedCode == 200 {
+				mock.ExpectQuery("SELECT oauth_client.client_id, oauth_client.name, oauth_consent.scope, oauth_consent.created_at FROM oauth_consent JOIN oauth_client ON oauth_client.id = oauth_consent.client_id WHERE oauth_consent.user_id=?").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"client_id", "name", "scope", "created_at"}).AddRow("public_client", "Test client", "download:read", time.Now()))
+			}
+			if tt.clientID != "" {
+				ExpectOAuthClientQuery(mock, tt.clientID)
+			}
+			if tt.clientID == "public_client" || tt.clientID == "confidential_client" {
+				var affected int64
+				if tt.expectedCode == 200 {
+					affected = 1
+				}
+				mock.ExpectExec("DELETE FROM oauth_consent WHERE user_id=? AND client_id=?").WithArgs(1, 7).WillReturnResult(sqlmock.NewResult(0, affected))
+			}
+
+			req, err := http.NewRequest(tt.method, "/oauth/consents", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			tokenString, _ := CreateJWT(testUser)
+			req.Header.Set("Authorization", "Bearer " + tokenString)
+			req.Header.Set("Client-Id", tt.clientID)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), OAuthConsents)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 && tt.method == "GET" {
+				var consents []OAuthConsent
+				if err := json.NewDecoder(resp.Body).Decode(&consents); err != nil { t.Fatal(err.Error()) }
+				if len(consents) != 1 || consents[0].ClientID != "public_client" || consents[0].Scope != "download:read" {
+					t.Fatal("Listed consents were incorrect", consents)
+				}
+			}
+		})
+	}
+}
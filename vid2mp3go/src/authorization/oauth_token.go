@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	AuditLog "microservices/authorization/audit_log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Successful response of the /token endpoint
+type OAuthTokenResponse struct {
+	AccessToken	string	`json:"access_token"`
+	TokenType	string	`json:"token_type"`
+	ExpiresIn	int64	`json:"expires_in"`
+	Scope		string	`json:"scope"`
+}
+
+// Token endpoint of the OAuth authorization server. Supports the authorization_code
+// grant, which requires the PKCE code_verifier, and the client_credentials grant for
+// confidential clients. Clients authenticate with HTTP Basic auth or the client_id and
+// client_secret form parameters. Public clients only send their client_id. The access
+// token is a JWT like the ones returned by /login, whose permissions are limited to the
+// granted scopes and which has a client_id claim. No refresh token is issued, clients
+// have to go through /authorize again once the access token has expired.
+func Token(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Token request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	client, ok := AuthenticateOAuthClient(w, r)
+	if !ok { return }
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		ExchangeAuthorizationCode(users, w, r, client)
+	case "client_credentials":
+		GrantClientCredentials(users, w, r, client)
+	default:
+		SendOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// Authenticates the OAuth client of a /token request. Confidential clients have to send
+// their secret, public clients must not send one. If authentication fails, an
+// invalid_client error is sent and ok is false.
+func AuthenticateOAuthClient(w http.ResponseWriter, r *http.Request) (client OAuthClient, ok bool) {
+	clientID, clientSecret := GetOAuthClientCredentials(r)
+	client, err := CheckOAuthClient(clientID, clientSecret)
+	if errors.Is(err, errInvalidClient) {
+		SendOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return OAuthClient{}, false
+	} else if err != nil {
+		SendStatus.InternalServerError(w)
+		return OAuthClient{}, false
+	}
+	return client, true
+}
+
+// Returns the client ID and secret of a request, sent with HTTP Basic auth or as the
+// client_id and client_secret form parameters.
+func GetOAuthClientCredentials(r *http.Request) (clientID string, clientSecret string) {
+	clientID, clientSecret, basic := r.BasicAuth()
+	if !basic {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	return clientID, clientSecret
+}
+
+// Returned by CheckOAuthClient if the client is unknown or its secret is wrong
+var errInvalidClient = errors.New("OAuth client is unknown or its secret is wrong")
+
+// Returns the OAuth client with the given ID, if the secret is the client's secret.
+// Confidential clients have to send their secret, public clients must not send one.
+func CheckOAuthClient(clientID string, clientSecret string) (client OAuthClient, err error) {
+	if clientID == "" {
+		return OAuthClient{}, errInvalidClient
+	}
+	client, err = GetOAuthClient(clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OAuthClient{}, errInvalidClient
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch OAuth client from DB:\n%s", err.Error())
+		return OAuthClient{}, err
+	}
+	if client.IsConfidential() {
+		if subtle.ConstantTimeCompare([]byte(SecureToken.Hash(clientSecret)), []byte(client.ClientSecretHash.String)) != 1 {
+			return OAuthClient{}, errInvalidClient
+		}
+	} else if clientSecret != "" {
+		return OAuthClient{}, errInvalidClient
+	}
+	return client, nil
+}
+
+// Exchanges an authorization code issued by /authorize for an access token. The code has
+// to belong to the client, match the redirect_uri it was issued for and the PKCE code
+// challenge, and can be used only once.
+func ExchangeAuthorizationCode(users UserStore.Store, w http.ResponseWriter, r *http.Request, client OAuthClient) {
+	code, redirectURI, codeVerifier := r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier")
+	if code == "" || codeVerifier == "" {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request", "")
+		return
+	}
+	var id, codeClientID, userID int64
+	var codeRedirectURI, scope, codeChallenge string
+	var expiresAt time.Time
+	var used bool
+	err := db.QueryRow(
+		"SELECT id, client_id, user_id, redirect_uri, scope, code_challenge, expires_at, used FROM oauth_authorization_code WHERE code_hash=?",
+		SecureToken.Hash(code),
+	).Scan(&id, &codeClientID, &userID, &codeRedirectURI, &scope, &codeChallenge, &expiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch authorization code from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if codeClientID != client.ID || used || time.Now().After(expiresAt) || redirectURI != codeRedirectURI || !VerifyCodeChallenge(codeVerifier, codeChallenge) {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	// Only one request can use the code, even if several arrive at once
+	res, err := db.Exec("UPDATE oauth_authorization_code SET used=TRUE WHERE id=? AND used=FALSE", id)
+	if err != nil {
+		log.Printf("Error occured while trying to use authorization code:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		log.Printf("Error occured while trying to use authorization code:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if n != 1 {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	SendOAuthToken(users, w, r, client, userID, ParseScope(scope))
+}
+
+// Issues an access token to a confidential client acting on behalf of the user that
+// registered it. The requested scope defaults to every scope the client may request.
+func GrantClientCredentials(users UserStore.Store, w http.ResponseWriter, r *http.Request, client OAuthClient) {
+	if !client.IsConfidential() {
+		SendOAuthError(w, http.StatusBadRequest, "unauthorized_client", "")
+		return
+	}
+	scopes := ParseScope(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !ScopesCovered(scopes, client.Scopes) {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_scope", "")
+		return
+	}
+	SendOAuthToken(users, w, r, client, client.OwnerID, scopes)
+}
+
+// Sends an access token for the given user, limited to the given scopes, to the client.
+// The user's permissions are fetched from the DB, so a scope only grants a permission
+// the user currently has. Disabled users get no tokens. The outcome is recorded in the
+// audit log.
+func SendOAuthToken(users UserStore.Store, w http.ResponseWriter, r *http.Request, client OAuthClient, userID int64, scopes []string) {
+	user, err := users.FindByID(userID)
+	if errors.Is(err, UserStore.ErrUserNotFound) || (err == nil && user.Disabled) {
+		RecordAuditEvent(r, AuditLog.Token, user.Email, AuditLog.Failure)
+		SendOAuthError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	_, permissions, err := GetUserRoles(userID)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch roles from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	tokenString, err := CreateJWT(User{
+		ID: userID,
+		Username: user.Email,
+		Permissions: ScopedPermissions(permissions, scopes),
+		EmailVerified: user.Verified,
+		ClientID: client.ClientID,
+	})
+	if err != nil {
+		log.Printf("Error occured while trying to create JWT:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Access token issued to OAuth client %s for user %s", client.ClientID, user.Email)
+	RecordAuditEvent(r, AuditLog.Token, user.Email, AuditLog.Success)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(OAuthTokenResponse{
+		AccessToken: tokenString,
+		TokenType: "Bearer",
+		ExpiresIn: int64(accessTokenTTL / time.Second),
+		Scope: strings.Join(scopes, " "),
+	})
+}
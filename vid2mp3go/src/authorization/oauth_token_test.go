@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectAuthorizationCode = "SELECT id, client_id, user_id, redirect_uri, scope, code_challenge, expires_at, used FROM oauth_authorization_code WHERE code_hash=?"
+
+func TestToken(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name				string
+		method				string
+		expectedCode		int
+		expectedError		string
+		grantType			string
+		clientID			string
+		clientSecret		string
+		basicAuth			bool
+		codeVerifier		string
+		redirectURI			string
+		codeExpired			bool
+		codeUsed			bool
+		scope				string
+		expectedPermissions	[]string
+	}{
+		{
+			name: "Successful code exchange by public client",
+			method: "POST",
+			expectedCode: 200,
+			grantType: "authorization_code",
+			clientID: "public_client",
+			scope: "download:read",
+			expectedPermissions: []string{"download:read"},
+		},
+		{
+			name: "Successful code exchange by confidential client",
+			method: "POST",
+			expectedCode: 200,
+			grantType: "authorization_code",
+			clientID: "confidential_client",
+			clientSecret: "client_secret",
+			basicAuth: true,
+			scope: "upload:write download:read",
+			expectedPermissions: []string{"upload:write", "download:read"},
+		},
+		{
+			name: "Code verifier does not match",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "invalid_grant",
+			grantType: "authorization_code",
+			clientID: "public_client",
+			codeVerifier: strings.Repeat("a", 43),
+		},
+		{
+			name: "Redirect URI does not match",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "invalid_grant",
+			grantType: "authorization_code",
+			clientID: "public_client",
+			redirectURI: "https://client.example/other",
+		},
+		{
+			name: "Code expired",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "invalid_grant",
+			grantType: "authorization_code",
+			clientID: "public_client",
+			codeExpired: true,
+		},
+		{
+			name: "Code already used",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "invalid_grant",
+			grantType: "authorization_code",
+			clientID: "public_client",
+			codeUsed: true,
+		},
+		{
+			name: "Code used concurrently",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "invalid_grant",
+			grantType: "authorization_code",
+			clientID: "public_client",
+		},
+		{
+			name: "Successful client credentials grant",
+			method: "POST",
+			expectedCode: 200,
+			grantType: "client_credentials",
+			clientID: "confidential_client",
+			clientSecret: "client_secret",
+			expectedPermissions: []string{"upload:write", "download:read"},
+		},
+		{
+			name: "Client credentials grant with narrower scope",
+			method: "POST",
+			expectedCode: 200,
+			grantType: "client_credentials",
+			clientID: "confidential_client",
+			clientSecret: "client_secret",
+			scope: "download:read",
+			expectedPermissions: []string{"download:read"},
+		},
+		{
+			name: "Client credentials grant with unsupported scope",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "invalid_scope",
+			grantType: "client_credentials",
+			clientID: "confidential_client",
+			clientSecret: "client_secret",
+			scope: "admin",
+		},
+		{
+			name: "Client credentials grant by public client",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "unauthorized_client",
+			grantType: "client_credentials",
+			clientID: "public_client",
+		},
+		{
+			name: "Client secret incorrect",
+			method: "POST",
+			expectedCode: 401,
+			expectedError: "invalid_client",
+			grantType: "client_credentials",
+			clientID: "confidential_client",
+			clientSecret: "wrong_secret",
+			basicAuth: true,
+		},
+		{
+			name: "Client secret missing",
+			method: "POST",
+			expectedCode: 401,
+			expectedError: "invalid_client",
+			grantType: "client_credentials",
+			clientID: "confidential_client",
+		},
+		{
+			name: "Client unknown",
+			method: "POST",
+			expectedCode: 401,
+			expectedError: "invalid_client",
+			grantType: "authorization_code",
+			clientID: "unknown_client",
+		},
+		{
+			name: "Grant type unsupported",
+			method: "POST",
+			expectedCode: 400,
+			expectedError: "unsupported_grant_type",
+			grantType: "password",
+			clientID: "public_client",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.codeVerifier == "" {
+				tt.codeVerifier = testCodeVerifier
+			}
+			if tt.redirectURI == "" {
+				tt.redirectURI = "https://client.example/cb"
+			}
+			if tt.clientID != "" {
+				ExpectOAuthClientQuery(mock, tt.clientID)
+			}
+			clientAuthenticated := tt.clientID != "" && tt.expectedCode != 401
+			if clientAuthenticated && tt.grantType == "authorization_code" {
+				expiresAt := time.Now().Add(time.Minute)
+				if tt.codeExpired {
+					expiresAt = time.Now().Add(-time.Minute)
+				}
+				mock.ExpectQuery(selectAuthorizationCode).WithArgs(SecureToken.Hash("test_code")).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "user_id", "redirect_uri", "scope", "code_challenge", "expires_at", "used"}).
+						AddRow(5, 7, 1, "https://client.example/cb", tt.scope, testCodeChallenge, expiresAt, tt.codeUsed))
+				if tt.expectedCode == 200 || tt.name == "Code used concurrently" {
+					var affected int64
+					if tt.expectedCode == 200 {
+						affected = 1
+					}
+					mock.ExpectExec("UPDATE oauth_authorization_code SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, affected))
+				}
+			}
+			if tt.expectedCode == 200 {
+				mock.ExpectQuery(selectUserByID).WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+				ExpectUserRolesQuery(mock, 1)
+			}
+
+			form := url.Values{
+				"grant_type": {tt.grantType},
+				"code": {"test_code"},
+				"redirect_uri": {tt.redirectURI},
+				"code_verifier": {tt.codeVerifier},
+			}
+			if tt.scope != "" && tt.grantType == "client_credentials" {
+				form.Set("scope", tt.scope)
+			}
+			if !tt.basicAuth {
+				form.Set("client_id", tt.clientID)
+				if tt.clientSecret != "" {
+					form.Set("client_secret", tt.clientSecret)
+				}
+			}
+			req, err := http.NewRequest(tt.method, "/token", strings.NewReader(form.Encode()))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.basicAuth {
+				req.SetBasicAuth(tt.clientID, tt.clientSecret)
+			}
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Token)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if tt.expectedError != "" {
+				var oauthError OAuthError
+				if err := json.NewDecoder(resp.Body).Decode(&oauthError); err != nil { t.Fatal(err.Error()) }
+				if oauthError.Error != tt.expectedError { t.Fatal("Error was incorrect", oauthError) }
+			}
+			if resp.Code == 200 {
+				if resp.Header().Get("Cache-Control") != "no-store" { t.Fatal("Cache-Control header was incorrect") }
+				var token OAuthTokenResponse
+				if err := json.NewDecoder(resp.Body).Decode(&token); err != nil { t.Fatal(err.Error()) }
+				if token.TokenType != "Bearer" || token.ExpiresIn <= 0 || token.Scope != strings.Join(tt.expectedPermissions, " ") {
+					t.Fatal("Token response was incorrect", token)
+				}
+				claims, err := ParseJWT(token.AccessToken)
+				if err != nil { t.Fatal(err.Error()) }
+				permissions := GetStringsClaim(claims, "permissions")
+				if claims["client_id"] != tt.clientID || claims["username"] != "test_user" || !slices.Equal(permissions, tt.expectedPermissions) {
+					t.Fatal("Claims were incorrect", claims)
+				}
+			}
+		})
+	}
+}
+
+// JWTs issued to OAuth clients must not be usable for managing the user's account
+func TestOAuthTokenRejectedForAccountManagement(t *testing.T) {
+	revocationStore = RevocationStore.NewMemoryStore()
+	delegatedUser := testUser
+	delegatedUser.ClientID = "public_client"
+	tokenString, err := CreateJWT(delegatedUser)
+	if err != nil { t.Fatal(err.Error()) }
+	tests := []struct {
+		method	string
+		handler	UserHandler
+	}{
+		{"GET", ApiKeys},
+		{"POST", OAuthClients},
+		{"GET", OAuthConsents},
+		{"GET", Authorize},
+		{"POST", EnrollMfa},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "/", nil)
+		if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+		req.Header.Set("Authorization", "Bearer " + tokenString)
+		resp := httptest.NewRecorder()
+		WithUserStore(MockUserStore(), tt.handler).ServeHTTP(resp, req)
+		if resp.Code != 403 { t.Fatal("Status was incorrect", resp.Code) }
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	AuditLog "microservices/authorization/audit_log"
+	OidcClient "microservices/authorization/oidc_client"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Lifetime of a pending OIDC login, i.e. how long the user has to log in at the IdP.
+// Configured with the OIDC_LOGIN_TTL env variable.
+var oidcLoginTTL = GetDurationEnv("OIDC_LOGIN_TTL", 10*time.Minute)
+
+// Lifetime of a pending link of an IdP identity to an existing user, i.e. how long the
+// user has to confirm it. Configured with the OIDC_LINK_TTL env variable.
+var oidcLinkTTL = GetDurationEnv("OIDC_LINK_TTL", 15*time.Minute)
+
+// Relying party of the external OpenID Connect IdP, configured with the OIDC_ISSUER,
+// OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URI env variables. The redirect
+// URI is the gateway's /login/oidc/callback. nil if OIDC_ISSUER is not set, which
+// disables federated login.
+var oidcProvider = NewOidcProvider()
+
+// Returned by ResolveOidcUser if the ID token belongs to an unknown identity whose
+// email address the IdP has not verified, so it can neither be linked nor provisioned.
+var errOidcEmailUnverified = errors.New("email address of OIDC identity is not verified")
+
+// Returned by ResolveOidcUser if the ID token belongs to an unknown identity that would
+// have to be provisioned, but registration is not open.
+var errOidcRegistrationClosed = errors.New("users can not be provisioned outside of open registration mode")
+
+// Returned by ResolveOidcUser, along with the user's ID, if the ID token belongs to an
+// unknown identity with the email address of an existing user. The identity is only
+// linked to the user once the user has confirmed the link at /login/oidc/link.
+var errOidcLinkRequired = errors.New("OIDC identity has to be linked by the existing user")
+
+// Creates the relying party of the IdP configured in the env variables, if there is one.
+func NewOidcProvider() *OidcClient.Provider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	return OidcClient.NewProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), os.Getenv("OIDC_REDIRECT_URI"))
+}
+
+// Starts a login through the external OIDC IdP by redirecting the user to the IdP's
+// authorization endpoint. The state, nonce and PKCE code verifier of the login are
+// stored, so that any replica can complete it at /login/oidc/callback.
+// If federated login is not configured, 404 is returned.
+func OidcLogin(w http.ResponseWriter, r *http.Request) {
+	log.Println("OidcLogin request received with method", r.Method)
+	if r.Method != "GET" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if oidcProvider == nil {
+		SendStatus.NotFound(w)
+		return
+	}
+	var state, nonce, codeVerifier string
+	var err error
+	for _, value := range []*string{&state, &nonce, &codeVerifier} {
+		if *value, err = SecureToken.Generate(32); err != nil {
+			log.Printf("Error occured while generating OIDC login parameters:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+	}
+	authURL, err := oidcProvider.AuthCodeURL(state, nonce, OidcClient.CodeChallenge(codeVerifier))
+	if err != nil {
+		log.Printf("Error occured while trying to discover OIDC provider:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(
+		"INSERT INTO oidc_login (state_hash, nonce, code_verifier, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		SecureToken.Hash(state), nonce, codeVerifier, now.Add(oidcLoginTTL), now,
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to insert OIDC login into DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Redirect URI of federated logins. Completes the login started at /login/oidc by
+// exchanging the code the IdP sent back for an ID token and verifying it. The IdP's
+// identity is mapped to a user through the user_identity table. Unknown identities are
+// provisioned as a new user with the default role, but only if the IdP has verified the
+// email address. If a user with that email address exists already, the identity is not
+// linked to it right away. Instead 409 is returned with a link token in the Oidc-Link
+// header, which the user has to confirm at /login/oidc/link. Federated users are treated
+// as verified. A JWT and a refresh token are returned like after a password login, so
+// users that have enabled MFA get an MFA challenge token with 202 instead.
+func OidcCallback(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("OidcCallback request received with method", r.Method)
+	if r.Method != "GET" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if oidcProvider == nil {
+		SendStatus.NotFound(w)
+		return
+	}
+	query := r.URL.Query()
+	if idpError := query.Get("error"); idpError != "" {
+		log.Printf("OIDC login failed at the IdP with error %s", idpError)
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	state, code := query.Get("state"), query.Get("code")
+	if state == "" || code == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	nonce, codeVerifier, ok, err := UseOidcLogin(state)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch OIDC login from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if !ok {
+		log.Println("OIDC login state is unknown, expired or already used")
+		SendStatus.BadRequest(w)
+		return
+	}
+	idToken, err := oidcProvider.Exchange(code, codeVerifier)
+	if err != nil {
+		log.Printf("Error occured while exchanging OIDC authorization code:\n%s", err.Error())
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	claims, err := oidcProvider.VerifyIDToken(idToken, nonce)
+	if errors.Is(err, OidcClient.ErrInvalidIDToken) {
+		log.Printf("ID token was rejected:\n%s", err.Error())
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while verifying ID token:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	userID, username, err := ResolveOidcUser(users, oidcProvider.Issuer, claims)
+	if errors.Is(err, errOidcEmailUnverified) {
+		log.Printf("OIDC identity %s has no verified email address", claims.Subject)
+		SendStatus.Forbidden(w)
+		return
+	} else if errors.Is(err, errOidcRegistrationClosed) {
+		log.Printf("OIDC identity %s rejected in %s registration mode", claims.Subject, registrationMode)
+		SendStatus.Forbidden(w)
+		return
+	} else if errors.Is(err, errOidcLinkRequired) {
+		if err := SendOidcLinkChallenge(w, userID, oidcProvider.Issuer, claims.Subject); err != nil {
+			log.Printf("Error occured while trying to create OIDC link:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+		}
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to resolve OIDC identity:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	mfaEnabled, err := IsMfaEnabled(userID)
+	if err != nil {
+		log.Printf("Error occured while checking MFA of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if mfaEnabled {
+		if err := SendMfaChallenge(w, userID); err != nil {
+			log.Printf("Error occured while trying to create MFA challenge:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+		}
+		return
+	}
+	RecordLoginSuccess(username)
+	if err := SendAuditedTokens(users, w, r, AuditLog.Login, userID, username, ""); err != nil {
+		log.Printf("Error occured while trying to create tokens:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+}
+
+// Marks the pending OIDC login with the given state as used and returns its nonce and
+// PKCE code verifier. ok is false if the login is unknown, expired or already used.
+func UseOidcLogin(state string) (nonce string, codeVerifier string, ok bool, err error) {
+	var id int64
+	var expiresAt time.Time
+	var used bool
+	err = db.QueryRow(
+		"SELECT id, nonce, code_verifier, expires_at, used FROM oidc_login WHERE state_hash=?",
+		SecureToken.Hash(state),
+	).Scan(&id, &nonce, &codeVerifier, &expiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", false, nil
+	} else if err != nil {
+		return "", "", false, err
+	}
+	if used || time.Now().After(expiresAt) {
+		return "", "", false, nil
+	}
+	// Only one request can complete the login, even if several arrive at once
+	res, err := db.Exec("UPDATE oidc_login SET used=TRUE WHERE id=? AND used=FALSE", id)
+	if err != nil {
+		return "", "", false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", "", false, err
+	} else if n != 1 {
+		return "", "", false, nil
+	}
+	return nonce, codeVerifier, true, nil
+}
+
+// Returns the user the IdP's identity belongs to, provisioning it if needed. If the
+// identity would have to be linked to an existing user, the user's ID is returned
+// along with errOidcLinkRequired.
+func ResolveOidcUser(users UserStore.Store, issuer string, claims OidcClient.IDTokenClaims) (userID int64, username string, err error) {
+	err = db.QueryRow(
+		"SELECT user_id FROM user_identity WHERE issuer=? AND subject=?",
+		issuer, claims.Subject,
+	).Scan(&userID)
+	if err == nil {
+		user, err := users.FindByID(userID)
+		return user.ID, user.Email, err
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", err
+	}
+	if !claims.EmailVerified || !IsValidEmail(claims.Email) {
+		return 0, "", errOidcEmailUnverified
+	}
+	user, err := users.FindByEmail(claims.Email)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		if registrationMode != registrationOpen {
+			return 0, "", errOidcRegistrationClosed
+		}
+		userID, err = ProvisionOidcUser(users, issuer, claims)
+		if err != nil {
+			return 0, "", err
+		}
+		log.Printf("Provisioned user %s for OIDC identity %s", claims.Email, claims.Subject)
+		return userID, claims.Email, nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	return user.ID, claims.Email, errOidcLinkRequired
+}
+
+// Stores a pending link of the IdP's identity to the existing user and sends its token
+// in the Oidc-Link header with 409, instead of sending the user's tokens. Matching email
+// addresses alone do not prove that the identity belongs to the user, so the user has
+// to confirm the link at /login/oidc/link.
+func SendOidcLinkChallenge(w http.ResponseWriter, userID int64, issuer string, subject string) (err error) {
+	linkToken, err := SecureToken.Generate(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(
+		"INSERT INTO oidc_link (token_hash, user_id, issuer, subject, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		SecureToken.Hash(linkToken), userID, issuer, subject, now.Add(oidcLinkTTL), now,
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf("Link of OIDC identity %s to user %d pending", subject, userID)
+	w.Header().Set("Oidc-Link", linkToken)
+	w.WriteHeader(http.StatusConflict)
+	fmt.Fprintf(w, "Account exists already. Log in and confirm the link.")
+	return nil
+}
+
+// Confirms the pending link with the token in the POST request's Oidc-Link header. The
+// request needs the JWT of the user the identity is linked to in the Authorization
+// header and the user's password in the Password header, so that only the user can
+// link an identity to its account. Afterwards the user can log in through the IdP.
+func ConfirmOidcLink(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ConfirmOidcLink request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	linkToken := r.Header.Get("Oidc-Link")
+	if linkToken == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	username := GetStringClaim(claims, "username")
+	userID, ok := CheckCurrentPassword(users, w, r, username, r.Header.Get("Password"))
+	if !ok { return }
+	linked, err := LinkOidcIdentity(users, linkToken, userID)
+	if errors.Is(err, errOidcIdentityLinked) {
+		SendStatus.Conflict(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to link OIDC identity to user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if !linked {
+		log.Printf("OIDC link of user %s is unknown, expired, used or belongs to another user", username)
+		SendStatus.NotFound(w)
+		return
+	}
+	log.Printf("Linked OIDC identity to user %s", username)
+	fmt.Fprintf(w, "Identity linked.")
+}
+
+// Returned by LinkOidcIdentity if the identity has been linked to a user already
+var errOidcIdentityLinked = errors.New("OIDC identity is linked to a user already")
+
+// Links the identity of the pending link with the given token to the user and marks the
+// link as used. Since the IdP has verified the user's email address, the user is marked
+// as verified afterwards. Nothing is changed and linked is false if the link is unknown,
+// expired, already used or belongs to another user. Identities that have been linked
+// already return errOidcIdentityLinked.
+func LinkOidcIdentity(users UserStore.Store, linkToken string, userID int64) (linked bool, err error) {
+	var id, linkUserID int64
+	var issuer, subject string
+	var expiresAt time.Time
+	var used bool
+	err = db.QueryRow(
+		"SELECT id, user_id, issuer, subject, expires_at, used FROM oidc_link WHERE token_hash=?",
+		SecureToken.Hash(linkToken),
+	).Scan(&id, &linkUserID, &issuer, &subject, &expiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if linkUserID != userID || used || time.Now().After(expiresAt) {
+		return false, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE oidc_link SET used=TRUE WHERE id=? AND used=FALSE", id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n != 1 {
+		return false, nil
+	}
+	err = InsertUserIdentity(tx, userID, issuer, subject)
+	if UserStore.IsDuplicateEntry(err) {
+		return false, errOidcIdentityLinked
+	} else if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	verified := true
+	return true, users.Update(userID, UserStore.Changes{Verified: &verified})
+}
+
+// Creates a verified user with the default role for the IdP's identity. The user gets
+// a random password, which is never revealed, so that it can only log in through the
+// IdP unless it resets its password. If the identity can not be stored, the user is
+// deleted again.
+func ProvisionOidcUser(users UserStore.Store, issuer string, claims OidcClient.IDTokenClaims) (userID int64, err error) {
+	password, err := SecureToken.Generate(32)
+	if err != nil {
+		return 0, err
+	}
+	hash, err := hashParams.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+	user, err := users.Create(claims.Email, hash)
+	if err != nil {
+		return 0, err
+	}
+	verified := true
+	err = users.Update(user.ID, UserStore.Changes{Verified: &verified})
+	if err == nil {
+		err = InsertUserIdentity(db, user.ID, issuer, claims.Subject)
+	}
+	if err != nil {
+		if deleteErr := users.Delete(user.ID); deleteErr != nil {
+			log.Printf("Error occured while trying to delete user %s:\n%s", claims.Email, deleteErr.Error())
+		}
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+// Executes SQL statements, either directly on the DB or as part of a transaction
+type SQLExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// Stores that the IdP's identity with the given subject belongs to the given user.
+func InsertUserIdentity(exec SQLExecutor, userID int64, issuer string, subject string) (err error) {
+	_, err = exec.Exec(
+		"INSERT INTO user_identity (user_id, issuer, subject, created_at) VALUES (?, ?, ?, ?)",
+		userID, issuer, subject, time.Now().UTC(),
+	)
+	return err
+}
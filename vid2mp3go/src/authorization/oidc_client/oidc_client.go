@@ -0,0 +1,308 @@
+package oidcclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// Signing algorithms accepted for ID tokens
+var signingMethods = []string{"RS256", "ES256", "EdDSA"}
+
+// Minimum time between two fetches of the IdP's JWKS, so that tokens with unknown
+// kids can not make the relying party hammer the IdP
+const jwksRefetchInterval = time.Minute
+
+// The parts of an OpenID Provider's discovery document the relying party uses
+type Discovery struct {
+	Issuer					string	`json:"issuer"`
+	AuthorizationEndpoint	string	`json:"authorization_endpoint"`
+	TokenEndpoint			string	`json:"token_endpoint"`
+	JwksURI					string	`json:"jwks_uri"`
+}
+
+// The claims of a verified ID token
+type IDTokenClaims struct {
+	Email			string	`json:"email"`
+	EmailVerified	bool	`json:"email_verified"`
+	Nonce			string	`json:"nonce"`
+	Azp				string	`json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// A single key of a JSON Web Key Set
+type jwk struct {
+	Kty	string	`json:"kty"`
+	Kid	string	`json:"kid"`
+	Crv	string	`json:"crv"`
+	N	string	`json:"n"`
+	E	string	`json:"e"`
+	X	string	`json:"x"`
+	Y	string	`json:"y"`
+}
+
+// OpenID Connect relying party of a single identity provider. Uses the authorization
+// code flow with PKCE and client_secret_basic authentication. The discovery document
+// and the IdP's signing keys are fetched lazily and cached.
+type Provider struct {
+	Issuer			string
+	ClientID		string
+	ClientSecret	string
+	RedirectURI		string
+	HTTPClient		*http.Client
+	mu				sync.Mutex
+	discovery		*Discovery
+	keys			map[string]any
+	keysFetchedAt	time.Time
+}
+
+// Creates a relying party for the IdP with the given issuer identifier.
+func NewProvider(issuer string, clientID string, clientSecret string, redirectURI string) *Provider {
+	return &Provider{
+		Issuer: strings.TrimSuffix(issuer, "/"),
+		ClientID: clientID,
+		ClientSecret: clientSecret,
+		RedirectURI: redirectURI,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Returns the S256 PKCE code challenge of the given code verifier.
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Fetches the IdP's discovery document, unless it has been fetched before. The issuer
+// in the document has to match the configured issuer.
+func (p *Provider) Discover() (discovery Discovery, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+	resp, err := p.HTTPClient.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return Discovery{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Discovery{}, fmt.Errorf("discovery failed with status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return Discovery{}, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.Issuer {
+		return Discovery{}, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+		return Discovery{}, errors.New("discovery document is missing endpoints")
+	}
+	p.discovery = &discovery
+	return discovery, nil
+}
+
+// Returns the URL of the IdP's authorization endpoint that the user is sent to.
+func (p *Provider) AuthCodeURL(state string, nonce string, codeChallenge string) (authURL string, err error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURI)
+	query.Set("scope", "openid email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Exchanges an authorization code, received on the redirect URI, for an ID token.
+// The ID token is not verified, VerifyIDToken has to be called on it.
+func (p *Provider) Exchange(code string, codeVerifier string) (idToken string, err error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"authorization_code"},
+		"code": {code},
+		"redirect_uri": {p.RedirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken	string	`json:"id_token"`
+		Error	string	`json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, body.Error)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no ID token")
+	}
+	return body.IDToken, nil
+}
+
+// Verifies the signature, issuer, audience, expiration time and nonce of an ID token
+// and returns its claims. Errors caused by the token itself wrap ErrInvalidIDToken.
+func (p *Provider) VerifyIDToken(idToken string, nonce string) (claims IDTokenClaims, err error) {
+	if _, err := p.Discover(); err != nil {
+		return IDTokenClaims{}, err
+	}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	var keyErr error
+	_, err = parser.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.verificationKey(kid)
+		keyErr = err
+		return key, err
+	})
+	if keyErr != nil && !errors.Is(keyErr, ErrInvalidIDToken) {
+		return IDTokenClaims{}, keyErr
+	}
+	if err != nil {
+		return IDTokenClaims{}, fmt.Errorf("%w: %s", ErrInvalidIDToken, err.Error())
+	}
+	if claims.Subject == "" {
+		return IDTokenClaims{}, fmt.Errorf("%w: sub is missing", ErrInvalidIDToken)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return IDTokenClaims{}, fmt.Errorf("%w: nonce does not match", ErrInvalidIDToken)
+	}
+	if len(claims.Audience) > 1 && claims.Azp != p.ClientID {
+		return IDTokenClaims{}, fmt.Errorf("%w: azp does not match", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// Returns the IdP's public key with the given kid. The JWKS is fetched again when the kid
+// is unknown, in case the IdP has rotated its keys.
+func (p *Provider) verificationKey(kid string) (key any, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < jwksRefetchInterval {
+		return nil, fmt.Errorf("%w: unknown kid %q", ErrInvalidIDToken, kid)
+	}
+	keys, err := p.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	p.keys, p.keysFetchedAt = keys, time.Now()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown kid %q", ErrInvalidIDToken, kid)
+}
+
+// Fetches the IdP's JWKS. Keys of unsupported types are skipped. Must be called with
+// p.mu held, after discovery.
+func (p *Provider) fetchKeys() (keys map[string]any, err error) {
+	resp, err := p.HTTPClient.Get(p.discovery.JwksURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS failed with status %d", resp.StatusCode)
+	}
+	var jwks struct {
+		Keys	[]jwk	`json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+	keys = map[string]any{}
+	for _, k := range jwks.Keys {
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// Converts the JWK into a public key usable by the jwt package.
+func (k jwk) publicKey() (key any, err error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return key, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
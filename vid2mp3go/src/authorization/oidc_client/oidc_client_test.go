@@ -0,0 +1,141 @@
+package oidcclient
+
+import (
+	"errors"
+	OidcStandIn "microservices/authorization/oidc_stand_in"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+var testIdentity = OidcStandIn.Identity{Subject: "employee-42", Email: "staff@example.com", EmailVerified: true}
+
+func NewTestIdP(t *testing.T) (idp *OidcStandIn.IdP, provider *Provider) {
+	idp, err := OidcStandIn.New("auth", "auth_secret", testIdentity)
+	if err != nil { t.Fatal(err.Error()) }
+	t.Cleanup(idp.Close)
+	return idp, NewProvider(idp.Issuer(), "auth", "auth_secret", "https://gateway.example/login/oidc/callback")
+}
+
+// Follows the authorization URL to the stand-in and returns the code it redirects with
+func Authorize(t *testing.T, authURL string) (code string) {
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil { t.Fatal(err.Error()) }
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound { t.Fatal("Authorization request was not redirected", resp.StatusCode) }
+	if location.Query().Get("state") != "state" { t.Fatal("State was not returned", location) }
+	return location.Query().Get("code")
+}
+
+func TestCodeFlow(t *testing.T) {
+	_, provider := NewTestIdP(t)
+	authURL, err := provider.AuthCodeURL("state", "nonce", CodeChallenge(testCodeVerifier))
+	if err != nil { t.Fatal(err.Error()) }
+	code := Authorize(t, authURL)
+
+	// A wrong code verifier is rejected by the IdP
+	if _, err := provider.Exchange(code, testCodeVerifier[1:] + "a"); err == nil { t.Fatal("Exchange with wrong verifier succeeded") }
+
+	code = Authorize(t, authURL)
+	idToken, err := provider.Exchange(code, testCodeVerifier)
+	if err != nil { t.Fatal(err.Error()) }
+	claims, err := provider.VerifyIDToken(idToken, "nonce")
+	if err != nil { t.Fatal(err.Error()) }
+	if claims.Subject != testIdentity.Subject || claims.Email != testIdentity.Email || !claims.EmailVerified {
+		t.Fatal("Claims were incorrect", claims)
+	}
+
+	// Codes are single-use
+	if _, err := provider.Exchange(code, testCodeVerifier); err == nil { t.Fatal("Code was accepted twice") }
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	idp, _ := NewTestIdP(t)
+	provider := NewProvider(idp.Issuer() + "/other", "auth", "auth_secret", "https://gateway.example/login/oidc/callback")
+	if _, err := provider.Discover(); err == nil { t.Fatal("Discovery of another issuer succeeded") }
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp, provider := NewTestIdP(t)
+	tests := []struct {
+		name	string
+		modify	func(claims jwt.MapClaims)
+		valid	bool
+	}{
+		{
+			name: "Valid ID token",
+			modify: func(claims jwt.MapClaims) {},
+			valid: true,
+		},
+		{
+			name: "Audience of another client",
+			modify: func(claims jwt.MapClaims) { claims["aud"] = "other" },
+		},
+		{
+			name: "Multiple audiences without azp",
+			modify: func(claims jwt.MapClaims) { claims["aud"] = []string{"auth", "other"} },
+		},
+		{
+			name: "Multiple audiences with azp",
+			modify: func(claims jwt.MapClaims) { claims["aud"], claims["azp"] = []string{"auth", "other"}, "auth" },
+			valid: true,
+		},
+		{
+			name: "Issuer incorrect",
+			modify: func(claims jwt.MapClaims) { claims["iss"] = "https://attacker.example" },
+		},
+		{
+			name: "Nonce incorrect",
+			modify: func(claims jwt.MapClaims) { claims["nonce"] = "other" },
+		},
+		{
+			name: "Expired",
+			modify: func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		},
+		{
+			name: "Expiration time missing",
+			modify: func(claims jwt.MapClaims) { delete(claims, "exp") },
+		},
+		{
+			name: "Subject missing",
+			modify: func(claims jwt.MapClaims) { delete(claims, "sub") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.IDTokenClaims(testIdentity, "nonce")
+			tt.modify(claims)
+			idToken, err := idp.Sign(claims)
+			if err != nil { t.Fatal(err.Error()) }
+			_, err = provider.VerifyIDToken(idToken, "nonce")
+			if tt.valid && err != nil { t.Fatal(err.Error()) }
+			if !tt.valid && !errors.Is(err, ErrInvalidIDToken) { t.Fatal("ID token was not rejected", err) }
+		})
+	}
+}
+
+func TestVerifyIDTokenSignature(t *testing.T) {
+	idp, provider := NewTestIdP(t)
+	claims := idp.IDTokenClaims(testIdentity, "nonce")
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := provider.VerifyIDToken(unsigned, "nonce"); !errors.Is(err, ErrInvalidIDToken) { t.Fatal("Unsigned ID token was not rejected", err) }
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = OidcStandIn.Kid
+	symmetric, _ := token.SignedString([]byte("auth_secret"))
+	if _, err := provider.VerifyIDToken(symmetric, "nonce"); !errors.Is(err, ErrInvalidIDToken) { t.Fatal("HS256 ID token was not rejected", err) }
+
+	other, err := OidcStandIn.New("auth", "auth_secret", testIdentity)
+	if err != nil { t.Fatal(err.Error()) }
+	defer other.Close()
+	foreign, _ := other.Sign(claims)
+	if _, err := provider.VerifyIDToken(foreign, "nonce"); !errors.Is(err, ErrInvalidIDToken) { t.Fatal("ID token of another IdP was not rejected", err) }
+}
@@ -0,0 +1,207 @@
+package oidcstandin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// The kid of the stand-in's signing key
+const Kid = "stand-in-key"
+
+// The end user that the stand-in logs in on every authorization request
+type Identity struct {
+	Subject			string
+	Email			string
+	EmailVerified	bool
+}
+
+// An authorization code issued by the stand-in
+type code struct {
+	redirectURI		string
+	nonce			string
+	codeChallenge	string
+	identity		Identity
+}
+
+// In-process stand-in for an OpenID Connect identity provider, used for testing the
+// relying party without a real IdP. It serves discovery, a JWKS, an authorization
+// endpoint that immediately logs in Identity and redirects back with a code, and a
+// token endpoint that exchanges the code for an RS256 signed ID token. Confidential
+// clients authenticate with client_secret_basic and PKCE (S256) is required.
+type IdP struct {
+	Server			*httptest.Server
+	ClientID		string
+	ClientSecret	string
+	mu				sync.Mutex
+	identity		Identity
+	codes			map[string]code
+	key				*rsa.PrivateKey
+}
+
+// Starts a stand-in IdP for the given client. Close has to be called when done.
+func New(clientID string, clientSecret string, identity Identity) (idp *IdP, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	idp = &IdP{ClientID: clientID, ClientSecret: clientSecret, identity: identity, codes: map[string]code{}, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	return idp, nil
+}
+
+// Stops the stand-in's server.
+func (idp *IdP) Close() {
+	idp.Server.Close()
+}
+
+// Returns the issuer identifier of the stand-in, which is its base URL.
+func (idp *IdP) Issuer() string {
+	return idp.Server.URL
+}
+
+// Replaces the end user that is logged in on the next authorization requests.
+func (idp *IdP) SetIdentity(identity Identity) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.identity = identity
+}
+
+// Signs the given claims with the stand-in's key. Used by tests to craft ID tokens.
+func (idp *IdP) Sign(claims jwt.MapClaims) (tokenString string, err error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = Kid
+	return token.SignedString(idp.key)
+}
+
+// Returns the claims of a valid ID token for the given identity and nonce.
+func (idp *IdP) IDTokenClaims(identity Identity, nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss": idp.Issuer(),
+		"sub": identity.Subject,
+		"aud": idp.ClientID,
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"iat": now.Unix(),
+		"nonce": nonce,
+		"email": identity.Email,
+		"email_verified": identity.EmailVerified,
+	}
+}
+
+func (idp *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer": idp.Issuer(),
+		"authorization_endpoint": idp.Issuer() + "/authorize",
+		"token_endpoint": idp.Issuer() + "/token",
+		"jwks_uri": idp.Issuer() + "/jwks",
+		"response_types_supported": []string{"code"},
+		"subject_types_supported": []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+func (idp *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	publicKey := idp.key.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": Kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != idp.ClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURI.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	codeBytes := make([]byte, 16)
+	if _, err := rand.Read(codeBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := base64.RawURLEncoding.EncodeToString(codeBytes)
+	idp.mu.Lock()
+	idp.codes[c] = code{
+		redirectURI: query.Get("redirect_uri"),
+		nonce: query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		identity: idp.identity,
+	}
+	idp.mu.Unlock()
+	params := redirectURI.Query()
+	params.Set("code", c)
+	params.Set("state", query.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (idp *IdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != idp.ClientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(idp.ClientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	idp.mu.Lock()
+	c, found := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || c.redirectURI != r.PostFormValue("redirect_uri") || base64.RawURLEncoding.EncodeToString(sum[:]) != c.codeChallenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	idToken, err := idp.Sign(idp.IDTokenClaims(c.identity, c.nonce))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "stand-in-access-token",
+		"token_type": "Bearer",
+		"expires_in": 300,
+		"id_token": idToken,
+	})
+}
+
+func tokenError(w http.ResponseWriter, statusCode int, errorCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": errorCode})
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	LoginThrottle "microservices/authorization/login_throttle"
+	OidcClient "microservices/authorization/oidc_client"
+	OidcStandIn "microservices/authorization/oidc_stand_in"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectOidcLogin = "SELECT id, nonce, code_verifier, expires_at, used FROM oidc_login WHERE state_hash=?"
+const selectUserIdentity = "SELECT user_id FROM user_identity WHERE issuer=? AND subject=?"
+
+// Starts a stand-in IdP and configures it as the OIDC provider for the duration of the test.
+func WithStandInIdP(t *testing.T, identity OidcStandIn.Identity) (idp *OidcStandIn.IdP) {
+	idp, err := OidcStandIn.New("auth", "auth_secret", identity)
+	if err != nil { t.Fatal(err.Error()) }
+	provider := oidcProvider
+	oidcProvider = OidcClient.NewProvider(idp.Issuer(), "auth", "auth_secret", "https://gateway.example/login/oidc/callback")
+	t.Cleanup(func() {
+		oidcProvider = provider
+		idp.Close()
+	})
+	return idp
+}
+
+// Logs in at the stand-in IdP and returns the code it redirects back with.
+func AuthorizeAtStandIn(t *testing.T, state string, nonce string, codeVerifier string) (code string) {
+	authURL, err := oidcProvider.AuthCodeURL(state, nonce, OidcClient.CodeChallenge(codeVerifier))
+	if err != nil { t.Fatal(err.Error()) }
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil { t.Fatal(err.Error()) }
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil { t.Fatal(err.Error()) }
+	return location.Query().Get("code")
+}
+
+func TestOidcLogin(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	idp := WithStandInIdP(t, OidcStandIn.Identity{Subject: "employee-42"})
+	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.ExpectExec("INSERT INTO oidc_login (state_hash, nonce, code_verifier, expires_at, created_at) VALUES (?, ?, ?, ?, ?)").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req, err := http.NewRequest("GET", "/login/oidc", nil)
+	if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+	resp := httptest.NewRecorder()
+	handler := http.HandlerFunc(OidcLogin)
+	handler.ServeHTTP(resp, req)
+
+	if resp.Code != 302 { t.Fatal("Status was incorrect", resp.Code) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+	location, err := url.Parse(resp.Header().Get("Location"))
+	if err != nil { t.Fatal(err.Error()) }
+	query := location.Query()
+	if !strings.HasPrefix(location.String(), idp.Issuer() + "/authorize?") || query.Get("state") == "" || query.Get("nonce") == "" || query.Get("code_challenge") == "" {
+		t.Fatal("Redirect was incorrect", location)
+	}
+}
+
+func TestOidcLoginDisabled(t *testing.T) {
+	provider := oidcProvider
+	oidcProvider = nil
+	defer func() { oidcProvider = provider }()
+	for _, handler := range []http.HandlerFunc{OidcLogin, WithUserStore(MockUserStore(), OidcCallback)} {
+		req, err := http.NewRequest("GET", "/login/oidc/callback?state=state&code=code", nil)
+		if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		if resp.Code != 404 { t.Fatal("Status was incorrect", resp.Code) }
+	}
+}
+
+func TestOidcCallback(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		expectedCode	int
+		identity		OidcStandIn.Identity
+		linkedUser		bool
+		existingUser	bool
+		storedNonce		string
+		loginUsed		bool
+		loginExpired	bool
+		loginUnknown	bool
+		query			string
+		registrationMode	string
+		mfa				bool
+	}{
+		{
+			name: "Login with linked identity",
+			expectedCode: 200,
+			identity: OidcStandIn.Identity{Subject: "employee-42"},
+			linkedUser: true,
+		},
+		{
+			name: "MFA challenge for linked identity",
+			expectedCode: 202,
+			identity: OidcStandIn.Identity{Subject: "employee-42"},
+			linkedUser: true,
+			mfa: true,
+		},
+		{
+			name: "Link to existing user with the same email address required",
+			expectedCode: 409,
+			identity: OidcStandIn.Identity{Subject: "employee-42", Email: "test_user@example.com", EmailVerified: true},
+			existingUser: true,
+		},
+		{
+			name: "User provisioned just in time",
+			expectedCode: 200,
+			identity: OidcStandIn.Identity{Subject: "employee-42", Email: "test_user@example.com", EmailVerified: true},
+		},
+		{
+			name: "User not provisioned in invite-only registration mode",
+			expectedCode: 403,
+			identity: OidcStandIn.Identity{Subject: "employee-42", Email: "test_user@example.com", EmailVerified: true},
+			registrationMode: registrationInviteOnly,
+		},
+		{
+			name: "Link required in closed registration mode",
+			expectedCode: 409,
+			identity: OidcStandIn.Identity{Subject: "employee-42", Email: "test_user@example.com", EmailVerified: true},
+			existingUser: true,
+			registrationMode: registrationClosed,
+		},
+		{
+			name: "Email address not verified by IdP",
+			expectedCode: 403,
+			identity: OidcStandIn.Identity{Subject: "employee-42", Email: "test_user@example.com"},
+			existingUser: true,
+		},
+		{
+			name: "Nonce does not match",
+			expectedCode: 401,
+			identity: OidcStandIn.Identity{Subject: "employee-42"},
+			storedNonce: "other_nonce",
+		},
+		{
+			name: "Login already used",
+			expectedCode: 400,
+			loginUsed: true,
+		},
+		{
+			name: "Login expired",
+			expectedCode: 400,
+			loginExpired: true,
+		},
+		{
+			name: "State unknown",
+			expectedCode: 400,
+			loginUnknown: true,
+		},
+		{
+			name: "Code missing",
+			expectedCode: 400,
+			query: "state=state",
+		},
+		{
+			name: "Login failed at IdP",
+			expectedCode: 401,
+			query: "error=access_denied&state=state",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := WithStandInIdP(t, tt.identity)
+			if tt.registrationMode != "" { WithRegistrationMode(t, tt.registrationMode) }
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			state, nonce, codeVerifier := "state", "nonce", testCodeVerifier
+			if tt.query == "" {
+				tt.query = url.Values{"state": {state}, "code": {AuthorizeAtStandIn(t, state, nonce, codeVerifier)}}.Encode()
+			}
+			if tt.storedNonce == "" {
+				tt.storedNonce = nonce
+			}
+			if strings.Contains(tt.query, "code=") {
+				loginRows := sqlmock.NewRows([]string{"id", "nonce", "code_verifier", "expires_at", "used"})
+				expiresAt := time.Now().Add(time.Minute)
+				if tt.loginExpired {
+					expiresAt = time.Now().Add(-time.Minute)
+				}
+				if !tt.loginUnknown {
+					loginRows.AddRow(3, tt.storedNonce, codeVerifier, expiresAt, tt.loginUsed)
+				}
+				mock.ExpectQuery(selectOidcLogin).WithArgs(SecureToken.Hash(state)).WillReturnRows(loginRows)
+			}
+			if tt.identity.Subject != "" {
+				mock.ExpectExec("UPDATE oidc_login SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			if tt.identity.Subject != "" && tt.storedNonce == nonce {
+				identityRows := sqlmock.NewRows([]string{"user_id"})
+				if tt.linkedUser {
+					identityRows.AddRow(1)
+				}
+				mock.ExpectQuery(selectUserIdentity).WithArgs(idp.Issuer(), tt.identity.Subject).WillReturnRows(identityRows)
+				if tt.linkedUser {
+					mock.ExpectQuery(selectUserByID).WithArgs(1).
+						WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user@example.com", "", true, false, nil))
+				}
+			}
+			if tt.identity.EmailVerified {
+				userRows := sqlmock.NewRows(userColumns)
+				if tt.existingUser {
+					userRows.AddRow(1, tt.identity.Email, "", false, false, nil)
+				}
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.identity.Email).WillReturnRows(userRows)
+			}
+			if tt.identity.EmailVerified && tt.existingUser {
+				mock.ExpectExec("INSERT INTO oidc_link (token_hash, user_id, issuer, subject, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)").
+					WithArgs(sqlmock.AnyArg(), 1, idp.Issuer(), tt.identity.Subject, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			} else if tt.identity.EmailVerified && tt.registrationMode == "" {
+				ExpectCreateUser(mock, tt.identity.Email, 1)
+				mock.ExpectExec("UPDATE user SET verified=? WHERE id=?").WithArgs(true, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO user_identity (user_id, issuer, subject, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(1, idp.Issuer(), tt.identity.Subject, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			if tt.expectedCode == 200 || tt.expectedCode == 202 {
+				ExpectMfaEnabledQuery(mock, 1, tt.mfa)
+			}
+			if tt.mfa {
+				mock.ExpectExec("INSERT INTO mfa_challenge (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			} else if tt.expectedCode == 200 {
+				ExpectSendTokens(mock, 1, true)
+			}
+
+			req, err := http.NewRequest("GET", "/login/oidc/callback?" + tt.query, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), OidcCallback)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 {
+				claims, err := ParseJWT(resp.Body.String())
+				if err != nil { t.Fatal(err.Error()) }
+				if claims["username"] != "test_user@example.com" || resp.Header().Get("Refresh-Token") == "" {
+					t.Fatal("Tokens were incorrect", claims)
+				}
+			}
+			if resp.Code == 202 && (resp.Header().Get("Mfa-Challenge") == "" || resp.Header().Get("Refresh-Token") != "") {
+				t.Fatal("MFA was skipped")
+			}
+			if resp.Code == 409 && (resp.Header().Get("Oidc-Link") == "" || resp.Header().Get("Refresh-Token") != "") {
+				t.Fatal("Identity was linked without confirmation")
+			}
+		})
+	}
+}
+
+func TestConfirmOidcLink(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		linkToken		string
+		password		string
+		linkUserID		int64
+		linkUsed		bool
+		linkExpired		bool
+		linkUnknown		bool
+	}{
+		{
+			name: "Link confirmed",
+			method: "POST",
+			expectedCode: 200,
+			linkToken: "link_token",
+			password: "test_password",
+			linkUserID: 1,
+		},
+		{
+			name: "Link belongs to another user",
+			method: "POST",
+			expectedCode: 404,
+			linkToken: "link_token",
+			password: "test_password",
+			linkUserID: 2,
+		},
+		{
+			name: "Link already used",
+			method: "POST",
+			expectedCode: 404,
+			linkToken: "link_token",
+			password: "test_password",
+			linkUserID: 1,
+			linkUsed: true,
+		},
+		{
+			name: "Link expired",
+			method: "POST",
+			expectedCode: 404,
+			linkToken: "link_token",
+			password: "test_password",
+			linkUserID: 1,
+			linkExpired: true,
+		},
+		{
+			name: "Link unknown",
+			method: "POST",
+			expectedCode: 404,
+			linkToken: "link_token",
+			password: "test_password",
+			linkUnknown: true,
+		},
+		{
+			name: "Password incorrect",
+			method: "POST",
+			expectedCode: 401,
+			linkToken: "link_token",
+			password: "wrong_password",
+		},
+		{
+			name: "Link token missing",
+			method: "POST",
+			expectedCode: 400,
+			password: "test_password",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.method == "POST" && tt.linkToken != "" {
+				ExpectCurrentPasswordQuery(mock)
+			}
+			if tt.expectedCode == 200 || tt.expectedCode == 404 {
+				linkRows := sqlmock.NewRows([]string{"id", "user_id", "issuer", "subject", "expires_at", "used"})
+				expiresAt := time.Now().Add(time.Minute)
+				if tt.linkExpired {
+					expiresAt = time.Now().Add(-time.Minute)
+				}
+				if !tt.linkUnknown {
+					linkRows.AddRow(5, tt.linkUserID, "https://idp.example", "employee-42", expiresAt, tt.linkUsed)
+				}
+				mock.ExpectQuery("SELECT id, user_id, issuer, subject, expires_at, used FROM oidc_link WHERE token_hash=?").WithArgs(SecureToken.Hash(tt.linkToken)).WillReturnRows(linkRows)
+			}
+			if tt.expectedCode == 200 {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE oidc_link SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO user_identity (user_id, issuer, subject, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(1, "https://idp.example", "employee-42", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				mock.ExpectExec("UPDATE user SET verified=? WHERE id=?").WithArgs(true, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			tokenString, _ := CreateJWT(testUser)
+			req, err := http.NewRequest(tt.method, "/login/oidc/link", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", "Bearer " + tokenString)
+			req.Header.Set("Oidc-Link", tt.linkToken)
+			req.Header.Set("Password", tt.password)
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ConfirmOidcLink)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	AccountEvents "microservices/authorization/account_events"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"time"
+)
+
+// Roles of the members of an organization. Owners and admins can invite members and
+// remove members. Only the owner can change roles and delete the organization.
+const (
+	orgOwner  = "owner"
+	orgAdmin  = "admin"
+	orgMember = "member"
+)
+
+// Lifetime of invitations to join an organization. Configured with the
+// ORG_INVITATION_TTL env variable.
+var orgInvitationTTL = GetDurationEnv("ORG_INVITATION_TTL", 7*24*time.Hour)
+
+// An organization, as returned by the GET /orgs endpoint. Role is the one of the
+// user requesting the organization.
+type Organization struct {
+	ID			int64					`json:"id"`
+	Name		string					`json:"name"`
+	Role		string					`json:"role"`
+	CreatedAt	time.Time				`json:"created_at"`
+	Members		[]OrganizationMember	`json:"members"`
+}
+
+// A member of an organization, as listed by the GET /orgs endpoint
+type OrganizationMember struct {
+	Username	string		`json:"username"`
+	Role		string		`json:"role"`
+	JoinedAt	time.Time	`json:"joined_at"`
+}
+
+// The membership of the user of a JWT in an organization
+type Membership struct {
+	UserID			int64
+	Username		string
+	OrgID			int64
+	OrgName			string
+	OrgCreatedAt	time.Time
+	Role			string
+}
+
+// Checks that the request has a JWT of a user, like RequireAuthentication, and
+// returns the user's ID and username.
+func RequireUser(w http.ResponseWriter, r *http.Request) (userID int64, username string, ok bool) {
+	claims, ok := RequireAuthentication(w, r)
+	if !ok {
+		return 0, "", false
+	}
+	userID, err := GetUserIDClaim(claims)
+	if err != nil {
+		log.Println("JWT had an invalid sub claim")
+		SendStatus.InvalidCredentials(w)
+		return 0, "", false
+	}
+	return userID, GetStringClaim(claims, "username"), true
+}
+
+// Checks that the request has a JWT of a user that is a member of an organization and
+// returns the membership. If the user is not a member of any organization, 404 is sent.
+func RequireMembership(w http.ResponseWriter, r *http.Request) (membership Membership, ok bool) {
+	membership.UserID, membership.Username, ok = RequireUser(w, r)
+	if !ok {
+		return Membership{}, false
+	}
+	err := db.QueryRow(
+		"SELECT organization.id, organization.name, organization.created_at, organization_member.role FROM organization_member JOIN organization ON organization.id = organization_member.organization_id WHERE organization_member.user_id=?",
+		membership.UserID,
+	).Scan(&membership.OrgID, &membership.OrgName, &membership.OrgCreatedAt, &membership.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.NotFound(w)
+		return Membership{}, false
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch organization from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return Membership{}, false
+	}
+	return membership, true
+}
+
+// Endpoint for the organization of the user of the JWT in the Authorization header. A user
+// can be a member of one organization, whose members share their uploaded files.
+// GET returns the organization and its members as JSON. POST creates an organization
+// with the name given in the Name header, whose owner the user becomes. DELETE deletes
+// the organization, which only its owner can do. JWTs only get the org claim of a new
+// membership when they are refreshed.
+func Organizations(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Organizations request received with method", r.Method)
+	switch r.Method {
+	case "GET":
+		GetOrganization(users, w, r)
+	case "POST":
+		CreateOrganization(w, r)
+	case "DELETE":
+		DeleteOrganization(users, w, r)
+	default:
+		SendStatus.MethodNotAllowed(w)
+	}
+}
+
+// Sends the organization of the user and its members as JSON.
+func GetOrganization(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	membership, ok := RequireMembership(w, r)
+	if !ok { return }
+	rows, err := db.Query(
+		"SELECT user_id, role, joined_at FROM organization_member WHERE organization_id=? ORDER BY joined_at",
+		membership.OrgID,
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch organization members from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer rows.Close()
+	org := Organization{
+		ID: membership.OrgID,
+		Name: membership.OrgName,
+		Role: membership.Role,
+		CreatedAt: membership.OrgCreatedAt,
+		Members: []OrganizationMember{},
+	}
+	memberIDs := []int64{}
+	for rows.Next() {
+		var member OrganizationMember
+		var memberID int64
+		if err := rows.Scan(&memberID, &member.Role, &member.JoinedAt); err != nil {
+			log.Printf("Error occured while trying to fetch organization members from DB:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		org.Members = append(org.Members, member)
+		memberIDs = append(memberIDs, memberID)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error occured while trying to fetch organization members from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	for i, memberID := range memberIDs {
+		member, err := users.FindByID(memberID)
+		if err != nil && !errors.Is(err, UserStore.ErrUserNotFound) {
+			log.Printf("Error occured while trying to fetch organization members from DB:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		org.Members[i].Username = member.Email
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// Creates an organization with the name in the Name header and makes the user its owner.
+// If the name is taken or the user already is a member of an organization, 409 is sent.
+func CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, username, ok := RequireUser(w, r)
+	if !ok { return }
+	name := r.Header.Get("Name")
+	if name == "" || len(name) > 255 {
+		SendStatus.BadRequest(w)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error occured while trying to create organization:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	result, err := tx.Exec("INSERT INTO organization (name, created_at) VALUES (?, ?)", name, now)
+	if err == nil {
+		var orgID int64
+		if orgID, err = result.LastInsertId(); err == nil {
+			_, err = tx.Exec(
+				"INSERT INTO organization_member (user_id, organization_id, role, joined_at) VALUES (?, ?, ?, ?)",
+				userID, orgID, orgOwner, now,
+			)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if UserStore.IsDuplicateEntry(err) {
+		SendStatus.Conflict(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to create organization:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Organization %s created by %s", name, username)
+	fmt.Fprintf(w, "Organization created.")
+}
+
+// Deletes the organization of the user, if the user is its owner. The JWTs of its
+// members are revoked, so that they can not access the organization's files anymore.
+func DeleteOrganization(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	membership, ok := RequireMembership(w, r)
+	if !ok { return }
+	if membership.Role != orgOwner {
+		SendStatus.Forbidden(w)
+		return
+	}
+	members, err := GetOrganizationUsernames(users, membership.OrgID)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM organization WHERE id=?", membership.OrgID)
+	}
+	for i := 0; err == nil && i < len(members); i++ {
+		err = revocationStore.RevokeUser(members[i], time.Now())
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to delete organization %s:\n%s", membership.OrgName, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Organization %s deleted by %s", membership.OrgName, membership.Username)
+	fmt.Fprintf(w, "Organization deleted.")
+}
+
+// Returns the usernames of the members of the given organization. Members whose user
+// does not exist anymore are left out.
+func GetOrganizationUsernames(users UserStore.Store, orgID int64) (usernames []string, err error) {
+	rows, err := db.Query("SELECT user_id FROM organization_member WHERE organization_id=?", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	memberIDs := []int64{}
+	for rows.Next() {
+		var memberID int64
+		if err := rows.Scan(&memberID); err != nil {
+			return nil, err
+		}
+		memberIDs = append(memberIDs, memberID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	usernames = []string{}
+	for _, memberID := range memberIDs {
+		member, err := users.FindByID(memberID)
+		if errors.Is(err, UserStore.ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, member.Email)
+	}
+	return usernames, nil
+}
+
+// Endpoint for managing the members of the organization of the user of the JWT in the
+// Authorization header. POST gives the member in the Username header the role in the
+// Org-Role header, admin or member, which only the owner can do. DELETE removes the
+// member in the Username header. Owners can remove anyone, admins only members, and
+// every member but the owner can leave the organization by removing themselves.
+// Removing a member revokes its JWTs, so that the org claim can not be used anymore.
+func OrganizationMembers(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("OrganizationMembers request received with method", r.Method)
+	if r.Method != "POST" && r.Method != "DELETE" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	membership, ok := RequireMembership(w, r)
+	if !ok { return }
+	username, role := r.Header.Get("Username"), r.Header.Get("Org-Role")
+	if username == "" || (r.Method == "POST" && role != orgAdmin && role != orgMember) {
+		SendStatus.BadRequest(w)
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	userID := user.ID
+	var currentRole string
+	err = db.QueryRow(
+		"SELECT role FROM organization_member WHERE user_id=? AND organization_id=?",
+		userID, membership.OrgID,
+	).Scan(&currentRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch organization member from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+
+	if r.Method == "POST" {
+		if membership.Role != orgOwner || userID == membership.UserID {
+			SendStatus.Forbidden(w)
+			return
+		}
+		_, err = db.Exec("UPDATE organization_member SET role=? WHERE user_id=?", role, userID)
+	} else {
+		if !CanRemoveMember(membership, userID, currentRole) {
+			SendStatus.Forbidden(w)
+			return
+		}
+		_, err = db.Exec("DELETE FROM organization_member WHERE user_id=?", userID)
+		if err == nil {
+			err = revocationStore.RevokeUser(username, time.Now())
+		}
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to update member %s of organization %s:\n%s", username, membership.OrgName, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Member %s of organization %s updated by %s, %s %s", username, membership.OrgName, membership.Username, r.Method, role)
+	fmt.Fprintf(w, "Organization member updated.")
+}
+
+// Returns true if the member with the given membership may remove the member with the
+// given user ID and role from the organization.
+func CanRemoveMember(membership Membership, userID int64, role string) bool {
+	if role == orgOwner {
+		return false
+	}
+	return userID == membership.UserID || membership.Role == orgOwner || (membership.Role == orgAdmin && role == orgMember)
+}
+
+// Endpoint for inviting a user to the organization of the user of the JWT in the
+// Authorization header, which owners and admins can do. The invitation is sent to the
+// email address in the Username header of the POST request and grants the role in the
+// optional Org-Role header, member by default. Only owners can invite admins. The
+// single-use invitation token is stored as a hash and sent to the invited user by
+// publishing an organization invited event. The user does not need an account yet.
+func OrganizationInvitations(w http.ResponseWriter, r *http.Request) {
+	log.Println("OrganizationInvitations request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	membership, ok := RequireMembership(w, r)
+	if !ok { return }
+	username, role := r.Header.Get("Username"), r.Header.Get("Org-Role")
+	if role == "" {
+		role = orgMember
+	}
+	if !IsValidEmail(username) || (role != orgAdmin && role != orgMember) {
+		SendStatus.BadRequest(w)
+		return
+	}
+	if membership.Role != orgOwner && (membership.Role != orgAdmin || role == orgAdmin) {
+		SendStatus.Forbidden(w)
+		return
+	}
+	invitationToken, err := SecureToken.Generate(32)
+	if err != nil {
+		log.Printf("Error occured while trying to create invitation token:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(orgInvitationTTL)
+	_, err = db.Exec(
+		"INSERT INTO organization_invitation (organization_id, email, role, token_hash, invited_by, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		membership.OrgID, username, role, SecureToken.Hash(invitationToken), membership.UserID, expiresAt, now,
+	)
+	if err == nil {
+		err = accountEvents.Publish(AccountEvents.Event{
+			Type: AccountEvents.OrganizationInvited,
+			Username: username,
+			Token: invitationToken,
+			Organization: membership.OrgName,
+			ExpiresAt: expiresAt,
+		})
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to send invitation:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("User %s invited to organization %s by %s", username, membership.OrgName, membership.Username)
+	fmt.Fprintf(w, "Invitation sent.")
+}
+
+// Makes the user of the JWT in the Authorization header a member of the organization it
+// was invited to with the invitation token in the Invitation-Token header of a POST request.
+// The invitation has to be for the user's email address, and can only be used once.
+// If the user already is a member of an organization, 409 is sent.
+func AcceptOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	log.Println("AcceptOrganizationInvitation request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	userID, username, ok := RequireUser(w, r)
+	if !ok { return }
+	invitationToken := r.Header.Get("Invitation-Token")
+	if invitationToken == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var id, orgID int64
+	var email, role string
+	var expiresAt time.Time
+	err := db.QueryRow(
+		"SELECT id, organization_id, email, role, expires_at FROM organization_invitation WHERE token_hash=?",
+		SecureToken.Hash(invitationToken),
+	).Scan(&id, &orgID, &email, &role, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch invitation from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if time.Now().After(expiresAt) {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	if email != username {
+		log.Printf("User %s tried to accept the invitation of %s", username, email)
+		SendStatus.Forbidden(w)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error occured while trying to accept invitation:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		"INSERT INTO organization_member (user_id, organization_id, role, joined_at) VALUES (?, ?, ?, ?)",
+		userID, orgID, role, time.Now().UTC(),
+	)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM organization_invitation WHERE id=?", id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if UserStore.IsDuplicateEntry(err) {
+		SendStatus.Conflict(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to accept invitation:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("User %s joined organization %d as %s", username, orgID, role)
+	fmt.Fprintf(w, "Invitation accepted.")
+}
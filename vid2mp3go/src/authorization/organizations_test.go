@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	AccountEvents "microservices/authorization/account_events"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectMembership = "SELECT organization.id, organization.name, organization.created_at, organization_member.role FROM organization_member JOIN organization ON organization.id = organization_member.organization_id WHERE organization_member.user_id=?"
+const selectOrgMember = "SELECT role FROM organization_member WHERE user_id=? AND organization_id=?"
+const insertOrgMember = "INSERT INTO organization_member (user_id, organization_id, role, joined_at) VALUES (?, ?, ?, ?)"
+
+// Adds the expectation of the membership of "test_user" in the organization "team",
+// with ID 7, being fetched. If role is empty, the user is not a member of any organization.
+func ExpectMembershipQuery(mock sqlmock.Sqlmock, role string) {
+	rows := sqlmock.NewRows([]string{"id", "name", "created_at", "role"})
+	if role != "" {
+		rows.AddRow(7, "team", time.Now(), role)
+	}
+	mock.ExpectQuery(selectMembership).WithArgs(1).WillReturnRows(rows)
+}
+
+func TestOrganizations(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		role			string
+		orgName			string
+		duplicate		bool
+		expectedCode	int
+	}{
+		{name: "Get organization", method: "GET", role: orgMember, expectedCode: 200},
+		{name: "Get organization of non-member", method: "GET", expectedCode: 404},
+		{name: "Create organization", method: "POST", orgName: "team", expectedCode: 200},
+		{name: "Create organization with taken name", method: "POST", orgName: "team", duplicate: true, expectedCode: 409},
+		{name: "Create organization without name", method: "POST", expectedCode: 400},
+		{name: "Delete organization", method: "DELETE", role: orgOwner, expectedCode: 200},
+		{name: "Delete organization as admin", method: "DELETE", role: orgAdmin, expectedCode: 403},
+		{name: "Incorrect HTTP request method", method: "PUT", expectedCode: 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := RevocationStore.NewMemoryStore()
+			revocationStore = store
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			switch {
+			case tt.method == "GET" || tt.method == "DELETE":
+				ExpectMembershipQuery(mock, tt.role)
+				if tt.method == "GET" && tt.expectedCode == 200 {
+					mock.ExpectQuery("SELECT user_id, role, joined_at FROM organization_member WHERE organization_id=? ORDER BY joined_at").
+						WithArgs(7).
+						WillReturnRows(sqlmock.NewRows([]string{"user_id", "role", "joined_at"}).AddRow(3, orgOwner, time.Now()).AddRow(1, orgMember, time.Now()))
+					mock.ExpectQuery(selectUserByID).WithArgs(3).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(3, "owner_user", "", true, false, nil))
+					mock.ExpectQuery(selectUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+				}
+				if tt.method == "DELETE" && tt.expectedCode == 200 {
+					mock.ExpectQuery("SELECT user_id FROM organization_member WHERE organization_id=?").
+						WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+					mock.ExpectQuery(selectUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+					mock.ExpectQuery(selectUserByID).WithArgs(2).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(2, "other_user", "", true, false, nil))
+					mock.ExpectExec("DELETE FROM organization WHERE id=?").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			case tt.method == "POST" && tt.orgName != "":
+				mock.ExpectBegin()
+				if tt.duplicate {
+					mock.ExpectExec("INSERT INTO organization (name, created_at) VALUES (?, ?)").WithArgs(tt.orgName, sqlmock.AnyArg()).WillReturnError(duplicateEntryErr)
+					mock.ExpectRollback()
+				} else {
+					mock.ExpectExec("INSERT INTO organization (name, created_at) VALUES (?, ?)").WithArgs(tt.orgName, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(7, 1))
+					mock.ExpectExec(insertOrgMember).WithArgs(1, 7, orgOwner, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectCommit()
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/orgs", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", SessionAuthHeader("test_session"))
+			if tt.orgName != "" { req.Header.Set("Name", tt.orgName) }
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Organizations)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if tt.method == "GET" && resp.Code == 200 {
+				var org Organization
+				if err := json.NewDecoder(resp.Body).Decode(&org); err != nil { t.Fatal(err.Error()) }
+				if org.ID != 7 || org.Name != "team" || org.Role != orgMember || len(org.Members) != 2 { t.Fatal("Organization was incorrect", org) }
+			}
+			if tt.method == "DELETE" && resp.Code == 200 {
+				revoked, _ := store.IsRevoked("", "other_user", time.Now().Add(-time.Minute))
+				if !revoked { t.Fatal("JWTs of members were not revoked") }
+			}
+		})
+	}
+}
+
+func TestOrganizationMembers(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		role			string
+		username		string
+		orgRole			string
+		targetID		int64
+		targetRole		string
+		expectedCode	int
+	}{
+		{name: "Owner makes member admin", method: "POST", role: orgOwner, username: "other_user", orgRole: orgAdmin, targetID: 2, targetRole: orgMember, expectedCode: 200},
+		{name: "Admin makes member admin", method: "POST", role: orgAdmin, username: "other_user", orgRole: orgAdmin, targetID: 2, targetRole: orgMember, expectedCode: 403},
+		{name: "Owner changes own role", method: "POST", role: orgOwner, username: "test_user", orgRole: orgMember, targetID: 1, targetRole: orgOwner, expectedCode: 403},
+		{name: "Invalid role", method: "POST", role: orgOwner, username: "other_user", orgRole: orgOwner, expectedCode: 400},
+		{name: "Admin removes member", method: "DELETE", role: orgAdmin, username: "other_user", targetID: 2, targetRole: orgMember, expectedCode: 200},
+		{name: "Admin removes admin", method: "DELETE", role: orgAdmin, username: "other_user", targetID: 2, targetRole: orgAdmin, expectedCode: 403},
+		{name: "Member leaves", method: "DELETE", role: orgMember, username: "test_user", targetID: 1, targetRole: orgMember, expectedCode: 200},
+		{name: "Owner leaves", method: "DELETE", role: orgOwner, username: "test_user", targetID: 1, targetRole: orgOwner, expectedCode: 403},
+		{name: "Unknown member", method: "DELETE", role: orgOwner, username: "unknown_user", expectedCode: 404},
+		{name: "Username missing", method: "DELETE", role: orgOwner, expectedCode: 400},
+		{name: "Not a member of an organization", method: "DELETE", username: "other_user", expectedCode: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := RevocationStore.NewMemoryStore()
+			revocationStore = store
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			ExpectMembershipQuery(mock, tt.role)
+			if tt.role != "" && tt.expectedCode != 400 {
+				userRows := sqlmock.NewRows(userColumns)
+				if tt.targetID != 0 { userRows.AddRow(tt.targetID, tt.username, "", true, false, nil) }
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.username).WillReturnRows(userRows)
+				if tt.targetID != 0 {
+					mock.ExpectQuery(selectOrgMember).WithArgs(tt.targetID, 7).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(tt.targetRole))
+				}
+			}
+			if tt.expectedCode == 200 && tt.method == "POST" {
+				mock.ExpectExec("UPDATE organization_member SET role=? WHERE user_id=?").WithArgs(tt.orgRole, tt.targetID).WillReturnResult(sqlmock.NewResult(0, 1))
+			} else if tt.expectedCode == 200 {
+				mock.ExpectExec("DELETE FROM organization_member WHERE user_id=?").WithArgs(tt.targetID).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			req, err := http.NewRequest(tt.method, "/orgs/members", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", SessionAuthHeader("test_session"))
+			req.Header.Set("Username", tt.username)
+			req.Header.Set("Org-Role", tt.orgRole)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), OrganizationMembers)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			revoked, _ := store.IsRevoked("", tt.username, time.Now().Add(-time.Minute))
+			if revoked != (tt.method == "DELETE" && tt.expectedCode == 200) { t.Fatal("Revocation was incorrect", revoked) }
+		})
+	}
+}
+
+func TestOrganizationInvitations(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		role			string
+		username		string
+		orgRole			string
+		expectedCode	int
+	}{
+		{name: "Owner invites admin", role: orgOwner, username: "new@example.com", orgRole: orgAdmin, expectedCode: 200},
+		{name: "Admin invites member", role: orgAdmin, username: "new@example.com", expectedCode: 200},
+		{name: "Admin invites admin", role: orgAdmin, username: "new@example.com", orgRole: orgAdmin, expectedCode: 403},
+		{name: "Member invites member", role: orgMember, username: "new@example.com", expectedCode: 403},
+		{name: "Invalid email", role: orgOwner, username: "not an email", expectedCode: 400},
+		{name: "Invalid role", role: orgOwner, username: "new@example.com", orgRole: orgOwner, expectedCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := AccountEvents.NewMemoryPublisher()
+			accountEvents = publisher
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			expectedRole := tt.orgRole
+			if expectedRole == "" { expectedRole = orgMember }
+			ExpectMembershipQuery(mock, tt.role)
+			if tt.expectedCode == 200 {
+				mock.ExpectExec("INSERT INTO organization_invitation (organization_id, email, role, token_hash, invited_by, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)").
+					WithArgs(7, tt.username, expectedRole, sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			req, err := http.NewRequest("POST", "/orgs/invitations", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", SessionAuthHeader("test_session"))
+			req.Header.Set("Username", tt.username)
+			req.Header.Set("Org-Role", tt.orgRole)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(OrganizationInvitations)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			events := publisher.Events()
+			if tt.expectedCode != 200 {
+				if len(events) != 0 { t.Fatal("Event was published", events) }
+				return
+			}
+			if len(events) != 1 || events[0].Type != AccountEvents.OrganizationInvited || events[0].Username != tt.username || events[0].Organization != "team" || events[0].Token == "" {
+				t.Fatal("Published event was incorrect", events)
+			}
+		})
+	}
+}
+
+func TestAcceptOrganizationInvitation(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		token			string
+		email			string
+		expiresAt		time.Time
+		duplicate		bool
+		expectedCode	int
+	}{
+		{name: "Invitation accepted", token: "invitationToken", email: "test_user", expiresAt: time.Now().Add(time.Hour), expectedCode: 200},
+		{name: "Invitation of another user", token: "invitationToken", email: "other_user", expiresAt: time.Now().Add(time.Hour), expectedCode: 403},
+		{name: "Invitation expired", token: "invitationToken", email: "test_user", expiresAt: time.Now().Add(-time.Hour), expectedCode: 401},
+		{name: "Already a member of an organization", token: "invitationToken", email: "test_user", expiresAt: time.Now().Add(time.Hour), duplicate: true, expectedCode: 409},
+		{name: "Invitation unknown", token: "unknownToken", expectedCode: 401},
+		{name: "Invitation token missing", expectedCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.token != "" {
+				rows := sqlmock.NewRows([]string{"id", "organization_id", "email", "role", "expires_at"})
+				if tt.email != "" { rows.AddRow(3, 7, tt.email, orgMember, tt.expiresAt) }
+				mock.ExpectQuery("SELECT id, organization_id, email, role, expires_at FROM organization_invitation WHERE token_hash=?").
+					WithArgs(SecureToken.Hash(tt.token)).WillReturnRows(rows)
+			}
+			if tt.expectedCode == 200 || tt.duplicate {
+				mock.ExpectBegin()
+				if tt.duplicate {
+					mock.ExpectExec(insertOrgMember).WithArgs(1, 7, orgMember, sqlmock.AnyArg()).WillReturnError(duplicateEntryErr)
+					mock.ExpectRollback()
+				} else {
+					mock.ExpectExec(insertOrgMember).WithArgs(1, 7, orgMember, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("DELETE FROM organization_invitation WHERE id=?").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectCommit()
+				}
+			}
+
+			req, err := http.NewRequest("POST", "/orgs/invitations/accept", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", SessionAuthHeader("test_session"))
+			req.Header.Set("Invitation-Token", tt.token)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(AcceptOrganizationInvitation)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+		})
+	}
+}
+
+func TestSendTokensOrgClaim(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+	mock.ExpectQuery(selectUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+	ExpectUserRolesQuery(mock, 1)
+	mock.ExpectQuery(selectUserOrg).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"organization_id"}).AddRow(7))
+	mock.ExpectExec("UPDATE session SET user_agent=?, ip=?, last_used_at=? WHERE family_id=?").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_token (user_id, family_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?)").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req, _ := http.NewRequest("POST", "/refresh", nil)
+	resp := httptest.NewRecorder()
+	if err := SendTokens(MockUserStore(), resp, req, 1, "test_user", "test_session"); err != nil { t.Fatal(err.Error()) }
+
+	claims := ParseTestClaims(t, "Bearer " + resp.Body.String())
+	if GetStringClaim(claims, "org") != "7" { t.Fatal("Org claim was incorrect", claims) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
@@ -0,0 +1,125 @@
+package passwordhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Prefix of every encoded argon2id hash. Stored passwords without it are
+// considered to be legacy plaintext values.
+const argon2idPrefix = "$argon2id$"
+
+var ErrInvalidHash = errors.New("encoded password hash is malformed")
+
+// Cost parameters used when hashing passwords with argon2id.
+type Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Returns the argon2id parameters configured with the ARGON2_MEMORY, ARGON2_ITERATIONS
+// and ARGON2_PARALLELISM env variables. Missing or invalid values fall back to the
+// defaults recommended by RFC 9106 for memory constrained environments.
+func NewParams() Params {
+	return Params{
+		Memory:      uint32(getEnvUint("ARGON2_MEMORY", 64*1024, 32)),
+		Iterations:  uint32(getEnvUint("ARGON2_ITERATIONS", 3, 32)),
+		Parallelism: uint8(getEnvUint("ARGON2_PARALLELISM", 2, 8)),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+func getEnvUint(name string, fallback uint64, bitSize int) uint64 {
+	value, err := strconv.ParseUint(os.Getenv(name), 10, bitSize)
+	if err != nil || value == 0 {
+		return fallback
+	}
+	return value
+}
+
+// Hashes the given password with argon2id and a random salt. The result is
+// encoded in the PHC string format, so the parameters travel with the hash.
+func (p Params) Hash(password string) (encoded string, err error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Returns true if the stored value should be replaced with a fresh hash, i.e.
+// it is still plaintext or it was hashed with different cost parameters.
+func (p Params) NeedsRehash(encoded string) bool {
+	if !IsHashed(encoded) {
+		return true
+	}
+	stored, _, _, err := decode(encoded)
+	if err != nil {
+		return true
+	}
+	return stored.Memory != p.Memory || stored.Iterations != p.Iterations ||
+		stored.Parallelism != p.Parallelism || stored.KeyLength != p.KeyLength
+}
+
+// Returns true if the stored value is an argon2id hash instead of plaintext.
+func IsHashed(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+// Checks whether password matches the stored value in constant time.
+// Legacy plaintext values are still accepted so that they can be upgraded
+// to a hash after a successful login.
+func Verify(password string, encoded string) (match bool, err error) {
+	if !IsHashed(encoded) {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1, nil
+	}
+	p, salt, key, err := decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// Parses a PHC formatted argon2id hash into its parameters, salt and key.
+func decode(encoded string) (p Params, salt []byte, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Params{}, nil, nil, ErrInvalidHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
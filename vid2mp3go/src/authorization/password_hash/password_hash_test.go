@@ -0,0 +1,63 @@
+package passwordhash
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Cheap parameters so that the tests run quickly
+var testParams = Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestNewParams(t *testing.T) {
+	os.Setenv("ARGON2_MEMORY", "2048")
+	os.Setenv("ARGON2_ITERATIONS", "4")
+	os.Setenv("ARGON2_PARALLELISM", "not a number")
+	defer os.Unsetenv("ARGON2_MEMORY")
+	defer os.Unsetenv("ARGON2_ITERATIONS")
+	defer os.Unsetenv("ARGON2_PARALLELISM")
+
+	p := NewParams()
+	if p.Memory != 2048 { t.Fatal("Memory was incorrect", p.Memory) }
+	if p.Iterations != 4 { t.Fatal("Iterations was incorrect", p.Iterations) }
+	if p.Parallelism != 2 { t.Fatal("Parallelism did not fall back to default", p.Parallelism) }
+}
+
+func TestHashAndVerify(t *testing.T) {
+	encoded, err := testParams.Hash("test_password")
+	if err != nil { t.Fatalf("Hashing failed:\n%s", err.Error()) }
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatal("Encoded hash was incorrect", encoded)
+	}
+	if strings.Contains(encoded, "test_password") { t.Fatal("Hash contained the password") }
+
+	match, err := Verify("test_password", encoded)
+	if err != nil || !match { t.Fatal("Correct password did not match") }
+	match, err = Verify("wrong_password", encoded)
+	if err != nil || match { t.Fatal("Incorrect password matched") }
+
+	other, _ := testParams.Hash("test_password")
+	if other == encoded { t.Fatal("Two hashes of the same password were identical") }
+}
+
+func TestVerifyPlaintext(t *testing.T) {
+	match, err := Verify("test_password", "test_password")
+	if err != nil || !match { t.Fatal("Plaintext password did not match") }
+	match, err = Verify("test_password", "different_password")
+	if err != nil || match { t.Fatal("Different plaintext password matched") }
+}
+
+func TestVerifyMalformedHash(t *testing.T) {
+	_, err := Verify("test_password", "$argon2id$v=19$m=1024$broken")
+	if err != ErrInvalidHash { t.Fatal("Malformed hash was not detected") }
+}
+
+func TestNeedsRehash(t *testing.T) {
+	encoded, _ := testParams.Hash("test_password")
+	if testParams.NeedsRehash(encoded) { t.Fatal("Hash with current params needed rehash") }
+	if !testParams.NeedsRehash("test_password") { t.Fatal("Plaintext did not need rehash") }
+
+	stronger := testParams
+	stronger.Iterations = 2
+	if !stronger.NeedsRehash(encoded) { t.Fatal("Hash with old params did not need rehash") }
+}
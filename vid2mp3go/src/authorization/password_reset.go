@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	AccountEvents "microservices/authorization/account_events"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"time"
+)
+
+// Lifetime of password reset tokens. Configured with the PASSWORD_RESET_TOKEN_TTL env variable.
+var passwordResetTokenTTL = GetDurationEnv("PASSWORD_RESET_TOKEN_TTL", time.Hour)
+
+// Receives the events published about user accounts. Replaced with a RabbitMQ
+// publisher in main(), unless the EVENT_PUBLISHER env variable is set to "memory".
+var accountEvents AccountEvents.Publisher = AccountEvents.NewMemoryPublisher()
+
+// Starts a password reset for the user given in the Username header of a POST request.
+// A single-use reset token is stored as a hash and sent to the user by publishing a
+// password reset requested event. The response is the same whether the user exists
+// or not, so that the endpoint can not be used to find out which usernames exist.
+func ForgotPassword(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ForgotPassword request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	username := r.Header.Get("Username")
+	if username == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		log.Printf("Password reset requested for unknown user %s", username)
+		fmt.Fprintf(w, "Password reset requested.")
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if err := SendPasswordReset(user.ID, username); err != nil {
+		log.Printf("Error occured while trying to send password reset:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Password reset requested for user %s", username)
+	fmt.Fprintf(w, "Password reset requested.")
+}
+
+// Creates a password reset token for the given user and publishes a password reset
+// requested event, so that the notification service sends the token to the user.
+func SendPasswordReset(userID int64, username string) (err error) {
+	resetToken, expiresAt, err := CreatePasswordResetToken(userID)
+	if err != nil {
+		return err
+	}
+	return accountEvents.Publish(AccountEvents.Event{
+		Type: AccountEvents.PasswordResetRequested,
+		Username: username,
+		Token: resetToken,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// Stores a new password reset token for the given user in the DB and returns it.
+// Reset tokens the user has not used yet are invalidated, so that only the
+// latest one can be used.
+func CreatePasswordResetToken(userID int64) (resetToken string, expiresAt time.Time, err error) {
+	resetToken, err = SecureToken.Generate(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now().UTC()
+	expiresAt = now.Add(passwordResetTokenTTL)
+	tx, err := db.Begin()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE password_reset_token SET used=TRUE WHERE user_id=? AND used=FALSE", userID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO password_reset_token (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		userID, SecureToken.Hash(resetToken), expiresAt, now,
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return resetToken, expiresAt, tx.Commit()
+}
+
+// Sets the password of a user to the one in the Password header of a POST request,
+// if the request's Reset-Token header contains a valid reset token for the user.
+// Every reset token can be used only once. A successful reset revokes all of the
+// user's refresh tokens and JWTs, so every existing session has to log in again.
+func ResetPassword(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ResetPassword request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	resetToken, password := r.Header.Get("Reset-Token"), r.Header.Get("Password")
+	if resetToken == "" || password == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var id, userID int64
+	var expiresAt time.Time
+	var used bool
+	err := db.QueryRow(
+		"SELECT id, user_id, expires_at, used FROM password_reset_token WHERE token_hash=?",
+		SecureToken.Hash(resetToken),
+	).Scan(&id, &userID, &expiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch password reset token from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if used || time.Now().After(expiresAt) {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	user, err := users.FindByID(userID)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	username := user.Email
+	hash, err := hashParams.Hash(password)
+	if err != nil {
+		log.Printf("Error occured while hashing password:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	used, err = UpdatePassword(users, id, userID, hash)
+	if err != nil {
+		log.Printf("Error occured while trying to reset password of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if used {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	if err := revocationStore.RevokeUser(username, time.Now()); err != nil {
+		log.Printf("Error occured while trying to revoke JWTs of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	RecordLoginSuccess(username)
+	log.Printf("Password of user %s reset", username)
+	fmt.Fprintf(w, "Password reset.")
+}
+
+// Marks the reset token with the given id as used and revokes the user's refresh tokens
+// in one transaction, before setting the user's password to the given hash. If the
+// reset token has already been used, nothing is changed and used is true.
+func UpdatePassword(users UserStore.Store, resetTokenID int64, userID int64, hash string) (used bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// Only one request can use the token, even if several arrive at once
+	res, err := tx.Exec("UPDATE password_reset_token SET used=TRUE WHERE id=? AND used=FALSE", resetTokenID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n != 1 {
+		return true, nil
+	}
+	if _, err := tx.Exec("UPDATE refresh_token SET revoked=TRUE WHERE user_id=?", userID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return false, users.Update(userID, UserStore.Changes{Password: &hash})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	AccountEvents "microservices/authorization/account_events"
+	LoginThrottle "microservices/authorization/login_throttle"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectPasswordResetToken = "SELECT id, user_id, expires_at, used FROM password_reset_token WHERE token_hash=?"
+
+func TestForgotPassword(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		username		string
+		expectedEvents	int
+	}{
+		{
+			name: "Reset requested",
+			method: "POST",
+			expectedCode: 200,
+			username: "test_user",
+			expectedEvents: 1,
+		},
+		{
+			name: "Unknown user",
+			method: "POST",
+			expectedCode: 200,
+			username: "unknown_user",
+		},
+		{
+			name: "Username missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			username: "test_user",
+		},
+		{
+			name: "DB fetch fails",
+			method: "POST",
+			expectedCode: 500,
+			username: "test_user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := AccountEvents.NewMemoryPublisher()
+			accountEvents = publisher
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.name == "DB fetch fails" {
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.username).WillReturnError(errors.New("db fetch failed"))
+			} else if tt.name == "Unknown user" {
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.username).WillReturnRows(sqlmock.NewRows(userColumns))
+			} else if tt.expectedCode == 200 {
+				ExpectUserQuery(mock, tt.username, 1)
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE password_reset_token SET used=TRUE WHERE user_id=? AND used=FALSE").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO password_reset_token (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			}
+
+			req, err := http.NewRequest(tt.method, "/password/forgot", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ForgotPassword)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			events := publisher.Events()
+			if len(events) != tt.expectedEvents { t.Fatal("Number of published events was incorrect", len(events)) }
+			if tt.expectedEvents > 0 {
+				if events[0].Type != AccountEvents.PasswordResetRequested || events[0].Username != tt.username || events[0].Token == "" {
+					t.Fatal("Published event was incorrect", events[0])
+				}
+			}
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		resetToken		string
+		password		string
+		expiresAt		time.Time
+		used			bool
+		concurrentUse	bool
+	}{
+		{
+			name: "Successful reset",
+			method: "POST",
+			expectedCode: 200,
+			resetToken: "test_reset_token",
+			password: "new_password",
+			expiresAt: time.Now().Add(time.Hour),
+		},
+		{
+			name: "Reset token expired",
+			method: "POST",
+			expectedCode: 401,
+			resetToken: "test_reset_token",
+			password: "new_password",
+			expiresAt: time.Now().Add(-time.Minute),
+		},
+		{
+			name: "Reset token already used",
+			method: "POST",
+			expectedCode: 401,
+			resetToken: "test_reset_token",
+			password: "new_password",
+			expiresAt: time.Now().Add(time.Hour),
+			used: true,
+		},
+		{
+			name: "Reset token used concurrently",
+			method: "POST",
+			expectedCode: 401,
+			resetToken: "test_reset_token",
+			password: "new_password",
+			expiresAt: time.Now().Add(time.Hour),
+			concurrentUse: true,
+		},
+		{
+			name: "Reset token unknown",
+			method: "POST",
+			expectedCode: 401,
+			resetToken: "unknown_reset_token",
+			password: "new_password",
+		},
+		{
+			name: "Password missing",
+			method: "POST",
+			expectedCode: 400,
+			resetToken: "test_reset_token",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			resetToken: "test_reset_token",
+			password: "new_password",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			loginAttempts = LoginThrottle.NewMemoryStore()
+			loginAttempts.Lock("account:test_user", time.Now().Add(time.Hour))
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			rows := sqlmock.NewRows([]string{"id", "user_id", "expires_at", "used"})
+			if tt.resetToken == "test_reset_token" {
+				rows.AddRow(5, 1, tt.expiresAt, tt.used)
+			}
+			if tt.method == "POST" && tt.password != "" {
+				mock.ExpectQuery(selectPasswordResetToken).WithArgs(SecureToken.Hash(tt.resetToken)).WillReturnRows(rows)
+			}
+			if tt.expectedCode == 200 || tt.concurrentUse {
+				mock.ExpectQuery(selectUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+			}
+			if tt.expectedCode == 200 || tt.concurrentUse {
+				mock.ExpectBegin()
+				affected := int64(1)
+				if tt.concurrentUse {
+					affected = 0
+				}
+				mock.ExpectExec("UPDATE password_reset_token SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, affected))
+				if !tt.concurrentUse {
+					mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE user_id=?").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+					mock.ExpectCommit()
+					mock.ExpectExec("UPDATE user SET password=? WHERE id=?").WithArgs(hashOf(tt.password), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				} else {
+					mock.ExpectRollback()
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/password/reset", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Reset-Token", tt.resetToken)
+			req.Header.Set("Password", tt.password)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ResetPassword)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			revoked, _ := revocationStore.IsRevoked("old_jti", "test_user", time.Now().Add(-time.Minute))
+			if revoked != (resp.Code == 200) { t.Fatal("Revocation of the user's JWTs was incorrect", revoked) }
+			retryAfter, _ := LoginRetryAfter("test_user", "203.0.113.7", time.Now())
+			if (retryAfter == 0) != (resp.Code == 200) { t.Fatal("Login lockout was not lifted after reset", retryAfter) }
+		})
+	}
+}
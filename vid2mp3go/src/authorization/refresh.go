@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	AuditLog "microservices/authorization/audit_log"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Lifetimes of access tokens (JWTs) and refresh tokens. Configured with the
+// ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL env variables.
+var accessTokenTTL = GetDurationEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+var refreshTokenTTL = GetDurationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+// Stores a new refresh token of the given token family for the given user in the DB
+// and returns it. Refresh tokens created by rotating an older token share its familyID.
+func CreateRefreshToken(userID int64, familyID string) (refreshToken string, err error) {
+	refreshToken, err = SecureToken.Generate(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec(
+		"INSERT INTO refresh_token (user_id, family_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, familyID, SecureToken.Hash(refreshToken), now.Add(refreshTokenTTL), now,
+	)
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// Revokes every refresh token that belongs to the given token family.
+func RevokeTokenFamily(familyID string) (err error) {
+	_, err = db.Exec("UPDATE refresh_token SET revoked=TRUE WHERE family_id=?", familyID)
+	return err
+}
+
+// Revokes the token family of the given refresh token, if it belongs to the user.
+// Unknown refresh tokens are ignored, since there is nothing to revoke.
+func RevokeRefreshToken(refreshToken string, userID int64) (err error) {
+	var familyID string
+	err = db.QueryRow(
+		"SELECT family_id FROM refresh_token WHERE token_hash=? AND user_id=?",
+		SecureToken.Hash(refreshToken), userID,
+	).Scan(&familyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return RevokeTokenFamily(familyID)
+}
+
+// Returned by IssueTokens for disabled users, who get no tokens
+var errUserDisabled = errors.New("user is disabled")
+
+// Access token and refresh token created by IssueTokens. User holds the claims of the
+// access token.
+type IssuedTokens struct {
+	AccessToken		string
+	RefreshToken	string
+	User			User
+}
+
+// Creates an access token and a refresh token for the given user.
+// The user's roles and verification status are fetched from the DB and the user store,
+// so that changes to them take effect whenever a new access token is created. Disabled
+// users get errUserDisabled instead of tokens.
+// Starting a new token family, i.e. without familyID, is recorded as the user's last login
+// and starts a session for the client. Otherwise the session of the token family is marked
+// as used. The family ID is the session's ID and the JWT's sid claim.
+// The organization the user is a member of is fetched along with the roles.
+func IssueTokens(users UserStore.Store, client ClientInfo, userID int64, username string, familyID string) (tokens IssuedTokens, err error) {
+	account, err := users.FindByID(userID)
+	if err != nil {
+		return IssuedTokens{}, err
+	}
+	if account.Disabled {
+		log.Printf("Tokens refused for disabled user %s", username)
+		return IssuedTokens{}, errUserDisabled
+	}
+	roles, permissions, err := GetUserRoles(userID)
+	if err != nil {
+		return IssuedTokens{}, err
+	}
+	var orgID sql.NullInt64
+	err = db.QueryRow("SELECT organization_id FROM organization_member WHERE user_id=?", userID).Scan(&orgID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return IssuedTokens{}, err
+	}
+	newFamily := familyID == ""
+	if newFamily {
+		if familyID, err = SecureToken.Generate(16); err != nil {
+			return IssuedTokens{}, err
+		}
+	}
+	user := User{ID: userID, Username: username, Roles: roles, Permissions: permissions, EmailVerified: account.Verified, SessionID: familyID}
+	if orgID.Valid {
+		user.Org = strconv.FormatInt(orgID.Int64, 10)
+	}
+	tokenString, err := CreateJWT(user)
+	if err != nil {
+		return IssuedTokens{}, err
+	}
+	if newFamily {
+		if err := StartSession(client, userID, familyID); err != nil {
+			return IssuedTokens{}, err
+		}
+	} else {
+		TouchSession(client, familyID)
+	}
+	refreshToken, err := CreateRefreshToken(userID, familyID)
+	if err != nil {
+		return IssuedTokens{}, err
+	}
+	if newFamily {
+		// Only shown to admins, so failures are only logged
+		now := time.Now()
+		if err := users.Update(userID, UserStore.Changes{LastLoginAt: &now}); err != nil {
+			log.Printf("Error occured while updating last login of user %s:\n%s", username, err.Error())
+		}
+	}
+	return IssuedTokens{AccessToken: tokenString, RefreshToken: refreshToken, User: user}, nil
+}
+
+// Creates tokens for the given user with IssueTokens, for the device of the request, and
+// sends them with SendIssuedTokens.
+func SendTokens(users UserStore.Store, w http.ResponseWriter, r *http.Request, userID int64, username string, familyID string) (err error) {
+	tokens, err := IssueTokens(users, GetClientInfo(r), userID, username, familyID)
+	return SendIssuedTokens(w, tokens, err)
+}
+
+// Sends the result of IssueTokens. The access token is written to the response body
+// and the refresh token to the Refresh-Token header. Disabled users get 403 instead of
+// tokens, which is not an error. Other errors are returned without writing anything.
+func SendIssuedTokens(w http.ResponseWriter, tokens IssuedTokens, err error) error {
+	if errors.Is(err, errUserDisabled) {
+		SendStatus.Forbidden(w)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	w.Header().Set("Refresh-Token", tokens.RefreshToken)
+	fmt.Fprintf(w, "%s", tokens.AccessToken)
+	return nil
+}
+
+// Exchanges the refresh token in the Refresh-Token header of a POST request for a new
+// access token and refresh token. Every refresh token can be used only once. If a used
+// refresh token is presented again, it has most likely been stolen, so every refresh
+// token in its family is revoked and the user has to log in again.
+func Refresh(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Refresh request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	refreshToken := r.Header.Get("Refresh-Token")
+	if refreshToken == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var id, userID int64
+	var familyID string
+	var expiresAt time.Time
+	var used, revoked bool
+	err := db.QueryRow(
+		"SELECT id, user_id, family_id, expires_at, used, revoked FROM refresh_token WHERE token_hash=?",
+		SecureToken.Hash(refreshToken),
+	).Scan(&id, &userID, &familyID, &expiresAt, &used, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch refresh token from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	user, err := users.FindByID(userID)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	username := user.Email
+	if revoked || time.Now().After(expiresAt) {
+		RecordAuditEvent(r, AuditLog.Token, username, AuditLog.Failure)
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	if used {
+		RecordAuditEvent(r, AuditLog.Token, username, AuditLog.Failure)
+		RevokeReusedTokenFamily(w, username, familyID)
+		return
+	}
+	// Only one request can mark the token as used, even if several arrive at once
+	res, err := db.Exec("UPDATE refresh_token SET used=TRUE WHERE id=? AND used=FALSE", id)
+	if err != nil {
+		log.Printf("Error occured while trying to mark refresh token as used:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		RecordAuditEvent(r, AuditLog.Token, username, AuditLog.Failure)
+		RevokeReusedTokenFamily(w, username, familyID)
+		return
+	}
+	if err := SendAuditedTokens(users, w, r, AuditLog.Token, userID, username, familyID); err != nil {
+		log.Printf("Error occured while trying to create tokens:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+}
+
+// Revokes the token family of a refresh token that was used more than once
+// and responds with InvalidCredentials.
+func RevokeReusedTokenFamily(w http.ResponseWriter, username string, familyID string) {
+	log.Printf("Refresh token reuse detected for user %s, revoking token family", username)
+	if err := RevokeTokenFamily(familyID); err != nil {
+		log.Printf("Error occured while trying to revoke token family:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	SendStatus.InvalidCredentials(w)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectRefreshToken = "SELECT id, user_id, family_id, expires_at, used, revoked FROM refresh_token WHERE token_hash=?"
+
+func TestRefresh(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		refreshToken	string
+		expiresAt		time.Time
+		used			bool
+		revoked			bool
+		markedUsed		int64
+		disabled		bool
+	}{
+		{
+			name: "Successful refresh",
+			method: "POST",
+			expectedCode: 200,
+			refreshToken: "test_refresh_token",
+			expiresAt: time.Now().Add(time.Hour),
+			markedUsed: 1,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			refreshToken: "test_refresh_token",
+		},
+		{
+			name: "Refresh token missing from headers",
+			method: "POST",
+			expectedCode: 400,
+			refreshToken: "",
+		},
+		{
+			name: "Unknown refresh token",
+			method: "POST",
+			expectedCode: 401,
+			refreshToken: "test_refresh_token",
+		},
+		{
+			name: "Refresh token expired",
+			method: "POST",
+			expectedCode: 401,
+			refreshToken: "test_refresh_token",
+			expiresAt: time.Now().Add(-time.Hour),
+		},
+		{
+			name: "Refresh token revoked",
+			method: "POST",
+			expectedCode: 401,
+			refreshToken: "test_refresh_token",
+			expiresAt: time.Now().Add(time.Hour),
+			revoked: true,
+		},
+		{
+			name: "Refresh token reused",
+			method: "POST",
+			expectedCode: 401,
+			refreshToken: "test_refresh_token",
+			expiresAt: time.Now().Add(time.Hour),
+			used: true,
+		},
+		{
+			name: "User disabled",
+			method: "POST",
+			expectedCode: 403,
+			refreshToken: "test_refresh_token",
+			expiresAt: time.Now().Add(time.Hour),
+			markedUsed: 1,
+			disabled: true,
+		},
+		{
+			name: "Refresh token used concurrently",
+			method: "POST",
+			expectedCode: 401,
+			refreshToken: "test_refresh_token",
+			expiresAt: time.Now().Add(time.Hour),
+			markedUsed: 0,
+		},
+		{
+			name: "DB fetch fails",
+			method: "POST",
+			expectedCode: 500,
+			refreshToken: "test_refresh_token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			columns := []string{"id", "user_id", "family_id", "expires_at", "used", "revoked"}
+			query := mock.ExpectQuery(selectRefreshToken).WithArgs(SecureToken.Hash(tt.refreshToken))
+			if tt.name == "DB fetch fails" {
+				query.WillReturnError(errors.New("db fetch failed"))
+			} else if tt.expiresAt.IsZero() {
+				query.WillReturnRows(sqlmock.NewRows(columns))
+			} else {
+				query.WillReturnRows(sqlmock.NewRows(columns).AddRow(7, 1, "test_family", tt.expiresAt, tt.used, tt.revoked))
+				mock.ExpectQuery(selectUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", true, false, nil))
+			}
+			if tt.used {
+				mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE family_id=?").WithArgs("test_family").WillReturnResult(sqlmock.NewResult(0, 2))
+			} else if tt.markedUsed == 0 {
+				mock.ExpectExec("UPDATE refresh_token SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE family_id=?").WithArgs("test_family").WillReturnResult(sqlmock.NewResult(0, 2))
+			} else {
+				mock.ExpectExec("UPDATE refresh_token SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, tt.markedUsed))
+				mock.ExpectQuery(selectUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", false, tt.disabled, nil))
+				if !tt.disabled {
+					ExpectUserRolesQuery(mock, 1)
+					mock.ExpectQuery(selectUserOrg).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"organization_id"}))
+					mock.ExpectExec("UPDATE session SET user_agent=?, ip=?, last_used_at=? WHERE family_id=?").
+						WithArgs("test-agent", "203.0.113.7", sqlmock.AnyArg(), "test_family").
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("INSERT INTO refresh_token (user_id, family_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?, ?)").
+						WithArgs(1, "test_family", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+						WillReturnResult(sqlmock.NewResult(8, 1))
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/refresh", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Refresh-Token", tt.refreshToken)
+			req.Header.Set("User-Agent", "test-agent")
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			FromTrustedPeer(t, req)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Refresh)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if resp.Code == 200 {
+				bodyBytes, err := io.ReadAll(resp.Body)
+				if err != nil { t.Fatalf("Error while reading resp body:\n%s", err.Error()) }
+				if len(bodyBytes) == 0 { t.Fatal("Did not receive JWT") }
+				newRefreshToken := resp.Header().Get("Refresh-Token")
+				if newRefreshToken == "" || newRefreshToken == tt.refreshToken {
+					t.Fatal("Did not receive a new refresh token")
+				}
+			}
+			if tt.name == "Refresh token reused" || tt.name == "Refresh token used concurrently" || tt.disabled {
+				if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			}
+		})
+	}
+}
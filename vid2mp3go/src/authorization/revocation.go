@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	RevocationStore "microservices/authorization/revocation_store"
+	SendStatus "microservices/authorization/send_status"
+	"net/http"
+	"slices"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Keeps track of revoked JWTs. Replaced with a MySQL backed store in main(),
+// unless the REVOCATION_STORE env variable is set to "memory".
+var revocationStore RevocationStore.Store = RevocationStore.NewMemoryStore()
+
+// Checks whether the JWT the given claims belong to has been revoked, individually,
+// along with its user or along with its session. Tokens without jti or iat claims can
+// not be checked, so they are treated as revoked.
+func IsTokenRevoked(claims jwt.MapClaims) (revoked bool, err error) {
+	jti, _ := claims["jti"].(string)
+	username, _ := claims["username"].(string)
+	issuedAt, err := claims.GetIssuedAt()
+	if jti == "" || err != nil || issuedAt == nil {
+		return true, nil
+	}
+	revoked, err = revocationStore.IsRevoked(jti, username, issuedAt.Time)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	// Revoked sessions are stored like revoked tokens, with the sid in place of the jti
+	if sid, _ := claims["sid"].(string); sid != "" {
+		return revocationStore.IsRevoked(sid, "", issuedAt.Time)
+	}
+	return false, nil
+}
+
+// Revocations published by /revocations. Tokens are listed by jti or sid.
+type RevocationList struct {
+	Tokens	map[string]time.Time	`json:"tokens"`
+	Users	map[string]time.Time	`json:"users"`
+}
+
+// Publishes the revocations that still affect unexpired JWTs, so that the gateway can
+// reject revoked JWTs it verifies locally. Tokens are listed until they expire and
+// users until accessTokenTTL has passed since their revocation, since every JWT issued
+// before has expired by then. The route is only meant for other services and is not
+// passed on by the gateway. Since the list names revoked users, callers authenticate
+// like at /introspect, as a confidential OAuth client with the token:introspect scope.
+func Revocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	clientID, clientSecret, _ := r.BasicAuth()
+	client, err := CheckOAuthClient(clientID, clientSecret)
+	if errors.Is(err, errInvalidClient) {
+		SendOAuthError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	} else if err != nil {
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if !client.IsConfidential() || !slices.Contains(client.Scopes, introspectScope) {
+		SendOAuthError(w, http.StatusForbidden, "unauthorized_client", "client may not fetch revocations")
+		return
+	}
+	now := time.Now()
+	tokens, users, err := revocationStore.Revocations(now, now.Add(-accessTokenTTL))
+	if err != nil {
+		log.Printf("Error occured while trying to fetch revocations:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(RevocationList{Tokens: tokens, Users: users})
+}
+
+// Logs a user out by revoking the JWT in the Authorization header of the POST request.
+// If the request also has a Refresh-Token header, that refresh token and every
+// token rotated from it are revoked as well. Expired JWTs are accepted, so that
+// their refresh tokens can still be revoked.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	log.Println("Logout request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	tokenString, ok := GetBearerToken(r)
+	if !ok {
+		SendStatus.BadRequest(w)
+		return
+	}
+	claims, err := ParseJWT(tokenString, jwt.WithoutClaimsValidation())
+	if err != nil {
+		log.Printf("JWT decode failed:\n%s", err.Error())
+		SendStatus.Forbidden(w)
+		return
+	}
+	jti, _ := claims["jti"].(string)
+	username, _ := claims["username"].(string)
+	expiresAt, err := claims.GetExpirationTime()
+	if jti == "" || username == "" || err != nil || expiresAt == nil {
+		SendStatus.BadRequest(w)
+		return
+	}
+	if err := revocationStore.RevokeToken(jti, expiresAt.Time); err != nil {
+		log.Printf("Error occured while trying to revoke JWT:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if refreshToken := r.Header.Get("Refresh-Token"); refreshToken != "" {
+		userID, err := GetUserIDClaim(claims)
+		if err != nil {
+			SendStatus.BadRequest(w)
+			return
+		}
+		if err := RevokeRefreshToken(refreshToken, userID); err != nil {
+			log.Printf("Error occured while trying to revoke refresh token:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+	}
+	log.Printf("User %s logged out", username)
+	fmt.Fprintf(w, "Logged out.")
+}
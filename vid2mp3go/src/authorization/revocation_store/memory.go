@@ -0,0 +1,72 @@
+package revocationstore
+
+import (
+	"sync"
+	"time"
+)
+
+// Store implementation that keeps revocations in memory, for tests and local instances
+type MemoryStore struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+	users  map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tokens: map[string]time.Time{},
+		users:  map[string]time.Time{},
+	}
+}
+
+func (s *MemoryStore) RevokeToken(jti string, expiresAt time.Time) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Forget revocations of tokens that have expired since
+	now := time.Now()
+	for revokedJti, revokedExpiresAt := range s.tokens {
+		if now.After(revokedExpiresAt) {
+			delete(s.tokens, revokedJti)
+		}
+	}
+	if expiresAt.After(s.tokens[jti]) {
+		s.tokens[jti] = expiresAt
+	}
+	return nil
+}
+
+func (s *MemoryStore) RevokeUser(username string, before time.Time) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if before.After(s.users[username]) {
+		s.users[username] = before
+	}
+	return nil
+}
+
+func (s *MemoryStore) IsRevoked(jti string, username string, issuedAt time.Time) (revoked bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[jti]; ok {
+		return true, nil
+	}
+	before, ok := s.users[username]
+	return ok && issuedBefore(issuedAt, before), nil
+}
+
+func (s *MemoryStore) Revocations(now time.Time, since time.Time) (tokens map[string]time.Time, users map[string]time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, users = map[string]time.Time{}, map[string]time.Time{}
+	for jti, expiresAt := range s.tokens {
+		if expiresAt.After(now) {
+			tokens[jti] = expiresAt
+		}
+	}
+	for username, before := range s.users {
+		if before.After(since) {
+			users[username] = before
+		}
+	}
+	return tokens, users, nil
+}
@@ -0,0 +1,98 @@
+package revocationstore
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Store implementation backed by the revoked_token and revoked_user tables,
+// so that revocations are shared by every replica of the service.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) RevokeToken(jti string, expiresAt time.Time) (err error) {
+	// Forget revocations of tokens that have expired since
+	_, err = s.db.Exec("DELETE FROM revoked_token WHERE expires_at < ?", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	// Revoking a token twice, e.g. by logging out twice, succeeds and keeps the later expiry
+	_, err = s.db.Exec(
+		"INSERT INTO revoked_token (jti, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at = GREATEST(expires_at, VALUES(expires_at))",
+		jti, expiresAt.UTC(),
+	)
+	return err
+}
+
+func (s *MySQLStore) RevokeUser(username string, before time.Time) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM revoked_user WHERE email=?", username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO revoked_user (email, revoked_before) VALUES (?, ?)", username, before.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *MySQLStore) IsRevoked(jti string, username string, issuedAt time.Time) (revoked bool, err error) {
+	var count int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM revoked_token WHERE jti=?", jti).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+	var before time.Time
+	err = s.db.QueryRow("SELECT revoked_before FROM revoked_user WHERE email=?", username).Scan(&before)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return issuedBefore(issuedAt, before), nil
+}
+
+func (s *MySQLStore) Revocations(now time.Time, since time.Time) (tokens map[string]time.Time, users map[string]time.Time, err error) {
+	tokens, err = s.queryRevocations("SELECT jti, expires_at FROM revoked_token WHERE expires_at > ?", now.UTC())
+	if err != nil {
+		return nil, nil, err
+	}
+	users, err = s.queryRevocations("SELECT email, revoked_before FROM revoked_user WHERE revoked_before > ?", since.UTC())
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, users, nil
+}
+
+// Runs a query selecting a key and a time and returns the rows as a map
+func (s *MySQLStore) queryRevocations(query string, arg time.Time) (revocations map[string]time.Time, err error) {
+	rows, err := s.db.Query(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revocations = map[string]time.Time{}
+	for rows.Next() {
+		var key string
+		var t time.Time
+		if err := rows.Scan(&key, &t); err != nil {
+			return nil, err
+		}
+		revocations[key] = t
+	}
+	return revocations, rows.Err()
+}
@@ -0,0 +1,27 @@
+package revocationstore
+
+import "time"
+
+// Keeps track of revoked JWTs, so that they are no longer accepted even though
+// they have not expired yet. Tokens are identified by their jti claim.
+type Store interface {
+	// Revokes a single token. The revocation only needs to be remembered
+	// until expiresAt, after which the token is rejected anyway.
+	RevokeToken(jti string, expiresAt time.Time) (err error)
+	// Revokes every token issued to the user before the given time.
+	RevokeUser(username string, before time.Time) (err error)
+	// Returns true if the token with the given jti, issued to username at
+	// issuedAt, has been revoked individually or along with its user.
+	IsRevoked(jti string, username string, issuedAt time.Time) (revoked bool, err error)
+	// Returns the revoked tokens that have not expired at now, mapped to when they
+	// expire, and the users whose tokens were revoked after since, mapped to the time
+	// their tokens issued before are revoked.
+	Revocations(now time.Time, since time.Time) (tokens map[string]time.Time, users map[string]time.Time, err error)
+}
+
+// Returns true if a token issued at issuedAt was issued before the user's tokens were
+// revoked at before. JWT timestamps only have second precision, so before is truncated
+// to make sure that tokens issued right after a revocation are not rejected.
+func issuedBefore(issuedAt time.Time, before time.Time) bool {
+	return issuedAt.Before(before.Truncate(time.Second))
+}
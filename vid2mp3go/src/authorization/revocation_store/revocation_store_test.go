@@ -0,0 +1,160 @@
+package revocationstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMemoryStoreRevokeToken(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	if err := s.RevokeToken("revoked_jti", now.Add(time.Hour)); err != nil { t.Fatal(err.Error()) }
+
+	revoked, err := s.IsRevoked("revoked_jti", "test_user", now)
+	if err != nil || !revoked { t.Fatal("Revoked token was not revoked") }
+	revoked, err = s.IsRevoked("other_jti", "test_user", now)
+	if err != nil || revoked { t.Fatal("Token that was not revoked was revoked") }
+}
+
+func TestMemoryStoreRevokeTokenTwice(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	if err := s.RevokeToken("revoked_jti", now.Add(time.Hour)); err != nil { t.Fatal(err.Error()) }
+	if err := s.RevokeToken("revoked_jti", now.Add(time.Minute)); err != nil { t.Fatal("Revoking a token twice failed", err.Error()) }
+
+	revoked, err := s.IsRevoked("revoked_jti", "test_user", now)
+	if err != nil || !revoked { t.Fatal("Token revoked twice was not revoked") }
+	if !s.tokens["revoked_jti"].Equal(now.Add(time.Hour)) { t.Fatal("Later expiry was replaced by an earlier one") }
+}
+
+func TestMemoryStoreForgetsExpiredTokens(t *testing.T) {
+	s := NewMemoryStore()
+	s.RevokeToken("expired_jti", time.Now().Add(-time.Minute))
+	s.RevokeToken("revoked_jti", time.Now().Add(time.Hour))
+	if _, ok := s.tokens["expired_jti"]; ok { t.Fatal("Expired token was not forgotten") }
+	if _, ok := s.tokens["revoked_jti"]; !ok { t.Fatal("Revoked token was forgotten") }
+}
+
+func TestMemoryStoreRevokeUser(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	if err := s.RevokeUser("test_user", now); err != nil { t.Fatal(err.Error()) }
+
+	revoked, _ := s.IsRevoked("old_jti", "test_user", now.Add(-time.Hour))
+	if !revoked { t.Fatal("Token issued before revocation was not revoked") }
+	revoked, _ = s.IsRevoked("new_jti", "test_user", now.Add(time.Second))
+	if revoked { t.Fatal("Token issued after revocation was revoked") }
+	revoked, _ = s.IsRevoked("same_second_jti", "test_user", now.Truncate(time.Second))
+	if revoked { t.Fatal("Token issued during the second of revocation was revoked") }
+	revoked, _ = s.IsRevoked("old_jti", "other_user", now.Add(-time.Hour))
+	if revoked { t.Fatal("Token of another user was revoked") }
+
+	// An older revocation must not undo a newer one
+	s.RevokeUser("test_user", now.Add(-2*time.Hour))
+	revoked, _ = s.IsRevoked("old_jti", "test_user", now.Add(-time.Hour))
+	if !revoked { t.Fatal("Older revocation replaced a newer one") }
+}
+
+func TestMySQLStoreRevokeToken(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	expiresAt := time.Now().Add(time.Hour)
+	insertRevokedToken := "INSERT INTO revoked_token (jti, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at = GREATEST(expires_at, VALUES(expires_at))"
+	mock.ExpectExec("DELETE FROM revoked_token WHERE expires_at < ?").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(insertRevokedToken).WithArgs("test_jti", expiresAt.UTC()).WillReturnResult(sqlmock.NewResult(1, 1))
+	// The token is already revoked, so MySQL reports that no row was affected
+	mock.ExpectExec("DELETE FROM revoked_token WHERE expires_at < ?").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(insertRevokedToken).WithArgs("test_jti", expiresAt.UTC()).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	s := NewMySQLStore(db)
+	if err := s.RevokeToken("test_jti", expiresAt); err != nil { t.Fatal(err.Error()) }
+	if err := s.RevokeToken("test_jti", expiresAt); err != nil { t.Fatal("Revoking a token twice failed", err.Error()) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestMemoryStoreRevocations(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.RevokeToken("revoked_jti", now.Add(time.Hour))
+	s.tokens["expired_jti"] = now.Add(-time.Minute)
+	s.RevokeUser("recent_user", now)
+	s.RevokeUser("old_user", now.Add(-time.Hour))
+
+	tokens, users, err := s.Revocations(now, now.Add(-15*time.Minute))
+	if err != nil { t.Fatal(err.Error()) }
+	if len(tokens) != 1 || !tokens["revoked_jti"].Equal(now.Add(time.Hour)) { t.Fatal("Tokens were incorrect", tokens) }
+	if len(users) != 1 || !users["recent_user"].Equal(now) { t.Fatal("Users were incorrect", users) }
+}
+
+func TestMySQLStoreRevokeUser(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	before := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM revoked_user WHERE email=?").WithArgs("test_user").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO revoked_user (email, revoked_before) VALUES (?, ?)").WithArgs("test_user", before.UTC()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := NewMySQLStore(db).RevokeUser("test_user", before); err != nil { t.Fatal(err.Error()) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestMySQLStoreRevocations(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	now := time.Now()
+	since := now.Add(-15*time.Minute)
+	mock.ExpectQuery("SELECT jti, expires_at FROM revoked_token WHERE expires_at > ?").WithArgs(now.UTC()).
+		WillReturnRows(sqlmock.NewRows([]string{"jti", "expires_at"}).AddRow("test_jti", now.Add(time.Hour)))
+	mock.ExpectQuery("SELECT email, revoked_before FROM revoked_user WHERE revoked_before > ?").WithArgs(since.UTC()).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "revoked_before"}).AddRow("test_user", now))
+
+	tokens, users, err := NewMySQLStore(db).Revocations(now, since)
+	if err != nil { t.Fatal(err.Error()) }
+	if !tokens["test_jti"].Equal(now.Add(time.Hour)) || !users["test_user"].Equal(now) { t.Fatal("Revocations were incorrect", tokens, users) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestMySQLStoreIsRevoked(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name			string
+		tokenCount		int
+		revokedBefore	time.Time
+		expected		bool
+	}{
+		{ name: "Token revoked", tokenCount: 1, expected: true, },
+		{ name: "Nothing revoked", tokenCount: 0, expected: false, },
+		{ name: "User revoked after token was issued", tokenCount: 0, revokedBefore: now.Add(time.Hour), expected: true, },
+		{ name: "User revoked before token was issued", tokenCount: 0, revokedBefore: now.Add(-time.Hour), expected: false, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT COUNT(*) FROM revoked_token WHERE jti=?").WithArgs("test_jti").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.tokenCount))
+			if tt.tokenCount == 0 {
+				rows := sqlmock.NewRows([]string{"revoked_before"})
+				if !tt.revokedBefore.IsZero() {
+					rows.AddRow(tt.revokedBefore)
+				}
+				mock.ExpectQuery("SELECT revoked_before FROM revoked_user WHERE email=?").WithArgs("test_user").WillReturnRows(rows)
+			}
+
+			revoked, err := NewMySQLStore(db).IsRevoked("test_jti", "test_user", now)
+			if err != nil { t.Fatal(err.Error()) }
+			if revoked != tt.expected { t.Fatal("Revocation status was incorrect", revoked) }
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	RevocationStore "microservices/authorization/revocation_store"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestLogout(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		expired			bool
+		refreshToken	string
+		authHeader		string
+	}{
+		{
+			name: "Successful logout",
+			method: "POST",
+			expectedCode: 200,
+		},
+		{
+			name: "Successful logout with refresh token",
+			method: "POST",
+			expectedCode: 200,
+			refreshToken: "test_refresh_token",
+		},
+		{
+			name: "Successful logout with expired JWT",
+			method: "POST",
+			expectedCode: 200,
+			expired: true,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+		{
+			name: "JWT missing from headers",
+			method: "POST",
+			expectedCode: 400,
+			authHeader: "",
+		},
+		{
+			name: "Not Authorized",
+			method: "POST",
+			expectedCode: 403,
+			authHeader: "Bearer tokenString",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tokenString, _ := CreateJWT(testUser)
+			if tt.expired {
+				signingKey, _ := keyRing.SigningKey()
+				tokenString = SignTestJWT(signingKey, jwt.MapClaims{
+					"jti": "expired_jti",
+					"iss": jwtIssuer,
+					"aud": jwtAudience,
+					"username": "test_user",
+					"exp": time.Now().Add(-time.Hour).Unix(),
+					"iat": time.Now().Add(-2 * time.Hour).Unix(),
+				})
+			}
+			claims, _ := ParseJWT(tokenString, jwt.WithoutClaimsValidation())
+
+			req, err := http.NewRequest(tt.method, "/logout", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.authHeader != "" || tt.expectedCode != 400 {
+				if tt.authHeader == "" {
+					tt.authHeader = "Bearer " + tokenString
+				}
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			if tt.refreshToken != "" {
+				req.Header.Set("Refresh-Token", tt.refreshToken)
+				mock.ExpectQuery("SELECT family_id FROM refresh_token WHERE token_hash=? AND user_id=?").
+					WithArgs(SecureToken.Hash(tt.refreshToken), 1).
+					WillReturnRows(sqlmock.NewRows([]string{"family_id"}).AddRow("test_family"))
+				mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE family_id=?").WithArgs("test_family").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Logout)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if resp.Code == 200 {
+				issuedAt, _ := claims.GetIssuedAt()
+				revoked, _ := revocationStore.IsRevoked(claims["jti"].(string), "test_user", issuedAt.Time)
+				if !revoked { t.Fatal("JWT was not revoked") }
+				if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			}
+		})
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	revocationStore = RevocationStore.NewMemoryStore()
+	now := time.Now()
+	revocationStore.RevokeToken("revoked_jti", now.Add(time.Minute))
+	revocationStore.RevokeToken("expired_jti", now.Add(-time.Minute))
+	revocationStore.RevokeUser("revoked_user", now)
+	revocationStore.RevokeUser("expired_user", now.Add(-accessTokenTTL - time.Minute))
+
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		clientID		string
+		clientSecret	string
+	}{
+		{name: "Revocations listed", method: "GET", expectedCode: 200, clientID: "resource_server", clientSecret: "client_secret"},
+		{name: "Client credentials missing", method: "GET", expectedCode: 401},
+		{name: "Client secret incorrect", method: "GET", expectedCode: 401, clientID: "resource_server", clientSecret: "wrong_secret"},
+		{name: "Client lacks introspection scope", method: "GET", expectedCode: 403, clientID: "confidential_client", clientSecret: "client_secret"},
+		{name: "Incorrect HTTP request method", method: "POST", expectedCode: 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			if tt.clientID != "" {
+				ExpectOAuthClientQuery(mock, tt.clientID)
+			}
+
+			req, err := http.NewRequest(tt.method, "/revocations", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.clientID != "" {
+				req.SetBasicAuth(tt.clientID, tt.clientSecret)
+			}
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Revocations)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code != 200 { return }
+			var revocations RevocationList
+			if err := json.NewDecoder(resp.Body).Decode(&revocations); err != nil { t.Fatal(err.Error()) }
+			if _, ok := revocations.Tokens["revoked_jti"]; !ok || len(revocations.Tokens) != 1 { t.Fatal("Tokens were incorrect", revocations.Tokens) }
+			if _, ok := revocations.Users["revoked_user"]; !ok || len(revocations.Users) != 1 { t.Fatal("Users were incorrect", revocations.Users) }
+		})
+	}
+}
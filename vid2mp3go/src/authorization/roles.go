@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Role given to every newly registered user
+const defaultRole = "user"
+
+// Permission required by the admin endpoints
+const adminPermission = "admin"
+
+// A user as represented in the claims of a JWT. ClientID is only set for JWTs
+// issued to OAuth clients acting on behalf of the user. SessionID is only set for
+// JWTs issued along with a refresh token, and for scoped JWTs minted from them.
+// Scoped is set for JWTs minted at /tokens/scoped, which can be restricted to the
+// mp3 with the given Fid. Org is the ID of the organization the user is a member of.
+type User struct {
+	ID            int64
+	Username      string
+	Roles         []string
+	Permissions   []string
+	EmailVerified bool
+	ClientID      string
+	SessionID     string
+	Scoped        bool
+	Fid           string
+	Org           string
+}
+
+// Roles and permissions of a user, as returned by the GET /admin/roles endpoint
+type UserRoles struct {
+	Username    string   `json:"username"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// Fetches the roles of a user and the permissions granted by them from the DB.
+func GetUserRoles(userID int64) (roles []string, permissions []string, err error) {
+	rows, err := db.Query(
+		"SELECT role.name, permission.name FROM user_role JOIN role ON role.id = user_role.role_id LEFT JOIN role_permission ON role_permission.role_id = role.id LEFT JOIN permission ON permission.id = role_permission.permission_id WHERE user_role.user_id=?",
+		userID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	roles, permissions = []string{}, []string{}
+	for rows.Next() {
+		var role string
+		var permission sql.NullString
+		if err := rows.Scan(&role, &permission); err != nil {
+			return nil, nil, err
+		}
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+		if permission.Valid && !slices.Contains(permissions, permission.String) {
+			permissions = append(permissions, permission.String)
+		}
+	}
+	return roles, permissions, rows.Err()
+}
+
+// Returns the value of a string claim, or "" if the claim is missing or not a string.
+func GetStringClaim(claims jwt.MapClaims, key string) (value string) {
+	value, _ = claims[key].(string)
+	return value
+}
+
+// Returns the user ID in the sub claim of a JWT created by CreateJWT.
+func GetUserIDClaim(claims jwt.MapClaims) (userID int64, err error) {
+	return strconv.ParseInt(GetStringClaim(claims, "sub"), 10, 64)
+}
+
+// Returns the elements of a string array claim. Elements that are not
+// strings are skipped, so unexpected claim values can not cause a panic.
+func GetStringsClaim(claims jwt.MapClaims, key string) (values []string) {
+	values = []string{}
+	list, _ := claims[key].([]interface{})
+	for _, val := range list {
+		if s, ok := val.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// Checks that the request's Authorization header contains a valid JWT that has not
+// been revoked. JWTs issued to OAuth clients and scoped JWTs are rejected, so that
+// third-party tools and narrowly scoped credentials, e.g. download links, can not
+// manage the user's account. If that is not the case, the appropriate status
+// is sent and ok is false. Otherwise the JWT's claims are returned.
+func RequireAuthentication(w http.ResponseWriter, r *http.Request) (claims jwt.MapClaims, ok bool) {
+	tokenString, ok := GetBearerToken(r)
+	if !ok {
+		SendStatus.InvalidCredentials(w)
+		return nil, false
+	}
+	claims, err := ParseJWT(tokenString)
+	if err != nil {
+		log.Printf("JWT decode failed:\n%s", err.Error())
+		SendStatus.InvalidCredentials(w)
+		return nil, false
+	}
+	revoked, err := IsTokenRevoked(claims)
+	if err != nil {
+		log.Printf("Error occured while checking if JWT was revoked:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return nil, false
+	}
+	if revoked {
+		SendStatus.Forbidden(w)
+		return nil, false
+	}
+	if _, delegated := claims["client_id"]; delegated {
+		log.Println("JWT issued to an OAuth client was rejected")
+		SendStatus.Forbidden(w)
+		return nil, false
+	}
+	if scoped, _ := claims["scoped"].(bool); scoped {
+		log.Println("Scoped JWT was rejected")
+		SendStatus.Forbidden(w)
+		return nil, false
+	}
+	return claims, true
+}
+
+// Same as RequireAuthentication, but the JWT also has to grant the given permission.
+// If it does not, 403 is sent and ok is false.
+func RequirePermission(w http.ResponseWriter, r *http.Request, permission string) (claims jwt.MapClaims, ok bool) {
+	claims, ok = RequireAuthentication(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !slices.Contains(GetStringsClaim(claims, "permissions"), permission) {
+		SendStatus.Forbidden(w)
+		return nil, false
+	}
+	return claims, true
+}
+
+// Admin endpoint for managing the roles of users. Requires a JWT with the admin permission.
+// GET returns the roles of the user given with the username query parameter as JSON.
+// POST assigns and DELETE removes the role given in the Role header to/from the user
+// given in the Username header. Removing a role revokes the user's current JWTs, so that
+// the permissions granted by the role can not be used until the user gets a new JWT.
+func Roles(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Roles request received with method", r.Method)
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	if _, ok := RequirePermission(w, r, adminPermission); !ok {
+		return
+	}
+	if r.Method == "GET" {
+		GetRoles(users, w, r.URL.Query().Get("username"))
+		return
+	}
+	username, role := r.Header.Get("Username"), r.Header.Get("Role")
+	if username == "" || role == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var roleID int64
+	user, err := users.FindByEmail(username)
+	if err == nil {
+		err = db.QueryRow("SELECT id FROM role WHERE name=?", role).Scan(&roleID)
+	}
+	if errors.Is(err, UserStore.ErrUserNotFound) || errors.Is(err, sql.ErrNoRows) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user or role from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+
+	if r.Method == "POST" {
+		_, err = db.Exec("INSERT INTO user_role (user_id, role_id) VALUES (?, ?)", user.ID, roleID)
+		if UserStore.IsDuplicateEntry(err) {
+			SendStatus.Conflict(w)
+			return
+		}
+	} else {
+		_, err = db.Exec("DELETE FROM user_role WHERE user_id=? AND role_id=?", user.ID, roleID)
+		if err == nil {
+			err = revocationStore.RevokeUser(username, time.Now())
+		}
+	}
+	if err != nil {
+		log.Printf("Error occured while trying to update roles of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Roles of user %s updated, %s %s", username, r.Method, role)
+	fmt.Fprintf(w, "Roles updated.")
+}
+
+// Sends the roles and permissions of the given user as JSON.
+func GetRoles(users UserStore.Store, w http.ResponseWriter, username string) {
+	if username == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.NotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	roles, permissions, err := GetUserRoles(user.ID)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch roles from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserRoles{Username: username, Roles: roles, Permissions: permissions})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	RevocationStore "microservices/authorization/revocation_store"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestGetStringsClaim(t *testing.T) {
+	claims := jwt.MapClaims{
+		"roles": []interface{}{"admin", 5, "user", nil},
+		"admin": true,
+	}
+	if roles := GetStringsClaim(claims, "roles"); !slices.Equal(roles, []string{"admin", "user"}) {
+		t.Fatal("Roles were incorrect", roles)
+	}
+	if values := GetStringsClaim(claims, "admin"); len(values) != 0 {
+		t.Fatal("Claim that was not an array returned values", values)
+	}
+	if values := GetStringsClaim(claims, "missing"); values == nil || len(values) != 0 {
+		t.Fatal("Missing claim did not return an empty array", values)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		permissions		[]string
+		username		string
+		role			string
+	}{
+		{
+			name: "Successful role listing",
+			method: "GET",
+			expectedCode: 200,
+			permissions: []string{"admin"},
+			username: "other_user",
+		},
+		{
+			name: "Successful role assignment",
+			method: "POST",
+			expectedCode: 200,
+			permissions: []string{"admin"},
+			username: "other_user",
+			role: "admin",
+		},
+		{
+			name: "Role already assigned",
+			method: "POST",
+			expectedCode: 409,
+			permissions: []string{"admin"},
+			username: "other_user",
+			role: "admin",
+		},
+		{
+			name: "Successful role removal",
+			method: "DELETE",
+			expectedCode: 200,
+			permissions: []string{"admin"},
+			username: "other_user",
+			role: "admin",
+		},
+		{
+			name: "Unknown user",
+			method: "POST",
+			expectedCode: 404,
+			permissions: []string{"admin"},
+			username: "unknown_user",
+			role: "admin",
+		},
+		{
+			name: "Unknown role",
+			method: "POST",
+			expectedCode: 404,
+			permissions: []string{"admin"},
+			username: "other_user",
+			role: "unknown_role",
+		},
+		{
+			name: "Role missing from headers",
+			method: "POST",
+			expectedCode: 400,
+			permissions: []string{"admin"},
+			username: "other_user",
+		},
+		{
+			name: "JWT missing from headers",
+			method: "POST",
+			expectedCode: 401,
+			username: "other_user",
+			role: "admin",
+		},
+		{
+			name: "Admin permission missing",
+			method: "POST",
+			expectedCode: 403,
+			permissions: []string{"upload:write", "download:read"},
+			username: "other_user",
+			role: "admin",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "PUT",
+			expectedCode: 405,
+			permissions: []string{"admin"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			req, err := http.NewRequest(tt.method, "/admin/roles?username="+tt.username, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.permissions != nil {
+				tokenString, _ := CreateJWT(User{ID: 1, Username: "test_user", Permissions: tt.permissions})
+				req.Header.Set("Authorization", "Bearer " + tokenString)
+			}
+			req.Header.Set("Username", tt.username)
+			req.Header.Set("Role", tt.role)
+
+			userRows := sqlmock.NewRows(userColumns)
+			if tt.username != "unknown_user" {
+				userRows.AddRow(2, tt.username, "", true, false, nil)
+			}
+			roleRows := sqlmock.NewRows([]string{"id"})
+			if tt.role != "unknown_role" {
+				roleRows.AddRow(3)
+			}
+			mock.ExpectQuery(selectUserByEmail).WithArgs(tt.username).WillReturnRows(userRows)
+			if tt.method == "GET" {
+				ExpectUserRolesQuery(mock, 2)
+			} else {
+				mock.ExpectQuery("SELECT id FROM role WHERE name=?").WithArgs(tt.role).WillReturnRows(roleRows)
+			}
+			if tt.name == "Role already assigned" {
+				mock.ExpectExec("INSERT INTO user_role (user_id, role_id) VALUES (?, ?)").WithArgs(2, 3).WillReturnError(duplicateEntryErr)
+			} else if tt.method == "POST" {
+				mock.ExpectExec("INSERT INTO user_role (user_id, role_id) VALUES (?, ?)").WithArgs(2, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+			} else if tt.method == "DELETE" {
+				mock.ExpectExec("DELETE FROM user_role WHERE user_id=? AND role_id=?").WithArgs(2, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Roles)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if resp.Code == 200 {
+				if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			}
+			if tt.method == "GET" && resp.Code == 200 {
+				bodyBytes, err := io.ReadAll(resp.Body)
+				if err != nil { t.Fatalf("Error while reading resp body:\n%s", err.Error()) }
+				if !strings.Contains(string(bodyBytes), `"roles":["user"]`) {
+					t.Fatal("Response JSON did not include roles", string(bodyBytes))
+				}
+			}
+			if tt.method == "DELETE" && resp.Code == 200 {
+				revoked, _ := revocationStore.IsRevoked("old_jti", "other_user", time.Now().Add(-time.Minute))
+				if !revoked { t.Fatal("JWTs of the user were not revoked") }
+			}
+		})
+	}
+}
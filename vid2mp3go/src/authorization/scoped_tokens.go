@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	AuditLog "microservices/authorization/audit_log"
+	SendStatus "microservices/authorization/send_status"
+	"net/http"
+	"slices"
+)
+
+// Scope a JWT restricted to a single mp3 is limited to
+const downloadScope = "download:read"
+
+// Endpoint for minting a scoped JWT, e.g. a download link that only grants access to
+// a single mp3. Requires a JWT of the user, which scoped JWTs can not be minted from.
+// The POST request's Scope header lists the scopes of the new JWT, separated by spaces.
+// They have to be scopes OAuth clients can be granted and be covered by the permissions
+// of the user's JWT, so the admin permission can not be minted. The optional Fid header
+// restricts the new JWT to the mp3 with that fid, which requires the scope to be
+// download:read only. The scoped JWT, which expires like any other JWT and belongs to
+// the same session, is written to the response body. It can not be used to manage the
+// user's account.
+func ScopedTokens(w http.ResponseWriter, r *http.Request) {
+	log.Println("ScopedTokens request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username := GetStringClaim(claims, "username")
+	scopes, fid := ParseScope(r.Header.Get("Scope")), r.Header.Get("Fid")
+	if len(scopes) == 0 || (fid != "" && !slices.Equal(scopes, []string{downloadScope})) {
+		SendStatus.BadRequest(w)
+		return
+	}
+	permissions := ScopedPermissions(GetStringsClaim(claims, "permissions"), scopes)
+	if !ScopesCovered(scopes, permissions) {
+		log.Printf("User %s requested a scoped JWT with scopes it was not granted: %v", username, scopes)
+		RecordAuditEvent(r, AuditLog.Token, username, AuditLog.Failure)
+		SendStatus.Forbidden(w)
+		return
+	}
+	userID, err := GetUserIDClaim(claims)
+	if err != nil {
+		log.Printf("JWT of user %s had an invalid sub claim", username)
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	emailVerified, _ := claims["email_verified"].(bool)
+	tokenString, err := CreateJWT(User{
+		ID: userID,
+		Username: username,
+		Roles: []string{},
+		Permissions: permissions,
+		EmailVerified: emailVerified,
+		SessionID: GetStringClaim(claims, "sid"),
+		Scoped: true,
+		Fid: fid,
+		Org: GetStringClaim(claims, "org"),
+	})
+	if err != nil {
+		log.Printf("Error occured while trying to create scoped JWT:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	RecordAuditEvent(r, AuditLog.Token, username, AuditLog.Success)
+	log.Printf("Scoped JWT with scopes %v minted for user %s", permissions, username)
+	fmt.Fprintf(w, "%s", tokenString)
+}
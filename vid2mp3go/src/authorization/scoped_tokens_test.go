@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	AuditLog "microservices/authorization/audit_log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Returns an Authorization header with a JWT of the given user belonging to the session "test_session".
+func ScopedTokenAuthHeader(user User) string {
+	user.SessionID = "test_session"
+	tokenString, _ := CreateJWT(user)
+	return "Bearer " + tokenString
+}
+
+func TestScopedTokens(t *testing.T) {
+	downloadOnly := testUser
+	downloadOnly.Roles, downloadOnly.Permissions = []string{"listener"}, []string{"download:read"}
+	scoped := testUser
+	scoped.Scoped = true
+	tests := []struct {
+		name			string
+		method			string
+		user			User
+		scope			string
+		fid				string
+		expectedCode	int
+	}{
+		{
+			name: "Download link for a single mp3",
+			method: "POST",
+			user: testUser,
+			scope: "download:read",
+			fid: "6650f1c2a1b2c3d4e5f60718",
+			expectedCode: 200,
+		},
+		{
+			name: "Several scopes",
+			method: "POST",
+			user: testUser,
+			scope: "upload:write download:read",
+			expectedCode: 200,
+		},
+		{
+			name: "Admin scope",
+			method: "POST",
+			user: testUser,
+			scope: "download:read admin",
+			expectedCode: 403,
+		},
+		{
+			name: "Scope the user was not granted",
+			method: "POST",
+			user: downloadOnly,
+			scope: "upload:write",
+			expectedCode: 403,
+		},
+		{
+			name: "Fid with other scopes than download:read",
+			method: "POST",
+			user: testUser,
+			scope: "upload:write download:read",
+			fid: "6650f1c2a1b2c3d4e5f60718",
+			expectedCode: 400,
+		},
+		{
+			name: "Scope missing",
+			method: "POST",
+			user: testUser,
+			expectedCode: 400,
+		},
+		{
+			name: "Minted from scoped JWT",
+			method: "POST",
+			user: scoped,
+			scope: "download:read",
+			expectedCode: 403,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			user: testUser,
+			scope: "download:read",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := WithTestAuditLog(t)
+			req, err := http.NewRequest(tt.method, "/tokens/scoped", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", ScopedTokenAuthHeader(tt.user))
+			if tt.scope != "" { req.Header.Set("Scope", tt.scope) }
+			if tt.fid != "" { req.Header.Set("Fid", tt.fid) }
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ScopedTokens)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code != 200 { return }
+			events := store.Events()
+			if events[len(events)-1].Type != AuditLog.Token || events[len(events)-1].Outcome != AuditLog.Success { t.Fatal("Audit event was incorrect", events) }
+
+			claims := ParseTestClaims(t, "Bearer " + resp.Body.String())
+			if scoped, _ := claims["scoped"].(bool); !scoped { t.Fatal("JWT was not marked as scoped") }
+			if GetStringClaim(claims, "scope") != tt.scope || GetStringClaim(claims, "fid") != tt.fid { t.Fatal("Scope or fid was incorrect", claims) }
+			if GetStringClaim(claims, "sid") != "test_session" || GetStringClaim(claims, "sub") != "1" { t.Fatal("Session or user was incorrect", claims) }
+			if admin, _ := claims["admin"].(bool); admin { t.Fatal("Scoped JWT was an admin JWT") }
+
+			// The gateway is told the scope and fid of the scoped JWT
+			req, _ = http.NewRequest("POST", "/validate", nil)
+			req.Header.Set("Authorization", "Bearer " + resp.Body.String())
+			resp = httptest.NewRecorder()
+			Validate(MockUserStore(), resp, req)
+			var validated JsonStruct
+			if err := json.NewDecoder(resp.Body).Decode(&validated); err != nil { t.Fatal(err.Error()) }
+			if validated.Scope != tt.scope || validated.Fid != tt.fid || validated.Admin { t.Fatal("Validation response was incorrect", validated) }
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package securetoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Returns a URL safe random string created from the given number of random bytes.
+// Use at least 32 bytes for anything that grants access to an account.
+func Generate(numBytes int) (token string, err error) {
+	b := make([]byte, numBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Returns the hex encoded SHA-256 hash of a token. Only hashes of tokens are
+// stored in the DB, so a leaked table cannot be used to access accounts.
+// A fast hash is enough, since generated tokens have plenty of entropy.
+func Hash(token string) (hash string) {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,20 @@
+package securetoken
+
+import "testing"
+
+func TestGenerate(t *testing.T) {
+	token, err := Generate(32)
+	if err != nil { t.Fatalf("Token generation failed:\n%s", err.Error()) }
+	if len(token) != 43 { t.Fatal("Token length was incorrect", len(token)) }
+
+	other, _ := Generate(32)
+	if token == other { t.Fatal("Two generated tokens were identical") }
+}
+
+func TestHash(t *testing.T) {
+	hash := Hash("test_token")
+	if hash != "cc0af97287543b65da2c7e1476426021826cab166f1e063ed012b855ff819656" {
+		t.Fatal("Hash was incorrect", hash)
+	}
+	if Hash("other_token") == hash { t.Fatal("Different tokens had the same hash") }
+}
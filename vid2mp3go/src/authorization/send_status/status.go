@@ -2,7 +2,10 @@ package sendstatus
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // This function is used to send a HTTP response with status code 400.
@@ -26,6 +29,13 @@ func Forbidden(w http.ResponseWriter) {
 	fmt.Fprintf(w, "Credentials were invalid.")
 }
 
+// This function is used to send a HTTP response with status code 404.
+// Use it when the requested resource, e.g. a user, does not exist.
+func NotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "Not found.")
+}
+
 // This function is used to send a HTTP response with status code 405.
 // Use it when receiving a request with an unallowed HTTP method.
 func MethodNotAllowed(w http.ResponseWriter) {
@@ -40,9 +50,23 @@ func Conflict(w http.ResponseWriter) {
 	fmt.Fprintf(w, "Conflict.")
 }
 
+// This function is used to send a HTTP response with status code 429.
+// Use it when a client has to wait before retrying, e.g. after too many
+// failed logins. retryAfter is sent in the Retry-After header in seconds.
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds(retryAfter)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "Too many requests.")
+}
+
 // This function is used to send a HTTP response with status code 500.
 // Use it when something unexpected occurs.
 func InternalServerError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	fmt.Fprintf(w, "Internal server error.")
-}
\ No newline at end of file
+}
+
+// Returns retryAfter in whole seconds, rounded up, as sent in the Retry-After header.
+func RetryAfterSeconds(retryAfter time.Duration) int {
+	return int(math.Ceil(retryAfter.Seconds()))
+}
@@ -2,7 +2,9 @@ package sendstatus
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type MockResponseWriter struct {
@@ -43,6 +45,10 @@ func TestForbidden(t *testing.T) {
 	CheckStatus(Forbidden, 403, t)
 }
 
+func TestNotFound(t *testing.T) {
+	CheckStatus(NotFound, 404, t)
+}
+
 func TestMethodNotwAllowed(t *testing.T) {
 	CheckStatus(MethodNotAllowed, 405, t)
 }
@@ -51,6 +57,13 @@ func TestConflict(t *testing.T) {
 	CheckStatus(Conflict, 409, t)
 }
 
+func TestTooManyRequests(t *testing.T) {
+	resp := httptest.NewRecorder()
+	TooManyRequests(resp, 1500*time.Millisecond)
+	if resp.Code != 429 { t.Fatal("Status was incorrect", resp.Code) }
+	if resp.Header().Get("Retry-After") != "2" { t.Fatal("Retry-After was incorrect", resp.Header().Get("Retry-After")) }
+}
+
 func TestInternalServerError(t *testing.T) {
 	CheckStatus(InternalServerError, 500, t)
 }
\ No newline at end of file
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"time"
+)
+
+// A device the user is logged in on, as listed by the GET /sessions endpoint. The ID is
+// the one of the session's refresh token family. Current is true for the session of the
+// JWT used for listing the sessions.
+type Session struct {
+	ID			string		`json:"id"`
+	UserAgent	string		`json:"user_agent"`
+	IP			string		`json:"ip"`
+	CreatedAt	time.Time	`json:"created_at"`
+	LastUsedAt	time.Time	`json:"last_used_at"`
+	Current		bool		`json:"current"`
+}
+
+// Records a new session of the given user for the token family started by the client.
+func StartSession(client ClientInfo, userID int64, familyID string) (err error) {
+	now := time.Now().UTC()
+	_, err = db.Exec(
+		"INSERT INTO session (family_id, user_id, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?)",
+		familyID, userID, client.UserAgent, client.IP, now, now,
+	)
+	return err
+}
+
+// Marks the session of the given token family as used by the client.
+// Failures are only logged, since the session is only shown to its user.
+func TouchSession(client ClientInfo, familyID string) {
+	_, err := db.Exec(
+		"UPDATE session SET user_agent=?, ip=?, last_used_at=? WHERE family_id=?",
+		client.UserAgent, client.IP, time.Now().UTC(), familyID,
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to update session:\n%s", err.Error())
+	}
+}
+
+// Endpoint for the sessions of the user of the JWT in the Authorization header. A session
+// is started by every login and lasts as long as its refresh tokens can be used.
+// GET lists the user's sessions, most recently used first, as JSON. DELETE ends the
+// session given in the Session-Id header by revoking its refresh tokens and JWTs.
+func Sessions(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Sessions request received with method", r.Method)
+	if r.Method != "GET" && r.Method != "DELETE" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	claims, ok := RequireAuthentication(w, r)
+	if !ok { return }
+	username := GetStringClaim(claims, "username")
+	sessionID := r.Header.Get("Session-Id")
+	if r.Method == "DELETE" && sessionID == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if r.Method == "DELETE" {
+		RevokeSession(w, user.ID, username, sessionID)
+		return
+	}
+	ListSessions(w, user.ID, GetStringClaim(claims, "sid"))
+}
+
+// Sends the sessions of the given user, whose refresh tokens can still be used, as JSON.
+// The session with the ID currentID is marked as the current one.
+func ListSessions(w http.ResponseWriter, userID int64, currentID string) {
+	rows, err := db.Query(
+		"SELECT family_id, user_agent, ip, created_at, last_used_at FROM session WHERE user_id=? AND EXISTS (SELECT 1 FROM refresh_token WHERE refresh_token.family_id = session.family_id AND refresh_token.used=FALSE AND refresh_token.revoked=FALSE AND refresh_token.expires_at > ?) ORDER BY last_used_at DESC",
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Printf("Error occured while trying to fetch sessions from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.ID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastUsedAt); err != nil {
+			log.Printf("Error occured while trying to fetch sessions from DB:\n%s", err.Error())
+			SendStatus.InternalServerError(w)
+			return
+		}
+		session.Current = session.ID == currentID
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error occured while trying to fetch sessions from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// Ends the session with the given ID, if it belongs to the given user. Its refresh tokens
+// are revoked and its ID is revoked like a jti until every JWT issued for the session has
+// expired, so that Validate rejects them. Sessions of other users are reported as unknown.
+func RevokeSession(w http.ResponseWriter, userID int64, username string, sessionID string) {
+	found, err := DeleteSession(userID, sessionID)
+	if err != nil {
+		log.Printf("Error occured while trying to delete session of user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if !found {
+		SendStatus.NotFound(w)
+		return
+	}
+	if err := revocationStore.RevokeToken(sessionID, time.Now().Add(accessTokenTTL)); err != nil {
+		log.Printf("Error occured while trying to revoke JWTs of session:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	log.Printf("Session of user %s revoked", username)
+	fmt.Fprintf(w, "Session revoked.")
+}
+
+// Deletes the session with the given ID, if it belongs to the given user, and revokes
+// its refresh tokens. Returns false if the user has no such session.
+func DeleteSession(userID int64, sessionID string) (found bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM session WHERE family_id=? AND user_id=?", sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE refresh_token SET revoked=TRUE WHERE family_id=?", sessionID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
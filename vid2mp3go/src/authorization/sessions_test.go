@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	RevocationStore "microservices/authorization/revocation_store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const selectSessions = "SELECT family_id, user_agent, ip, created_at, last_used_at FROM session WHERE user_id=? AND EXISTS (SELECT 1 FROM refresh_token WHERE refresh_token.family_id = session.family_id AND refresh_token.used=FALSE AND refresh_token.revoked=FALSE AND refresh_token.expires_at > ?) ORDER BY last_used_at DESC"
+
+// Returns an Authorization header with a JWT of "test_user" belonging to the given session.
+func SessionAuthHeader(sessionID string) string {
+	user := testUser
+	user.SessionID = sessionID
+	tokenString, _ := CreateJWT(user)
+	return "Bearer " + tokenString
+}
+
+func TestSessions(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		sessionID		string
+		expectedCode	int
+		deleted			int64
+	}{
+		{
+			name: "List sessions",
+			method: "GET",
+			expectedCode: 200,
+		},
+		{
+			name: "Revoke session",
+			method: "DELETE",
+			sessionID: "other_session",
+			expectedCode: 200,
+			deleted: 1,
+		},
+		{
+			name: "Revoke unknown session",
+			method: "DELETE",
+			sessionID: "unknown_session",
+			expectedCode: 404,
+		},
+		{
+			name: "Session ID missing",
+			method: "DELETE",
+			expectedCode: 400,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "POST",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocationStore = RevocationStore.NewMemoryStore()
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.expectedCode == 200 || tt.expectedCode == 404 {
+				ExpectUserQuery(mock, "test_user", 1)
+			}
+			if tt.method == "GET" {
+				mock.ExpectQuery(selectSessions).WithArgs(1, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"family_id", "user_agent", "ip", "created_at", "last_used_at"}).
+						AddRow("current_session", "test-agent", "203.0.113.7", time.Now(), time.Now()).
+						AddRow("other_session", "other-agent", "198.51.100.2", time.Now(), time.Now().Add(-time.Hour)))
+			} else if tt.expectedCode != 400 && tt.expectedCode != 405 {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM session WHERE family_id=? AND user_id=?").WithArgs(tt.sessionID, 1).WillReturnResult(sqlmock.NewResult(0, tt.deleted))
+				if tt.deleted == 1 {
+					mock.ExpectExec("UPDATE refresh_token SET revoked=TRUE WHERE family_id=?").WithArgs(tt.sessionID).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectCommit()
+				} else {
+					mock.ExpectRollback()
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/sessions", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", SessionAuthHeader("current_session"))
+			if tt.sessionID != "" { req.Header.Set("Session-Id", tt.sessionID) }
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Sessions)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			if tt.method == "GET" && resp.Code == 200 {
+				var sessions []Session
+				if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil { t.Fatal(err.Error()) }
+				if len(sessions) != 2 || !sessions[0].Current || sessions[1].Current || sessions[1].IP != "198.51.100.2" {
+					t.Fatal("Listed sessions were incorrect", sessions)
+				}
+			}
+			if tt.method == "DELETE" && resp.Code == 200 {
+				// JWTs of the revoked session are rejected, those of other sessions are not
+				revoked, _ := IsTokenRevoked(ParseTestClaims(t, SessionAuthHeader("other_session")))
+				if !revoked { t.Fatal("JWT of revoked session was not revoked") }
+				revoked, _ = IsTokenRevoked(ParseTestClaims(t, SessionAuthHeader("current_session")))
+				if revoked { t.Fatal("JWT of other session was revoked") }
+			}
+		})
+	}
+}
+
+func TestSendTokensStartsSession(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+	ExpectSendTokens(mock, 1, true)
+
+	req, _ := http.NewRequest("POST", "/login", nil)
+	resp := httptest.NewRecorder()
+	if err := SendTokens(MockUserStore(), resp, req, 1, "test_user", ""); err != nil { t.Fatal(err.Error()) }
+
+	claims := ParseTestClaims(t, "Bearer " + resp.Body.String())
+	if sid, _ := claims["sid"].(string); sid == "" { t.Fatal("JWT has no session ID") }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+// Parses the JWT of the given Authorization header.
+func ParseTestClaims(t *testing.T, authHeader string) jwt.MapClaims {
+	claims, err := ParseJWT(authHeader[len("Bearer "):])
+	if err != nil { t.Fatal(err.Error()) }
+	return claims
+}
@@ -0,0 +1,36 @@
+package signingkeys
+
+import "sync"
+
+// Store implementation that keeps keys in memory, for tests and local instances
+type MemoryStore struct {
+	mu   sync.Mutex
+	keys map[string]Key
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{keys: map[string]Key{}}
+}
+
+func (s *MemoryStore) List() (keys []Key, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) Insert(key Key) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.Kid] = key
+	return nil
+}
+
+func (s *MemoryStore) Delete(kid string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, kid)
+	return nil
+}
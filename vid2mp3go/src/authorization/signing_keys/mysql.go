@@ -0,0 +1,83 @@
+package signingkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+// Store implementation backed by the signing_key table. Private keys are
+// stored as PEM encoded PKCS #8, so access to the table must be restricted
+// to the authorization service.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) List() (keys []Key, err error) {
+	rows, err := s.db.Query("SELECT private_key, created_at FROM signing_key")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var privateKeyPem string
+		var createdAt time.Time
+		if err := rows.Scan(&privateKeyPem, &createdAt); err != nil {
+			return nil, err
+		}
+		privateKey, err := decodePrivateKey(privateKeyPem)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, NewKey(privateKey, createdAt))
+	}
+	return keys, rows.Err()
+}
+
+func (s *MySQLStore) Insert(key Key) (err error) {
+	privateKeyPem, err := encodePrivateKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO signing_key (kid, private_key, created_at) VALUES (?, ?, ?)",
+		key.Kid, privateKeyPem, key.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (s *MySQLStore) Delete(kid string) (err error) {
+	_, err = s.db.Exec("DELETE FROM signing_key WHERE kid=?", kid)
+	return err
+}
+
+func encodePrivateKey(privateKey ed25519.PrivateKey) (privateKeyPem string, err error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func decodePrivateKey(privateKeyPem string) (privateKey ed25519.PrivateKey, err error) {
+	block, _ := pem.Decode([]byte(privateKeyPem))
+	if block == nil {
+		return nil, errors.New("signing key was not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key was not an Ed25519 key")
+	}
+	return privateKey, nil
+}
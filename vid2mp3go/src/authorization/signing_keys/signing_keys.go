@@ -0,0 +1,200 @@
+package signingkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoSigningKey = errors.New("no signing key available")
+
+// An Ed25519 key used for signing JWTs. Kid is the key's RFC 7638 thumbprint.
+type Key struct {
+	Kid        string
+	PrivateKey ed25519.PrivateKey
+	CreatedAt  time.Time
+}
+
+// Persists signing keys, so that every replica of the service signs
+// with and publishes the same keys.
+type Store interface {
+	// Returns every stored key
+	List() (keys []Key, err error)
+	Insert(key Key) (err error)
+	Delete(kid string) (err error)
+}
+
+// A public key in the JSON Web Key format (RFC 8037)
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// A JSON Web Key Set, as published at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Creates a new Ed25519 key.
+func GenerateKey(now time.Time) (key Key, err error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Key{}, err
+	}
+	return NewKey(privateKey, now), nil
+}
+
+// Wraps an existing Ed25519 private key into a Key.
+func NewKey(privateKey ed25519.PrivateKey, createdAt time.Time) (key Key) {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	return Key{Kid: thumbprint(publicKey), PrivateKey: privateKey, CreatedAt: createdAt}
+}
+
+// Returns the RFC 7638 JWK thumbprint of a public key. The members of
+// the JWK are in lexicographic order, as required by the RFC.
+func thumbprint(publicKey ed25519.PublicKey) string {
+	jwk := `{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(publicKey) + `"}`
+	sum := sha256.Sum256([]byte(jwk))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (k Key) PublicKey() ed25519.PublicKey {
+	return k.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+func (k Key) JWK() JWK {
+	return JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   base64.RawURLEncoding.EncodeToString(k.PublicKey()),
+		Kid: k.Kid,
+		Use: "sig",
+		Alg: "EdDSA",
+	}
+}
+
+// Keeps track of the keys that are used for signing and verifying JWTs.
+// The newest key signs new JWTs. A new key is created every rotationInterval.
+// Older keys stay published, so that the JWTs they signed can still be verified,
+// until tokenTTL has passed since they were replaced. Then they are retired.
+type KeyRing struct {
+	store            Store
+	rotationInterval time.Duration
+	tokenTTL         time.Duration
+
+	mu       sync.RWMutex
+	keys     []Key
+	loadedAt time.Time
+}
+
+func NewKeyRing(store Store, rotationInterval time.Duration, tokenTTL time.Duration) *KeyRing {
+	return &KeyRing{store: store, rotationInterval: rotationInterval, tokenTTL: tokenTTL}
+}
+
+// Loads the keys from the store. Creates a new signing key if there are no keys or the
+// newest key is older than rotationInterval, and retires keys whose JWTs have expired.
+// Should be called on startup and periodically after that.
+func (k *KeyRing) Rotate(now time.Time) (err error) {
+	keys, err := k.listSorted()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 || now.Sub(keys[len(keys)-1].CreatedAt) >= k.rotationInterval {
+		key, err := GenerateKey(now)
+		if err != nil {
+			return err
+		}
+		if err := k.store.Insert(key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	active := []Key{}
+	for i, key := range keys {
+		// Every JWT signed with a key expires tokenTTL after the next key replaced it
+		if i < len(keys)-1 && !now.Before(keys[i+1].CreatedAt.Add(k.tokenTTL)) {
+			if err := k.store.Delete(key.Kid); err != nil {
+				return err
+			}
+			continue
+		}
+		active = append(active, key)
+	}
+	k.setKeys(active, now)
+	return nil
+}
+
+// Reloads the keys from the store, e.g. after another replica has rotated them.
+// Does nothing if the keys were loaded less than minInterval ago.
+func (k *KeyRing) Reload(now time.Time, minInterval time.Duration) (err error) {
+	k.mu.RLock()
+	recent := now.Sub(k.loadedAt) < minInterval
+	k.mu.RUnlock()
+	if recent {
+		return nil
+	}
+	keys, err := k.listSorted()
+	if err != nil {
+		return err
+	}
+	k.setKeys(keys, now)
+	return nil
+}
+
+func (k *KeyRing) listSorted() (keys []Key, err error) {
+	keys, err = k.store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (k *KeyRing) setKeys(keys []Key, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.loadedAt = now
+}
+
+// Returns the newest key, which is used for signing new JWTs.
+func (k *KeyRing) SigningKey() (key Key, err error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return Key{}, ErrNoSigningKey
+	}
+	return k.keys[len(k.keys)-1], nil
+}
+
+// Returns the public key with the given kid, if it has not been retired.
+func (k *KeyRing) PublicKey(kid string) (publicKey ed25519.PublicKey, ok bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Kid == kid {
+			return key.PublicKey(), true
+		}
+	}
+	return nil, false
+}
+
+// Returns the public keys that have not been retired as a JSON Web Key Set.
+func (k *KeyRing) JWKS() (jwks JWKS) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	jwks.Keys = []JWK{}
+	for _, key := range k.keys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+	return jwks
+}
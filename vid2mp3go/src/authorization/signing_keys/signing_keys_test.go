@@ -0,0 +1,105 @@
+package signingkeys
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestKeyRingRotate(t *testing.T) {
+	store := NewMemoryStore()
+	ring := NewKeyRing(store, 24*time.Hour, time.Hour)
+	now := time.Now()
+
+	if _, err := ring.SigningKey(); err != ErrNoSigningKey { t.Fatal("Empty key ring returned a signing key") }
+
+	// First rotation creates the initial key
+	if err := ring.Rotate(now); err != nil { t.Fatal(err.Error()) }
+	first, err := ring.SigningKey()
+	if err != nil { t.Fatal(err.Error()) }
+
+	// The key is not replaced before rotationInterval has passed
+	ring.Rotate(now.Add(23 * time.Hour))
+	if key, _ := ring.SigningKey(); key.Kid != first.Kid { t.Fatal("Signing key was replaced too early") }
+
+	// The new key signs, but the old one is still published for verification
+	ring.Rotate(now.Add(24 * time.Hour))
+	second, _ := ring.SigningKey()
+	if second.Kid == first.Kid { t.Fatal("Signing key was not replaced") }
+	if _, ok := ring.PublicKey(first.Kid); !ok { t.Fatal("Old key was retired before its JWTs expired") }
+	if len(ring.JWKS().Keys) != 2 { t.Fatal("JWKS did not contain both keys") }
+
+	// Once every JWT signed with the old key has expired, it is retired
+	ring.Rotate(now.Add(25 * time.Hour))
+	if _, ok := ring.PublicKey(first.Kid); ok { t.Fatal("Old key was not retired") }
+	if keys, _ := store.List(); len(keys) != 1 { t.Fatal("Old key was not deleted from the store") }
+	if _, ok := ring.PublicKey(second.Kid); !ok { t.Fatal("Signing key was retired") }
+}
+
+func TestKeyRingReload(t *testing.T) {
+	store := NewMemoryStore()
+	ring := NewKeyRing(store, 24*time.Hour, time.Hour)
+	other := NewKeyRing(store, 24*time.Hour, time.Hour)
+	now := time.Now()
+	ring.Rotate(now)
+
+	// Another replica created the key, so this one has to reload to find it
+	key, _ := ring.SigningKey()
+	other.Reload(now, time.Minute)
+	if _, ok := other.PublicKey(key.Kid); !ok { t.Fatal("Key was not found after reload") }
+
+	store.Insert(mustGenerateKey(t, now.Add(time.Second)))
+	other.Reload(now.Add(time.Second), time.Minute)
+	if len(other.JWKS().Keys) != 1 { t.Fatal("Keys were reloaded before minInterval passed") }
+	other.Reload(now.Add(time.Minute), time.Minute)
+	if len(other.JWKS().Keys) != 2 { t.Fatal("Keys were not reloaded after minInterval passed") }
+}
+
+func TestJWK(t *testing.T) {
+	// Test vector from RFC 8037, appendix A
+	seed := []byte{
+		0x9d, 0x61, 0xb1, 0x9d, 0xef, 0xfd, 0x5a, 0x60, 0xba, 0x84, 0x4a, 0xf4, 0x92, 0xec, 0x2c, 0xc4,
+		0x44, 0x49, 0xc5, 0x69, 0x7b, 0x32, 0x69, 0x19, 0x70, 0x3b, 0xac, 0x03, 0x1c, 0xae, 0x7f, 0x60,
+	}
+	key := NewKey(ed25519.NewKeyFromSeed(seed), time.Now())
+	jwk := key.JWK()
+	if jwk.X != "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo" { t.Fatal("x was incorrect", jwk.X) }
+	if jwk.Kid != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" { t.Fatal("kid was incorrect", jwk.Kid) }
+	if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.Alg != "EdDSA" { t.Fatal("JWK was incorrect", jwk) }
+}
+
+func TestMySQLStore(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+	store := NewMySQLStore(db)
+
+	key := mustGenerateKey(t, time.Now().UTC().Truncate(time.Second))
+	privateKeyPem, _ := encodePrivateKey(key.PrivateKey)
+	mock.ExpectExec("INSERT INTO signing_key (kid, private_key, created_at) VALUES (?, ?, ?)").
+		WithArgs(key.Kid, privateKeyPem, key.CreatedAt).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT private_key, created_at FROM signing_key").
+		WillReturnRows(sqlmock.NewRows([]string{"private_key", "created_at"}).AddRow(privateKeyPem, key.CreatedAt))
+	mock.ExpectExec("DELETE FROM signing_key WHERE kid=?").WithArgs(key.Kid).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.Insert(key); err != nil { t.Fatal(err.Error()) }
+	keys, err := store.List()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(keys) != 1 || keys[0].Kid != key.Kid || !keys[0].PrivateKey.Equal(key.PrivateKey) {
+		t.Fatal("Listed key was incorrect")
+	}
+	if err := store.Delete(key.Kid); err != nil { t.Fatal(err.Error()) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestDecodePrivateKeyInvalid(t *testing.T) {
+	if _, err := decodePrivateKey("not a key"); err == nil { t.Fatal("Invalid key was decoded") }
+}
+
+func mustGenerateKey(t *testing.T, now time.Time) Key {
+	key, err := GenerateKey(now)
+	if err != nil { t.Fatal(err.Error()) }
+	return key
+}
@@ -0,0 +1,89 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters of the generated one-time passwords. These are the defaults of RFC 6238,
+// which every authenticator app supports.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+)
+
+// Number of periods before and after the current one whose codes are also accepted,
+// so that small clock differences between the server and the user's device are tolerated.
+const Skew = 1
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns a new random secret encoded as base32, the way authenticator apps expect it.
+func GenerateSecret() (secret string, err error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Returns the time step that the given time falls into.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Returns the one-time password of the given time step, as defined by RFC 4226.
+func Code(secret string, step int64) (code string, err error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000), nil
+}
+
+// Checks the given code against the codes of the time steps around now. If the code
+// is valid, the step it belongs to is returned, so that the caller can reject codes
+// of steps that have already been used.
+func Validate(secret string, code string, now time.Time) (step int64, ok bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for s := current - Skew; s <= current+Skew; s++ {
+		expected, err := Code(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the otpauth:// URI of the secret. Authenticator apps can import the
+// secret by scanning the URI as a QR code.
+func URI(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
@@ -0,0 +1,68 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Base32 encoding of the secret "12345678901234567890" used by the RFC 6238 test vectors
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix		int64
+		expected	string
+	}{
+		{ unix: 59, expected: "287082", },
+		{ unix: 1111111109, expected: "081804", },
+		{ unix: 1234567890, expected: "005924", },
+		{ unix: 2000000000, expected: "279037", },
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil { t.Fatalf("Code creation failed:\n%s", err.Error()) }
+		if code != tt.expected { t.Fatal("Code was incorrect", tt.unix, code) }
+	}
+	if _, err := Code("not base32!", 1); err == nil { t.Fatal("Invalid secret was accepted") }
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	tests := []struct {
+		name		string
+		at			time.Time
+		ok			bool
+	}{
+		{ name: "Current step", at: now, ok: true, },
+		{ name: "Previous step", at: now.Add(-Period), ok: true, },
+		{ name: "Next step", at: now.Add(Period), ok: true, },
+		{ name: "Too old", at: now.Add(-3 * Period), ok: false, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := Code(rfcSecret, Step(tt.at))
+			step, ok := Validate(rfcSecret, code, now)
+			if ok != tt.ok { t.Fatal("Validation result was incorrect", ok) }
+			if ok && step != Step(tt.at) { t.Fatal("Step was incorrect", step) }
+		})
+	}
+	if _, ok := Validate(rfcSecret, "12345", now); ok { t.Fatal("Code with wrong length was accepted") }
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil { t.Fatalf("Secret generation failed:\n%s", err.Error()) }
+	if len(secret) != 32 { t.Fatal("Secret length was incorrect", len(secret)) }
+	if _, err := Code(secret, 1); err != nil { t.Fatal("Generated secret could not be used", err) }
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("vid2mp3", "user@example.com", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/vid2mp3:user@example.com?") {
+		t.Fatal("URI label was incorrect", uri)
+	}
+	for _, param := range []string{"secret=" + rfcSecret, "issuer=vid2mp3", "digits=6", "period=30"} {
+		if !strings.Contains(uri, param) { t.Fatal("URI was missing", param, uri) }
+	}
+}
@@ -0,0 +1,126 @@
+package userstore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store implementation that keeps users in memory. Users are lost on restart,
+// so it is only meant for tests and running the service locally.
+type MemoryStore struct {
+	mu		sync.Mutex
+	nextID	int64
+	users	map[int64]User
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{nextID: 1, users: map[int64]User{}}
+}
+
+func (s *MemoryStore) Create(email string, password string) (user User, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.findByEmail(email); ok {
+		return User{}, ErrDuplicateUser
+	}
+	user = User{ID: s.nextID, Email: email, Password: password}
+	s.users[user.ID] = user
+	s.nextID++
+	return user, nil
+}
+
+func (s *MemoryStore) FindByEmail(email string) (user User, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.findByEmail(email)
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (s *MemoryStore) FindByID(id int64) (user User, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// Matches email addresses case-insensitively, like the default collation of MySQL.
+func (s *MemoryStore) List(search string, offset int, limit int) (users []User, total int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matching := []User{}
+	for _, user := range s.users {
+		if strings.Contains(strings.ToLower(user.Email), strings.ToLower(search)) {
+			user.Password = ""
+			matching = append(matching, copyUser(user))
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+	total = int64(len(matching))
+	start, end := min(offset, len(matching)), min(offset+limit, len(matching))
+	return matching[start:end], total, nil
+}
+
+func (s *MemoryStore) Update(id int64, changes Changes) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if changes.Email != nil {
+		if other, ok := s.findByEmail(*changes.Email); ok && other.ID != id {
+			return ErrDuplicateUser
+		}
+		user.Email = *changes.Email
+	}
+	if changes.Password != nil {
+		user.Password = *changes.Password
+	}
+	if changes.Verified != nil {
+		user.Verified = *changes.Verified
+	}
+	if changes.Disabled != nil {
+		user.Disabled = *changes.Disabled
+	}
+	if changes.LastLoginAt != nil {
+		user.LastLoginAt = changes.LastLoginAt
+	}
+	s.users[id] = copyUser(user)
+	return nil
+}
+
+func (s *MemoryStore) Delete(id int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+// Returns the user with the given email address. The caller has to hold the lock.
+func (s *MemoryStore) findByEmail(email string) (user User, ok bool) {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Returns a copy of the user that does not share LastLoginAt with the stored one.
+func copyUser(user User) User {
+	if user.LastLoginAt != nil {
+		lastLoginAt := *user.LastLoginAt
+		user.LastLoginAt = &lastLoginAt
+	}
+	return user
+}
@@ -0,0 +1,141 @@
+package userstore
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error number of inserting a duplicate value into a UNIQUE column
+const mysqlDuplicateEntry = 1062
+
+// Store implementation backed by the user table of the auth database. New users
+// are given the default role, since roles are kept in the same database.
+type MySQLStore struct {
+	db			*sql.DB
+	defaultRole	string
+}
+
+func NewMySQLStore(db *sql.DB, defaultRole string) *MySQLStore {
+	return &MySQLStore{db: db, defaultRole: defaultRole}
+}
+
+func (s *MySQLStore) Create(email string, password string) (user User, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO user (email, password) VALUES (?, ?)", email, password)
+	if IsDuplicateEntry(err) {
+		return User{}, ErrDuplicateUser
+	} else if err != nil {
+		return User{}, err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?", userID, s.defaultRole)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, err
+	}
+	return User{ID: userID, Email: email, Password: password}, nil
+}
+
+func (s *MySQLStore) FindByEmail(email string) (user User, err error) {
+	return scanMySQLUser(s.db.QueryRow("SELECT id, email, password, verified, disabled, last_login_at FROM user WHERE email=?", email))
+}
+
+func (s *MySQLStore) FindByID(id int64) (user User, err error) {
+	return scanMySQLUser(s.db.QueryRow("SELECT id, email, password, verified, disabled, last_login_at FROM user WHERE id=?", id))
+}
+
+func (s *MySQLStore) List(search string, offset int, limit int) (users []User, total int64, err error) {
+	pattern := "%" + escapeLikePattern(search) + "%"
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM user WHERE email LIKE ?", pattern).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.Query(
+		"SELECT id, email, verified, disabled, last_login_at FROM user WHERE email LIKE ? ORDER BY id LIMIT ? OFFSET ?",
+		pattern, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	users, err = scanListedUsers(rows)
+	return users, total, err
+}
+
+func (s *MySQLStore) Update(id int64, changes Changes) (err error) {
+	columns, args := changedColumns(changes)
+	if columns == "" {
+		_, err := s.FindByID(id)
+		return err
+	}
+	res, err := s.db.Exec("UPDATE user SET "+columns+" WHERE id=?", append(args, id)...)
+	if IsDuplicateEntry(err) {
+		return ErrDuplicateUser
+	} else if err != nil {
+		return err
+	}
+	return checkMySQLRowsAffected(s.db, res, id)
+}
+
+func (s *MySQLStore) Delete(id int64) (err error) {
+	res, err := s.db.Exec("DELETE FROM user WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Scans a row of the user table into a User.
+func scanMySQLUser(row *sql.Row) (user User, err error) {
+	var lastLoginAt sql.NullTime
+	err = row.Scan(&user.ID, &user.Email, &user.Password, &user.Verified, &user.Disabled, &lastLoginAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	} else if err != nil {
+		return User{}, err
+	}
+	if lastLoginAt.Valid {
+		user.LastLoginAt = &lastLoginAt.Time
+	}
+	return user, nil
+}
+
+// MySQL only counts rows that were actually changed as affected, so an update
+// that changes nothing is told apart from a missing user by looking the user up.
+func checkMySQLRowsAffected(db *sql.DB, res sql.Result, id int64) (err error) {
+	affected, err := res.RowsAffected()
+	if err != nil || affected > 0 {
+		return err
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM user WHERE id=?", id).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Returns true if err was caused by inserting a duplicate value into a UNIQUE column
+// of a MySQL table. Callers outside of the store map it to their own typed errors.
+func IsDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
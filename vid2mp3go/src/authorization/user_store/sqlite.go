@@ -0,0 +1,120 @@
+package userstore
+
+import (
+	"database/sql"
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Store implementation backed by a SQLite database, e.g. one opened with
+// sql.Open("sqlite", path). Used for running the service locally without MySQL.
+type SQLiteStore struct {
+	db	*sql.DB
+}
+
+// Creates the user table in the given SQLite database, unless it exists already.
+func NewSQLiteStore(db *sql.DB) (store *SQLiteStore, err error) {
+	_, err = db.Exec(
+		"CREATE TABLE IF NOT EXISTS user (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL UNIQUE, password TEXT NOT NULL, verified BOOLEAN NOT NULL DEFAULT FALSE, disabled BOOLEAN NOT NULL DEFAULT FALSE, last_login_at DATETIME NULL)",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Create(email string, password string) (user User, err error) {
+	res, err := s.db.Exec("INSERT INTO user (email, password) VALUES (?, ?)", email, password)
+	if isSQLiteDuplicateEntry(err) {
+		return User{}, ErrDuplicateUser
+	} else if err != nil {
+		return User{}, err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return User{ID: userID, Email: email, Password: password}, nil
+}
+
+func (s *SQLiteStore) FindByEmail(email string) (user User, err error) {
+	return scanSQLiteUser(s.db.QueryRow("SELECT id, email, password, verified, disabled, last_login_at FROM user WHERE email=?", email))
+}
+
+func (s *SQLiteStore) FindByID(id int64) (user User, err error) {
+	return scanSQLiteUser(s.db.QueryRow("SELECT id, email, password, verified, disabled, last_login_at FROM user WHERE id=?", id))
+}
+
+func (s *SQLiteStore) List(search string, offset int, limit int) (users []User, total int64, err error) {
+	pattern := "%" + escapeLikePattern(search) + "%"
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM user WHERE email LIKE ? ESCAPE '\'`, pattern).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.Query(
+		`SELECT id, email, verified, disabled, last_login_at FROM user WHERE email LIKE ? ESCAPE '\' ORDER BY id LIMIT ? OFFSET ?`,
+		pattern, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	users, err = scanListedUsers(rows)
+	return users, total, err
+}
+
+func (s *SQLiteStore) Update(id int64, changes Changes) (err error) {
+	columns, args := changedColumns(changes)
+	if columns == "" {
+		_, err := s.FindByID(id)
+		return err
+	}
+	res, err := s.db.Exec("UPDATE user SET "+columns+" WHERE id=?", append(args, id)...)
+	if isSQLiteDuplicateEntry(err) {
+		return ErrDuplicateUser
+	} else if err != nil {
+		return err
+	}
+	return checkSQLiteRowsAffected(res)
+}
+
+func (s *SQLiteStore) Delete(id int64) (err error) {
+	res, err := s.db.Exec("DELETE FROM user WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+	return checkSQLiteRowsAffected(res)
+}
+
+// Scans a row of the user table into a User.
+func scanSQLiteUser(row *sql.Row) (user User, err error) {
+	var lastLoginAt sql.NullTime
+	err = row.Scan(&user.ID, &user.Email, &user.Password, &user.Verified, &user.Disabled, &lastLoginAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	} else if err != nil {
+		return User{}, err
+	}
+	if lastLoginAt.Valid {
+		user.LastLoginAt = &lastLoginAt.Time
+	}
+	return user, nil
+}
+
+// SQLite counts every matched row as affected, so no rows means no such user.
+func checkSQLiteRowsAffected(res sql.Result) (err error) {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Returns true if err was caused by inserting a duplicate value into a UNIQUE column.
+func isSQLiteDuplicateEntry(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
@@ -0,0 +1,100 @@
+package userstore
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrDuplicateUser = errors.New("a user with this email address exists already")
+var ErrUserNotFound = errors.New("user not found")
+
+// A user account. Password holds the password hash, or the plaintext password
+// of rows that have not been migrated to hashes yet.
+type User struct {
+	ID			int64
+	Email		string
+	Password	string
+	Verified	bool
+	Disabled	bool
+	LastLoginAt	*time.Time
+}
+
+// Changes made to a user by Store.Update. Fields that are nil are left as they are,
+// so that concurrent updates of different fields do not undo each other.
+type Changes struct {
+	Email		*string
+	Password	*string
+	Verified	*bool
+	Disabled	*bool
+	LastLoginAt	*time.Time
+}
+
+// Keeps the user accounts of the auth service. Users are identified by their ID
+// and their email address, which is unique.
+type Store interface {
+	// Creates an unverified user with the given email address and password hash
+	// and returns it. Returns ErrDuplicateUser if the email address is taken.
+	Create(email string, password string) (user User, err error)
+	// Returns the user with the given email address, or ErrUserNotFound.
+	FindByEmail(email string) (user User, err error)
+	// Returns the user with the given ID, or ErrUserNotFound.
+	FindByID(id int64) (user User, err error)
+	// Returns the users whose email address contains search, ordered by ID, skipping the
+	// first offset users and returning at most limit. total is the number of users
+	// matching the search. Listed users have no Password.
+	List(search string, offset int, limit int) (users []User, total int64, err error)
+	// Applies the changes to the user with the given ID. Returns ErrUserNotFound if
+	// there is no such user and ErrDuplicateUser if the new email address is taken.
+	Update(id int64, changes Changes) (err error)
+	// Deletes the user with the given ID, or returns ErrUserNotFound.
+	Delete(id int64) (err error)
+}
+
+// Returns the SET clause of an SQL update of the user table applying the changes, e.g.
+// "password=?, verified=?", along with its arguments. Used by the SQL stores.
+func changedColumns(changes Changes) (columns string, args []any) {
+	var set []string
+	if changes.Email != nil {
+		set, args = append(set, "email=?"), append(args, *changes.Email)
+	}
+	if changes.Password != nil {
+		set, args = append(set, "password=?"), append(args, *changes.Password)
+	}
+	if changes.Verified != nil {
+		set, args = append(set, "verified=?"), append(args, *changes.Verified)
+	}
+	if changes.Disabled != nil {
+		set, args = append(set, "disabled=?"), append(args, *changes.Disabled)
+	}
+	if changes.LastLoginAt != nil {
+		set, args = append(set, "last_login_at=?"), append(args, changes.LastLoginAt.UTC())
+	}
+	return strings.Join(set, ", "), args
+}
+
+// Scans the rows of a listing of the user table, which selects every column but the
+// password, into Users. The rows are closed afterwards. Used by the SQL stores.
+func scanListedUsers(rows *sql.Rows) (users []User, err error) {
+	defer rows.Close()
+	users = []User{}
+	for rows.Next() {
+		var user User
+		var lastLoginAt sql.NullTime
+		if err := rows.Scan(&user.ID, &user.Email, &user.Verified, &user.Disabled, &lastLoginAt); err != nil {
+			return nil, err
+		}
+		if lastLoginAt.Valid {
+			user.LastLoginAt = &lastLoginAt.Time
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Escapes the wildcards of LIKE patterns in the given string, so that it only
+// matches itself. Backslash is the escape character.
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,189 @@
+package userstore
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Runs the same checks against a store that starts out empty
+func testStore(t *testing.T, s Store) {
+	user, err := s.Create("test_user@example.com", "test_hash")
+	if err != nil { t.Fatal(err.Error()) }
+	if user.Email != "test_user@example.com" || user.Password != "test_hash" || user.Verified || user.Disabled { t.Fatal("Created user was incorrect", user) }
+	if _, err := s.Create("test_user@example.com", "other_hash"); !errors.Is(err, ErrDuplicateUser) { t.Fatal("Duplicate user was created", err) }
+	other, err := s.Create("other_user@example.com", "other_hash")
+	if err != nil || other.ID == user.ID { t.Fatal("Second user was not created", err) }
+
+	found, err := s.FindByEmail("test_user@example.com")
+	if err != nil || found.ID != user.ID || found.Password != "test_hash" || found.LastLoginAt != nil { t.Fatal("User was not found by email", found, err) }
+	if _, err := s.FindByEmail("unknown@example.com"); !errors.Is(err, ErrUserNotFound) { t.Fatal("Unknown user was found", err) }
+	if _, err := s.FindByID(0); !errors.Is(err, ErrUserNotFound) { t.Fatal("Unknown ID was found", err) }
+
+	lastLoginAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	password, verified, disabled := "new_hash", true, true
+	if err := s.Update(user.ID, Changes{Password: &password, Verified: &verified, LastLoginAt: &lastLoginAt}); err != nil { t.Fatal(err.Error()) }
+	// Fields that are not changed keep their values
+	if err := s.Update(user.ID, Changes{Disabled: &disabled}); err != nil { t.Fatal(err.Error()) }
+	updated, err := s.FindByID(user.ID)
+	if err != nil || updated.Password != "new_hash" || !updated.Verified || !updated.Disabled { t.Fatal("User was not updated", updated, err) }
+	if updated.LastLoginAt == nil || !updated.LastLoginAt.Equal(lastLoginAt) { t.Fatal("Last login was not updated", updated.LastLoginAt) }
+	// Updating with the same values is not mistaken for a missing user
+	if err := s.Update(user.ID, Changes{Disabled: &disabled}); err != nil { t.Fatal(err.Error()) }
+	if err := s.Update(user.ID, Changes{}); err != nil { t.Fatal(err.Error()) }
+	email := "other_user@example.com"
+	if err := s.Update(user.ID, Changes{Email: &email}); !errors.Is(err, ErrDuplicateUser) { t.Fatal("Email was changed to a taken one", err) }
+	if err := s.Update(0, Changes{Password: &password}); !errors.Is(err, ErrUserNotFound) { t.Fatal("Unknown user was updated", err) }
+	if err := s.Update(0, Changes{}); !errors.Is(err, ErrUserNotFound) { t.Fatal("Unknown user was updated", err) }
+
+	users, total, err := s.List("USER@", 0, 10)
+	if err != nil || total != 2 || len(users) != 2 || users[0].ID != user.ID || users[1].ID != other.ID || users[0].Password != "" { t.Fatal("Users were not listed", users, total, err) }
+	if !users[0].Disabled || users[0].LastLoginAt == nil { t.Fatal("Listed user was incorrect", users[0]) }
+	users, total, err = s.List("", 1, 10)
+	if err != nil || total != 2 || len(users) != 1 || users[0].ID != other.ID { t.Fatal("Second page was incorrect", users, total, err) }
+	// Wildcards in the search only match themselves
+	users, total, err = s.List("_", 0, 10)
+	if err != nil || total != 2 || len(users) != 2 { t.Fatal("Underscore was not matched", users, total, err) }
+	users, total, err = s.List("%", 0, 10)
+	if err != nil || total != 0 || len(users) != 0 { t.Fatal("Percent sign matched", users, total, err) }
+
+	if err := s.Delete(user.ID); err != nil { t.Fatal(err.Error()) }
+	if _, err := s.FindByID(user.ID); !errors.Is(err, ErrUserNotFound) { t.Fatal("Deleted user was found", err) }
+	if err := s.Delete(user.ID); !errors.Is(err, ErrUserNotFound) { t.Fatal("Deleted user was deleted again", err) }
+	if _, err := s.FindByEmail("other_user@example.com"); err != nil { t.Fatal("Other user was deleted", err) }
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil { t.Fatal(err.Error()) }
+	defer db.Close()
+	s, err := NewSQLiteStore(db)
+	if err != nil { t.Fatal(err.Error()) }
+	testStore(t, s)
+
+	// Opening the store again keeps the existing users
+	s, err = NewSQLiteStore(db)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, err := s.FindByEmail("other_user@example.com"); err != nil { t.Fatal("Existing user was lost", err) }
+}
+
+func TestMySQLStoreCreate(t *testing.T) {
+	tests := []struct {
+		name		string
+		insertErr	error
+		expectedErr	error
+	}{
+		{
+			name: "Successful creation",
+		},
+		{
+			name: "Duplicate email",
+			insertErr: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"},
+			expectedErr: ErrDuplicateUser,
+		},
+		{
+			name: "Insert fails",
+			insertErr: errors.New("db insert failed"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+			defer db.Close()
+
+			mock.ExpectBegin()
+			insert := mock.ExpectExec("INSERT INTO user (email, password) VALUES (?, ?)").WithArgs("test_user@example.com", "test_hash")
+			if tt.insertErr != nil {
+				insert.WillReturnError(tt.insertErr)
+				mock.ExpectRollback()
+			} else {
+				insert.WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectExec("INSERT INTO user_role (user_id, role_id) SELECT ?, id FROM role WHERE name=?").WithArgs(7, "user").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+
+			user, err := NewMySQLStore(db, "user").Create("test_user@example.com", "test_hash")
+			if tt.insertErr == nil && (err != nil || user.ID != 7) { t.Fatal("User was not created", user, err) }
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) { t.Fatal("Error was incorrect", err) }
+			if tt.insertErr != nil && err == nil { t.Fatal("Error was not returned") }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+		})
+	}
+}
+
+func TestMySQLStoreFindByEmail(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+	defer db.Close()
+
+	query := "SELECT id, email, password, verified, disabled, last_login_at FROM user WHERE email=?"
+	columns := []string{"id", "email", "password", "verified", "disabled", "last_login_at"}
+	mock.ExpectQuery(query).WithArgs("test_user@example.com").WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "test_user@example.com", "test_hash", true, false, nil))
+	mock.ExpectQuery(query).WithArgs("unknown@example.com").WillReturnRows(sqlmock.NewRows(columns))
+
+	s := NewMySQLStore(db, "user")
+	user, err := s.FindByEmail("test_user@example.com")
+	if err != nil || user.ID != 1 || !user.Verified || user.LastLoginAt != nil { t.Fatal("User was incorrect", user, err) }
+	if _, err := s.FindByEmail("unknown@example.com"); !errors.Is(err, ErrUserNotFound) { t.Fatal("Unknown user was found", err) }
+	if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+}
+
+func TestMySQLStoreUpdate(t *testing.T) {
+	tests := []struct {
+		name		string
+		affected	int64
+		count		int
+		updateErr	error
+		expectedErr	error
+	}{
+		{
+			name: "Successful update",
+			affected: 1,
+		},
+		{
+			name: "Nothing changed",
+			count: 1,
+		},
+		{
+			name: "Unknown user",
+			expectedErr: ErrUserNotFound,
+		},
+		{
+			name: "Duplicate email",
+			updateErr: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"},
+			expectedErr: ErrDuplicateUser,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil { t.Fatalf("an error '%s' was not expected when opening a stub database connection", err) }
+			defer db.Close()
+
+			update := mock.ExpectExec("UPDATE user SET password=?, verified=? WHERE id=?").WithArgs("new_hash", true, 1)
+			if tt.updateErr != nil {
+				update.WillReturnError(tt.updateErr)
+			} else {
+				update.WillReturnResult(sqlmock.NewResult(0, tt.affected))
+			}
+			if tt.updateErr == nil && tt.affected == 0 {
+				mock.ExpectQuery("SELECT COUNT(*) FROM user WHERE id=?").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.count))
+			}
+
+			password, verified := "new_hash", true
+			err = NewMySQLStore(db, "user").Update(1, Changes{Password: &password, Verified: &verified})
+			if !errors.Is(err, tt.expectedErr) { t.Fatal("Error was incorrect", err) }
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+		})
+	}
+}
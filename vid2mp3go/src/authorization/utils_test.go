@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetDurationEnv(t *testing.T) {
+	tests := []struct {
+		name		string
+		value		string
+		expected	time.Duration
+	}{
+		{ name: "Env set", value: "90s", expected: 90 * time.Second, },
+		{ name: "Env missing", value: "", expected: time.Minute, },
+		{ name: "Env invalid", value: "ten minutes", expected: time.Minute, },
+		{ name: "Env negative", value: "-5m", expected: time.Minute, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TEST_DURATION", tt.value)
+			defer os.Unsetenv("TEST_DURATION")
+			if d := GetDurationEnv("TEST_DURATION", time.Minute); d != tt.expected {
+				t.Fatal("Duration was incorrect", d)
+			}
+		})
+	}
+}
+
+func TestGetEnv(t *testing.T) {
+	os.Setenv("TEST_STRING", "value")
+	defer os.Unsetenv("TEST_STRING")
+	if v := GetEnv("TEST_STRING", "fallback"); v != "value" { t.Fatal("Value was incorrect", v) }
+	if v := GetEnv("TEST_STRING_MISSING", "fallback"); v != "fallback" { t.Fatal("Fallback was not used", v) }
+}
+
+func TestGetIntEnv(t *testing.T) {
+	tests := []struct {
+		name		string
+		value		string
+		expected	int
+	}{
+		{ name: "Env set", value: "7", expected: 7, },
+		{ name: "Env missing", value: "", expected: 5, },
+		{ name: "Env invalid", value: "seven", expected: 5, },
+		{ name: "Env zero", value: "0", expected: 5, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TEST_INT", tt.value)
+			defer os.Unsetenv("TEST_INT")
+			if v := GetIntEnv("TEST_INT", 5); v != tt.expected {
+				t.Fatal("Value was incorrect", v)
+			}
+		})
+	}
+}
+
+func TestIsValidEmail(t *testing.T) {
+	tests := []struct {
+		name		string
+		email		string
+		expected	bool
+	}{
+		{ name: "Plain address", email: "user@example.com", expected: true, },
+		{ name: "Missing domain", email: "user", expected: false, },
+		{ name: "Display name", email: "User <user@example.com>", expected: false, },
+		{ name: "Empty", email: "", expected: false, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v := IsValidEmail(tt.email); v != tt.expected {
+				t.Fatal("Result was incorrect", v)
+			}
+		})
+	}
+}
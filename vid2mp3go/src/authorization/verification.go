@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	AccountEvents "microservices/authorization/account_events"
+	SecureToken "microservices/authorization/secure_token"
+	SendStatus "microservices/authorization/send_status"
+	UserStore "microservices/authorization/user_store"
+	"net/http"
+	"time"
+)
+
+// Lifetime of email verification tokens. Configured with the VERIFICATION_TOKEN_TTL env variable.
+var verificationTokenTTL = GetDurationEnv("VERIFICATION_TOKEN_TTL", 48*time.Hour)
+
+// Stores a new email verification token for the given user in the DB and publishes
+// an email verification requested event, so that the notification service sends the
+// token to the user. Verification tokens sent earlier can no longer be used.
+func SendVerification(userID int64, username string) (err error) {
+	verificationToken, err := SecureToken.Generate(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(verificationTokenTTL)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE verification_token SET used=TRUE WHERE user_id=? AND used=FALSE", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO verification_token (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		userID, SecureToken.Hash(verificationToken), expiresAt, now,
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return accountEvents.Publish(AccountEvents.Event{
+		Type: AccountEvents.EmailVerificationRequested,
+		Username: username,
+		Token: verificationToken,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// Verifies the email address of the user that the verification token in the POST
+// request's Verification-Token header was sent to. Every verification token can be
+// used only once. JWTs created after the verification have the email_verified claim
+// set, so the user has to refresh their tokens before uploading files.
+func Verify(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("Verify request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	verificationToken := r.Header.Get("Verification-Token")
+	if verificationToken == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	var id, userID int64
+	var expiresAt time.Time
+	var used bool
+	err := db.QueryRow(
+		"SELECT id, user_id, expires_at, used FROM verification_token WHERE token_hash=?",
+		SecureToken.Hash(verificationToken),
+	).Scan(&id, &userID, &expiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch verification token from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if used || time.Now().After(expiresAt) {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	user, err := users.FindByID(userID)
+	if errors.Is(err, UserStore.ErrUserNotFound) {
+		SendStatus.InvalidCredentials(w)
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	username := user.Email
+	used, err = MarkVerified(users, id, userID)
+	if err != nil {
+		log.Printf("Error occured while trying to verify user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	} else if used {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	log.Printf("Email of user %s verified", username)
+	fmt.Fprintf(w, "Email verified.")
+}
+
+// Marks the verification token with the given id as used and then the user as verified.
+// If the token has already been used, nothing is changed and used is true.
+func MarkVerified(users UserStore.Store, verificationTokenID int64, userID int64) (used bool, err error) {
+	// Only one request can use the token, even if several arrive at once
+	res, err := db.Exec("UPDATE verification_token SET used=TRUE WHERE id=? AND used=FALSE", verificationTokenID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n != 1 {
+		return true, nil
+	}
+	verified := true
+	return false, users.Update(userID, UserStore.Changes{Verified: &verified})
+}
+
+// Sends a new verification token to the user given in the POST request's Username
+// header, in case the previous one was lost or has expired. The response is the same
+// whether the user exists and is unverified or not, so that the endpoint can not be
+// used to find out which usernames exist.
+func ResendVerification(users UserStore.Store, w http.ResponseWriter, r *http.Request) {
+	log.Println("ResendVerification request received with method", r.Method)
+	if r.Method != "POST" {
+		SendStatus.MethodNotAllowed(w)
+		return
+	}
+	username := r.Header.Get("Username")
+	if username == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	user, err := users.FindByEmail(username)
+	if errors.Is(err, UserStore.ErrUserNotFound) || (err == nil && user.Verified) {
+		fmt.Fprintf(w, "Verification sent.")
+		return
+	} else if err != nil {
+		log.Printf("Error occured while trying to fetch user from DB:\n%s", err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if err := SendVerification(user.ID, username); err != nil {
+		log.Printf("Error occured while trying to send verification to user %s:\n%s", username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	fmt.Fprintf(w, "Verification sent.")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	AccountEvents "microservices/authorization/account_events"
+	SecureToken "microservices/authorization/secure_token"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectVerificationToken = "SELECT id, user_id, expires_at, used FROM verification_token WHERE token_hash=?"
+
+// Adds the expectations of SendVerification storing a new verification token for the
+// given user. The mock has to use sqlmock.QueryMatcherEqual.
+func ExpectSendVerification(mock sqlmock.Sqlmock, userID int64) {
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE verification_token SET used=TRUE WHERE user_id=? AND used=FALSE").WithArgs(userID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO verification_token (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)").
+		WithArgs(userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestVerify(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name				string
+		method				string
+		expectedCode		int
+		verificationToken	string
+		expiresAt			time.Time
+		used				bool
+		concurrentUse		bool
+	}{
+		{
+			name: "Successful verification",
+			method: "POST",
+			expectedCode: 200,
+			verificationToken: "test_verification_token",
+			expiresAt: time.Now().Add(time.Hour),
+		},
+		{
+			name: "Verification token expired",
+			method: "POST",
+			expectedCode: 401,
+			verificationToken: "test_verification_token",
+			expiresAt: time.Now().Add(-time.Minute),
+		},
+		{
+			name: "Verification token already used",
+			method: "POST",
+			expectedCode: 401,
+			verificationToken: "test_verification_token",
+			expiresAt: time.Now().Add(time.Hour),
+			used: true,
+		},
+		{
+			name: "Verification token used concurrently",
+			method: "POST",
+			expectedCode: 401,
+			verificationToken: "test_verification_token",
+			expiresAt: time.Now().Add(time.Hour),
+			concurrentUse: true,
+		},
+		{
+			name: "Verification token unknown",
+			method: "POST",
+			expectedCode: 401,
+			verificationToken: "unknown_verification_token",
+		},
+		{
+			name: "Verification token missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			verificationToken: "test_verification_token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			rows := sqlmock.NewRows([]string{"id", "user_id", "expires_at", "used"})
+			if tt.verificationToken == "test_verification_token" {
+				rows.AddRow(5, 1, tt.expiresAt, tt.used)
+			}
+			if tt.method == "POST" && tt.verificationToken != "" {
+				mock.ExpectQuery(selectVerificationToken).WithArgs(SecureToken.Hash(tt.verificationToken)).WillReturnRows(rows)
+			}
+			if tt.expectedCode == 200 || tt.concurrentUse {
+				mock.ExpectQuery(selectUserByID).WithArgs(1).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "test_user", "", false, false, nil))
+				affected := int64(1)
+				if tt.concurrentUse {
+					affected = 0
+				}
+				mock.ExpectExec("UPDATE verification_token SET used=TRUE WHERE id=? AND used=FALSE").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, affected))
+				if !tt.concurrentUse {
+					mock.ExpectExec("UPDATE user SET verified=? WHERE id=?").WithArgs(true, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/verify", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Verification-Token", tt.verificationToken)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), Verify)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+		})
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	var mock sqlmock.Sqlmock
+	var err error
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		username		string
+		verified		bool
+		expectedEvents	int
+	}{
+		{
+			name: "Verification resent",
+			method: "POST",
+			expectedCode: 200,
+			username: "test_user",
+			expectedEvents: 1,
+		},
+		{
+			name: "User already verified",
+			method: "POST",
+			expectedCode: 200,
+			username: "test_user",
+			verified: true,
+		},
+		{
+			name: "Unknown user",
+			method: "POST",
+			expectedCode: 200,
+			username: "unknown_user",
+		},
+		{
+			name: "Username missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			username: "test_user",
+		},
+		{
+			name: "DB fetch fails",
+			method: "POST",
+			expectedCode: 500,
+			username: "test_user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := AccountEvents.NewMemoryPublisher()
+			accountEvents = publisher
+			db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			if tt.name == "DB fetch fails" {
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.username).WillReturnError(errors.New("db fetch failed"))
+			} else if tt.name == "Unknown user" {
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.username).WillReturnRows(sqlmock.NewRows(userColumns))
+			} else if tt.expectedCode == 200 {
+				mock.ExpectQuery(selectUserByEmail).WithArgs(tt.username).WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, tt.username, "", tt.verified, false, nil))
+				if !tt.verified {
+					ExpectSendVerification(mock, 1)
+				}
+			}
+
+			req, err := http.NewRequest(tt.method, "/verify/resend", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := WithUserStore(MockUserStore(), ResendVerification)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode {
+				t.Fatal("Status was incorrect", resp.Code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil { t.Fatal(err.Error()) }
+			events := publisher.Events()
+			if len(events) != tt.expectedEvents { t.Fatal("Number of published events was incorrect", len(events)) }
+			if tt.expectedEvents > 0 {
+				if events[0].Type != AccountEvents.EmailVerificationRequested || events[0].Username != tt.username || events[0].Token == "" {
+					t.Fatal("Published event was incorrect", events[0])
+				}
+			}
+		})
+	}
+}
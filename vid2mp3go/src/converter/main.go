@@ -7,6 +7,7 @@ import (
 	"os/exec"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
@@ -21,6 +22,18 @@ type RabbitMQMessage struct {
 	VideoFid	string		`json:"video_fid"`
 	Mp3Fid		string		`json:"mp3_fid"`
 	Username	string		`json:"username"`
+	Org			string		`json:"org,omitempty"`
+}
+
+// Returns the GridFS metadata of the mp3 converted from the message's video. The mp3
+// belongs to the owner of the video, so that it is deleted along with the owner's
+// account, and to the owner's organization, if the video was uploaded for one.
+func Mp3Metadata(msg RabbitMQMessage) (metadata bson.M) {
+	metadata = bson.M{"owner": msg.Username}
+	if msg.Org != "" {
+		metadata["org"] = msg.Org
+	}
+	return metadata
 }
 
 func ConvertToMp3(body []byte) (err error) {
@@ -65,7 +78,8 @@ func ConvertToMp3(body []byte) (err error) {
 
 	// Upload the extracted audio to MongoDB and get its FID.
 	log.Println("Saving audio to MongoDB")
-	audioFid, err := fsMp3s.UploadFromStream(tempAudioFile.Name(), tempAudioFile)
+	uploadOptions := options.GridFSUpload().SetMetadata(Mp3Metadata(receivedMsg))
+	audioFid, err := fsMp3s.UploadFromStream(tempAudioFile.Name(), tempAudioFile, uploadOptions)
 	if err != nil { return err }
 	log.Printf("Audio uploaded with FID %s\n", audioFid)
 
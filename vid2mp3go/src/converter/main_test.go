@@ -30,4 +30,11 @@ func TestGetMongUri(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestMp3Metadata(t *testing.T) {
+	metadata := Mp3Metadata(RabbitMQMessage{Username: "test"})
+	if len(metadata) != 1 || metadata["owner"] != "test" { t.Fatal("Metadata was incorrect", metadata) }
+	metadata = Mp3Metadata(RabbitMQMessage{Username: "test", Org: "7"})
+	if len(metadata) != 2 || metadata["owner"] != "test" || metadata["org"] != "7" { t.Fatal("Metadata of organization was incorrect", metadata) }
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	AuthService "gateway/auth_service"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Client of the auth service's gRPC API. If the AUTH_GRPC_ADDRESS env variable is set,
+// main() connects it and logins, registrations and remote token validation use it
+// instead of the auth service's HTTP routes.
+var authClient AuthService.AuthServiceClient
+
+// Deadline of each call to the auth service's gRPC API
+var authRpcTimeout = GetDurationEnv("AUTH_RPC_TIMEOUT", 5*time.Second)
+
+// HTTP status codes sent to the user for the gRPC status codes of failed calls.
+// Other codes are sent as 500.
+var rpcStatusCodes = map[codes.Code]int{
+	codes.InvalidArgument: http.StatusBadRequest,
+	codes.Unauthenticated: http.StatusUnauthorized,
+	codes.PermissionDenied: http.StatusForbidden,
+	codes.NotFound: http.StatusNotFound,
+	codes.AlreadyExists: http.StatusConflict,
+	codes.ResourceExhausted: http.StatusTooManyRequests,
+	codes.Unavailable: http.StatusServiceUnavailable,
+	codes.DeadlineExceeded: http.StatusGatewayTimeout,
+}
+
+// Connects to the auth service's gRPC API at the given address. The connection is
+// only established once the first call is made.
+func ConnectToAuthService(address string) (conn *grpc.ClientConn, err error) {
+	conn, err = grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	authClient = AuthService.NewAuthServiceClient(conn)
+	return conn, nil
+}
+
+// Returns the HTTP status code corresponding to the error of a failed call
+func RpcStatusCode(err error) (statusCode int) {
+	statusCode, ok := rpcStatusCodes[status.Code(err)]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	return statusCode
+}
+
+// Sends the HTTP status code corresponding to the error of a failed call to the user.
+// If the auth service attached RetryInfo, e.g. to a locked out login, it is sent in
+// the Retry-After header.
+func SendRpcError(w http.ResponseWriter, err error) {
+	log.Printf("Call to auth service failed:\n%s", err.Error())
+	for _, detail := range status.Convert(err).Details() {
+		if retryInfo, ok := detail.(*errdetails.RetryInfo); ok {
+			seconds := int(retryInfo.GetRetryDelay().AsDuration().Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		}
+	}
+	w.WriteHeader(RpcStatusCode(err))
+}
+
+// Returns the client of the request, which the auth service uses for lockouts,
+// sessions and the audit log
+func RpcClient(r *http.Request) *AuthService.Client {
+	return &AuthService.Client{Ip: GetClientIP(r), UserAgent: r.UserAgent()}
+}
+
+// Same as AuthorizeUser, but calls the Login RPC. Users that have enabled MFA get 202
+// with an Mfa-Challenge header, like from the HTTP route.
+func AuthorizeUserWithRpc(username string, password string, clientIP string, userAgent string, w http.ResponseWriter) (tokenString []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), authRpcTimeout)
+	defer cancel()
+	resp, err := authClient.Login(ctx, &AuthService.LoginRequest{
+		Username: username,
+		Password: password,
+		Client: &AuthService.Client{Ip: clientIP, UserAgent: userAgent},
+	})
+	if err != nil {
+		SendRpcError(w, err)
+		return nil
+	}
+	if resp.GetMfaChallenge() != "" {
+		w.Header().Set("Mfa-Challenge", resp.GetMfaChallenge())
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("MFA code required."))
+		return nil
+	}
+	w.Header().Set("Refresh-Token", resp.GetTokens().GetRefreshToken())
+	return []byte(resp.GetTokens().GetAccessToken())
+}
+
+// Same as the HTTP part of Register, but calls the Register RPC. The JWT is written to
+// the response body and the refresh token to the Refresh-Token header.
+func RegisterWithRpc(w http.ResponseWriter, r *http.Request, username string, password string) {
+	ctx, cancel := context.WithTimeout(r.Context(), authRpcTimeout)
+	defer cancel()
+	resp, err := authClient.Register(ctx, &AuthService.RegisterRequest{
+		Username: username,
+		Password: password,
+		InviteCode: r.Header.Get("Invite-Code"),
+		Client: RpcClient(r),
+	})
+	if err != nil {
+		SendRpcError(w, err)
+		return
+	}
+	w.Header().Set("Refresh-Token", resp.GetTokens().GetRefreshToken())
+	w.Write([]byte(resp.GetTokens().GetAccessToken()))
+}
+
+// Same as ValidateTokenRemotely, but calls the Validate RPC. The request's Authorization
+// header has to hold either a Bearer token or an API key.
+func ValidateTokenWithRpc(r *http.Request) (token JsonStruct, statusCode int) {
+	log.Println("Validating token with RPC")
+	req := &AuthService.ValidateRequest{}
+	authHeader := r.Header.Get("Authorization")
+	if accessToken, ok := strings.CutPrefix(authHeader, "Bearer "); ok && accessToken != "" {
+		req.Credential = &AuthService.ValidateRequest_AccessToken{AccessToken: accessToken}
+	} else if apiKey, ok := strings.CutPrefix(authHeader, "ApiKey "); ok && apiKey != "" {
+		req.Credential = &AuthService.ValidateRequest_ApiKey{ApiKey: apiKey}
+	} else if authHeader == "" {
+		return JsonStruct{}, 401
+	} else {
+		return JsonStruct{}, 400
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), authRpcTimeout)
+	defer cancel()
+	resp, err := authClient.Validate(ctx, req)
+	if err != nil {
+		log.Printf("Token validation failed:\n%s", err.Error())
+		return JsonStruct{}, RpcStatusCode(err)
+	}
+	return JsonStruct{
+		Username: resp.GetUsername(),
+		Exp: float64(resp.GetExp()),
+		Admin: resp.GetAdmin(),
+		Roles: resp.GetRoles(),
+		Permissions: resp.GetPermissions(),
+		EmailVerified: resp.GetEmailVerified(),
+		ClientID: resp.GetClientId(),
+		Scope: resp.GetScope(),
+		Fid: resp.GetFid(),
+		Org: resp.GetOrg(),
+	}, 200
+}
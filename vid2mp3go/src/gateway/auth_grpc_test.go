@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	AuthService "gateway/auth_service"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Stands in for the auth service's gRPC API, like the Mock...Handler functions do
+// for its HTTP routes
+type MockAuthServiceServer struct {
+	AuthService.UnimplementedAuthServiceServer
+}
+
+var mockTokens = &AuthService.Tokens{AccessToken: "tokenString", RefreshToken: "refreshToken", TokenType: "Bearer", ExpiresIn: 900}
+
+func (s *MockAuthServiceServer) Login(ctx context.Context, req *AuthService.LoginRequest) (*AuthService.LoginResponse, error) {
+	if req.GetClient().GetIp() != "203.0.113.7" {
+		return nil, status.Error(codes.InvalidArgument, "client missing")
+	}
+	if req.GetUsername() == "locked" {
+		st, _ := status.New(codes.ResourceExhausted, "locked out").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(30 * time.Second)})
+		return nil, st.Err()
+	}
+	if req.GetUsername() == "slow" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if req.GetUsername() == "mfa" && req.GetPassword() == "test" {
+		return &AuthService.LoginResponse{MfaChallenge: "challengeToken"}, nil
+	}
+	if req.GetUsername() != "test" || req.GetPassword() != "test" {
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+	return &AuthService.LoginResponse{Tokens: mockTokens}, nil
+}
+
+func (s *MockAuthServiceServer) Register(ctx context.Context, req *AuthService.RegisterRequest) (*AuthService.RegisterResponse, error) {
+	if req.GetUsername() == "taken" {
+		return nil, status.Error(codes.AlreadyExists, "user exists already")
+	}
+	return &AuthService.RegisterResponse{Tokens: mockTokens}, nil
+}
+
+func (s *MockAuthServiceServer) Validate(ctx context.Context, req *AuthService.ValidateRequest) (*AuthService.ValidateResponse, error) {
+	if req.GetAccessToken() != "tokenString" && req.GetApiKey() != "apiKey" {
+		return nil, status.Error(codes.PermissionDenied, "invalid token")
+	}
+	return &AuthService.ValidateResponse{Username: "test", Exp: 1, Permissions: []string{"download:read"}, Scope: "download:read"}, nil
+}
+
+// Connects authClient to MockAuthServiceServer over an in-memory connection for the
+// duration of the test
+func WithMockAuthClient(t *testing.T) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	AuthService.RegisterAuthServiceServer(server, &MockAuthServiceServer{})
+	go server.Serve(listener)
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil { t.Fatalf("Client creation failed:\n%s", err.Error()) }
+	authClient = AuthService.NewAuthServiceClient(conn)
+	t.Cleanup(func() {
+		authClient = nil
+		conn.Close()
+		server.Stop()
+	})
+}
+
+func TestLoginWithRpc(t *testing.T) {
+	tests := []struct {
+		name			string
+		credentials		[]string
+		expectedCode	int
+	}{
+		{
+			name: "Successful login",
+			credentials: []string{"test", "test"},
+			expectedCode: 200,
+		},
+		{
+			name: "Credentials incorrect",
+			credentials: []string{"wrong", "wrong"},
+			expectedCode: 401,
+		},
+		{
+			name: "Locked out",
+			credentials: []string{"locked", "test"},
+			expectedCode: 429,
+		},
+		{
+			name: "MFA required",
+			credentials: []string{"mfa", "test"},
+			expectedCode: 202,
+		},
+		{
+			name: "Deadline exceeded",
+			credentials: []string{"slow", "test"},
+			expectedCode: 504,
+		},
+	}
+	WithMockAuthClient(t)
+	timeout := authRpcTimeout
+	authRpcTimeout = 100 * time.Millisecond
+	defer func() { authRpcTimeout = timeout }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/login", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.SetBasicAuth(tt.credentials[0], tt.credentials[1])
+			req.RemoteAddr = "203.0.113.7:41000"
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Login)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 429 && resp.Header().Get("Retry-After") != "30" {
+				t.Fatal("Retry-After was not passed on", resp.Header().Get("Retry-After"))
+			}
+			if resp.Code == 202 && resp.Header().Get("Mfa-Challenge") != "challengeToken" {
+				t.Fatal("MFA challenge was not passed on", resp.Header().Get("Mfa-Challenge"))
+			}
+			if resp.Code == 200 && (resp.Body.String() != "tokenString" || resp.Header().Get("Refresh-Token") != "refreshToken") {
+				t.Fatal("Did not receive tokens", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestRegisterWithRpc(t *testing.T) {
+	tests := []struct {
+		name			string
+		username		string
+		expectedCode	int
+	}{
+		{
+			name: "Successful registration",
+			username: "test",
+			expectedCode: 200,
+		},
+		{
+			name: "Duplicate user",
+			username: "taken",
+			expectedCode: 409,
+		},
+	}
+	WithMockAuthClient(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/register", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Username", tt.username)
+			req.Header.Set("Password", "test")
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Register)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && (resp.Body.String() != "tokenString" || resp.Header().Get("Refresh-Token") != "refreshToken") {
+				t.Fatal("Did not receive tokens", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateTokenWithRpc(t *testing.T) {
+	tests := []struct {
+		name			string
+		authHeader		string
+		expectedCode	int
+	}{
+		{
+			name: "API key",
+			authHeader: "ApiKey apiKey",
+			expectedCode: 200,
+		},
+		{
+			name: "Invalid API key",
+			authHeader: "ApiKey wrong",
+			expectedCode: 403,
+		},
+		{
+			name: "Malformed Authorization header",
+			authHeader: "Basic dGVzdDp0ZXN0",
+			expectedCode: 400,
+		},
+		{
+			name: "Authorization header missing",
+			expectedCode: 401,
+		},
+	}
+	WithMockAuthClient(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/download", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.authHeader != "" { req.Header.Set("Authorization", tt.authHeader) }
+
+			token, statusCode := ValidateTokenRemotely(req)
+
+			if statusCode != tt.expectedCode { t.Fatal("Status was incorrect", statusCode) }
+			if statusCode == 200 && (token.Username != "test" || token.Scope != "download:read") {
+				t.Fatal("Token was incorrect", token)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package authservice holds the Go client of the authorization service's gRPC API.
+// It is generated from authorization/auth_service/auth_service.proto by the
+// go:generate directives of that package.
+package authservice
@@ -0,0 +1,151 @@
+package jwtverifier
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Returned when a JWT was signed with a key that is not in the auth service's JWKS,
+// even after fetching it again. Such JWTs should be validated by the auth service.
+var ErrUnknownKey = errors.New("JWT was signed with an unknown key")
+
+// Minimum time between fetching the JWKS because of an unknown kid, so that
+// JWTs with made up kids can not be used to flood the auth service with requests.
+const minFetchInterval = 10 * time.Second
+
+// Claims of a JWT created by the auth service
+type Claims struct {
+	Username      string   `json:"username"`
+	Admin         bool     `json:"admin"`
+	Roles         []string `json:"roles"`
+	Permissions   []string `json:"permissions"`
+	EmailVerified bool     `json:"email_verified"`
+	ClientID      string   `json:"client_id"`
+	Scope         string   `json:"scope"`
+	Fid           string   `json:"fid"`
+	Org           string   `json:"org"`
+	Sid           string   `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// A single key of a JSON Web Key Set. Only Ed25519 keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+}
+
+// Verifies JWTs locally with the public keys published by the auth service.
+// The keys are cached for cacheTTL. If fetching fresh keys fails, the cached keys
+// keep being used, so an auth service outage does not prevent verifying JWTs.
+type Verifier struct {
+	jwksURL   string
+	issuer    string
+	audience  string
+	cacheTTL  time.Duration
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]ed25519.PublicKey
+	fetchedAt time.Time
+	triedAt   time.Time
+}
+
+// Returns a Verifier that fetches the public keys from jwksURL and requires
+// JWTs to have the given issuer and audience.
+func NewVerifier(jwksURL string, issuer string, audience string, cacheTTL time.Duration) *Verifier {
+	return &Verifier{
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		cacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		keys:     map[string]ed25519.PublicKey{},
+	}
+}
+
+// Verifies the signature, expiration time, issuer and audience of the JWT and
+// returns its claims. If the JWT was signed with an unknown key, the returned
+// error wraps ErrUnknownKey.
+func (v *Verifier) Verify(tokenString string) (claims *Claims, err error) {
+	claims = &Claims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, v.keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithAudience(v.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) keyFunc(token *jwt.Token) (key interface{}, err error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("kid was missing from JWT header")
+	}
+	return v.PublicKey(kid, time.Now())
+}
+
+// Returns the public key with the given kid. The JWKS is fetched again if the
+// cache has expired or the kid is unknown, but at most once per minFetchInterval.
+func (v *Verifier) PublicKey(kid string, now time.Time) (key ed25519.PublicKey, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	stale := now.Sub(v.fetchedAt) >= v.cacheTTL
+	if (!ok || stale) && now.Sub(v.triedAt) >= minFetchInterval {
+		v.triedAt = now
+		err = v.fetch(now)
+		key, ok = v.keys[kid]
+	}
+	if !ok {
+		if err != nil {
+			return nil, fmt.Errorf("%w: fetching JWKS failed: %w", ErrUnknownKey, err)
+		}
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Fetches the JWKS and replaces the cached keys with it. Must be called with mu held.
+func (v *Verifier) fetch(now time.Time) (err error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS request returned status %d", resp.StatusCode)
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return err
+	}
+	keys := map[string]ed25519.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "OKP" || k.Crv != "Ed25519" || k.Kid == "" {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.Kid] = ed25519.PublicKey(x)
+	}
+	v.keys = keys
+	v.fetchedAt = now
+	return nil
+}
@@ -0,0 +1,159 @@
+package jwtverifier
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Ed25519 key published by the mock auth service
+type testKey struct {
+	kid     string
+	private ed25519.PrivateKey
+}
+
+func newTestKey(kid string) testKey {
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	return testKey{kid: kid, private: private}
+}
+
+// Signs a JWT with the given claims the same way the auth service does
+func (k testKey) sign(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = k.kid
+	tokenString, _ := token.SignedString(k.private)
+	return tokenString
+}
+
+// Returns claims that pass verification with the issuer "auth" and audience "gateway"
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": "auth",
+		"aud": "gateway",
+		"username": "test_user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"permissions": []string{"upload:write"},
+		"email_verified": true,
+	}
+}
+
+// Starts a mock auth service that publishes the given keys. The returned
+// counter is incremented on every JWKS request. If *down is true, 503 is returned.
+func newJWKSServer(t *testing.T, keys *[]testKey, down *bool) (server *httptest.Server, requests *int) {
+	requests = new(int)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if *down {
+			w.WriteHeader(503)
+			return
+		}
+		jwks := map[string][]jwk{"keys": {}}
+		for _, k := range *keys {
+			jwks["keys"] = append(jwks["keys"], jwk{
+				Kty: "OKP",
+				Crv: "Ed25519",
+				X: base64.RawURLEncoding.EncodeToString(k.private.Public().(ed25519.PublicKey)),
+				Kid: k.kid,
+			})
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestVerify(t *testing.T) {
+	key := newTestKey("key1")
+	keys, down := []testKey{key}, false
+	server, _ := newJWKSServer(t, &keys, &down)
+
+	tests := []struct {
+		name		string
+		claims		func(c jwt.MapClaims)
+		signer		testKey
+		expectedErr	error
+	}{
+		{ name: "Valid JWT", claims: func(c jwt.MapClaims) {}, signer: key, },
+		{ name: "Expired JWT", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, signer: key, expectedErr: jwt.ErrTokenExpired, },
+		{ name: "Expiration missing", claims: func(c jwt.MapClaims) { delete(c, "exp") }, signer: key, expectedErr: jwt.ErrTokenRequiredClaimMissing, },
+		{ name: "Wrong issuer", claims: func(c jwt.MapClaims) { c["iss"] = "other" }, signer: key, expectedErr: jwt.ErrTokenInvalidIssuer, },
+		{ name: "Wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "other" }, signer: key, expectedErr: jwt.ErrTokenInvalidAudience, },
+		{ name: "Unknown kid", claims: func(c jwt.MapClaims) {}, signer: newTestKey("unknown"), expectedErr: ErrUnknownKey, },
+		{ name: "Forged signature", claims: func(c jwt.MapClaims) {}, signer: testKey{kid: "key1", private: newTestKey("").private}, expectedErr: jwt.ErrTokenSignatureInvalid, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(server.URL, "auth", "gateway", time.Minute)
+			claims := validClaims()
+			tt.claims(claims)
+
+			verified, err := v.Verify(tt.signer.sign(claims))
+			if tt.expectedErr == nil {
+				if err != nil { t.Fatalf("Valid JWT was rejected:\n%s", err.Error()) }
+				if verified.Username != "test_user" || len(verified.Permissions) != 1 || !verified.EmailVerified { t.Fatal("Claims were incorrect", verified) }
+				return
+			}
+			if !errors.Is(err, tt.expectedErr) { t.Fatal("Error was incorrect", err) }
+		})
+	}
+}
+
+func TestVerifyHS256Rejected(t *testing.T) {
+	keys, down := []testKey{newTestKey("key1")}, false
+	server, _ := newJWKSServer(t, &keys, &down)
+	v := NewVerifier(server.URL, "auth", "gateway", time.Minute)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+	token.Header["kid"] = "key1"
+	tokenString, _ := token.SignedString([]byte("secret"))
+	if _, err := v.Verify(tokenString); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Fatal("HS256 JWT was not rejected", err)
+	}
+}
+
+func TestPublicKeyCaching(t *testing.T) {
+	key := newTestKey("key1")
+	keys, down := []testKey{key}, false
+	server, requests := newJWKSServer(t, &keys, &down)
+	v := NewVerifier(server.URL, "auth", "gateway", time.Minute)
+	now := time.Now()
+
+	if _, err := v.PublicKey("key1", now); err != nil { t.Fatalf("Key was not found:\n%s", err.Error()) }
+	if _, err := v.PublicKey("key1", now.Add(30*time.Second)); err != nil { t.Fatal("Cached key was not found") }
+	if *requests != 1 { t.Fatal("Cached JWKS was fetched again", *requests) }
+
+	// Unknown kids are fetched at most once per minFetchInterval
+	if _, err := v.PublicKey("key2", now.Add(time.Second)); !errors.Is(err, ErrUnknownKey) { t.Fatal("Unknown kid was found") }
+	if _, err := v.PublicKey("key2", now.Add(2*time.Second)); !errors.Is(err, ErrUnknownKey) { t.Fatal("Unknown kid was found") }
+	if *requests != 1 { t.Fatal("JWKS was fetched before minFetchInterval passed", *requests) }
+
+	// A rotated key is picked up once minFetchInterval has passed
+	keys = append(keys, newTestKey("key2"))
+	if _, err := v.PublicKey("key2", now.Add(minFetchInterval)); err != nil { t.Fatal("Rotated key was not found") }
+	if *requests != 2 { t.Fatal("JWKS was not fetched for unknown kid", *requests) }
+}
+
+func TestPublicKeyAuthServiceDown(t *testing.T) {
+	keys, down := []testKey{newTestKey("key1")}, false
+	server, requests := newJWKSServer(t, &keys, &down)
+	v := NewVerifier(server.URL, "auth", "gateway", time.Minute)
+	now := time.Now()
+
+	if _, err := v.PublicKey("key1", now); err != nil { t.Fatalf("Key was not found:\n%s", err.Error()) }
+	down = true
+	if _, err := v.PublicKey("key1", now.Add(2*time.Minute)); err != nil {
+		t.Fatal("Cached key was not used while the auth service was down")
+	}
+	if *requests != 2 { t.Fatal("Expired JWKS was not fetched again", *requests) }
+	if _, err := v.PublicKey("key2", now.Add(3*time.Minute)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatal("Error was not ErrUnknownKey", err)
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	JwtVerifier "gateway/jwt_verifier"
+	RevocationList "gateway/revocation_list"
 	SendStatus "gateway/send_status"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -19,12 +27,72 @@ type JsonStruct struct {
 	Username	string		`json:"username"`
 	Exp			float64		`json:"exp"`
 	Admin		bool		`json:"admin"`
+	Roles		[]string	`json:"roles"`
+	Permissions	[]string	`json:"permissions"`
+	EmailVerified	bool	`json:"email_verified"`
+	ClientID	string		`json:"client_id,omitempty"`
+	Scope		string		`json:"scope"`
+	Fid			string		`json:"fid,omitempty"`
+	Org			string		`json:"org,omitempty"`
+}
+
+// Returns the scopes the token grants. Tokens without a scope claim, which were
+// issued before the auth service added it, are granted their permissions.
+func (token JsonStruct) Scopes() (scopes []string) {
+	if token.Scope == "" {
+		return token.Permissions
+	}
+	return strings.Fields(token.Scope)
+}
+
+// Returns true if the token may be used for the mp3 with the given fid. Only scoped
+// tokens minted for a single mp3 are restricted.
+func (token JsonStruct) CoversFile(fid string) bool {
+	return token.Fid == "" || token.Fid == fid
+}
+
+// Returns the metadata of files uploaded with the token. Files uploaded by members of
+// an organization belong to the organization too.
+func (token JsonStruct) FileMetadata() FileMetadata {
+	return FileMetadata{Owner: token.Username, Org: token.Org}
+}
+
+// Returns a GridFS filter matching the files the token gives access to, i.e. the ones
+// owned by its user and, for members of an organization, the organization's files.
+// Files uploaded before files got an owner have no owner metadata. Back then only
+// admins could upload and download files, so admins keep access to them.
+func (token JsonStruct) FilesFilter() (filter bson.M) {
+	owners := []bson.M{{"metadata.owner": token.Username}}
+	if token.Org != "" {
+		owners = append(owners, bson.M{"metadata.org": token.Org})
+	}
+	if token.Admin {
+		owners = append(owners, bson.M{"metadata.owner": bson.M{"$exists": false}})
+	}
+	return bson.M{"$or": owners}
 }
 
 type RabbitMQMessage struct {
 	VideoFid	string		`json:"video_fid"`
 	Mp3Fid		string		`json:"mp3_fid"`
 	Username	string		`json:"username"`
+	Org			string		`json:"org,omitempty"`
+}
+
+// GridFS metadata of uploaded videos and the mp3s converted from them. Org is the ID
+// of the organization of the owner, whose members share the files.
+type FileMetadata struct {
+	Owner	string	`bson:"owner" json:"owner"`
+	Org		string	`bson:"org,omitempty" json:"org,omitempty"`
+}
+
+// A file stored in GridFS, as listed by the GET /files endpoint
+type StoredFile struct {
+	Fid			primitive.ObjectID	`bson:"_id" json:"fid"`
+	Filename	string				`bson:"filename" json:"filename"`
+	Length		int64				`bson:"length" json:"length"`
+	UploadDate	time.Time			`bson:"uploadDate" json:"upload_date"`
+	Metadata	FileMetadata		`bson:"metadata" json:"metadata"`
 }
 
 var servicePort string = "8080"
@@ -36,6 +104,33 @@ var GetAuthServiceUrl = func () (url string) {
 	return "http://" + os.Getenv("AUTH_SVC_ADDRESS")
 }
 
+// Verifies JWTs locally with the auth service's public keys. Created in main().
+var tokenVerifier *JwtVerifier.Verifier
+
+// Revocations of JWTs, which are checked for JWTs verified locally. Created in main().
+var revocationList *RevocationList.List
+
+// Number of proxies, e.g. the ingress controller, that add the client's address to
+// X-Forwarded-For before a request reaches the gateway. Configured with the
+// TRUSTED_PROXY_COUNT env variable.
+var trustedProxyCount = GetIntEnv("TRUSTED_PROXY_COUNT", 0)
+
+// Returns the IP address of the client that sent the request. Addresses in
+// X-Forwarded-For are only trusted if they were added by one of the trusted
+// proxies, since the client can put anything in the header itself.
+func GetClientIP(r *http.Request) (ip string) {
+	forwardedFor := r.Header.Get("X-Forwarded-For")
+	if trustedProxyCount > 0 && forwardedFor != "" {
+		addresses := strings.Split(forwardedFor, ",")
+		return strings.TrimSpace(addresses[max(len(addresses)-trustedProxyCount, 0)])
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
 // Check if the HTTP request used the POST method. If POST was used, the function
 // returns true. Otherwise MethodNotAllowed is sent and false is returned.
 func IsPostRequest(w http.ResponseWriter, r *http.Request) bool {
@@ -59,7 +154,13 @@ func IsGetRequest(w http.ResponseWriter, r *http.Request) bool {
 // Uses the received BasicAuth credentials to request authorization from the auth service.
 // If everything is correct, this function returns the JWT token string given by the auth service.
 // Otherwise it will write a StatusCode corresponding to what went wrong and return nil.
-func AuthorizeUser(username string, password string, w http.ResponseWriter) (tokenString []byte) {
+// The client's IP is passed on in X-Forwarded-For, so that the auth service can lock it out,
+// and the client's User-Agent, so that the auth service can show which device a session is on.
+// If the gateway is connected to the auth service's gRPC API, the Login RPC is called instead.
+func AuthorizeUser(username string, password string, clientIP string, userAgent string, w http.ResponseWriter) (tokenString []byte) {
+	if authClient != nil {
+		return AuthorizeUserWithRpc(username, password, clientIP, userAgent, w)
+	}
 	url := GetAuthServiceUrl() + "/login"
 	// Create a new POST request to the auth service
 	reqToAuthService, err := http.NewRequest("POST", url, nil)
@@ -69,6 +170,8 @@ func AuthorizeUser(username string, password string, w http.ResponseWriter) (tok
 	}
 	// Set basic auth credentials for the POST request
 	reqToAuthService.SetBasicAuth(username, password)
+	reqToAuthService.Header.Set("X-Forwarded-For", clientIP)
+	reqToAuthService.Header.Set("User-Agent", userAgent)
 
 	// Send the POST request
 	resp, err := http.DefaultClient.Do(reqToAuthService)
@@ -78,9 +181,12 @@ func AuthorizeUser(username string, password string, w http.ResponseWriter) (tok
 	}
 	defer resp.Body.Close()
 
-	// If the request status is not 200, write the returned status code
+	// If the request status is not 200, write the returned status code and body.
+	// Users that have enabled MFA get 202 with an Mfa-Challenge header instead of a JWT.
 	if resp.StatusCode != 200 {
+		CopyAuthHeaders(w, resp)
 		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
 		return nil
 	}
 
@@ -90,9 +196,75 @@ func AuthorizeUser(username string, password string, w http.ResponseWriter) (tok
 		SendStatus.InternalServerError(w)
 		return nil
 	}
+	CopyAuthHeaders(w, resp)
 	return body
 }
 
+// Headers of the auth service's responses that are passed on to the user
+var authResponseHeaders = []string{"Refresh-Token", "Retry-After", "Mfa-Challenge", "Oidc-Link", "Location", "Cache-Control", "WWW-Authenticate"}
+
+// Client for requests forwarded to the auth service. Redirects, e.g. those of /authorize
+// to an OAuth client's redirect URI, are not followed but passed on to the user.
+var authServiceClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Copies the token and rate limit related headers, e.g. Refresh-Token and Retry-After,
+// of a response received from the auth service to the response sent to the user.
+func CopyAuthHeaders(w http.ResponseWriter, resp *http.Response) {
+	for _, header := range authResponseHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+}
+
+// Forwards the request to the given route of the auth service. Only the listed request
+// headers are passed on, along with the query, the request body, its Content-Type, the
+// client's User-Agent and the client's IP in X-Forwarded-For. The status code, auth
+// headers and body of the auth service's response are sent back to the user.
+func ForwardToAuthService(w http.ResponseWriter, r *http.Request, route string, headers ...string) {
+	resp, err := SendToAuthService(r, route, headers...)
+	if err != nil {
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer resp.Body.Close()
+	SendAuthResponse(w, resp)
+}
+
+// Sends the request to the given route of the auth service, like ForwardToAuthService,
+// and returns the auth service's response. The caller has to close the response body.
+func SendToAuthService(r *http.Request, route string, headers ...string) (resp *http.Response, err error) {
+	if r.URL.RawQuery != "" {
+		route += "?" + r.URL.RawQuery
+	}
+	reqToAuthService, err := http.NewRequest(r.Method, GetAuthServiceUrl()+route, r.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range append(headers, "Content-Type") {
+		if value := r.Header.Get(header); value != "" {
+			reqToAuthService.Header.Set(header, value)
+		}
+	}
+	reqToAuthService.Header.Set("X-Forwarded-For", GetClientIP(r))
+	reqToAuthService.Header.Set("User-Agent", r.UserAgent())
+	return authServiceClient.Do(reqToAuthService)
+}
+
+// Sends the status code, auth headers and body of the auth service's response to the user.
+func SendAuthResponse(w http.ResponseWriter, resp *http.Response) {
+	CopyAuthHeaders(w, resp)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
 func Login(w http.ResponseWriter, r *http.Request) {
 	log.Println("Login request received")
 	if !IsPostRequest(w, r) { return }
@@ -105,7 +277,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Println("Authorizing user")
-	if tokenString := AuthorizeUser(username, password, w); tokenString != nil {
+	if tokenString := AuthorizeUser(username, password, GetClientIP(r), r.UserAgent(), w); tokenString != nil {
 		log.Println("User authorized successfully")
 		// Since AuthorizeUser handles setting statusCodes, we can just write the msg body here
 		w.Write(tokenString)
@@ -114,10 +286,92 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Second step of a login with MFA. Exchanges the challenge token, received from /login
+// in the Mfa-Challenge header, for a JWT and a refresh token. The POST request needs the
+// challenge token in its Mfa-Challenge header and either a TOTP code in the Mfa-Code header
+// or a recovery code in the Recovery-Code header. The request is passed onto the
+// authorization service and its response is sent back to the user.
+func LoginMfa(w http.ResponseWriter, r *http.Request) {
+	log.Println("LoginMfa request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Mfa-Challenge") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/login/mfa", "Mfa-Challenge", "Mfa-Code", "Recovery-Code")
+}
+
+// Starts a login through the corporate OpenID Connect identity provider. The authorization
+// service redirects the user to the IdP, which sends them back to /login/oidc/callback.
+func OidcLogin(w http.ResponseWriter, r *http.Request) {
+	log.Println("OidcLogin request received")
+	if !IsGetRequest(w, r) { return }
+
+	ForwardToAuthService(w, r, "/login/oidc")
+}
+
+// Redirect URI of logins through the OpenID Connect identity provider. The code and state
+// sent back by the IdP are passed onto the authorization service, which responds with a
+// JWT and a refresh token like /login. If an account with the IdP's email address exists
+// already, it responds with 409 and a link token in the Oidc-Link header instead.
+func OidcCallback(w http.ResponseWriter, r *http.Request) {
+	log.Println("OidcCallback request received")
+	if !IsGetRequest(w, r) { return }
+
+	ForwardToAuthService(w, r, "/login/oidc/callback")
+}
+
+// Links the IdP identity of the link token in the Oidc-Link header to the account of
+// the JWT in the Authorization header. The account's password has to be given in the
+// Password header. The request is passed onto the authorization service.
+func ConfirmOidcLink(w http.ResponseWriter, r *http.Request) {
+	log.Println("ConfirmOidcLink request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/login/oidc/link", "Authorization", "Oidc-Link", "Password")
+}
+
+// Starts an MFA enrollment for the user of the JWT in the Authorization header.
+// The authorization service responds with a TOTP secret and its otpauth:// URI.
+func EnrollMfa(w http.ResponseWriter, r *http.Request) {
+	log.Println("EnrollMfa request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/mfa/enroll", "Authorization")
+}
+
+// Enables MFA for the user of the JWT in the Authorization header by confirming the
+// pending enrollment with a TOTP code, given in the Mfa-Code header. The authorization
+// service responds with the user's recovery codes.
+func ConfirmMfa(w http.ResponseWriter, r *http.Request) {
+	log.Println("ConfirmMfa request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	if r.Header.Get("Mfa-Code") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/mfa/confirm", "Authorization", "Mfa-Code")
+}
+
 // This function expects to find a Username and Password for a new user
 // in the POST request's headers. If found, this information is passed onto
 // the authorization service and the status code the service returns is sent
-// back to the user.
+// back to the user. The Invite-Code header, which the authorization service
+// requires in invite-only registration mode, is passed on too.
 func Register(w http.ResponseWriter, r *http.Request) {
 	log.Println("Register request received")
 	if !IsPostRequest(w, r) { return }
@@ -128,6 +382,10 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		SendStatus.BadRequest(w)
 		return
 	}
+	if authClient != nil {
+		RegisterWithRpc(w, r, username, password)
+		return
+	}
 
 	url := GetAuthServiceUrl() + "/register"
 	reqToAuthService, err := http.NewRequest("POST", url, nil)
@@ -137,15 +395,23 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	}
 	reqToAuthService.Header.Add("Username", username)
 	reqToAuthService.Header.Add("Password", password)
+	if inviteCode := r.Header.Get("Invite-Code"); inviteCode != "" {
+		reqToAuthService.Header.Set("Invite-Code", inviteCode)
+	}
+	reqToAuthService.Header.Set("X-Forwarded-For", GetClientIP(r))
+	reqToAuthService.Header.Set("User-Agent", r.UserAgent())
 
 	resp, err := http.DefaultClient.Do(reqToAuthService)
 	if err != nil {
 		SendStatus.InternalServerError(w)
 		return
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
+		CopyAuthHeaders(w, resp)
 		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
 		return
 	}
 
@@ -155,9 +421,568 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		SendStatus.InternalServerError(w)
 		return
 	}
+	CopyAuthHeaders(w, resp)
 	w.Write(body)
 }
 
+// JSON versions of /login and /register. The POST request's body holds the username
+// and password as JSON, e.g. {"username": "...", "password": "..."}, so that the password
+// is not sent in a header. The request is passed onto the same route of the authorization
+// service and its JSON response, with the access token, its type and expiry, the refresh
+// token and the user's info, is sent back to the user. Users that have enabled MFA get
+// 202 with the challenge token, which they complete at /login/mfa.
+func LoginV1(w http.ResponseWriter, r *http.Request) {
+	log.Println("LoginV1 request received")
+	if !IsPostRequest(w, r) { return }
+	ForwardToAuthService(w, r, "/v1/login")
+}
+
+// JSON version of /register, which returns the same JSON as LoginV1
+func RegisterV1(w http.ResponseWriter, r *http.Request) {
+	log.Println("RegisterV1 request received")
+	if !IsPostRequest(w, r) { return }
+	ForwardToAuthService(w, r, "/v1/register")
+}
+
+// Exchanges the refresh token found in the POST request's Refresh-Token header
+// for a new JWT and refresh token. The refresh token is passed onto the
+// authorization service and its response is sent back to the user.
+func Refresh(w http.ResponseWriter, r *http.Request) {
+	log.Println("Refresh request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Refresh-Token") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/refresh", "Refresh-Token")
+}
+
+// Logs the user out by passing the JWT in the Authorization header, and the optional
+// Refresh-Token header, onto the authorization service, which revokes them.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	log.Println("Logout request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/logout", "Authorization", "Refresh-Token")
+}
+
+// Starts a password reset for the user given in the POST request's Username header.
+// The auth service sends the user a reset token through the notification service.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	log.Println("ForgotPassword request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Username") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/password/forgot", "Username")
+}
+
+// Sets a new password, given in the POST request's Password header, for the user
+// that the reset token in the Reset-Token header was sent to. The request is passed
+// onto the authorization service and its response is sent back to the user.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	log.Println("ResetPassword request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Reset-Token") == "" || r.Header.Get("Password") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/password/reset", "Reset-Token", "Password")
+}
+
+// Verifies the email address of a user with the verification token sent to them,
+// given in the POST request's Verification-Token header. The request is passed onto
+// the authorization service and its response is sent back to the user.
+func Verify(w http.ResponseWriter, r *http.Request) {
+	log.Println("Verify request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Verification-Token") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/verify", "Verification-Token")
+}
+
+// Sends a new verification token to the user given in the POST request's Username
+// header. The request is passed onto the authorization service and its response is
+// sent back to the user.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	log.Println("ResendVerification request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Username") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/verify/resend", "Username")
+}
+
+// Admin endpoint for listing, assigning and removing the roles of users.
+// The request is passed onto the authorization service, which checks that
+// the JWT in the Authorization header grants the admin permission.
+func Roles(w http.ResponseWriter, r *http.Request) {
+	log.Println("Roles request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/admin/roles", "Authorization", "Username", "Role")
+}
+
+// Admin endpoint for listing, creating and revoking the invite codes required to
+// register in invite-only registration mode. The request is passed onto the
+// authorization service, which checks that the JWT in the Authorization header
+// grants the admin permission.
+func InviteCodes(w http.ResponseWriter, r *http.Request) {
+	log.Println("InviteCodes request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/admin/invites", "Authorization", "Max-Uses", "Expires-In", "Roles", "Invite-Id")
+}
+
+// Endpoint for listing, creating, labelling and revoking the API keys of the user of the
+// JWT in the Authorization header. The request is passed onto the authorization service.
+// API keys can be used instead of JWTs on /upload and /download, by sending them in
+// the Authorization header with the ApiKey scheme, e.g. "ApiKey <key>".
+func ApiKeys(w http.ResponseWriter, r *http.Request) {
+	log.Println("ApiKeys request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/api-keys", "Authorization", "Label", "Key-Id")
+}
+
+// Endpoint for listing the sessions, i.e. the devices, the user of the JWT in the
+// Authorization header is logged in on (GET) and ending the session given in the
+// Session-Id header (DELETE). The request is passed onto the authorization service.
+func Sessions(w http.ResponseWriter, r *http.Request) {
+	log.Println("Sessions request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/sessions", "Authorization", "Session-Id")
+}
+
+// Endpoint for minting a scoped JWT, e.g. a download link for a single mp3, with the JWT
+// in the Authorization header. The scopes are given in the Scope header and the mp3 in
+// the optional Fid header, which has to be a valid fid. The request is passed onto the
+// authorization service, which responds with the scoped JWT.
+func ScopedTokens(w http.ResponseWriter, r *http.Request) {
+	log.Println("ScopedTokens request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	if fid := r.Header.Get("Fid"); fid != "" && !primitive.IsValidObjectID(fid) {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/tokens/scoped", "Authorization", "Scope", "Fid")
+}
+
+// Endpoint for organizations, which let teams share their files. Depending on the
+// route, the organization of the user of the JWT in the Authorization header is
+// created, fetched or deleted (/orgs), its members are managed (/orgs/members),
+// users are invited to it (/orgs/invitations) or an invitation is accepted
+// (/orgs/invitations/accept). The request is passed onto the same route of the
+// authorization service, which checks the user's role in the organization.
+func Organizations(w http.ResponseWriter, r *http.Request) {
+	log.Println("Organizations request received for", r.URL.Path)
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, r.URL.Path, "Authorization", "Name", "Username", "Org-Role", "Invitation-Token")
+}
+
+// Endpoint for registering OAuth clients, e.g. third-party tools that upload or download
+// on behalf of the user of the JWT in the Authorization header. The POST request's JSON
+// body is passed onto the authorization service, which responds with the client_id and,
+// for confidential clients, the client_secret.
+func OAuthClients(w http.ResponseWriter, r *http.Request) {
+	log.Println("OAuthClients request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/oauth/clients", "Authorization")
+}
+
+// Endpoint for listing the consents the user of the JWT in the Authorization header has
+// given to OAuth clients (GET) and withdrawing the consent given to the client in the
+// Client-Id header (DELETE). The request is passed onto the authorization service.
+func OAuthConsents(w http.ResponseWriter, r *http.Request) {
+	log.Println("OAuthConsents request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/oauth/consents", "Authorization", "Client-Id")
+}
+
+// Authorization endpoint of the OAuth authorization code grant. The user is identified
+// by the JWT in the Authorization header. The OAuth parameters, sent in the query or the
+// form of a POST request, are passed onto the authorization service, which either asks
+// for the user's consent or redirects to the client with an authorization code.
+func Authorize(w http.ResponseWriter, r *http.Request) {
+	log.Println("Authorize request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/authorize", "Authorization")
+}
+
+// Token endpoint of the OAuth authorization server. OAuth clients exchange authorization
+// codes, or their client credentials, for a JWT that can be used on /upload and /download
+// like the ones returned by /login. The form and the client's Basic auth credentials are
+// passed onto the authorization service.
+func Token(w http.ResponseWriter, r *http.Request) {
+	log.Println("Token request received")
+	if !IsPostRequest(w, r) { return }
+
+	ForwardToAuthService(w, r, "/token", "Authorization")
+}
+
+// Endpoint for the account of the user of the JWT in the Authorization header. GET returns
+// the user's profile. DELETE deletes the account, after the authorization service has
+// checked the password given in the Password header, along with every video and mp3 the
+// user has uploaded. The files are deleted with CleanUpUserFiles once the account has been
+// deleted, so the deletion succeeds even if the files have to be deleted later.
+func Me(w http.ResponseWriter, r *http.Request) {
+	log.Println("Me request received")
+	if r.Method != "DELETE" {
+		if r.Header.Get("Authorization") == "" {
+			SendStatus.InvalidCredentials(w)
+			return
+		}
+		ForwardToAuthService(w, r, "/me", "Authorization")
+		return
+	}
+
+	token, statusCode := VerifyToken(r)
+	if !SendStatus.BasedOnValue(w, statusCode) { return }
+
+	resp, err := SendToAuthService(r, "/me", "Authorization", "Password")
+	if err != nil {
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		CleanUpUserFiles(token.Username, time.Now())
+	}
+	SendAuthResponse(w, resp)
+}
+
+// Changes the password of the user of the JWT in the Authorization header. The POST
+// request needs the current password in the Password header and the new one in the
+// New-Password header. The user's other sessions are ended, and the authorization service
+// responds with a new JWT and refresh token for the current one.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	log.Println("ChangePassword request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	if r.Header.Get("Password") == "" || r.Header.Get("New-Password") == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/me/password", "Authorization", "Password", "New-Password")
+}
+
+// GridFS databases that hold the files of users. Uploaded videos and the mp3s converted
+// from them have the username of their owner in the owner metadata field.
+var userFileDatabases = []string{"videos", "mp3s"}
+
+// Returns the files of the given GridFS database that match the filter, newest first.
+// Swapped out in tests, which have no MongoDB.
+var FindFiles = func(database string, filter bson.M) (files []StoredFile, err error) {
+	uri, err := GetMongoUri()
+	if err != nil {
+		return nil, err
+	}
+	client := ConnectToMongoDB(uri)
+	defer client.Disconnect(context.TODO())
+	bucket, err := gridfs.NewBucket(client.Database(database), options.GridFSBucket())
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := bucket.Find(filter, options.GridFSFind().SetSort(bson.D{{Key: "uploadDate", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	files = []StoredFile{}
+	if err := cursor.All(context.TODO(), &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Endpoint for listing the mp3s the JWT in the Authorization header gives access to as
+// JSON, newest first. These are the user's own mp3s and, for members of an organization,
+// the mp3s of the other members uploaded for the organization. Requires the
+// download:read scope.
+func Files(w http.ResponseWriter, r *http.Request) {
+	log.Println("Files request received")
+	if !IsGetRequest(w, r) { return }
+
+	token, ok := RequireScope(w, r, "download:read")
+	if !ok { return }
+	if token.Fid != "" {
+		log.Printf("Token of user %s is restricted to a single mp3", token.Username)
+		SendStatus.Forbidden(w)
+		return
+	}
+	files, err := FindFiles("mp3s", token.FilesFilter())
+	if err != nil {
+		log.Printf("Error occured while trying to list files of user %s:\n%s", token.Username, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// How often file cleanups that failed are retried. Configured with the
+// FILE_CLEANUP_INTERVAL env variable.
+var fileCleanupInterval = GetDurationEnv("FILE_CLEANUP_INTERVAL", 5*time.Minute)
+
+// Deletes the files of a user whose account has been deleted at deletedAt. The account
+// can not be deleted again, so if deleting the files fails, the cleanup is queued and
+// retried by RetryFileCleanups instead of failing the request.
+func CleanUpUserFiles(username string, deletedAt time.Time) {
+	log.Println("Deleting files of user", username)
+	err := DeleteUserFiles(username, deletedAt)
+	if err == nil {
+		return
+	}
+	log.Printf("Deleting files of user %s failed, retrying later:\n%s", username, err.Error())
+	if err := QueueFileCleanup(username, deletedAt); err != nil {
+		log.Printf("Error occured while queueing file cleanup of user %s:\n%s", username, err.Error())
+	}
+}
+
+// Retries the queued file cleanups every fileCleanupInterval.
+func RetryFileCleanupsPeriodically() {
+	for range time.Tick(fileCleanupInterval) {
+		RetryFileCleanups()
+	}
+}
+
+// Retries every queued file cleanup and removes those that succeed from the queue.
+func RetryFileCleanups() {
+	cleanups, err := QueuedFileCleanups()
+	if err != nil {
+		log.Printf("Error occured while fetching queued file cleanups:\n%s", err.Error())
+		return
+	}
+	for _, cleanup := range cleanups {
+		if err := DeleteUserFiles(cleanup.Username, cleanup.DeletedAt); err != nil {
+			log.Printf("Deleting files of user %s failed again:\n%s", cleanup.Username, err.Error())
+			continue
+		}
+		if err := RemoveFileCleanup(cleanup); err != nil {
+			log.Printf("Error occured while removing file cleanup of user %s:\n%s", cleanup.Username, err.Error())
+		}
+	}
+}
+
+// Cleanup of the files of a deleted user, queued because deleting them failed
+type FileCleanup struct {
+	Username	string		`bson:"_id"`
+	DeletedAt	time.Time	`bson:"deleted_at"`
+}
+
+// Collection the queued file cleanups are stored in, so that they survive restarts
+const fileCleanupDatabase, fileCleanupCollection = "gateway", "file_cleanups"
+
+// Queues the cleanup of the files of the given user. If a cleanup of the user is queued
+// already, e.g. because the username was registered and deleted again, the later
+// deletion time is kept. Swapped out in tests, which have no MongoDB.
+var QueueFileCleanup = func(username string, deletedAt time.Time) (err error) {
+	uri, err := GetMongoUri()
+	if err != nil {
+		return err
+	}
+	client := ConnectToMongoDB(uri)
+	defer client.Disconnect(context.TODO())
+	_, err = client.Database(fileCleanupDatabase).Collection(fileCleanupCollection).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": username},
+		bson.M{"$max": bson.M{"deleted_at": deletedAt}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// Returns the queued file cleanups. Swapped out in tests, which have no MongoDB.
+var QueuedFileCleanups = func() (cleanups []FileCleanup, err error) {
+	uri, err := GetMongoUri()
+	if err != nil {
+		return nil, err
+	}
+	client := ConnectToMongoDB(uri)
+	defer client.Disconnect(context.TODO())
+	cursor, err := client.Database(fileCleanupDatabase).Collection(fileCleanupCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	cleanups = []FileCleanup{}
+	if err := cursor.All(context.TODO(), &cleanups); err != nil {
+		return nil, err
+	}
+	return cleanups, nil
+}
+
+// Removes a file cleanup from the queue, unless the user has been deleted again since.
+// Swapped out in tests, which have no MongoDB.
+var RemoveFileCleanup = func(cleanup FileCleanup) (err error) {
+	uri, err := GetMongoUri()
+	if err != nil {
+		return err
+	}
+	client := ConnectToMongoDB(uri)
+	defer client.Disconnect(context.TODO())
+	_, err = client.Database(fileCleanupDatabase).Collection(fileCleanupCollection).DeleteOne(
+		context.TODO(),
+		bson.M{"_id": cleanup.Username, "deleted_at": cleanup.DeletedAt},
+	)
+	return err
+}
+
+// Deletes every video and mp3 the given user uploaded before deletedAt from GridFS. Files
+// uploaded later belong to a new user who registered with the same username. Deleting
+// files that have been deleted already succeeds, so failed deletions can be retried.
+// Swapped out in tests, which have no MongoDB.
+var DeleteUserFiles = func(username string, deletedAt time.Time) (err error) {
+	uri, err := GetMongoUri()
+	if err != nil {
+		return err
+	}
+	client := ConnectToMongoDB(uri)
+	defer client.Disconnect(context.TODO())
+	for _, database := range userFileDatabases {
+		bucket, err := gridfs.NewBucket(client.Database(database), options.GridFSBucket())
+		if err != nil {
+			return err
+		}
+		cursor, err := bucket.Find(bson.M{"metadata.owner": username, "uploadDate": bson.M{"$lt": deletedAt}})
+		if err != nil {
+			return err
+		}
+		var files []struct {
+			ID	primitive.ObjectID	`bson:"_id"`
+		}
+		if err := cursor.All(context.TODO(), &files); err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := bucket.Delete(file.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+				return err
+			}
+		}
+		log.Printf("Deleted %d files of user %s from %s", len(files), username, database)
+	}
+	return nil
+}
+
+// Admin endpoint for lifting login lockouts of an account, given in the Username
+// header, and/or a client IP, given in the IP header. The request is passed onto
+// the authorization service, which checks that the JWT grants the admin permission.
+func Unlock(w http.ResponseWriter, r *http.Request) {
+	log.Println("Unlock request received")
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/admin/unlock", "Authorization", "Username", "IP")
+}
+
+// Admin endpoint for listing and searching users (GET) and deleting the user given in
+// the Username header (DELETE). The request is passed onto the authorization service,
+// which checks that the JWT grants the admin permission. After the authorization service
+// has deleted a user, the user's videos and mp3s are deleted too, with CleanUpUserFiles.
+func AdminUsers(w http.ResponseWriter, r *http.Request) {
+	log.Println("AdminUsers request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	resp, err := SendToAuthService(r, "/admin/users", "Authorization", "Username")
+	if err != nil {
+		SendStatus.InternalServerError(w)
+		return
+	}
+	defer resp.Body.Close()
+	if r.Method == "DELETE" && resp.StatusCode == http.StatusOK {
+		CleanUpUserFiles(r.Header.Get("Username"), time.Now())
+	}
+	SendAuthResponse(w, resp)
+}
+
+// Admin endpoint for disabling or enabling the account of the user given in the Username
+// header, or forcing the user to reset their password, depending on the route. The request
+// is passed onto the same route of the authorization service, which checks that the JWT
+// grants the admin permission.
+func AdminUserAction(w http.ResponseWriter, r *http.Request) {
+	log.Println("AdminUserAction request received for", r.URL.Path)
+	if !IsPostRequest(w, r) { return }
+
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, r.URL.Path, "Authorization", "Username")
+}
+
+// Admin endpoint for listing the log of actions admins have taken on user accounts.
+// The request is passed onto the authorization service, which checks that the JWT
+// grants the admin permission.
+func AdminActions(w http.ResponseWriter, r *http.Request) {
+	log.Println("AdminActions request received")
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, "/admin/actions", "Authorization")
+}
+
+// Admin endpoint for querying the audit log of logins, registrations and issued tokens
+// (/admin/audit) and exporting it as JSON lines (/admin/audit/export). The request is
+// passed onto the same route of the authorization service, which checks that the JWT
+// grants the admin permission.
+func AuditEvents(w http.ResponseWriter, r *http.Request) {
+	log.Println("AuditEvents request received for", r.URL.Path)
+	if r.Header.Get("Authorization") == "" {
+		SendStatus.InvalidCredentials(w)
+		return
+	}
+	ForwardToAuthService(w, r, r.URL.Path, "Authorization")
+}
+
 func ValidateToken(r *http.Request) (jwtObject []byte, statusCode int) {
 	log.Println("Validating token")
 	if r.Header.Get("Authorization") == "" {
@@ -185,139 +1010,304 @@ func ValidateToken(r *http.Request) (jwtObject []byte, statusCode int) {
 	return jwtObject, 200
 }
 
+// Validates the token of the request with the auth service and converts the
+// returned jwtObject into a JsonStruct. If the gateway is connected to the auth
+// service's gRPC API, the Validate RPC is called instead.
+func ValidateTokenRemotely(r *http.Request) (token JsonStruct, statusCode int) {
+	if authClient != nil {
+		return ValidateTokenWithRpc(r)
+	}
+	jwtObject, statusCode := ValidateToken(r)
+	if statusCode != 200 {
+		return JsonStruct{}, statusCode
+	}
+
+	log.Println("Converting jwtObject to JsonStruct")
+	if err := json.Unmarshal(jwtObject, &token); err != nil {
+		log.Println(err.Error())
+		return JsonStruct{}, 500
+	}
+	return token, 200
+}
+
+// Verifies the JWT in the request's Authorization header locally, without contacting
+// the auth service. Only JWTs signed with a key missing from the auth service's JWKS,
+// and tokens that are not Bearer tokens, e.g. API keys, are validated remotely with
+// ValidateToken. JWTs verified locally are checked against the auth service's
+// revocations, which are cached for REVOCATION_REFRESH_INTERVAL. If they could not be
+// fetched for longer than REVOCATION_MAX_AGE, the JWT is validated remotely as well.
+func VerifyToken(r *http.Request) (token JsonStruct, statusCode int) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return JsonStruct{}, 401
+	}
+	tokenString, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok {
+		return ValidateTokenRemotely(r)
+	}
+
+	log.Println("Verifying token locally")
+	claims, err := tokenVerifier.Verify(tokenString)
+	if errors.Is(err, JwtVerifier.ErrUnknownKey) {
+		log.Printf("Falling back to remote validation:\n%s", err.Error())
+		return ValidateTokenRemotely(r)
+	} else if err != nil {
+		log.Printf("JWT verification failed:\n%s", err.Error())
+		return JsonStruct{}, 403
+	}
+	if claims.ID == "" || claims.IssuedAt == nil {
+		// Revocation can not be checked without jti and iat claims
+		log.Println("JWT was missing jti or iat claim")
+		return JsonStruct{}, 403
+	}
+	revoked, err := revocationList.IsRevoked(claims.ID, claims.Sid, claims.Username, claims.IssuedAt.Time, time.Now())
+	if err != nil {
+		log.Printf("Falling back to remote validation:\n%s", err.Error())
+		return ValidateTokenRemotely(r)
+	}
+	if revoked {
+		log.Printf("JWT of user %s has been revoked", claims.Username)
+		return JsonStruct{}, 403
+	}
+	return JsonStruct{
+		Username: claims.Username,
+		Exp: float64(claims.ExpiresAt.Unix()),
+		Admin: claims.Admin,
+		Roles: claims.Roles,
+		Permissions: claims.Permissions,
+		EmailVerified: claims.EmailVerified,
+		ClientID: claims.ClientID,
+		Scope: claims.Scope,
+		Fid: claims.Fid,
+		Org: claims.Org,
+	}, 200
+}
+
+// Verifies the JWT of the request with VerifyToken and checks that it grants
+// the given scope. If it does not, 403 is sent and ok is false. Other failures
+// send the status code returned by VerifyToken. Otherwise the verified token is returned.
+func RequireScope(w http.ResponseWriter, r *http.Request, scope string) (token JsonStruct, ok bool) {
+	token, statusCode := VerifyToken(r)
+	if !SendStatus.BasedOnValue(w, statusCode) {
+		return JsonStruct{}, false
+	}
+
+	if !slices.Contains(token.Scopes(), scope) {
+		log.Printf("Token of user %s is missing scope %s", token.Username, scope)
+		SendStatus.Forbidden(w)
+		return JsonStruct{}, false
+	}
+	return token, true
+}
+
+// Same as RequireScope, but the token also has to belong to a user that has
+// verified their email address. If it does not, 403 is sent and ok is false.
+func RequireVerifiedScope(w http.ResponseWriter, r *http.Request, scope string) (token JsonStruct, ok bool) {
+	token, ok = RequireScope(w, r, scope)
+	if !ok {
+		return JsonStruct{}, false
+	}
+	if !token.EmailVerified {
+		log.Printf("User %s has not verified their email address", token.Username)
+		SendStatus.Forbidden(w)
+		return JsonStruct{}, false
+	}
+	return token, true
+}
+
 func Upload(w http.ResponseWriter, r *http.Request) {
 	log.Println("Upload request received")
 	if !IsPostRequest(w, r) { return }
 
-	jwtObject, statusCode := ValidateToken(r)
-	if !SendStatus.BasedOnValue(w, statusCode) {
-		return
-	}
+	token, ok := RequireVerifiedScope(w, r, "upload:write")
+	if !ok { return }
 
-	log.Println("Converting jwtObject to JsonStruct")
-	var token JsonStruct
-	err := json.Unmarshal(jwtObject, &token)
+	log.Println("Getting file from request")
+	file, header, err := r.FormFile("file")
 	if err != nil {
-		SendStatus.InternalServerError(w)
 		log.Println(err.Error())
+		SendStatus.BadRequest(w)
 		return
 	}
+	defer file.Close()
+	fileName := strings.Split(header.Filename, ".")
+	fmt.Println("Filename was ", fileName[0])
 
-	if token.Admin {
-		log.Println("Getting file from request")
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			log.Println(err.Error())
-			SendStatus.BadRequest(w)
-			return
-		}
-		defer file.Close()
-		fileName := strings.Split(header.Filename, ".")
-		fmt.Println("Filename was ", fileName[0])
-
-		log.Println("Connecting to MongoDB")
-		uri, err := GetMongoUri()
-		FailOnError(err, "MongoUri creation failed")
-		client := ConnectToMongoDB(uri)
-		dbVideos := client.Database("videos")
-
-		log.Println("Creating GridFs bucket")
-		fsVideos, err := gridfs.NewBucket(dbVideos, options.GridFSBucket())
-		FailOnError(err, "fsVideo creation failed")
-
-		log.Println("Uploading file to MongoDB")
-		fid, err := fsVideos.UploadFromStream(fileName[0], file)
-		FailOnError(err, "Video upload to MongoDB failed")
-
-		log.Println("Connecting to RabbitMQ")
-		connection := ConnectToRabbitMQ()
-		defer connection.Close()
-		channel := OpenChannel(connection)
-		defer channel.Close()
-
-		log.Println("Creating RabbitMQMessage JSON")
-		rabbitMqMessage := RabbitMQMessage{
-			VideoFid: fid.Hex(),
-			Mp3Fid: "",
-			Username: token.Username,
-		}
-		body, err := json.Marshal(rabbitMqMessage)
-		FailOnError(err, "Creating RabbitMQMessage JSON failed")
+	log.Println("Connecting to MongoDB")
+	uri, err := GetMongoUri()
+	FailOnError(err, "MongoUri creation failed")
+	client := ConnectToMongoDB(uri)
+	dbVideos := client.Database("videos")
+
+	log.Println("Creating GridFs bucket")
+	fsVideos, err := gridfs.NewBucket(dbVideos, options.GridFSBucket())
+	FailOnError(err, "fsVideo creation failed")
 
-		log.Println("Publishing JSON with FID to Mp3 queue")
-		err = channel.Publish(
-			"",						// Exchange
-			os.Getenv("VIDEO_QUEUE"),// Routing key
-			false,					// Mandatory
-			false,					// Immediate
-			amqp.Publishing{		// Msg
-				ContentType: "application/json",
-				Body: body,
-			},
-		)
-		FailOnError(err, "RabbitMQ message publishing failed")
+	log.Println("Uploading file to MongoDB")
+	uploadOptions := options.GridFSUpload().SetMetadata(token.FileMetadata())
+	fid, err := fsVideos.UploadFromStream(fileName[0], file, uploadOptions)
+	FailOnError(err, "Video upload to MongoDB failed")
 
-		log.Println("File uploaded with fid:", fid.Hex())
+	log.Println("Connecting to RabbitMQ")
+	connection := ConnectToRabbitMQ()
+	defer connection.Close()
+	channel := OpenChannel(connection)
+	defer channel.Close()
+
+	log.Println("Creating RabbitMQMessage JSON")
+	rabbitMqMessage := RabbitMQMessage{
+		VideoFid: fid.Hex(),
+		Mp3Fid: "",
+		Username: token.Username,
+		Org: token.Org,
 	}
+	body, err := json.Marshal(rabbitMqMessage)
+	FailOnError(err, "Creating RabbitMQMessage JSON failed")
+
+	log.Println("Publishing JSON with FID to Mp3 queue")
+	err = channel.Publish(
+		"",						// Exchange
+		os.Getenv("VIDEO_QUEUE"),// Routing key
+		false,					// Mandatory
+		false,					// Immediate
+		amqp.Publishing{		// Msg
+			ContentType: "application/json",
+			Body: body,
+		},
+	)
+	FailOnError(err, "RabbitMQ message publishing failed")
+
+	log.Println("File uploaded with fid:", fid.Hex())
 }
 
 func Download(w http.ResponseWriter, r *http.Request) {
 	log.Println("Download request received")
 	if !IsGetRequest(w, r) { return }
 
-	jwtObject, statusCode := ValidateToken(r)
-	if !SendStatus.BasedOnValue(w, statusCode) {
+	token, ok := RequireScope(w, r, "download:read")
+	if !ok { return }
+
+	log.Println("Getting FID from request")
+	fid := r.URL.Query().Get("fid")
+	if fid == "" {
+		SendStatus.BadRequest(w)
+		return
+	}
+	if !token.CoversFile(fid) {
+		log.Printf("Token of user %s is restricted to another mp3", token.Username)
+		SendStatus.Forbidden(w)
 		return
 	}
 
-	log.Println("Converting jwtObject to JsonStruct")
-	var token JsonStruct
-	err := json.Unmarshal(jwtObject, &token)
+	log.Println("Getting ID from Hex string", fid)
+	id, err := primitive.ObjectIDFromHex(fid)
 	if err != nil {
-		SendStatus.InternalServerError(w)
-		log.Println(err.Error())
+		SendStatus.BadRequest(w)
 		return
 	}
 
-	if token.Admin {
-		log.Println("Getting FID from request")
-		fid := r.URL.Query().Get("fid")
-		if fid == "" {
-			SendStatus.BadRequest(w)
-			return
-		}
-
-		log.Println("Connecting to MongoDB")
-		uri, err := GetMongoUri()
-		FailOnError(err, "MongoUri creation failed")
-		client := ConnectToMongoDB(uri)
-		dbMp3s := client.Database("mp3s")
+	// Only the owner of the mp3 and the members of its organization may download it
+	filter := token.FilesFilter()
+	filter["_id"] = id
+	files, err := FindFiles("mp3s", filter)
+	if err != nil {
+		log.Printf("Error occured while trying to find mp3 %s:\n%s", fid, err.Error())
+		SendStatus.InternalServerError(w)
+		return
+	}
+	if len(files) == 0 {
+		log.Printf("User %s has no access to mp3 %s", token.Username, fid)
+		SendStatus.NotFound(w)
+		return
+	}
 
-		log.Println("Creating GridFs bucket")
-		fsMp3, err := gridfs.NewBucket(dbMp3s, options.GridFSBucket())
-		FailOnError(err, "fsMp3s creation failed")
+	log.Println("Connecting to MongoDB")
+	uri, err := GetMongoUri()
+	FailOnError(err, "MongoUri creation failed")
+	client := ConnectToMongoDB(uri)
+	dbMp3s := client.Database("mp3s")
 
-		log.Println("Getting ID from Hex string", fid)
-		id, err := primitive.ObjectIDFromHex(fid)
-		FailOnError(err, "Getting ID from fid failed")
+	log.Println("Creating GridFs bucket")
+	fsMp3, err := gridfs.NewBucket(dbMp3s, options.GridFSBucket())
+	FailOnError(err, "fsMp3s creation failed")
 
-		log.Println("Downloading file from MongoDB")
-		fileStream, err := fsMp3.OpenDownloadStream(id)
-		FailOnError(err, "Download from MongoDB failed")
-		defer fileStream.Close()
+	log.Println("Downloading file from MongoDB")
+	fileStream, err := fsMp3.OpenDownloadStream(id)
+	FailOnError(err, "Download from MongoDB failed")
+	defer fileStream.Close()
 
-		_, err = io.Copy(w, fileStream)
-		FailOnError(err, "Copying file to w failed")
-	}
+	_, err = io.Copy(w, fileStream)
+	FailOnError(err, "Copying file to w failed")
 }
 
 func main() {
 	log.Println("Gateway service starting...")
 
+	tokenVerifier = JwtVerifier.NewVerifier(
+		GetAuthServiceUrl() + "/.well-known/jwks.json",
+		GetEnv("JWT_ISSUER", "auth"),
+		GetEnv("JWT_AUDIENCE", "gateway"),
+		GetDurationEnv("JWKS_CACHE_TTL", 5*time.Minute),
+	)
+	revocationList = RevocationList.NewList(
+		GetAuthServiceUrl() + "/revocations",
+		os.Getenv("REVOCATIONS_CLIENT_ID"),
+		os.Getenv("REVOCATIONS_CLIENT_SECRET"),
+		GetDurationEnv("REVOCATION_REFRESH_INTERVAL", 10*time.Second),
+		GetDurationEnv("REVOCATION_MAX_AGE", time.Minute),
+	)
+
+	// Use the auth service's gRPC API for logins, registrations and token validation
+	if authGrpcAddress := os.Getenv("AUTH_GRPC_ADDRESS"); authGrpcAddress != "" {
+		conn, err := ConnectToAuthService(authGrpcAddress)
+		if err != nil { log.Fatal(err.Error()) }
+		defer conn.Close()
+	}
+
+	go RetryFileCleanupsPeriodically()
+
 	http.HandleFunc("/login", Login)
+	http.HandleFunc("/login/mfa", LoginMfa)
+	http.HandleFunc("/login/oidc", OidcLogin)
+	http.HandleFunc("/login/oidc/callback", OidcCallback)
+	http.HandleFunc("/login/oidc/link", ConfirmOidcLink)
+	http.HandleFunc("/mfa/enroll", EnrollMfa)
+	http.HandleFunc("/mfa/confirm", ConfirmMfa)
 	http.HandleFunc("/register", Register)
+	http.HandleFunc("/v1/login", LoginV1)
+	http.HandleFunc("/v1/register", RegisterV1)
+	http.HandleFunc("/me", Me)
+	http.HandleFunc("/me/password", ChangePassword)
+	http.HandleFunc("/sessions", Sessions)
+	http.HandleFunc("/tokens/scoped", ScopedTokens)
+	http.HandleFunc("/orgs", Organizations)
+	http.HandleFunc("/orgs/members", Organizations)
+	http.HandleFunc("/orgs/invitations", Organizations)
+	http.HandleFunc("/orgs/invitations/accept", Organizations)
+	http.HandleFunc("/refresh", Refresh)
+	http.HandleFunc("/logout", Logout)
+	http.HandleFunc("/password/forgot", ForgotPassword)
+	http.HandleFunc("/password/reset", ResetPassword)
+	http.HandleFunc("/verify", Verify)
+	http.HandleFunc("/verify/resend", ResendVerification)
+	http.HandleFunc("/api-keys", ApiKeys)
+	http.HandleFunc("/oauth/clients", OAuthClients)
+	http.HandleFunc("/oauth/consents", OAuthConsents)
+	http.HandleFunc("/authorize", Authorize)
+	http.HandleFunc("/token", Token)
+	http.HandleFunc("/admin/roles", Roles)
+	http.HandleFunc("/admin/invites", InviteCodes)
+	http.HandleFunc("/admin/unlock", Unlock)
+	http.HandleFunc("/admin/users", AdminUsers)
+	http.HandleFunc("/admin/users/disable", AdminUserAction)
+	http.HandleFunc("/admin/users/enable", AdminUserAction)
+	http.HandleFunc("/admin/users/password-reset", AdminUserAction)
+	http.HandleFunc("/admin/actions", AdminActions)
+	http.HandleFunc("/admin/audit", AuditEvents)
+	http.HandleFunc("/admin/audit/export", AuditEvents)
 	http.HandleFunc("/upload", Upload)
 	http.HandleFunc("/download", Download)
+	http.HandleFunc("/files", Files)
 
 	log.Println("Gateway service running on port", servicePort)
 	err := http.ListenAndServe(":"+servicePort, nil)
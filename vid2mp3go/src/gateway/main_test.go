@@ -1,18 +1,47 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	JwtVerifier "gateway/jwt_verifier"
+	RevocationList "gateway/revocation_list"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func MockLoginHandler(w http.ResponseWriter, r *http.Request) {
 	username, password, ok := r.BasicAuth()
+	if r.Header.Get("X-Forwarded-For") != "203.0.113.7" {
+		w.WriteHeader(400)
+		return
+	}
+	if username == "locked" {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(429)
+		return
+	}
+	if username == "mfa" && password == "test" {
+		w.Header().Set("Mfa-Challenge", "challengeToken")
+		w.WriteHeader(202)
+		w.Write([]byte("MFA code required."))
+		return
+	}
 	if !ok || username != "test" || password != "test" {
 		w.WriteHeader(401)
+		return
 	}
+	w.Header().Set("Refresh-Token", "refreshToken")
 	w.Write([]byte("tokenString"))
 }
 
@@ -53,12 +82,25 @@ func TestLogin(t *testing.T) {
 			expectedCode: 401,
 			credentials: []string{"wrong", "wrong"},
 		},
+		{
+			name: "Locked out",
+			method: "POST",
+			expectedCode: 429,
+			credentials: []string{"locked", "test"},
+		},
+		{
+			name: "MFA required",
+			method: "POST",
+			expectedCode: 202,
+			credentials: []string{"mfa", "test"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req, err := http.NewRequest(tt.method, "/login", nil)
 			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
 			req.SetBasicAuth(tt.credentials[0], tt.credentials[1])
+			req.RemoteAddr = "203.0.113.7:41000"
 
 			if tt.expectedCode != 500 {
 				// When expectedCode is 500 the AuthService should not be reachable.
@@ -72,12 +114,219 @@ func TestLogin(t *testing.T) {
 			handler.ServeHTTP(resp, req)
 
 			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 429 && resp.Header().Get("Retry-After") != "30" {
+				t.Fatal("Retry-After was not passed on", resp.Header().Get("Retry-After"))
+			}
+			if resp.Code == 202 && resp.Header().Get("Mfa-Challenge") != "challengeToken" {
+				t.Fatal("MFA challenge was not passed on", resp.Header().Get("Mfa-Challenge"))
+			}
 			if resp.Code == 200 {
 				bodyBytes, err := io.ReadAll(resp.Body)
 				if err != nil { t.Fatalf("Error while reading resp body:\n%s", err.Error()) }
 				if string(bodyBytes) != "tokenString" {
 					t.Fatal("Did not receive JWT")
 				}
+				if resp.Header().Get("Refresh-Token") != "refreshToken" {
+					t.Fatal("Did not receive refresh token")
+				}
+			}
+		})
+	}
+}
+
+func MockMfaHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/login/mfa":
+		if r.Header.Get("Mfa-Challenge") != "challengeToken" || r.Header.Get("Mfa-Code") != "123456" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Refresh-Token", "refreshToken")
+		w.Write([]byte("tokenString"))
+	case "/mfa/enroll":
+		if r.Header.Get("Authorization") != "Bearer tokenString" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"secret":"SECRET","uri":"otpauth://totp/vid2mp3:test?secret=SECRET"}`))
+	case "/mfa/confirm":
+		if r.Header.Get("Authorization") != "Bearer tokenString" || r.Header.Get("Mfa-Code") != "123456" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"recovery_codes":["recoveryCode"]}`))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestLoginMfa(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		challengeToken	string
+		code			string
+	}{
+		{
+			name: "Successful login",
+			method: "POST",
+			expectedCode: 200,
+			challengeToken: "challengeToken",
+			code: "123456",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			challengeToken: "challengeToken",
+			code: "123456",
+		},
+		{
+			name: "Challenge missing",
+			method: "POST",
+			expectedCode: 400,
+			code: "123456",
+		},
+		{
+			name: "Code incorrect",
+			method: "POST",
+			expectedCode: 401,
+			challengeToken: "challengeToken",
+			code: "000000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockMfaHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/login/mfa", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Mfa-Challenge", tt.challengeToken)
+			req.Header.Set("Mfa-Code", tt.code)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(LoginMfa)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 {
+				if resp.Body.String() != "tokenString" { t.Fatal("Did not receive JWT") }
+				if resp.Header().Get("Refresh-Token") != "refreshToken" { t.Fatal("Did not receive refresh token") }
+			}
+		})
+	}
+}
+
+func TestEnrollMfa(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		authHeader		string
+	}{
+		{
+			name: "Successful enrollment",
+			method: "POST",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			authHeader: "Bearer tokenString",
+		},
+		{
+			name: "Auth header missing",
+			method: "POST",
+			expectedCode: 401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockMfaHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/mfa/enroll", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(EnrollMfa)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && !strings.Contains(resp.Body.String(), "otpauth://") {
+				t.Fatal("Did not receive otpauth URI", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestConfirmMfa(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		authHeader		string
+		code			string
+	}{
+		{
+			name: "Successful confirmation",
+			method: "POST",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+			code: "123456",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			authHeader: "Bearer tokenString",
+			code: "123456",
+		},
+		{
+			name: "Auth header missing",
+			method: "POST",
+			expectedCode: 401,
+			code: "123456",
+		},
+		{
+			name: "Code missing",
+			method: "POST",
+			expectedCode: 400,
+			authHeader: "Bearer tokenString",
+		},
+		{
+			name: "Code incorrect",
+			method: "POST",
+			expectedCode: 401,
+			authHeader: "Bearer tokenString",
+			code: "000000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockMfaHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/mfa/confirm", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			req.Header.Set("Mfa-Code", tt.code)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ConfirmMfa)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && !strings.Contains(resp.Body.String(), "recovery_codes") {
+				t.Fatal("Did not receive recovery codes", resp.Body.String())
 			}
 		})
 	}
@@ -89,6 +338,12 @@ func MockRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if username == "" || password == "" {
 		w.WriteHeader(400)
 	}
+	if username == "throttled" {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(429)
+		w.Write([]byte("Too many requests."))
+		return
+	}
 	w.Write([]byte("tokenString"))
 }
 
@@ -123,6 +378,12 @@ func TestRegister(t *testing.T) {
 			expectedCode: 500,
 			credentials: []string{"test", "test"},
 		},
+		{
+			name: "Registration throttled",
+			method: "POST",
+			expectedCode: 429,
+			credentials: []string{"throttled", "test"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -150,6 +411,9 @@ func TestRegister(t *testing.T) {
 					t.Fatal("Did not receive JWT")
 				}
 			}
+			if resp.Code == 429 && (resp.Header().Get("Retry-After") != "30" || resp.Body.String() != "Too many requests.") {
+				t.Fatal("Response of the auth service was not passed on", resp.Header(), resp.Body.String())
+			}
 		})
 	}
 }
@@ -217,3 +481,2114 @@ func TestValidateToken(t *testing.T) {
 		})
 	}
 }
+
+func MockRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	if r.Header.Get("Refresh-Token") != "refreshToken" {
+		w.WriteHeader(401)
+		return
+	}
+	w.Header().Set("Refresh-Token", "newRefreshToken")
+	w.Write([]byte("tokenString"))
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		refreshToken	string
+	}{
+		{
+			name: "Successful refresh",
+			method: "POST",
+			expectedCode: 200,
+			refreshToken: "refreshToken",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			refreshToken: "refreshToken",
+		},
+		{
+			name: "Refresh token missing",
+			method: "POST",
+			expectedCode: 400,
+			refreshToken: "",
+		},
+		{
+			name: "Refresh token incorrect",
+			method: "POST",
+			expectedCode: 401,
+			refreshToken: "wrong",
+		},
+		{
+			name: "Auth service not reachable",
+			method: "POST",
+			expectedCode: 500,
+			refreshToken: "refreshToken",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "/refresh", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Refresh-Token", tt.refreshToken)
+
+			if tt.expectedCode != 500 {
+				// When expectedCode is 500 the AuthService should not be reachable.
+				mockAuthService := httptest.NewServer(http.HandlerFunc(MockRefreshHandler))
+				defer mockAuthService.Close()
+				GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+			}
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Refresh)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 {
+				bodyBytes, err := io.ReadAll(resp.Body)
+				if err != nil { t.Fatalf("Error while reading resp body:\n%s", err.Error()) }
+				if string(bodyBytes) != "tokenString" {
+					t.Fatal("Did not receive JWT")
+				}
+				if resp.Header().Get("Refresh-Token") != "newRefreshToken" {
+					t.Fatal("Did not receive new refresh token")
+				}
+			}
+		})
+	}
+}
+
+func MockLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test" {
+		w.WriteHeader(403)
+		return
+	}
+	if r.Header.Get("Refresh-Token") != "refreshToken" {
+		w.WriteHeader(400)
+		return
+	}
+	w.Write([]byte("Logged out."))
+}
+
+func TestLogout(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		header			string
+	}{
+		{
+			name: "Successful logout",
+			method: "POST",
+			expectedCode: 200,
+			header: "Bearer test",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			header: "Bearer test",
+		},
+		{
+			name: "Auth header empty or missing",
+			method: "POST",
+			expectedCode: 401,
+			header: "",
+		},
+		{
+			name: "JWT incorrect",
+			method: "POST",
+			expectedCode: 403,
+			header: "Bearer wrong",
+		},
+		{
+			name: "Auth service not reachable",
+			method: "POST",
+			expectedCode: 500,
+			header: "Bearer test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "/logout", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			req.Header.Set("Refresh-Token", "refreshToken")
+
+			if tt.expectedCode != 500 {
+				// When expectedCode is 500 the AuthService should not be reachable.
+				mockAuthService := httptest.NewServer(http.HandlerFunc(MockLogoutHandler))
+				defer mockAuthService.Close()
+				GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+			}
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Logout)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func MockPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/password/forgot":
+		if r.Header.Get("Username") == "" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte("Password reset requested."))
+	case "/password/reset":
+		if r.Header.Get("Reset-Token") != "resetToken" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.Header.Get("Password") == "" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte("Password reset."))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestForgotPassword(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		username		string
+	}{
+		{
+			name: "Reset requested",
+			method: "POST",
+			expectedCode: 200,
+			username: "test",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			username: "test",
+		},
+		{
+			name: "Username missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "Auth service not reachable",
+			method: "POST",
+			expectedCode: 500,
+			username: "test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.expectedCode != 500 {
+				// When expectedCode is 500 the AuthService should not be reachable.
+				mockAuthService := httptest.NewServer(http.HandlerFunc(MockPasswordHandler))
+				defer mockAuthService.Close()
+				GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+			}
+
+			req, err := http.NewRequest(tt.method, "/password/forgot", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ForgotPassword)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		resetToken		string
+		password		string
+	}{
+		{
+			name: "Successful reset",
+			method: "POST",
+			expectedCode: 200,
+			resetToken: "resetToken",
+			password: "new",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			resetToken: "resetToken",
+			password: "new",
+		},
+		{
+			name: "Password missing",
+			method: "POST",
+			expectedCode: 400,
+			resetToken: "resetToken",
+		},
+		{
+			name: "Reset token invalid",
+			method: "POST",
+			expectedCode: 401,
+			resetToken: "wrong",
+			password: "new",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockPasswordHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/password/reset", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Reset-Token", tt.resetToken)
+			req.Header.Set("Password", tt.password)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ResetPassword)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func MockVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/verify":
+		if r.Header.Get("Verification-Token") != "verificationToken" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte("Email verified."))
+	case "/verify/resend":
+		if r.Header.Get("Username") == "" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte("Verification sent."))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name				string
+		method				string
+		expectedCode		int
+		verificationToken	string
+	}{
+		{
+			name: "Successful verification",
+			method: "POST",
+			expectedCode: 200,
+			verificationToken: "verificationToken",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			verificationToken: "verificationToken",
+		},
+		{
+			name: "Verification token missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "Verification token invalid",
+			method: "POST",
+			expectedCode: 401,
+			verificationToken: "wrong",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockVerificationHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/verify", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Verification-Token", tt.verificationToken)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Verify)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		username		string
+	}{
+		{
+			name: "Verification resent",
+			method: "POST",
+			expectedCode: 200,
+			username: "test",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			username: "test",
+		},
+		{
+			name: "Username missing",
+			method: "POST",
+			expectedCode: 400,
+		},
+		{
+			name: "Auth service not reachable",
+			method: "POST",
+			expectedCode: 500,
+			username: "test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.expectedCode != 500 {
+				// When expectedCode is 500 the AuthService should not be reachable.
+				mockAuthService := httptest.NewServer(http.HandlerFunc(MockVerificationHandler))
+				defer mockAuthService.Close()
+				GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+			}
+
+			req, err := http.NewRequest(tt.method, "/verify/resend", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ResendVerification)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	tests := []struct {
+		name				string
+		trustedProxyCount	int
+		forwardedFor		string
+		expected			string
+	}{
+		{ name: "No trusted proxies", trustedProxyCount: 0, forwardedFor: "198.51.100.1", expected: "192.0.2.1", },
+		{ name: "Header missing", trustedProxyCount: 1, expected: "192.0.2.1", },
+		{ name: "Added by trusted proxy", trustedProxyCount: 1, forwardedFor: "198.51.100.1", expected: "198.51.100.1", },
+		{ name: "Spoofed by client", trustedProxyCount: 1, forwardedFor: "10.0.0.1, 198.51.100.1", expected: "198.51.100.1", },
+		{ name: "Fewer addresses than proxies", trustedProxyCount: 3, forwardedFor: "198.51.100.1", expected: "198.51.100.1", },
+	}
+	defer func() { trustedProxyCount = 0 }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxyCount = tt.trustedProxyCount
+			req, _ := http.NewRequest("POST", "/login", nil)
+			req.RemoteAddr = "192.0.2.1:41000"
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if ip := GetClientIP(req); ip != tt.expected { t.Fatal("IP was incorrect", ip) }
+		})
+	}
+}
+
+func MockApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer tokenString" {
+		w.WriteHeader(401)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Write([]byte(`[{"id":3,"label":"batch"}]`))
+	case "POST":
+		w.Write([]byte(`{"id":3,"label":"` + r.Header.Get("Label") + `","key":"apiKey"}`))
+	case "DELETE":
+		if r.Header.Get("Key-Id") != "3" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte("API key updated."))
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func TestApiKeys(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		authHeader		string
+		label			string
+		keyID			string
+	}{
+		{
+			name: "Successful listing",
+			method: "GET",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+		},
+		{
+			name: "Successful creation",
+			method: "POST",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+			label: "batch",
+		},
+		{
+			name: "Successful revocation",
+			method: "DELETE",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+			keyID: "3",
+		},
+		{
+			name: "Unknown key",
+			method: "DELETE",
+			expectedCode: 404,
+			authHeader: "Bearer tokenString",
+			keyID: "4",
+		},
+		{
+			name: "Auth header missing",
+			method: "GET",
+			expectedCode: 401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockApiKeysHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/api-keys", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			req.Header.Set("Label", tt.label)
+			req.Header.Set("Key-Id", tt.keyID)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ApiKeys)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if tt.method == "POST" && !strings.Contains(resp.Body.String(), `"label":"batch"`) {
+				t.Fatal("Label was not passed on", resp.Body.String())
+			}
+		})
+	}
+}
+
+func MockOidcHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/login/oidc":
+		http.Redirect(w, r, "https://idp.example/authorize?state=state", http.StatusFound)
+	case "/login/oidc/callback":
+		if r.URL.Query().Get("state") == "state" && r.URL.Query().Get("code") == "existing" {
+			w.Header().Set("Oidc-Link", "linkToken")
+			w.WriteHeader(409)
+			return
+		}
+		if r.URL.Query().Get("state") != "state" || r.URL.Query().Get("code") != "code" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Header().Set("Refresh-Token", "refreshToken")
+		w.Write([]byte("tokenString"))
+	case "/login/oidc/link":
+		if r.Header.Get("Authorization") != "Bearer tokenString" || r.Header.Get("Password") != "password" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.Header.Get("Oidc-Link") != "linkToken" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte("Identity linked."))
+	}
+}
+
+func TestOidcLogin(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		route			string
+		expectedCode	int
+		handler			http.HandlerFunc
+		headers			map[string]string
+	}{
+		{
+			name: "Redirect to IdP passed on",
+			method: "GET",
+			route: "/login/oidc",
+			expectedCode: 302,
+			handler: OidcLogin,
+		},
+		{
+			name: "Successful callback",
+			method: "GET",
+			route: "/login/oidc/callback?state=state&code=code",
+			expectedCode: 200,
+			handler: OidcCallback,
+		},
+		{
+			name: "Callback with unknown state",
+			method: "GET",
+			route: "/login/oidc/callback?state=other&code=code",
+			expectedCode: 400,
+			handler: OidcCallback,
+		},
+		{
+			name: "Link token of existing account passed on",
+			method: "GET",
+			route: "/login/oidc/callback?state=state&code=existing",
+			expectedCode: 409,
+			handler: OidcCallback,
+		},
+		{
+			name: "Link confirmed",
+			method: "POST",
+			route: "/login/oidc/link",
+			expectedCode: 200,
+			handler: ConfirmOidcLink,
+			headers: map[string]string{"Authorization": "Bearer tokenString", "Oidc-Link": "linkToken", "Password": "password"},
+		},
+		{
+			name: "Link confirmation without JWT",
+			method: "POST",
+			route: "/login/oidc/link",
+			expectedCode: 401,
+			handler: ConfirmOidcLink,
+			headers: map[string]string{"Oidc-Link": "linkToken", "Password": "password"},
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "POST",
+			route: "/login/oidc",
+			expectedCode: 405,
+			handler: OidcLogin,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockOidcHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, tt.route, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			for header, value := range tt.headers { req.Header.Set(header, value) }
+
+			resp := httptest.NewRecorder()
+			tt.handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 409 && resp.Header().Get("Oidc-Link") != "linkToken" { t.Fatal("Link token was not passed on") }
+			if resp.Code == 302 && resp.Header().Get("Location") != "https://idp.example/authorize?state=state" {
+				t.Fatal("Location was incorrect", resp.Header().Get("Location"))
+			}
+			if resp.Code == 200 && strings.HasPrefix(tt.route, "/login/oidc/callback") && (resp.Body.String() != "tokenString" || resp.Header().Get("Refresh-Token") != "refreshToken") {
+				t.Fatal("Tokens were not passed on")
+			}
+		})
+	}
+}
+
+func MockOAuthHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/token":
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "client" || clientSecret != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+			w.WriteHeader(401)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		if r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"unsupported_grant_type"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(`{"access_token":"tokenString","token_type":"Bearer","expires_in":900,"scope":"download:read"}`))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer tokenString" {
+		w.WriteHeader(401)
+		return
+	}
+	switch r.URL.Path {
+	case "/authorize":
+		if r.FormValue("client_id") != "client" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"invalid_request"}`))
+			return
+		}
+		http.Redirect(w, r, "https://client.example/cb?code=code&state=" + r.FormValue("state"), http.StatusFound)
+	case "/oauth/clients":
+		w.Write([]byte(`{"client_id":"client","name":"Test client"}`))
+	case "/oauth/consents":
+		if r.Method == "DELETE" && r.Header.Get("Client-Id") != "client" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`[{"client_id":"client","scope":"download:read"}]`))
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name				string
+		method				string
+		expectedCode		int
+		expectedLocation	string
+		authHeader			string
+		query				string
+		form				string
+	}{
+		{
+			name: "Redirect passed on",
+			method: "GET",
+			expectedCode: 302,
+			expectedLocation: "https://client.example/cb?code=code&state=xyz",
+			authHeader: "Bearer tokenString",
+			query: "client_id=client&state=xyz",
+		},
+		{
+			name: "Consent approved with form",
+			method: "POST",
+			expectedCode: 302,
+			expectedLocation: "https://client.example/cb?code=code&state=abc",
+			authHeader: "Bearer tokenString",
+			form: "client_id=client&state=abc&consent=approve",
+		},
+		{
+			name: "Client unknown",
+			method: "GET",
+			expectedCode: 400,
+			authHeader: "Bearer tokenString",
+			query: "client_id=unknown",
+		},
+		{
+			name: "Auth header missing",
+			method: "GET",
+			expectedCode: 401,
+			query: "client_id=client",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockOAuthHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/authorize?" + tt.query, strings.NewReader(tt.form))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			if tt.form != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Authorize)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Header().Get("Location") != tt.expectedLocation {
+				t.Fatal("Location was incorrect", resp.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		clientSecret	string
+		grantType		string
+	}{
+		{
+			name: "Successful client credentials grant",
+			method: "POST",
+			expectedCode: 200,
+			clientSecret: "secret",
+			grantType: "client_credentials",
+		},
+		{
+			name: "Grant type unsupported",
+			method: "POST",
+			expectedCode: 400,
+			clientSecret: "secret",
+			grantType: "password",
+		},
+		{
+			name: "Client secret incorrect",
+			method: "POST",
+			expectedCode: 401,
+			clientSecret: "wrong",
+			grantType: "client_credentials",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockOAuthHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/token", strings.NewReader("grant_type=" + tt.grantType))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth("client", tt.clientSecret)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Token)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && (resp.Header().Get("Cache-Control") != "no-store" || !strings.Contains(resp.Body.String(), `"access_token":"tokenString"`)) {
+				t.Fatal("Token response was incorrect", resp.Body.String())
+			}
+			if resp.Code == 401 && resp.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("WWW-Authenticate header was not passed on")
+			}
+		})
+	}
+}
+
+func TestOAuthClients(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		authHeader		string
+	}{
+		{
+			name: "Successful registration",
+			method: "POST",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+		},
+		{
+			name: "Auth header missing",
+			method: "POST",
+			expectedCode: 401,
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			authHeader: "Bearer tokenString",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockOAuthHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/oauth/clients", strings.NewReader(`{"name":"Test client","scopes":["download:read"],"confidential":true}`))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(OAuthClients)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func TestOAuthConsents(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		authHeader		string
+		clientID		string
+	}{
+		{
+			name: "Successful listing",
+			method: "GET",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+		},
+		{
+			name: "Successful withdrawal",
+			method: "DELETE",
+			expectedCode: 200,
+			authHeader: "Bearer tokenString",
+			clientID: "client",
+		},
+		{
+			name: "Unknown client",
+			method: "DELETE",
+			expectedCode: 404,
+			authHeader: "Bearer tokenString",
+			clientID: "unknown",
+		},
+		{
+			name: "Auth header missing",
+			method: "GET",
+			expectedCode: 401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockOAuthHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/oauth/consents", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			req.Header.Set("Client-Id", tt.clientID)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(OAuthConsents)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func MockUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer admin" {
+		w.WriteHeader(403)
+		return
+	}
+	if r.Header.Get("Username") != "test" && r.Header.Get("IP") != "203.0.113.7" {
+		w.WriteHeader(400)
+		return
+	}
+	w.Write([]byte("Unlocked."))
+}
+
+func TestUnlock(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		header			string
+		username		string
+		ip				string
+	}{
+		{
+			name: "Unlock account",
+			method: "POST",
+			expectedCode: 200,
+			header: "Bearer admin",
+			username: "test",
+		},
+		{
+			name: "Unlock IP",
+			method: "POST",
+			expectedCode: 200,
+			header: "Bearer admin",
+			ip: "203.0.113.7",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			header: "Bearer admin",
+			username: "test",
+		},
+		{
+			name: "Auth header empty or missing",
+			method: "POST",
+			expectedCode: 401,
+			username: "test",
+		},
+		{
+			name: "Not an admin",
+			method: "POST",
+			expectedCode: 403,
+			header: "Bearer test",
+			username: "test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockUnlockHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/admin/unlock", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			req.Header.Set("Username", tt.username)
+			req.Header.Set("IP", tt.ip)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Unlock)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+// Key the mock auth service signs JWTs with and publishes in its JWKS
+var testSigningKey = func() ed25519.PrivateKey {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	return key
+}()
+
+// Signs a JWT for the user "test" with the given permissions, the same way the
+// auth service does. The audience claim is taken from aud. The user has verified
+// their email address.
+func SignTestJWT(kid string, aud string, permissions ...string) string {
+	return SignTestClaims(kid, jwt.MapClaims{
+		"iss": "auth",
+		"aud": aud,
+		"username": "test",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"permissions": permissions,
+		"email_verified": true,
+	})
+}
+
+// Signs a scoped JWT for the user "test" with the given scope, restricted to the mp3
+// with the given fid unless it is empty. The user has the upload:write and
+// download:read permissions.
+func SignTestScopedJWT(scope string, fid string) string {
+	claims := jwt.MapClaims{
+		"iss": "auth",
+		"aud": "gateway",
+		"username": "test",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"permissions": []string{"upload:write", "download:read"},
+		"scope": scope,
+		"scoped": true,
+		"email_verified": true,
+	}
+	if fid != "" {
+		claims["fid"] = fid
+	}
+	return SignTestClaims("test_kid", claims)
+}
+
+// Signs a JWT with the given claims using testSigningKey. Like every JWT issued by the
+// auth service, it gets jti and iat claims, unless they are set already.
+func SignTestClaims(kid string, claims jwt.MapClaims) string {
+	if _, ok := claims["jti"]; !ok {
+		claims["jti"] = "test_jti"
+	}
+	if _, ok := claims["iat"]; !ok {
+		claims["iat"] = time.Now().Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = kid
+	tokenString, _ := token.SignedString(testSigningKey)
+	return tokenString
+}
+
+// Mock auth service publishing testSigningKey with the kid "test_kid" and the revocation
+// of the JWT with the jti "revoked_jti". The /validate route accepts a JWT for remote validation if it was signed with testSigningKey,
+// whatever its kid is, as well as the API key "apiKey". It responds with "not json"
+// to the token "malformed".
+func MockPermissionsValidationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/.well-known/jwks.json" {
+		x := base64.RawURLEncoding.EncodeToString(testSigningKey.Public().(ed25519.PublicKey))
+		fmt.Fprintf(w, `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"%s","kid":"test_kid"}]}`, x)
+		return
+	}
+	if r.URL.Path == "/revocations" {
+		fmt.Fprintf(w, `{"tokens":{"revoked_jti":"%s"},"users":{}}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		return
+	}
+	auth := strings.Split(r.Header.Get("Authorization"), " ")
+	tokenString := auth[len(auth)-1]
+	if tokenString == "malformed" {
+		w.Write([]byte(`not json`))
+		return
+	}
+	if auth[0] == "ApiKey" {
+		if tokenString != "apiKey" {
+			w.WriteHeader(403)
+			return
+		}
+		w.Write([]byte(`{"username":"test","permissions":["upload:write"],"email_verified":true}`))
+		return
+	}
+	_, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		return testSigningKey.Public(), nil
+	})
+	if err != nil {
+		w.WriteHeader(403)
+		return
+	}
+	w.Write([]byte(`{"username":"test","permissions":["upload:write"],"email_verified":true}`))
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name			string
+		expectedCode	int
+		header			string
+		scope			string
+		remote			bool
+		revocationsDown	bool
+	}{
+		{
+			name: "Permission granted",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway", "upload:write"),
+			scope: "upload:write",
+		},
+		{
+			name: "Scope missing",
+			expectedCode: 403,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway", "upload:write"),
+			scope: "download:read",
+		},
+		{
+			name: "Scope claim granted",
+			expectedCode: 200,
+			header: "Bearer " + SignTestScopedJWT("download:read", ""),
+			scope: "download:read",
+		},
+		{
+			name: "Scope claim narrower than permissions",
+			expectedCode: 403,
+			header: "Bearer " + SignTestScopedJWT("download:read", ""),
+			scope: "upload:write",
+		},
+		{
+			name: "JWT invalid",
+			expectedCode: 403,
+			header: "Bearer wrong",
+			scope: "upload:write",
+		},
+		{
+			name: "JWT for another audience",
+			expectedCode: 403,
+			header: "Bearer " + SignTestJWT("test_kid", "other", "upload:write"),
+			scope: "upload:write",
+		},
+		{
+			name: "Auth header empty or missing",
+			expectedCode: 401,
+			header: "",
+			scope: "upload:write",
+		},
+		{
+			name: "JWT revoked",
+			expectedCode: 403,
+			header: "Bearer " + SignTestClaims("test_kid", jwt.MapClaims{"iss": "auth", "aud": "gateway", "username": "test", "exp": time.Now().Add(time.Hour).Unix(), "permissions": []string{"upload:write"}, "jti": "revoked_jti"}),
+			scope: "upload:write",
+		},
+		{
+			name: "JWT without jti",
+			expectedCode: 403,
+			header: "Bearer " + SignTestClaims("test_kid", jwt.MapClaims{"iss": "auth", "aud": "gateway", "username": "test", "exp": time.Now().Add(time.Hour).Unix(), "permissions": []string{"upload:write"}, "jti": ""}),
+			scope: "upload:write",
+		},
+		{
+			name: "Revocations unavailable validated remotely",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway", "upload:write"),
+			scope: "upload:write",
+			remote: true,
+			revocationsDown: true,
+		},
+		{
+			name: "Unknown kid validated remotely",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("new_kid", "gateway", "upload:write"),
+			scope: "upload:write",
+			remote: true,
+		},
+		{
+			name: "API key validated remotely",
+			expectedCode: 200,
+			header: "ApiKey apiKey",
+			scope: "upload:write",
+			remote: true,
+		},
+		{
+			name: "API key unknown",
+			expectedCode: 403,
+			header: "ApiKey wrong",
+			scope: "upload:write",
+			remote: true,
+		},
+		{
+			name: "Validation response malformed",
+			expectedCode: 500,
+			header: "ApiKey malformed",
+			scope: "upload:write",
+			remote: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remoteValidations := 0
+			mockAuthService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/validate" { remoteValidations++ }
+				if r.URL.Path == "/revocations" && tt.revocationsDown {
+					w.WriteHeader(503)
+					return
+				}
+				MockPermissionsValidationHandler(w, r)
+			}))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+			tokenVerifier = JwtVerifier.NewVerifier(mockAuthService.URL + "/.well-known/jwks.json", "auth", "gateway", time.Minute)
+			revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+	revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+
+			req, err := http.NewRequest("POST", "/upload", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+
+			resp := httptest.NewRecorder()
+			token, ok := RequireScope(resp, req, tt.scope)
+			if ok != (tt.expectedCode == 200) { t.Fatal("ok was incorrect", ok) }
+			if ok && token.Username != "test" { t.Fatal("Token was incorrect", token) }
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if (remoteValidations > 0) != tt.remote { t.Fatal("Remote validation was incorrect", remoteValidations) }
+		})
+	}
+}
+
+func TestRequireVerifiedScope(t *testing.T) {
+	tests := []struct {
+		name			string
+		expectedCode	int
+		header			string
+	}{
+		{
+			name: "Email verified",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway", "upload:write"),
+		},
+		{
+			name: "Email not verified",
+			expectedCode: 403,
+			header: "Bearer " + SignTestClaims("test_kid", jwt.MapClaims{
+				"iss": "auth",
+				"aud": "gateway",
+				"username": "test",
+				"exp": time.Now().Add(time.Hour).Unix(),
+				"permissions": []string{"upload:write"},
+				"email_verified": false,
+			}),
+		},
+		{
+			name: "Permission missing",
+			expectedCode: 403,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway", "download:read"),
+		},
+		{
+			name: "Auth header empty or missing",
+			expectedCode: 401,
+			header: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockPermissionsValidationHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+			tokenVerifier = JwtVerifier.NewVerifier(mockAuthService.URL + "/.well-known/jwks.json", "auth", "gateway", time.Minute)
+			revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+	revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+
+			req, err := http.NewRequest("POST", "/upload", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+
+			resp := httptest.NewRecorder()
+			token, ok := RequireVerifiedScope(resp, req, "upload:write")
+			if ok != (tt.expectedCode == 200) { t.Fatal("ok was incorrect", ok) }
+			if ok && !token.EmailVerified { t.Fatal("Token was incorrect", token) }
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+// Mock auth service for the account endpoints. It publishes testSigningKey like
+// MockPermissionsValidationHandler and accepts JWTs signed with it. The current
+// password of the user is "password".
+func MockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/.well-known/jwks.json" || r.URL.Path == "/revocations" {
+		MockPermissionsValidationHandler(w, r)
+		return
+	}
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	_, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		return testSigningKey.Public(), nil
+	})
+	if err != nil {
+		w.WriteHeader(403)
+		return
+	}
+	switch {
+	case r.URL.Path == "/me" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"username":"test"}`))
+	case r.URL.Path == "/me" && r.Method == "DELETE", r.URL.Path == "/me/password":
+		if r.Header.Get("Password") != "password" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.URL.Path == "/me/password" {
+			w.Header().Set("Refresh-Token", "newRefreshToken")
+		}
+		w.Write([]byte("OK"))
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func TestMe(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		header			string
+		password		string
+		filesDeleted	bool
+		deleteErr		error
+		queued			bool
+	}{
+		{
+			name: "Get profile",
+			method: "GET",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+		},
+		{
+			name: "Delete account",
+			method: "DELETE",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+			password: "password",
+			filesDeleted: true,
+		},
+		{
+			name: "Delete account with wrong password",
+			method: "DELETE",
+			expectedCode: 401,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+			password: "wrong",
+		},
+		{
+			name: "Deleting files fails",
+			method: "DELETE",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+			password: "password",
+			filesDeleted: true,
+			deleteErr: errors.New("mongo unreachable"),
+			queued: true,
+		},
+		{
+			name: "Auth header empty or missing",
+			method: "GET",
+			expectedCode: 401,
+		},
+		{
+			name: "Delete without auth header",
+			method: "DELETE",
+			expectedCode: 401,
+			password: "password",
+		},
+		{
+			name: "JWT invalid",
+			method: "DELETE",
+			expectedCode: 403,
+			header: "Bearer wrong",
+			password: "password",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockAccountHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+			tokenVerifier = JwtVerifier.NewVerifier(mockAuthService.URL + "/.well-known/jwks.json", "auth", "gateway", time.Minute)
+			revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+	revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+
+			deletedFilesOf := ""
+			DeleteUserFiles = func(username string, deletedAt time.Time) (err error) {
+				deletedFilesOf = username
+				return tt.deleteErr
+			}
+			queuedCleanupOf := ""
+			QueueFileCleanup = func(username string, deletedAt time.Time) (err error) {
+				queuedCleanupOf = username
+				return nil
+			}
+
+			req, err := http.NewRequest(tt.method, "/me", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			req.Header.Set("Password", tt.password)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Me)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if tt.filesDeleted != (deletedFilesOf == "test") { t.Fatal("Files of the user were not deleted as expected") }
+			if tt.queued != (queuedCleanupOf == "test") { t.Fatal("File cleanup was not queued as expected") }
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		header			string
+		password		string
+		newPassword		string
+	}{
+		{
+			name: "Change password",
+			method: "POST",
+			expectedCode: 200,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+			password: "password",
+			newPassword: "newPassword",
+		},
+		{
+			name: "Wrong current password",
+			method: "POST",
+			expectedCode: 401,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+			password: "wrong",
+			newPassword: "newPassword",
+		},
+		{
+			name: "New password missing",
+			method: "POST",
+			expectedCode: 400,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+			password: "password",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			expectedCode: 405,
+			header: "Bearer " + SignTestJWT("test_kid", "gateway"),
+			password: "password",
+			newPassword: "newPassword",
+		},
+		{
+			name: "Auth header empty or missing",
+			method: "POST",
+			expectedCode: 401,
+			password: "password",
+			newPassword: "newPassword",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockAccountHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, "/me/password", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			req.Header.Set("Password", tt.password)
+			req.Header.Set("New-Password", tt.newPassword)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ChangePassword)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if tt.expectedCode == 200 && resp.Header().Get("Refresh-Token") != "newRefreshToken" {
+				t.Fatal("Did not receive new refresh token")
+			}
+		})
+	}
+}
+
+// Mock auth service for the admin user management endpoints. Only "Bearer admin" is
+// accepted, and "other_user" is the only user that can be managed.
+func MockAdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer admin" {
+		w.WriteHeader(403)
+		return
+	}
+	switch {
+	case r.URL.Path == "/admin/users" && r.Method == "GET", r.URL.Path == "/admin/actions", r.URL.Path == "/admin/audit":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"query":"%s"}`, r.URL.RawQuery)
+	case r.URL.Path == "/admin/audit/export":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintf(w, "{\"type\":\"login\"}\n{\"type\":\"register\"}\n")
+	case r.Header.Get("Username") != "other_user":
+		w.WriteHeader(404)
+	default:
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		expectedCode	int
+		header			string
+		username		string
+		filesDeleted	bool
+		deleteErr		error
+		queued			bool
+	}{
+		{
+			name: "List users",
+			method: "GET",
+			expectedCode: 200,
+			header: "Bearer admin",
+		},
+		{
+			name: "Delete user",
+			method: "DELETE",
+			expectedCode: 200,
+			header: "Bearer admin",
+			username: "other_user",
+			filesDeleted: true,
+		},
+		{
+			name: "Delete unknown user",
+			method: "DELETE",
+			expectedCode: 404,
+			header: "Bearer admin",
+			username: "unknown_user",
+		},
+		{
+			name: "Deleting files fails",
+			method: "DELETE",
+			expectedCode: 200,
+			header: "Bearer admin",
+			username: "other_user",
+			filesDeleted: true,
+			deleteErr: errors.New("mongo unreachable"),
+			queued: true,
+		},
+		{
+			name: "Not an admin",
+			method: "DELETE",
+			expectedCode: 403,
+			header: "Bearer test",
+			username: "other_user",
+		},
+		{
+			name: "Auth header empty or missing",
+			method: "GET",
+			expectedCode: 401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockAdminUsersHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			deletedFilesOf := ""
+			DeleteUserFiles = func(username string, deletedAt time.Time) (err error) {
+				deletedFilesOf = username
+				return tt.deleteErr
+			}
+			queuedCleanupOf := ""
+			QueueFileCleanup = func(username string, deletedAt time.Time) (err error) {
+				queuedCleanupOf = username
+				return nil
+			}
+
+			req, err := http.NewRequest(tt.method, "/admin/users?search=test&page=2", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(AdminUsers)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if tt.filesDeleted != (deletedFilesOf == "other_user") { t.Fatal("Files of the user were not deleted as expected") }
+			if tt.queued != (queuedCleanupOf == "other_user") { t.Fatal("File cleanup was not queued as expected") }
+			if tt.method == "GET" && resp.Code == 200 && resp.Body.String() != `{"query":"search=test&page=2"}` {
+				t.Fatal("Query was not forwarded", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminUserAction(t *testing.T) {
+	tests := []struct {
+		name			string
+		method			string
+		route			string
+		expectedCode	int
+		header			string
+		username		string
+	}{
+		{
+			name: "Disable user",
+			method: "POST",
+			route: "/admin/users/disable",
+			expectedCode: 200,
+			header: "Bearer admin",
+			username: "other_user",
+		},
+		{
+			name: "Force password reset",
+			method: "POST",
+			route: "/admin/users/password-reset",
+			expectedCode: 200,
+			header: "Bearer admin",
+			username: "other_user",
+		},
+		{
+			name: "Unknown user",
+			method: "POST",
+			route: "/admin/users/enable",
+			expectedCode: 404,
+			header: "Bearer admin",
+			username: "unknown_user",
+		},
+		{
+			name: "Incorrect HTTP request method",
+			method: "GET",
+			route: "/admin/users/disable",
+			expectedCode: 405,
+			header: "Bearer admin",
+			username: "other_user",
+		},
+		{
+			name: "Auth header empty or missing",
+			method: "POST",
+			route: "/admin/users/disable",
+			expectedCode: 401,
+			username: "other_user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAuthService := httptest.NewServer(http.HandlerFunc(MockAdminUsersHandler))
+			defer mockAuthService.Close()
+			GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+			req, err := http.NewRequest(tt.method, tt.route, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+			req.Header.Set("Username", tt.username)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(AdminUserAction)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && resp.Body.String() != "POST " + tt.route {
+				t.Fatal("Request was not forwarded to the same route", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockAdminUsersHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+	for header, expectedCode := range map[string]int{"Bearer admin": 200, "Bearer test": 403, "": 401} {
+		req, err := http.NewRequest("GET", "/admin/actions?page=2", nil)
+		if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+		req.Header.Set("Authorization", header)
+
+		resp := httptest.NewRecorder()
+		handler := http.HandlerFunc(AdminActions)
+		handler.ServeHTTP(resp, req)
+
+		if resp.Code != expectedCode { t.Fatal("Status was incorrect", header, resp.Code) }
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockAdminUsersHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+	tests := []struct {
+		name			string
+		path			string
+		header			string
+		expectedCode	int
+		expectedType	string
+	}{
+		{name: "Query audit log", path: "/admin/audit?type=login&username=test_user", header: "Bearer admin", expectedCode: 200, expectedType: "application/json"},
+		{name: "Export audit log", path: "/admin/audit/export?from=2024-06-01T00:00:00Z", header: "Bearer admin", expectedCode: 200, expectedType: "application/x-ndjson"},
+		{name: "Not an admin", path: "/admin/audit", header: "Bearer test", expectedCode: 403},
+		{name: "Authorization missing", path: "/admin/audit/export", expectedCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tt.path, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			if tt.header != "" { req.Header.Set("Authorization", tt.header) }
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(AuditEvents)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if tt.expectedType != "" && resp.Header().Get("Content-Type") != tt.expectedType { t.Fatal("Content-Type was incorrect", resp.Header().Get("Content-Type")) }
+			if tt.path == "/admin/audit?type=login&username=test_user" && !strings.Contains(resp.Body.String(), "type=login&username=test_user") {
+				t.Fatal("Query was not forwarded", resp.Body.String())
+			}
+		})
+	}
+}
+
+func MockSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer tokenString" {
+		w.WriteHeader(401)
+		return
+	}
+	switch {
+	case r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"id":"current","user_agent":"%s","ip":"%s","current":true}]`, r.UserAgent(), r.Header.Get("X-Forwarded-For"))
+	case r.Method == "DELETE" && r.Header.Get("Session-Id") == "other":
+		w.Write([]byte("Session revoked."))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockSessionsHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+	tests := []struct {
+		name			string
+		method			string
+		authHeader		string
+		sessionID		string
+		expectedCode	int
+	}{
+		{name: "List sessions", method: "GET", authHeader: "Bearer tokenString", expectedCode: 200},
+		{name: "Revoke session", method: "DELETE", authHeader: "Bearer tokenString", sessionID: "other", expectedCode: 200},
+		{name: "Unknown session", method: "DELETE", authHeader: "Bearer tokenString", sessionID: "unknown", expectedCode: 404},
+		{name: "Auth header missing", method: "GET", expectedCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "/sessions", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			req.Header.Set("Session-Id", tt.sessionID)
+			req.Header.Set("User-Agent", "test-agent")
+			req.RemoteAddr = "203.0.113.7:4321"
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Sessions)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if tt.method == "GET" && resp.Code == 200 && !strings.Contains(resp.Body.String(), `"user_agent":"test-agent","ip":"203.0.113.7"`) {
+				t.Fatal("Device of the client was not passed on", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestDownloadRestrictedToFile(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockPermissionsValidationHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+	tokenVerifier = JwtVerifier.NewVerifier(mockAuthService.URL + "/.well-known/jwks.json", "auth", "gateway", time.Minute)
+	revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+
+	tests := []struct {
+		name			string
+		header			string
+		fid				string
+		expectedCode	int
+	}{
+		{name: "Token restricted to another mp3", header: "Bearer " + SignTestScopedJWT("download:read", "6650f1c2a1b2c3d4e5f60718"), fid: "6650f1c2a1b2c3d4e5f60719", expectedCode: 403},
+		{name: "Token without download scope", header: "Bearer " + SignTestScopedJWT("upload:write", ""), fid: "6650f1c2a1b2c3d4e5f60718", expectedCode: 403},
+		{name: "Fid missing", header: "Bearer " + SignTestScopedJWT("download:read", "6650f1c2a1b2c3d4e5f60718"), expectedCode: 400},
+		{name: "Fid invalid", header: "Bearer " + SignTestScopedJWT("download:read", ""), fid: "not-a-fid", expectedCode: 400},
+		{name: "Mp3 of another user", header: "Bearer " + SignTestScopedJWT("download:read", ""), fid: "6650f1c2a1b2c3d4e5f60718", expectedCode: 404},
+	}
+	FindFiles = func(database string, filter bson.M) (files []StoredFile, err error) {
+		return []StoredFile{}, nil
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/download?fid=" + tt.fid, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Download)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+		})
+	}
+}
+
+func MockScopedTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer tokenString" {
+		w.WriteHeader(401)
+		return
+	}
+	if r.Header.Get("Scope") != "download:read" {
+		w.WriteHeader(403)
+		return
+	}
+	fmt.Fprintf(w, "scopedToken for %s", r.Header.Get("Fid"))
+}
+
+func TestScopedTokens(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockScopedTokensHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+	tests := []struct {
+		name			string
+		method			string
+		authHeader		string
+		scope			string
+		fid				string
+		expectedCode	int
+	}{
+		{name: "Download link minted", method: "POST", authHeader: "Bearer tokenString", scope: "download:read", fid: "6650f1c2a1b2c3d4e5f60718", expectedCode: 200},
+		{name: "Scope not granted", method: "POST", authHeader: "Bearer tokenString", scope: "admin", expectedCode: 403},
+		{name: "Fid invalid", method: "POST", authHeader: "Bearer tokenString", scope: "download:read", fid: "not-a-fid", expectedCode: 400},
+		{name: "Auth header missing", method: "POST", scope: "download:read", expectedCode: 401},
+		{name: "Incorrect HTTP request method", method: "GET", authHeader: "Bearer tokenString", scope: "download:read", expectedCode: 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "/tokens/scoped", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			req.Header.Set("Scope", tt.scope)
+			req.Header.Set("Fid", tt.fid)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(ScopedTokens)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && resp.Body.String() != "scopedToken for " + tt.fid { t.Fatal("Response was incorrect", resp.Body.String()) }
+		})
+	}
+}
+
+func MockV1Handler(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Username	string	`json:"username"`
+		Password	string	`json:"password"`
+	}
+	if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Forwarded-For") != "203.0.113.7" {
+		w.WriteHeader(400)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil || credentials.Password != "test" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error": "Credentials were invalid."}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"access_token": "tokenString", "token_type": "Bearer", "path": "%s"}`, r.URL.Path)
+}
+
+func TestV1(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockV1Handler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+	tests := []struct {
+		name			string
+		method			string
+		route			string
+		handler			http.HandlerFunc
+		body			string
+		expectedCode	int
+	}{
+		{name: "Login", method: "POST", route: "/v1/login", handler: LoginV1, body: `{"username": "test", "password": "test"}`, expectedCode: 200},
+		{name: "Login with incorrect password", method: "POST", route: "/v1/login", handler: LoginV1, body: `{"username": "test", "password": "wrong"}`, expectedCode: 401},
+		{name: "Register", method: "POST", route: "/v1/register", handler: RegisterV1, body: `{"username": "test", "password": "test"}`, expectedCode: 200},
+		{name: "Incorrect HTTP request method", method: "GET", route: "/v1/login", handler: LoginV1, expectedCode: 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.route, strings.NewReader(tt.body))
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Content-Type", "application/json")
+			req.RemoteAddr = "203.0.113.7:41000"
+
+			resp := httptest.NewRecorder()
+			tt.handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if tt.method != "POST" { return }
+			if resp.Header().Get("Content-Type") != "application/json" { t.Fatal("Response was not JSON") }
+			var body map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil { t.Fatal(err.Error()) }
+			if resp.Code == 200 && (body["access_token"] != "tokenString" || body["path"] != tt.route) { t.Fatal("Response was incorrect", body) }
+			if resp.Code == 401 && body["error"] == "" { t.Fatal("Error was not passed on", body) }
+		})
+	}
+}
+
+// Signs a JWT for the user "test", who is a member of the organization with the given
+// ID unless it is empty, with the download:read permission.
+func SignTestOrgJWT(org string) string {
+	return SignTestClaims("test_kid", OrgTestClaims(org))
+}
+
+// Returns the claims of the JWT signed by SignTestOrgJWT
+func OrgTestClaims(org string) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss": "auth",
+		"aud": "gateway",
+		"username": "test",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"permissions": []string{"download:read"},
+		"email_verified": true,
+	}
+	if org != "" {
+		claims["org"] = org
+	}
+	return claims
+}
+
+// Signs a JWT for the admin "test" with the download:read permission
+func SignTestAdminFilesJWT() string {
+	claims := OrgTestClaims("")
+	claims["admin"] = true
+	return SignTestClaims("test_kid", claims)
+}
+
+func TestFiles(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockPermissionsValidationHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+	tokenVerifier = JwtVerifier.NewVerifier(mockAuthService.URL + "/.well-known/jwks.json", "auth", "gateway", time.Minute)
+	revocationList = RevocationList.NewList(mockAuthService.URL + "/revocations", "resource_server", "client_secret", time.Minute, time.Hour)
+
+	tests := []struct {
+		name			string
+		method			string
+		header			string
+		expectedOwners	int
+		withoutOwner	bool
+		expectedCode	int
+	}{
+		{name: "Files of user", method: "GET", header: "Bearer " + SignTestOrgJWT(""), expectedOwners: 1, expectedCode: 200},
+		{name: "Files of user and organization", method: "GET", header: "Bearer " + SignTestOrgJWT("7"), expectedOwners: 2, expectedCode: 200},
+		{name: "Files of admin and files without owner", method: "GET", header: "Bearer " + SignTestAdminFilesJWT(), expectedOwners: 2, withoutOwner: true, expectedCode: 200},
+		{name: "Token restricted to a single mp3", method: "GET", header: "Bearer " + SignTestScopedJWT("download:read", "6650f1c2a1b2c3d4e5f60718"), expectedCode: 403},
+		{name: "Token without download scope", method: "GET", header: "Bearer " + SignTestScopedJWT("upload:write", ""), expectedCode: 403},
+		{name: "Incorrect HTTP request method", method: "POST", header: "Bearer " + SignTestOrgJWT(""), expectedCode: 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var usedFilter bson.M
+			FindFiles = func(database string, filter bson.M) (files []StoredFile, err error) {
+				if database != "mp3s" { t.Fatal("Database was incorrect", database) }
+				usedFilter = filter
+				return []StoredFile{{Filename: "song", Metadata: FileMetadata{Owner: "other", Org: "7"}}}, nil
+			}
+
+			req, err := http.NewRequest(tt.method, "/files", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.header)
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Files)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code != 200 { return }
+			owners, _ := usedFilter["$or"].([]bson.M)
+			if len(owners) != tt.expectedOwners || owners[0]["metadata.owner"] != "test" { t.Fatal("Filter was incorrect", usedFilter) }
+			if tt.withoutOwner {
+				withoutOwner, _ := owners[1]["metadata.owner"].(bson.M)
+				if withoutOwner["$exists"] != false { t.Fatal("Filter was incorrect", usedFilter) }
+			} else if tt.expectedOwners == 2 && owners[1]["metadata.org"] != "7" { t.Fatal("Filter was incorrect", usedFilter) }
+			if !strings.Contains(resp.Body.String(), `"filename":"song"`) || !strings.Contains(resp.Body.String(), `"org":"7"`) {
+				t.Fatal("Listed files were incorrect", resp.Body.String())
+			}
+		})
+	}
+}
+
+func MockOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer tokenString" {
+		w.WriteHeader(401)
+		return
+	}
+	fmt.Fprintf(w, "%s %s %s %s %s %s", r.Method, r.URL.Path, r.Header.Get("Name"), r.Header.Get("Username"), r.Header.Get("Org-Role"), r.Header.Get("Invitation-Token"))
+}
+
+func TestOrganizations(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockOrganizationsHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+	tests := []struct {
+		name			string
+		method			string
+		path			string
+		authHeader		string
+		headers			map[string]string
+		expectedBody	string
+		expectedCode	int
+	}{
+		{name: "Create organization", method: "POST", path: "/orgs", authHeader: "Bearer tokenString", headers: map[string]string{"Name": "team"}, expectedBody: "POST /orgs team   ", expectedCode: 200},
+		{name: "Change role of member", method: "POST", path: "/orgs/members", authHeader: "Bearer tokenString", headers: map[string]string{"Username": "other", "Org-Role": "admin"}, expectedBody: "POST /orgs/members  other admin ", expectedCode: 200},
+		{name: "Invite user", method: "POST", path: "/orgs/invitations", authHeader: "Bearer tokenString", headers: map[string]string{"Username": "new@example.com"}, expectedBody: "POST /orgs/invitations  new@example.com  ", expectedCode: 200},
+		{name: "Accept invitation", method: "POST", path: "/orgs/invitations/accept", authHeader: "Bearer tokenString", headers: map[string]string{"Invitation-Token": "invitationToken"}, expectedBody: "POST /orgs/invitations/accept    invitationToken", expectedCode: 200},
+		{name: "Auth header missing", method: "GET", path: "/orgs", expectedCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.path, nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			for header, value := range tt.headers { req.Header.Set(header, value) }
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(Organizations)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && resp.Body.String() != tt.expectedBody { t.Fatal("Request was not passed on", resp.Body.String()) }
+		})
+	}
+}
+
+func MockInviteCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer tokenString" {
+		w.WriteHeader(401)
+		return
+	}
+	fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.Header.Get("Max-Uses"), r.Header.Get("Expires-In"), r.Header.Get("Roles"), r.Header.Get("Invite-Id"))
+}
+
+func TestInviteCodes(t *testing.T) {
+	mockAuthService := httptest.NewServer(http.HandlerFunc(MockInviteCodesHandler))
+	defer mockAuthService.Close()
+	GetAuthServiceUrl = func() (url string) { return mockAuthService.URL }
+
+	tests := []struct {
+		name			string
+		method			string
+		authHeader		string
+		headers			map[string]string
+		expectedBody	string
+		expectedCode	int
+	}{
+		{name: "List invite codes", method: "GET", authHeader: "Bearer tokenString", expectedBody: "GET    ", expectedCode: 200},
+		{name: "Create invite code", method: "POST", authHeader: "Bearer tokenString", headers: map[string]string{"Max-Uses": "5", "Expires-In": "72h", "Roles": "editor"}, expectedBody: "POST 5 72h editor ", expectedCode: 200},
+		{name: "Revoke invite code", method: "DELETE", authHeader: "Bearer tokenString", headers: map[string]string{"Invite-Id": "1"}, expectedBody: "DELETE    1", expectedCode: 200},
+		{name: "Auth header missing", method: "GET", expectedCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "/admin/invites", nil)
+			if err != nil { t.Fatalf("NewRequest creation failed:\n%s", err.Error()) }
+			req.Header.Set("Authorization", tt.authHeader)
+			for header, value := range tt.headers { req.Header.Set(header, value) }
+
+			resp := httptest.NewRecorder()
+			handler := http.HandlerFunc(InviteCodes)
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedCode { t.Fatal("Status was incorrect", resp.Code) }
+			if resp.Code == 200 && resp.Body.String() != tt.expectedBody { t.Fatal("Request was not passed on", resp.Body.String()) }
+		})
+	}
+}
+
+func TestRetryFileCleanups(t *testing.T) {
+	deletedAt := time.Now()
+	tests := []struct {
+		name		string
+		deleteErr	error
+		removed		bool
+	}{
+		{
+			name: "Cleanup succeeds",
+			removed: true,
+		},
+		{
+			name: "Cleanup fails again",
+			deleteErr: errors.New("mongo unreachable"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			QueuedFileCleanups = func() (cleanups []FileCleanup, err error) {
+				return []FileCleanup{{Username: "test", DeletedAt: deletedAt}}, nil
+			}
+			DeleteUserFiles = func(username string, before time.Time) (err error) {
+				if username != "test" || !before.Equal(deletedAt) { t.Fatal("Wrong files were deleted", username, before) }
+				return tt.deleteErr
+			}
+			removed := false
+			RemoveFileCleanup = func(cleanup FileCleanup) (err error) {
+				removed = cleanup.Username == "test" && cleanup.DeletedAt.Equal(deletedAt)
+				return nil
+			}
+
+			RetryFileCleanups()
+
+			if removed != tt.removed { t.Fatal("File cleanup was not removed from the queue as expected") }
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package revocationlist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Returned when the revocation list could not be refreshed for longer than its maximum
+// age. JWTs should then be validated by the auth service, which always knows the
+// current revocations.
+var ErrStale = errors.New("revocation list is stale")
+
+// Minimum time between fetching the revocations after a failed fetch, so that an auth
+// service outage does not cause a request to it for every verified JWT.
+const minFetchInterval = time.Second
+
+// Revocations published by the auth service's /revocations route. Tokens are listed
+// by jti or sid, users by username.
+type revocations struct {
+	Tokens map[string]time.Time `json:"tokens"`
+	Users  map[string]time.Time `json:"users"`
+}
+
+// Caches the revocations published by the auth service, so that JWTs verified locally
+// can be checked for revocation without contacting the auth service for every request.
+// The revocations are fetched again once refreshInterval has passed, so a revocation
+// takes effect after refreshInterval at the latest. If the revocations could not be
+// fetched for maxAge, the list is considered stale. The list is fetched as the
+// confidential OAuth client with the given ID and secret.
+type List struct {
+	url             string
+	clientID        string
+	clientSecret    string
+	refreshInterval time.Duration
+	maxAge          time.Duration
+	client          *http.Client
+	mu              sync.Mutex
+	revocations     revocations
+	fetchedAt       time.Time
+	triedAt         time.Time
+}
+
+// Returns a List that fetches the revocations from url as the given OAuth client
+func NewList(url string, clientID string, clientSecret string, refreshInterval time.Duration, maxAge time.Duration) *List {
+	return &List{
+		url:             url,
+		clientID:        clientID,
+		clientSecret:    clientSecret,
+		refreshInterval: refreshInterval,
+		maxAge:          maxAge,
+		client:          &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Returns true if the JWT with the given jti and sid claims, issued to username at
+// issuedAt, has been revoked individually, along with its session or along with its
+// user. The revocations are fetched again if they are older than refreshInterval.
+// If they are older than maxAge even after that, ErrStale is returned.
+func (l *List) IsRevoked(jti string, sid string, username string, issuedAt time.Time, now time.Time) (revoked bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.fetchedAt) >= l.refreshInterval && now.Sub(l.triedAt) >= minFetchInterval {
+		l.triedAt = now
+		err = l.fetch(now)
+	}
+	if now.Sub(l.fetchedAt) >= l.maxAge {
+		if err != nil {
+			return false, fmt.Errorf("%w: fetching revocations failed: %w", ErrStale, err)
+		}
+		return false, ErrStale
+	}
+	if _, ok := l.revocations.Tokens[jti]; ok {
+		return true, nil
+	}
+	if _, ok := l.revocations.Tokens[sid]; ok && sid != "" {
+		return true, nil
+	}
+	// JWT timestamps only have second precision, so tokens issued during the second
+	// of the revocation are not rejected, like the auth service does
+	before, ok := l.revocations.Users[username]
+	return ok && issuedAt.Before(before.Truncate(time.Second)), nil
+}
+
+// Fetches the revocations and replaces the cached ones. Must be called with mu held.
+func (l *List) fetch(now time.Time) (err error) {
+	req, err := http.NewRequest("GET", l.url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(l.clientID, l.clientSecret)
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocations request returned status %d", resp.StatusCode)
+	}
+	var fetched revocations
+	if err := json.NewDecoder(resp.Body).Decode(&fetched); err != nil {
+		return err
+	}
+	l.revocations = fetched
+	l.fetchedAt = now
+	return nil
+}
@@ -0,0 +1,112 @@
+package revocationlist
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Starts a mock auth service that publishes the given revocations. The returned
+// counter is incremented on every request. If *down is true, 503 is returned. Only the
+// OAuth client "gateway" with the secret "client_secret" may fetch the revocations.
+func newRevocationsServer(t *testing.T, published *revocations, down *bool) (server *httptest.Server, requests *int) {
+	requests = new(int)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if *down {
+			w.WriteHeader(503)
+			return
+		}
+		if clientID, clientSecret, _ := r.BasicAuth(); clientID != "gateway" || clientSecret != "client_secret" {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewEncoder(w).Encode(published)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestIsRevoked(t *testing.T) {
+	now := time.Now()
+	published, down := revocations{
+		Tokens: map[string]time.Time{"revoked_jti": now.Add(time.Hour), "revoked_sid": now.Add(time.Hour)},
+		Users: map[string]time.Time{"revoked_user": now},
+	}, false
+	server, _ := newRevocationsServer(t, &published, &down)
+
+	tests := []struct {
+		name		string
+		jti			string
+		sid			string
+		username	string
+		issuedAt	time.Time
+		expected	bool
+	}{
+		{ name: "Nothing revoked", jti: "test_jti", sid: "test_sid", username: "test_user", issuedAt: now, expected: false, },
+		{ name: "Token revoked", jti: "revoked_jti", username: "test_user", issuedAt: now, expected: true, },
+		{ name: "Session revoked", jti: "test_jti", sid: "revoked_sid", username: "test_user", issuedAt: now, expected: true, },
+		{ name: "User revoked after token was issued", jti: "test_jti", username: "revoked_user", issuedAt: now.Add(-time.Minute), expected: true, },
+		{ name: "User revoked before token was issued", jti: "test_jti", username: "revoked_user", issuedAt: now.Add(time.Second), expected: false, },
+		{ name: "Token issued during the second of revocation", jti: "test_jti", username: "revoked_user", issuedAt: now.Truncate(time.Second), expected: false, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewList(server.URL, "gateway", "client_secret", 10*time.Second, time.Minute)
+			revoked, err := l.IsRevoked(tt.jti, tt.sid, tt.username, tt.issuedAt, now)
+			if err != nil { t.Fatal(err.Error()) }
+			if revoked != tt.expected { t.Fatal("Revocation status was incorrect", revoked) }
+		})
+	}
+}
+
+func TestRevocationsRefreshed(t *testing.T) {
+	published, down := revocations{}, false
+	server, requests := newRevocationsServer(t, &published, &down)
+	l := NewList(server.URL, "gateway", "client_secret", 10*time.Second, time.Minute)
+	now := time.Now()
+
+	if revoked, err := l.IsRevoked("test_jti", "", "test_user", now, now); err != nil || revoked { t.Fatal("Token was revoked", err) }
+	published.Tokens = map[string]time.Time{"test_jti": now.Add(time.Hour)}
+	if revoked, _ := l.IsRevoked("test_jti", "", "test_user", now, now.Add(5*time.Second)); revoked { t.Fatal("Cached revocations were not used") }
+	if *requests != 1 { t.Fatal("Cached revocations were fetched again", *requests) }
+
+	// A revocation takes effect once refreshInterval has passed
+	if revoked, _ := l.IsRevoked("test_jti", "", "test_user", now, now.Add(10*time.Second)); !revoked { t.Fatal("Revocation was not picked up") }
+	if *requests != 2 { t.Fatal("Revocations were not fetched again", *requests) }
+}
+
+func TestRevocationsClientRejected(t *testing.T) {
+	published, down := revocations{}, false
+	server, _ := newRevocationsServer(t, &published, &down)
+	l := NewList(server.URL, "gateway", "wrong_secret", 10*time.Second, time.Minute)
+	now := time.Now()
+
+	if _, err := l.IsRevoked("test_jti", "", "test_user", now, now); !errors.Is(err, ErrStale) { t.Fatal("Error was not ErrStale", err) }
+}
+
+func TestRevocationsAuthServiceDown(t *testing.T) {
+	published, down := revocations{}, true
+	server, requests := newRevocationsServer(t, &published, &down)
+	l := NewList(server.URL, "gateway", "client_secret", 10*time.Second, time.Minute)
+	now := time.Now()
+
+	if _, err := l.IsRevoked("test_jti", "", "test_user", now, now); !errors.Is(err, ErrStale) { t.Fatal("Error was not ErrStale", err) }
+
+	// Cached revocations are used until maxAge has passed
+	down = false
+	l.IsRevoked("test_jti", "", "test_user", now, now.Add(minFetchInterval))
+	down = true
+	if _, err := l.IsRevoked("test_jti", "", "test_user", now, now.Add(30*time.Second)); err != nil {
+		t.Fatal("Cached revocations were not used while the auth service was down")
+	}
+	if _, err := l.IsRevoked("test_jti", "", "test_user", now, now.Add(2*time.Minute)); !errors.Is(err, ErrStale) {
+		t.Fatal("Error was not ErrStale", err)
+	}
+	// Failed fetches are retried at most once per minFetchInterval
+	l.IsRevoked("test_jti", "", "test_user", now, now.Add(2*time.Minute + minFetchInterval/2))
+	if *requests != 4 { t.Fatal("Revocations were fetched too often", *requests) }
+}
@@ -26,6 +26,13 @@ func Forbidden(w http.ResponseWriter) {
 	fmt.Fprintf(w, "Credentials were invalid.")
 }
 
+// This function is used to send a HTTP response with status code 404.
+// Use it when the requested resource, e.g. a file, does not exist.
+func NotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "Not found.")
+}
+
 // This function is used to send a HTTP response with status code 405.
 // Use it when receiving a request with an unallowed HTTP method.
 func MethodNotAllowed(w http.ResponseWriter) {
@@ -43,6 +43,10 @@ func TestForbidden(t *testing.T) {
 	CheckStatus(Forbidden, 403, t)
 }
 
+func TestNotFound(t *testing.T) {
+	CheckStatus(NotFound, 404, t)
+}
+
 func TestMethodNotwAllowed(t *testing.T) {
 	CheckStatus(MethodNotAllowed, 405, t)
 }
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -22,6 +24,44 @@ func FailOnError(err error, msg string) {
 	}
 }
 
+// Reads the env variable with the given name. If it is not set, fallback is returned.
+func GetEnv(name string, fallback string) (value string) {
+	if value = os.Getenv(name); value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Reads a non-negative integer from the env variable with the given name.
+// If the variable is not set or can not be parsed, fallback is returned.
+func GetIntEnv(name string, fallback int) (value int) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		log.Printf("Env variable %s had an invalid integer %q, using %d", name, raw, fallback)
+		return fallback
+	}
+	return value
+}
+
+// Reads a duration, e.g. "5m", from the env variable with the given name.
+// If the variable is not set or can not be parsed, fallback is returned.
+func GetDurationEnv(name string, fallback time.Duration) (duration time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Env variable %s had an invalid duration %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return duration
+}
+
 // This function reads the MONGODB_HOST and MONGODB_PORT env variables
 // and uses them to create the mongoUri. If the env variables have not been
 // set, this function returns an error.
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -16,6 +18,15 @@ type RabbitMQMessage struct {
 	Username	string		`json:"username"`
 }
 
+// An event about a user account, published by the authorization service
+type AccountEvent struct {
+	Type			string		`json:"type"`
+	Username		string		`json:"username"`
+	Token			string		`json:"token"`
+	Organization	string		`json:"organization"`
+	ExpiresAt		time.Time	`json:"expires_at"`
+}
+
 
 // Parses the JSON encoded body of a message received from the RabbitMQ mp3 queue.
 // The message's contents is then used to print out a notification.
@@ -28,17 +39,32 @@ func Notify(body []byte) (err error) {
 	return nil
 }
 
-func main() {
-	log.Println("Notification service starting...")
-
-	connection := ConnectToRabbitMQ()
-	defer connection.Close()
-
-	channel = OpenChannel(connection)
-	defer channel.Close()
-
-	queue := CreateQueue(channel, os.Getenv("MP3_QUEUE"))
+// Parses the JSON encoded body of a message received from the RabbitMQ account queue
+// and prints out the notification for the event's type. Printing stands in for email
+// delivery, so the logs contain the event's token. If JSON unmarshalling fails or the
+// event's type is unknown, an error is returned.
+func NotifyAccountEvent(body []byte) (err error) {
+	var event AccountEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil { return err }
+	switch event.Type {
+	case "password_reset_requested":
+		log.Printf("Attention user %s! A password reset was requested for your account.\nReset token: %s\nThe token expires at %s. If you did not request the reset, you can ignore this message.\n",
+			event.Username, event.Token, event.ExpiresAt.Format(time.RFC1123))
+	case "email_verification_requested":
+		log.Printf("Welcome %s! Please verify your email address to start uploading videos.\nVerification token: %s\nThe token expires at %s.\n",
+			event.Username, event.Token, event.ExpiresAt.Format(time.RFC1123))
+	case "organization_invited":
+		log.Printf("Hello %s! You have been invited to join the organization %s and share its files.\nInvitation token: %s\nThe invitation expires at %s. Log in or register to accept it.\n",
+			event.Username, event.Organization, event.Token, event.ExpiresAt.Format(time.RFC1123))
+	default:
+		return fmt.Errorf("unknown account event type %q", event.Type)
+	}
+	return nil
+}
 
+// Consumes the messages of the given queue, passing the body of each message to notify.
+func ConsumeQueue(queue amqp.Queue, notify func(body []byte) error) {
 	msgs, err := channel.Consume(
 		queue.Name, // Queue
 		"",     	// Consumer
@@ -50,20 +76,34 @@ func main() {
 	)
 	FailOnError(err, "Channel consume failed")
 
-	var forever chan struct{}
-	go func() {
-		for msg := range msgs {
-			log.Printf("Received a message: %s", msg.Body)
-			if err := Notify(msg.Body); err != nil {
-				// Send nack if something goes wrong with convertion
-				log.Println("Error occured while creating notification:\n", err.Error())
-				channel.Ack(msg.DeliveryTag, true)
-				//channel.Nack(msg.DeliveryTag, false, true)
-			} else {
-				channel.Ack(msg.DeliveryTag, true)
-			}
+	for msg := range msgs {
+		log.Printf("Received a message from queue %s", queue.Name)
+		if err := notify(msg.Body); err != nil {
+			// Send nack if something goes wrong with convertion
+			log.Println("Error occured while creating notification:\n", err.Error())
+			channel.Ack(msg.DeliveryTag, false)
+			//channel.Nack(msg.DeliveryTag, false, true)
+		} else {
+			channel.Ack(msg.DeliveryTag, false)
 		}
-	}()
+	}
+}
+
+func main() {
+	log.Println("Notification service starting...")
+
+	connection := ConnectToRabbitMQ()
+	defer connection.Close()
+
+	channel = OpenChannel(connection)
+	defer channel.Close()
+
+	mp3Queue := CreateQueue(channel, os.Getenv("MP3_QUEUE"))
+	accountQueue := CreateQueue(channel, os.Getenv("ACCOUNT_QUEUE"))
+
+	var forever chan struct{}
+	go ConsumeQueue(mp3Queue, Notify)
+	go ConsumeQueue(accountQueue, NotifyAccountEvent)
 	log.Println("Waiting for messages...")
 	<-forever
 }
\ No newline at end of file
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNotifyAccountEvent(t *testing.T) {
+	tests := []struct {
+		name		string
+		body		string
+		expected	[]string
+		expectErr	bool
+	}{
+		{
+			name: "Password reset requested",
+			body: `{"type":"password_reset_requested","username":"test_user","token":"reset_token","expires_at":"2024-01-02T15:04:05Z"}`,
+			expected: []string{"test_user", "password reset", "reset_token", "Tue, 02 Jan 2024 15:04:05 UTC"},
+		},
+		{
+			name: "Email verification requested",
+			body: `{"type":"email_verification_requested","username":"test_user","token":"verification_token","expires_at":"2024-01-02T15:04:05Z"}`,
+			expected: []string{"test_user", "verify your email", "verification_token"},
+		},
+		{
+			name: "Organization invited",
+			body: `{"type":"organization_invited","username":"test_user","token":"invitation_token","organization":"Test org","expires_at":"2024-01-02T15:04:05Z"}`,
+			expected: []string{"test_user", "Test org", "invitation_token"},
+		},
+		{ name: "Unknown event type", body: `{"type":"account_deleted","username":"test_user"}`, expectErr: true, },
+		{ name: "Invalid JSON", body: `not json`, expectErr: true, },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			log.SetOutput(&output)
+			defer log.SetOutput(os.Stderr)
+
+			err := NotifyAccountEvent([]byte(tt.body))
+			if tt.expectErr {
+				if err == nil { t.Fatal("No error returned for an invalid event") }
+				return
+			}
+			if err != nil { t.Fatal(err.Error()) }
+			for _, expected := range tt.expected {
+				if !strings.Contains(output.String(), expected) { t.Fatalf("Notification did not contain %q:\n%s", expected, output.String()) }
+			}
+		})
+	}
+}